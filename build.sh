@@ -10,4 +10,9 @@ if [ $gitRepo != "master" ]; then
     v=$v"_"$gitRepo
 fi
 
-go build -ldflags "-X main.version=$v -X main.Env=dev" iotit.go
+ldflags="-X main.version=$v -X main.Env=dev"
+if [ -n "$MAPPING_PUBLIC_KEY" ]; then
+    ldflags=$ldflags" -X github.com/xshellinc/iotit/repo.MappingPublicKey=$MAPPING_PUBLIC_KEY"
+fi
+
+go build -ldflags "$ldflags" iotit.go
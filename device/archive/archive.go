@@ -0,0 +1,347 @@
+// Package archive detects image archives by their magic bytes and decompresses them as streams,
+// so images can be written to disks without extracting them first.
+package archive
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Format is an archive format of the image
+type Format string
+
+// Supported formats, Raw is an uncompressed image
+const (
+	Raw   Format = "raw"
+	Zip   Format = "zip"
+	Gzip  Format = "gzip"
+	Xz    Format = "xz"
+	Bzip2 Format = "bzip2"
+	Zstd  Format = "zstd"
+)
+
+// magic numbers of the formats
+var magics = []struct {
+	format Format
+	magic  []byte
+}{
+	{Zip, []byte("PK\x03\x04")},
+	{Gzip, []byte{0x1F, 0x8B}},
+	{Xz, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+	{Bzip2, []byte("BZh")},
+	{Zstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+}
+
+// headerSize is amount of bytes needed to detect the format
+const headerSize = 6
+
+// suffixes are removed from the archive name to get the image name
+var suffixes = map[Format]string{Gzip: ".gz", Xz: ".xz", Bzip2: ".bz2", Zstd: ".zst"}
+
+// Detect returns format by the magic bytes of the file header, Raw is returned for unknown headers
+func Detect(header []byte) Format {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format
+		}
+	}
+	return Raw
+}
+
+// DetectFile returns format of the file
+func DetectFile(name string) (Format, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return Detect(header[:n]), nil
+}
+
+// Open returns decompressed content of the image file and it's size, size is 0 when it's unknown before decompression.
+// The largest .img file is used from zip archives
+func Open(name string) (io.ReadCloser, int64, error) {
+	format, err := DetectFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch format {
+	case Raw:
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	case Zip:
+		return openZip(name)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := decompress(format, bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s: %s", name, err)
+	}
+	return &readCloser{r, []io.Closer{r, f}}, 0, nil
+}
+
+// NewReader detects format of the stream and returns decompressed stream, zip archives aren't supported
+func NewReader(r io.Reader) (io.ReadCloser, Format, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	header, err := br.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	format := Detect(header)
+	switch format {
+	case Raw:
+		return ioutil.NopCloser(br), format, nil
+	case Zip:
+		return nil, format, errors.New("zip archive can't be read as a stream")
+	}
+	rc, err := decompress(format, br)
+	return rc, format, err
+}
+
+// decompress returns decompressor of the format
+func decompress(format Format, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Xz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %s", format)
+}
+
+// FormatByName returns format of the archive by suffix of the file name, Raw is returned for other names
+func FormatByName(name string) Format {
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".zip") {
+		return Zip
+	}
+	for format, suffix := range suffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return format
+		}
+	}
+	return Raw
+}
+
+// NewWriter returns compressor of the format writing into w, closing it doesn't close w
+func NewWriter(w io.Writer, format Format) (io.WriteCloser, error) {
+	switch format {
+	case Raw:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Xz:
+		return xz.NewWriter(w)
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("compression to %s isn't supported", format)
+}
+
+// CheckOutput returns error for output names of the formats which can't be written
+func CheckOutput(name string) error {
+	if format := FormatByName(name); format == Zip || format == Bzip2 {
+		return fmt.Errorf("compression to %s isn't supported, use .img, .img.gz, .img.xz or .img.zst", format)
+	}
+	return nil
+}
+
+// WriteFile compresses r into the output file by it's suffix (.gz, .xz or .zst) and writes sha256 of the file into
+// the output.sha256 sidecar in the sha256sum format. The output is replaced only once it's complete, it's sha256 is returned
+func WriteFile(output string, r io.Reader) ([]byte, error) {
+	if err := CheckOutput(output); err != nil {
+		return nil, err
+	}
+
+	tmp := output + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	h := sha256.New()
+	w, err := NewWriter(io.MultiWriter(f, h), FormatByName(output))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		return nil, err
+	}
+
+	sum := h.Sum(nil)
+	sidecar := fmt.Sprintf("%x  %s\n", sum, filepath.Base(output))
+	return sum, ioutil.WriteFile(output+".sha256", []byte(sidecar), 0644)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openZip opens the largest image inside of zip archive
+func openZip(name string) (io.ReadCloser, int64, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var img *zip.File
+	for _, f := range z.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if img == nil || isImage(f.Name) && !isImage(img.Name) ||
+			isImage(f.Name) == isImage(img.Name) && f.UncompressedSize64 > img.UncompressedSize64 {
+			img = f
+		}
+	}
+	if img == nil {
+		z.Close()
+		return nil, 0, fmt.Errorf("%s: zip archive is empty", name)
+	}
+	r, err := img.Open()
+	if err != nil {
+		z.Close()
+		return nil, 0, err
+	}
+	return &readCloser{r, []io.Closer{r, z}}, int64(img.UncompressedSize64), nil
+}
+
+func isImage(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".img")
+}
+
+// ImageName returns name of the image extracted from the archive by ExtractCommand
+func ImageName(name string, format Format) string {
+	name = filepath.Base(name)
+	if suffix, ok := suffixes[format]; ok {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	if !isImage(name) {
+		name += ".img"
+	}
+	return name
+}
+
+// ExtractCommand returns shell command which extracts the archive, like help.GetExtractCommand it is formatted
+// with the archive path and the destination folder. Tar archives are detected by their suffix.
+// Empty string is returned for raw images which don't need extraction
+func ExtractCommand(name string, format Format) string {
+	switch tool := Tool(name, format); tool {
+	case "":
+		return ""
+	case "tar":
+		return "tar xvf %s -C %s"
+	case "unzip":
+		return "unzip -o %s -d %s"
+	default:
+		img := ImageName(name, format)
+		return tool + " -dc %s > %s" + img + " && echo " + img
+	}
+}
+
+// Tool returns the program run by ExtractCommand, empty string is returned for raw images
+func Tool(name string, format Format) string {
+	if IsTar(name) {
+		return "tar"
+	}
+	switch format {
+	case Zip:
+		return "unzip"
+	case Gzip:
+		return "gzip"
+	case Xz:
+		return "xz"
+	case Bzip2:
+		return "bzip2"
+	case Zstd:
+		return "zstd"
+	}
+	return ""
+}
+
+// IsTar reports whether the name has a suffix of compressed tar archives
+func IsTar(name string) bool {
+	lower := strings.ToLower(name)
+	for _, suffix := range []string{".tar.gz", ".tgz", ".tar.bz2", ".tbz", ".tar.xz", ".txz", ".tar.zst"} {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCloser closes all underlying readers
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+// content is the same as in testdata/disk.img.bz2
+func content() []byte {
+	b := make([]byte, 100000)
+	for i := range b {
+		b[i] = byte(i * 7 % 251)
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iotit-archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	data := content()
+
+	writers := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"disk.img": func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		"disk.img.gz": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"disk.img.xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		"disk.img.zst": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	files := map[string]Format{"disk.img": Raw, "disk.img.gz": Gzip, "disk.img.xz": Xz, "disk.img.zst": Zstd,
+		"disk.zip": Zip, filepath.Join("testdata", "disk.img.bz2"): Bzip2}
+	for name, fn := range writers {
+		b := &bytes.Buffer{}
+		w, err := fn(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644))
+	}
+	b := &bytes.Buffer{}
+	z := zip.NewWriter(b)
+	readme, _ := z.Create("README.txt")
+	readme.Write(bytes.Repeat([]byte("large readme "), 20000))
+	img, _ := z.Create("disk.img")
+	img.Write(data)
+	assert.NoError(t, z.Close())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "disk.zip"), b.Bytes(), 0644))
+
+	for name, format := range files {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			path := name
+			if filepath.Dir(name) == "." {
+				path = filepath.Join(dir, name)
+			}
+			f, err := DetectFile(path)
+			assert.NoError(err)
+			assert.Equal(format, f)
+
+			r, size, err := Open(path)
+			if !assert.NoError(err) {
+				return
+			}
+			defer r.Close()
+			out, err := ioutil.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(data, out)
+			if format == Raw || format == Zip {
+				assert.Equal(int64(len(data)), size)
+			}
+		})
+	}
+}
+
+func TestExtractCommand(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("xz -dc %s > %sraspios.img && echo raspios.img", ExtractCommand("raspios.img.xz", Xz))
+	assert.Equal("zstd -dc %s > %sarmbian.img && echo armbian.img", ExtractCommand("armbian", Zstd))
+	assert.Equal("unzip -o %s -d %s", ExtractCommand("download", Zip))
+	assert.Equal("tar xvf %s -C %s", ExtractCommand("image.tar.gz", Gzip))
+	assert.Equal("", ExtractCommand("image.img", Raw))
+	assert.Equal("tar", Tool("image.TGZ", Gzip))
+	assert.Equal("bzip2", Tool("image.img.bz2", Bzip2))
+	assert.Equal("", Tool("image.img", Raw))
+}
+
+func TestNewWriter(t *testing.T) {
+	assert := assert.New(t)
+	data := content()
+
+	// compressed data is read back with the compression packages, not with NewReader
+	readers := map[Format]func(r io.Reader) (io.Reader, error){
+		Raw:  func(r io.Reader) (io.Reader, error) { return r, nil },
+		Gzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		Xz:   func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		Zstd: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for format, fn := range readers {
+		b := &bytes.Buffer{}
+		w, err := NewWriter(b, format)
+		if !assert.NoError(err, string(format)) {
+			continue
+		}
+		_, err = w.Write(data)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+
+		r, err := fn(b)
+		if !assert.NoError(err, string(format)) {
+			continue
+		}
+		out, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(data, out, string(format))
+	}
+
+	_, err := NewWriter(&bytes.Buffer{}, Zip)
+	assert.Error(err)
+	_, err = NewWriter(&bytes.Buffer{}, Bzip2)
+	assert.Error(err)
+
+	assert.Equal(Xz, FormatByName("raspios.IMG.xz"))
+	assert.Equal(Zip, FormatByName("disk.zip"))
+	assert.Equal(Raw, FormatByName("disk.img"))
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iotit-archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for name, format := range map[string]Format{"disk.img": Raw, "disk.img.gz": Gzip, "disk.img.xz": Xz, "disk.img.zst": Zstd} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			output := filepath.Join(dir, name)
+			sum, err := WriteFile(output, bytes.NewReader(content()))
+			if !assert.NoError(err) {
+				return
+			}
+			_, err = os.Stat(output + ".part")
+			assert.True(os.IsNotExist(err))
+
+			f, err := DetectFile(output)
+			assert.NoError(err)
+			assert.Equal(format, f)
+			r, _, err := Open(output)
+			if !assert.NoError(err) {
+				return
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			assert.NoError(err)
+			assert.Equal(content(), data)
+
+			// sidecar is checked by `sha256sum -c` in the output folder
+			data, err = ioutil.ReadFile(output)
+			assert.NoError(err)
+			assert.Equal(fmt.Sprintf("%x", sha256.Sum256(data)), fmt.Sprintf("%x", sum))
+			sidecar, err := ioutil.ReadFile(output + ".sha256")
+			assert.NoError(err)
+			assert.Equal(fmt.Sprintf("%x  %s\n", sum, name), string(sidecar))
+		})
+	}
+
+	// raw output is the image itself
+	sidecar, err := ioutil.ReadFile(filepath.Join(dir, "disk.img.sha256"))
+	assert.NoError(t, err)
+	assert.Equal(t, "96ad0ddabe9c733d4550fde750255a94806811029be67504bd9bd68e556686b9  disk.img\n", string(sidecar))
+
+	for _, name := range []string{"disk.zip", "disk.img.bz2"} {
+		output := filepath.Join(dir, name)
+		_, err := WriteFile(output, bytes.NewReader(content()))
+		assert.Error(t, err, name)
+		_, err = os.Stat(output)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// failed output isn't replaced
+	output := filepath.Join(dir, "disk.img.gz")
+	before, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	_, err = WriteFile(output, io.MultiReader(bytes.NewReader(content()), errReader{}))
+	assert.Error(t, err)
+	after, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	_, err = os.Stat(output + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read error")
+}
@@ -0,0 +1,282 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/iotit/device/archive"
+	"github.com/xshellinc/iotit/device/image"
+	"github.com/xshellinc/iotit/workstation"
+	"github.com/xshellinc/tools/dialogs"
+)
+
+// batchOptions are used to write the same image to several removable disks at once
+type batchOptions struct {
+	Disks        []string
+	AllRemovable bool
+	// Hostname is a template, {n} is replaced with the disk number
+	Hostname string
+	Start    int
+
+	ws    workstation.WorkStation
+	disks []*workstation.MountInfo
+}
+
+// enabled returns true if several disks were requested
+func (b *batchOptions) enabled() bool {
+	return b.AllRemovable || len(b.Disks) > 0
+}
+
+// hostname returns hostname of the n-th disk starting from 0
+func (b *batchOptions) hostname(n int) string {
+	return image.ExpandHostname(b.Hostname, b.Start+n)
+}
+
+// selectDisks lists disks which will be written and asks for confirmation.
+// When batch mode isn't enabled the disk set with --disk or selected with a dialog is used
+func (d *sdFlasher) selectDisks() error {
+	b := &d.batch
+	b.ws = workstation.NewWorkStation("")
+	var (
+		disks []*workstation.MountInfo
+		err   error
+	)
+	switch {
+	case b.enabled():
+		disks, err = b.ws.SelectDisks(b.Disks, b.AllRemovable)
+	case d.Disk != "":
+		disks, err = b.ws.SelectDisks([]string{d.Disk}, false)
+	default:
+		if disks, err = b.ws.SelectDisks(nil, true); err == nil {
+			rng := make([]string, len(disks))
+			for i, m := range disks {
+				rng[i] = fmt.Sprintf(dialogs.PrintColored("%s")+" - "+dialogs.PrintColored("%s"), m.DeviceName(), m.DiskName())
+			}
+			disks = disks[dialogs.SelectOneDialog("Select mount to format: ", rng):][:1]
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.disks = disks
+
+	fmt.Println("[+] Image will be written to the following disks:")
+	for i, m := range disks {
+		host := ""
+		if b.Hostname != "" {
+			host = "hostname: " + b.hostname(i)
+		}
+		fmt.Printf("\t%d: %s %s %s\n", b.Start+i, m.DiskName(), m.DeviceName(), host)
+	}
+	if !d.Quiet && !dialogs.YesNoDialog("All data on these disks will be erased. Proceed to image flashing?") {
+		return fmt.Errorf("Aborted")
+	}
+	return nil
+}
+
+// writeBatch writes the image to the selected disks concurrently and prints a summary
+func (d *sdFlasher) writeBatch(img string) error {
+	b := &d.batch
+	fmt.Printf("[+] Writing image to %d disks\n", len(b.disks))
+
+	src := d.batchSource(img)
+	p := newBatchProgress(b.disks)
+	results := b.ws.WriteToDisks(b.disks, src, p.update)
+	p.stop()
+
+	if d.verify {
+		d.verifyBatch(results, src)
+	}
+
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tDISK\tDEVICE\tHOSTNAME\tTIME\tRESULT")
+	for _, r := range results {
+		host := "-"
+		if b.Hostname != "" {
+			host = b.hostname(r.N)
+		}
+		result := "OK"
+		if r.Err != nil {
+			failed++
+			result = "FAILED: " + r.Err.Error()
+			log.WithField("disk", r.Disk.DiskName()).Error(r.Err)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", b.Start+r.N, r.Disk.DiskName(), r.Disk.DeviceName(), host,
+			r.Duration.Round(time.Second), result)
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d disks failed", failed, len(results))
+	}
+	return nil
+}
+
+// verifyBatch reads back the disks which were written successfully and updates their results
+func (d *sdFlasher) verifyBatch(results []*workstation.Result, src workstation.Source) {
+	var (
+		disks []*workstation.MountInfo
+		index []int
+	)
+	for i, r := range results {
+		if r.Err == nil {
+			disks = append(disks, r.Disk)
+			index = append(index, i)
+		}
+	}
+	if len(disks) == 0 {
+		return
+	}
+
+	fmt.Printf("[+] Verifying %d disks\n", len(disks))
+	p := newBatchProgress(disks)
+	verified := d.batch.ws.VerifyDisks(disks, func(n int) (io.ReadCloser, int64, error) {
+		return src(index[n])
+	}, p.update)
+	p.stop()
+
+	for i, v := range verified {
+		r := results[index[i]]
+		r.Duration += v.Duration
+		if v.Err != nil {
+			r.Err = fmt.Errorf("verify: %s", verifyError(v.Err))
+		}
+	}
+}
+
+// writeArchive writes the image which wasn't configured straight from the host,
+// archives are decompressed on the fly, so neither the workspace nor the extracted image is needed
+func (d *sdFlasher) writeArchive() error {
+	_, img, err := d.DownloadImage()
+	if err != nil {
+		return err
+	}
+	if d.batch.Hostname != "" {
+		if format, err := archive.DetectFile(img); err != nil {
+			return err
+		} else if format != archive.Raw {
+			return fmt.Errorf("hostname can't be set in %s archive, please use flash command to configure the image", format)
+		}
+	}
+
+	if err := d.selectDisks(); err != nil {
+		return err
+	}
+	if err := d.writeBatch(img); err != nil {
+		return err
+	}
+	return d.Done()
+}
+
+// batchSource returns image for the n-th disk, archives are decompressed on the fly.
+// Hostname is stamped into the in-memory copy of the image
+func (d *sdFlasher) batchSource(img string) workstation.Source {
+	return func(n int) (io.ReadCloser, int64, error) {
+		if d.batch.Hostname == "" {
+			return archive.Open(img)
+		}
+
+		o, err := image.NewOverlay(img)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := stampHostname(o, d.batch.hostname(n)); err != nil {
+			o.Close()
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{o.Reader(), o}, o.Size(), nil
+	}
+}
+
+// stampHostname sets hostname of the image root partition
+func stampHostname(o *image.Overlay, hostname string) error {
+	img, err := o.Image()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return image.SetHostname(img, hostname)
+}
+
+// batchProgress prints progress of all disks in one line
+type batchProgress struct {
+	mu      sync.Mutex
+	names   []string
+	written []int64
+	total   []int64
+	start   time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newBatchProgress(disks []*workstation.MountInfo) *batchProgress {
+	p := &batchProgress{
+		written: make([]int64, len(disks)),
+		total:   make([]int64, len(disks)),
+		start:   time.Now(),
+		done:    make(chan struct{}),
+	}
+	for _, m := range disks {
+		p.names = append(p.names, filepath.Base(m.DiskName()))
+	}
+	p.wg.Add(1)
+	go p.render()
+	return p
+}
+
+// update is a workstation.Progress callback
+func (p *batchProgress) update(n int, written, total int64) {
+	p.mu.Lock()
+	p.written[n] = written
+	p.total[n] = total
+	p.mu.Unlock()
+}
+
+func (p *batchProgress) render() {
+	defer p.wg.Done()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.print()
+		case <-p.done:
+			p.print()
+			fmt.Println()
+			return
+		}
+	}
+}
+
+// print prints throughput and ETA of the single disk or percents of several disks
+func (p *batchProgress) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	parts := make([]string, len(p.names))
+	for i, name := range p.names {
+		s := &workstation.Stats{Written: p.written[i], Total: p.total[i], Elapsed: time.Since(p.start)}
+		if len(p.names) > 1 && s.Total > 0 {
+			parts[i] = fmt.Sprintf("%s %3d%%", name, s.Written*100/s.Total)
+		} else {
+			parts[i] = fmt.Sprintf("%s %s", name, s)
+		}
+	}
+	fmt.Printf("\r\033[K[+] %s", strings.Join(parts, " | "))
+}
+
+// stop prints the final progress line
+func (p *batchProgress) stop() {
+	close(p.done)
+	p.wg.Wait()
+}
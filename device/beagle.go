@@ -25,7 +25,8 @@ func (d *beagleBone) Configure() error {
 	}
 	log.WithField("device", "beaglebone").Debug("Configure")
 	job := help.NewBackgroundJob()
-	c := config.NewDefault(d.conf.SSH)
+	c := d.newConfigurator()
+	c.ApplyProfile(d.profile)
 
 	go func() {
 		defer job.Close()
@@ -50,7 +51,7 @@ func (d *beagleBone) Configure() error {
 	// why?
 	command := fmt.Sprintf("ln -sf %s %s/%s", "/dev/null", help.AddPathSuffix("unix", config.MountDir, "etc", "udev", "rules.d"), "80-net-setup-link.rules")
 	log.WithField("command", command).Debug("Linking tmp folder")
-	out, eut, err := d.conf.SSH.Run(command)
+	out, eut, err := d.ws.Run(command)
 	if err != nil {
 		log.Error("[-] Error when execute: ", command, eut)
 		return err
@@ -58,7 +59,11 @@ func (d *beagleBone) Configure() error {
 	log.Debug(out, eut)
 
 	// write configs that were setup above
-	if err := c.Write(); err != nil {
+	if err := d.writeConfig(c); err != nil {
+		return err
+	}
+
+	if err := d.customizeImage(map[string]string{partRootfs: config.MountDir}); err != nil {
 		return err
 	}
 
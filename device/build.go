@@ -0,0 +1,437 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/recipe"
+	"github.com/xshellinc/iotit/repo"
+	"github.com/xshellinc/tools/lib/help"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// names of the mounted image partitions passed to the build steps
+const (
+	partRootfs = recipe.PartRootfs
+	partBoot   = recipe.PartBoot
+)
+
+// manifestPath is where the build manifest is embedded into the image
+const manifestPath = "/etc/iotit/manifest.json"
+
+// run steps are copied into the image root and run chrooted into it
+const (
+	chrootScript = "/tmp/iotit-step.sh"
+	chrootPath   = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// stepFailed is written to stderr with the exit status of the failed step
+	stepFailed = "iotit: step failed with status"
+)
+
+// elfMachines maps e_machine of ELF headers to qemu-user architectures
+var elfMachines = map[string]string{"3": "i386", "40": "arm", "62": "x86_64", "183": "aarch64"}
+
+// BuildOptions of the image build
+type BuildOptions struct {
+	// Version of iotit recorded in the manifest
+	Version string
+	// Output overrides the recipe output
+	Output string
+}
+
+// Manifest records what the image was built from, it's embedded into the image and written next to it
+type Manifest struct {
+	Iotit     string `json:"iotit"`
+	Recipe    string `json:"recipe"`
+	Device    string `json:"device"`
+	Image     string `json:"image"`
+	ImageURL  string `json:"image_url"`
+	ImageHash string `json:"image_hash"`
+}
+
+// imageFlasher is implemented by flashers configuring SD card images
+type imageFlasher interface {
+	Flasher
+	Exporter
+	sdCard() *sdFlasher
+}
+
+func (d *sdFlasher) sdCard() *sdFlasher {
+	return d
+}
+
+// customizeImage copies overlays and runs build steps on the mounted image partitions
+func (d *sdFlasher) customizeImage(mounts map[string]string) error {
+	for _, o := range d.overlays {
+		fmt.Println("[+] Copying overlay", o.Dir, "to", o.Partition)
+		if err := d.extractOverlay(o, mounts); err != nil {
+			return err
+		}
+	}
+	if d.customize == nil {
+		return nil
+	}
+	return d.customize(mounts)
+}
+
+// extractOverlay renders templates of the overlay and extracts it into the mounted partition
+func (d *sdFlasher) extractOverlay(o recipe.Overlay, mounts map[string]string) error {
+	mount, ok := mounts[o.Partition]
+	if !ok {
+		return fmt.Errorf("%s partition of %s images isn't supported", o.Partition, d.device)
+	}
+	buf := &bytes.Buffer{}
+	if err := recipe.OverlayTar(buf, o.Dir, d.overlayVars(mounts[partRootfs])); err != nil {
+		return fmt.Errorf("overlay %s: %s", o.Dir, err)
+	}
+	remote, cleanup, err := d.upload("iotit-overlay.tar", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return d.execOverSSH(fmt.Sprintf("tar xf %s -C %s", remote, mount), nil)
+}
+
+// overlayVars returns values of the configured image used by overlay templates
+func (d *sdFlasher) overlayVars(root string) *recipe.Vars {
+	v := &recipe.Vars{Device: d.device, Image: d.devRepo.Image.Title, Interfaces: make(map[string]config.Interfaces)}
+	if out, _, err := d.ws.Run("cat " + help.AddPathSuffix("unix", root, "etc", "hostname")); err == nil {
+		v.Hostname = strings.TrimSpace(out)
+	}
+	if p := d.profile; p != nil {
+		if p.Wifi != nil {
+			v.SSID = p.Wifi.SSID
+		}
+		for _, i := range p.Interfaces {
+			if v.IP == "" {
+				v.IP = i.Address
+			}
+			v.Interfaces[i.Name] = i
+		}
+	}
+	return v
+}
+
+// Build configures the base image with the recipe steps and saves it to the output file
+func Build(c *cli.Context, path string, opts *BuildOptions) error {
+	r, err := recipe.Load(path)
+	if err != nil {
+		return err
+	}
+	output := opts.Output
+	if output == "" {
+		output = r.Path(r.Output)
+	}
+	if output == "" {
+		return errors.New("output isn't set in the recipe")
+	}
+	fmt.Println("[+] Building", filepath.Base(path), "sha256:"+r.Hash)
+
+	repo.CheckDevicesRepository()
+	dev, err := repo.GetDeviceRepo(r.Device)
+	if err != nil {
+		return err
+	}
+	f, err := getFlasher(dev.Name, r.Image, c)
+	if err != nil {
+		return err
+	}
+	img, ok := f.(imageFlasher)
+	if !ok {
+		return fmt.Errorf("%s images can't be built", dev.Name)
+	}
+
+	d := img.sdCard()
+	d.Quiet = true
+	// config steps are applied in order by applyRecipe
+	d.profile = nil
+	if d.seed, d.lastChange, err = buildSeed(r); err != nil {
+		return err
+	}
+	if r.Workspace != "" && !c.IsSet("workspace") {
+		d.workspace = r.Workspace
+	}
+	m := &Manifest{Iotit: opts.Version, Recipe: "sha256:" + r.Hash, Device: dev.Name,
+		Image: d.devRepo.Image.Title, ImageURL: d.devRepo.Image.URL}
+	d.customize = func(mounts map[string]string) error {
+		hash, err := d.sourceHash()
+		if err != nil {
+			return err
+		}
+		m.ImageHash = hash
+		return d.applyRecipe(r, m, mounts)
+	}
+
+	if err := img.Configure(); err != nil {
+		return err
+	}
+	if m.ImageHash == "" {
+		return errors.New("image wasn't customized, no linux partitions were found")
+	}
+	if err := img.Export(output); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(output+".manifest.json", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Println("[+] Manifest saved to", output+".manifest.json")
+	return nil
+}
+
+// buildSeed returns the seed of password salts and the day of the last password change of the build.
+// The day comes from SOURCE_DATE_EPOCH, it's left empty in /etc/shadow without it
+func buildSeed(r *recipe.Recipe) (string, int, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return r.Hash, -1, nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || sec < 0 {
+		return "", 0, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	return r.Hash, int(sec / 86400), nil
+}
+
+// sourceHash returns the hash of the base image from mapping.json or sha256 of the downloaded file
+func (d *sdFlasher) sourceHash() (string, error) {
+	if d.devRepo.Image.Hash != "" {
+		if digest, err := repo.ParseDigest(d.devRepo.Image.Hash); err == nil {
+			return digest.String(), nil
+		}
+	}
+	f, err := os.Open(d.source)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// applyRecipe applies configuration, copies files and runs scripts of the recipe steps in order,
+// the manifest is written last
+func (d *sdFlasher) applyRecipe(r *recipe.Recipe, m *Manifest, mounts map[string]string) error {
+	root := mounts[partRootfs]
+	for i, s := range r.Steps {
+		name := s.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		// overlay templates see the configuration applied by the previous steps
+		d.profile = r.Profile(i)
+		switch {
+		case s.Config != nil:
+			fmt.Println("[+] Configuring:", name)
+			c := d.newConfigurator()
+			c.ApplyProfile(s.Config)
+			if err := d.writeConfig(c); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		case len(s.Files) > 0:
+			fmt.Println("[+] Copying files:", name)
+			if err := d.extractFiles(r.Dir, s.Files, root); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		case len(s.Overlay) > 0:
+			for _, o := range r.Overlays(s) {
+				fmt.Println("[+] Copying overlay", o.Dir, "to", o.Partition)
+				if err := d.extractOverlay(o, mounts); err != nil {
+					return fmt.Errorf("%s: %s", name, err)
+				}
+			}
+		case s.Run != "":
+			fmt.Println("[+] Running:", name)
+			if err := d.runScript(s.Run, mounts); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return d.extractFiles(r.Dir, []recipe.File{{Path: manifestPath, Content: string(data) + "\n"}}, root)
+}
+
+// extractFiles uploads the files into the workspace as a tar archive and extracts it into the mounted partition
+func (d *sdFlasher) extractFiles(dir string, files []recipe.File, mount string) error {
+	buf := &bytes.Buffer{}
+	if err := recipe.Tar(buf, dir, files); err != nil {
+		return err
+	}
+	remote, cleanup, err := d.upload("iotit-files.tar", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return d.execOverSSH(fmt.Sprintf("tar xf %s -C %s", remote, mount), nil)
+}
+
+// runScript runs the shell script chrooted into the mounted root partition, so it can't change the workspace.
+// ROOT is / there and BOOT is the boot partition mounted at /boot
+func (d *sdFlasher) runScript(script string, mounts map[string]string) error {
+	root := mounts[partRootfs]
+	remote, cleanup, err := d.upload("iotit-step.sh", []byte(script))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	revert, err := d.prepareChroot(root, mounts[partBoot], remote)
+	if err != nil {
+		return err
+	}
+	defer revert()
+
+	env := []string{"ROOT=/", "PATH=" + chrootPath}
+	if _, ok := mounts[partBoot]; ok {
+		env = append(env, "BOOT=/boot")
+	}
+	// easyssh doesn't return exit codes, so a failure is reported in stderr
+	command := fmt.Sprintf(`%s chroot %s /bin/sh -e %s || echo "%s $?" >&2`,
+		strings.Join(env, " "), root, chrootScript, stepFailed)
+	log.WithField("command", command).Debug("runScript")
+	d.ws.SetTimer(help.SshExtendedCommandTimeout)
+	out, eut, err := d.ws.Run(command)
+	if out = strings.TrimSpace(out); out != "" {
+		fmt.Println(out)
+	}
+	eut = strings.TrimSpace(eut)
+	if err != nil {
+		return fmt.Errorf("%s %s", err, eut)
+	}
+	if strings.Contains(eut, stepFailed) {
+		return errors.New(eut)
+	}
+	if eut != "" {
+		fmt.Println(eut)
+	}
+	return nil
+}
+
+// prepareChroot copies the script and qemu-user-static for images of other architectures into the root,
+// mounts /proc, /dev and the boot partition there. The returned function reverts it
+func (d *sdFlasher) prepareChroot(root, boot, script string) (func(), error) {
+	steps := [][2]string{
+		{fmt.Sprintf("mkdir -p %s && cp %s %s", help.AddPathSuffix("unix", root, "tmp"), script,
+			help.AddPathSuffix("unix", root, chrootScript)),
+			"rm -f " + help.AddPathSuffix("unix", root, chrootScript)},
+		{"mount -t proc proc " + help.AddPathSuffix("unix", root, "proc"), "umount " + help.AddPathSuffix("unix", root, "proc")},
+		{"mount -o bind /dev " + help.AddPathSuffix("unix", root, "dev"), "umount " + help.AddPathSuffix("unix", root, "dev")},
+	}
+	if boot != "" {
+		dir := help.AddPathSuffix("unix", root, "boot")
+		steps = append(steps, [2]string{fmt.Sprintf("mkdir -p %s && mount -o bind %s %s", dir, boot, dir), "umount " + dir})
+	}
+	qemu, err := d.chrootQemu(root)
+	if err != nil {
+		return nil, err
+	}
+	if qemu != "" {
+		// binfmt_misc runs foreign binaries with /usr/bin/qemu-<arch>-static, which has to be in the root
+		dst := help.AddPathSuffix("unix", root, "usr", "bin", qemu)
+		out := ""
+		if err := d.execOverSSH(fmt.Sprintf("test -e %s && echo yes; true", dst), &out); err != nil {
+			return nil, err
+		}
+		if out != "yes" {
+			steps = append(steps, [2]string{fmt.Sprintf("cp $(command -v %s) %s", qemu, dst), "rm -f " + dst})
+		}
+	}
+
+	var undo []string
+	revert := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := d.execOverSSH(undo[i], nil); err != nil {
+				log.WithField("command", undo[i]).Error(err)
+			}
+		}
+	}
+	for _, s := range steps {
+		if err := d.execOverSSH(s[0], nil); err != nil {
+			revert()
+			return nil, err
+		}
+		undo = append(undo, s[1])
+	}
+	return revert, nil
+}
+
+// chrootQemu returns qemu-user-static binary running binaries of the image root in the workspace,
+// it's empty when the workspace runs them natively
+func (d *sdFlasher) chrootQemu(root string) (string, error) {
+	machine, host := "", ""
+	// e_machine of the ELF header of the image shell
+	command := fmt.Sprintf(`for f in bin/busybox bin/dash bin/bash usr/bin/dash usr/bin/bash; do `+
+		`if [ -f %[1]s/$f ] && [ ! -h %[1]s/$f ]; then od -A n -t u2 -j 18 -N 2 %[1]s/$f; break; fi; done`, root)
+	if err := d.execOverSSH(command, &machine); err != nil {
+		return "", err
+	}
+	arch, ok := elfMachines[machine]
+	if !ok {
+		return "", fmt.Errorf("unknown architecture of the image binaries %q", machine)
+	}
+	if err := d.execOverSSH("uname -m", &host); err != nil {
+		return "", err
+	}
+	if hostArch(host) == arch {
+		return "", nil
+	}
+
+	qemu := "qemu-" + arch + "-static"
+	if err := d.execOverSSH(fmt.Sprintf("command -v %s > /dev/null || echo %s is not found >&2", qemu, qemu), nil); err != nil {
+		return "", fmt.Errorf("%s images run scripts with qemu-user-static in the workspace: %s", arch, err)
+	}
+	return qemu, nil
+}
+
+// hostArch returns qemu architecture of `uname -m`
+func hostArch(machine string) string {
+	switch {
+	case machine == "amd64":
+		return "x86_64"
+	case machine == "arm64":
+		return "aarch64"
+	case strings.HasPrefix(machine, "arm"):
+		return "arm"
+	case len(machine) == 4 && machine[0] == 'i' && strings.HasSuffix(machine, "86"):
+		return "i386"
+	}
+	return machine
+}
+
+// upload copies data into the workspace temporary folder and returns it's path there
+func (d *sdFlasher) upload(name string, data []byte) (string, func(), error) {
+	local := filepath.Join(help.GetTempDir(), name)
+	if err := ioutil.WriteFile(local, data, 0644); err != nil {
+		return "", nil, err
+	}
+	if err := d.ws.Scp(local, d.ws.TmpDir()); err != nil {
+		os.Remove(local)
+		return "", nil, err
+	}
+	remote := help.AddPathSuffix("unix", d.ws.TmpDir(), name)
+	return remote, func() {
+		d.ws.Run("rm -f " + remote)
+		os.Remove(local)
+	}, nil
+}
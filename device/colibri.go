@@ -2,21 +2,19 @@ package device
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/xshellinc/esp-flasher/serialport"
-	"github.com/xshellinc/go-serial"
 	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/console"
 	"github.com/xshellinc/iotit/workstation"
 	"github.com/xshellinc/tools/dialogs"
 	"github.com/xshellinc/tools/lib/help"
 )
 
-var serialPort serial.Serial
-
 const portSelectionTries = 3
 
 // toradex colibri imx6 device
@@ -37,27 +35,28 @@ func (d *colibri) Prepare() error {
 }
 
 func (d *colibri) getPort() error {
-	if d.Port != "" {
-		return nil
-	}
 	var perr error
 	for attempt := 0; attempt < portSelectionTries; attempt++ {
 		if attempt > 0 && !dialogs.YesNoDialog("No ports found. Reconnect your device and try again. Ready?") {
 			return perr
 		}
 		fmt.Println("[+] Enumerating serial ports...")
-		port, err := serialport.GetPort("auto")
-		if err != nil {
+		port, err := selectPort(d.Port, colibriChips, d.Quiet)
+		if err == errNoPorts {
 			perr = err
 			continue
 		}
+		if err != nil {
+			return err
+		}
 		d.Port = port
+		perr = nil
 		break
 	}
-	if d.Port == "" {
+	if perr != nil {
 		return perr
 	}
-	fmt.Println("[+] Using ", dialogs.PrintColored(d.Port))
+	fmt.Println("[+] Using ", dialogs.PrintColored(portDescription(d.Port)))
 	return nil
 }
 
@@ -118,10 +117,10 @@ func (d *colibri) configureImage() error {
 		return err
 	}
 	log.Debug("Running update.sh")
-	d.conf.SSH.SetTimer(help.SshExtendedCommandTimeout)
+	d.ws.SetTimer(help.SshExtendedCommandTimeout)
 	command = fmt.Sprintf("cd %s && ./update.sh -o %s", help.AddPathSuffix("unix", config.TmpDir, d.folder), config.MountDir)
 	log.Debug(command)
-	if out, eut, err := d.conf.SSH.Run(command); err != nil {
+	if out, eut, err := d.ws.Run(command); err != nil {
 		log.Error("[-] Error executing: ", command, eut)
 		return err
 	} else if strings.TrimSpace(out) != "" {
@@ -145,7 +144,7 @@ func (d *colibri) Write() error {
 		job := help.NewBackgroundJob()
 		go func() {
 			defer job.Close()
-			if err := d.conf.SSH.ScpFrom(help.AddPathSuffix("unix", config.TmpDir, d.img), filepath.Join(help.GetTempDir(), d.img)); err != nil {
+			if err := d.ws.ScpFrom(help.AddPathSuffix("unix", config.TmpDir, d.img), filepath.Join(help.GetTempDir(), d.img)); err != nil {
 				job.Error(err)
 			}
 		}()
@@ -176,136 +175,89 @@ func (d *colibri) Write() error {
 		w.Unmount()
 		fmt.Println("[+] SD card prepared")
 	}
-	if d.Port == "" {
-		if err := d.getPort(); err != nil {
-			log.Error(err)
-			return err
-		}
-	}
-	commonOpts := serial.OpenOptions{
-		BaudRate:              115200,
-		DataBits:              8,
-		ParityMode:            serial.PARITY_NONE,
-		StopBits:              1,
-		InterCharacterTimeout: 200.0,
-		PortName:              d.Port,
+	if err := d.getPort(); err != nil {
+		log.Error(err)
+		return err
 	}
-	var err error
-	serialPort, err = serial.Open(commonOpts)
+	sp, err := console.Open(d.Port, console.DefaultBaudRate)
 	if err != nil {
 		return err
 	}
+	defer sp.Close()
 
-	defer serialPort.Close()
-
-	if err := d.runUpdate(); err != nil {
+	if err := d.runUpdate(console.NewSession(sp, os.Stdout)); err != nil {
 		return err
 	}
 
 	return d.Done()
 }
 
-func readResponse() string {
-	data := make([]byte, 10000)
-	if _, err := serialPort.Read(data); err != nil {
-		log.Error(err)
-	}
-	line := strings.TrimSpace(string(data))
-	log.WithField("data", line).Debug("Response")
-	return line
+// colibriAbort are U-Boot errors failing the update
+var colibriAbort = []string{`Unknown command`, `\*\* Unable to`, `## Error`}
+
+// colibriReboot logs in with the default root account and reboots the board
+var colibriReboot = &console.Script{
+	Name: "reboot",
+	Steps: []console.Step{
+		{Name: "login prompt", Send: "\r\n", Expect: `imx6 login:`, Timeout: 10 * time.Second, Retry: 5},
+		{Name: "login", Send: "root\r\n", Expect: `#`, Timeout: 10 * time.Second},
+		{Name: "reboot", Send: "reboot\r\n"},
+	},
 }
 
-func rebootBoard() error {
-	serialPort.SetReadTimeout(time.Second * 5)
-	if _, err := serialPort.Write([]byte("\r\n")); err != nil {
-		log.Error(err)
-		serialPort.Write([]byte("\r\n"))
-	}
-	for {
-		line := readResponse()
-		if line != "" {
-			if strings.Contains(line, "imx6 login:") {
-				if _, err := serialPort.Write([]byte("root\r\n")); err != nil {
-					log.Error(err)
-				}
-				readResponse() //command echo
-				readResponse() //response
-				time.Sleep(time.Second * 2)
-				if _, err := serialPort.Write([]byte("reboot\r\n")); err != nil {
-					log.Error(err)
-				}
-				readResponse() //command echo
-				readResponse() //response
-				time.Sleep(time.Second * 2)
-				return nil
-			}
-		}
-	}
+// colibriRecovery stops autoboot at the U-Boot prompt
+var colibriRecovery = &console.Script{
+	Name: "recovery",
+	Steps: []console.Step{
+		{Name: "stop autoboot", Send: " ", Every: 200 * time.Millisecond, Expect: `iMX6 #`, Timeout: 3 * time.Minute},
+	},
 }
 
-func bootInRecovery() *help.BackgroundJob {
-	job := help.NewBackgroundJob()
-	go func() {
-		defer job.Close()
-		for {
-			if _, err := serialPort.Write([]byte(" ")); err != nil {
-				job.Error(err)
-			}
-			data := make([]byte, 10000)
-			if _, err := serialPort.Read(data); err == nil {
-				log.WithField("data", string(data)).Debug("Response")
-				if strings.Contains(string(data), "Colibri iMX6 #") || strings.Contains(string(data), "iMX6 #") {
-					break
-				}
-			}
-		}
-	}()
-	return job
+// colibriUpdate flashes the eMMC from the SD card with U-Boot update scripts
+var colibriUpdate = &console.Script{
+	Name: "update",
+	Steps: []console.Step{
+		{Name: "run setupdate", Wait: time.Second, Send: "run setupdate\r\n", Expect: `iMX6 #`, Timeout: time.Minute},
+		{Name: "run update", Wait: time.Second, Send: "run update\r\n", Expect: `resetting`, Timeout: 30 * time.Minute, Echo: true},
+	},
+	Abort: colibriAbort,
 }
 
-func (d *colibri) runUpdate() error {
+func (d *colibri) runUpdate(s *console.Session) error {
 	for !dialogs.YesNoDialog("Please insert prepared SD card into your Colibri iMX6 board. Type yes once ready.") {
 	}
 	message := "Now reset or power up the board"
 	if !dialogs.YesNoDialog("Do you have a reset button on your carrier board?") {
 		fmt.Println("[+] Trying to reboot the board")
-		rebootBoard()
+		if err := s.Run(colibriReboot); err != nil {
+			return err
+		}
 		message = "Booting in recovery"
 	}
-	job := bootInRecovery()
+
+	job := help.NewBackgroundJob()
+	go func() {
+		defer job.Close()
+		if err := s.Run(colibriRecovery); err != nil {
+			job.Error(err)
+		}
+	}()
 	if err := help.WaitJobAndSpin(message, job); err != nil {
 		log.Error(err)
 		return err
 	}
-	fmt.Println("[+] Flashing to eMMC")
-	if _, err := serialPort.Write([]byte("run setupdate\r\n")); err != nil {
-		log.Error(err)
-	}
 
-	readResponse()
-	time.Sleep(time.Second * 1)
-	readResponse()
-	time.Sleep(time.Second * 2)
-	if n, err := serialPort.Write([]byte("run update\r\n")); err != nil {
-		log.Error(err)
-	} else {
-		log.Debug("Written:", n)
-	}
-	readResponse()
-	for {
-		serialPort.SetReadTimeout(time.Second * 5)
-		line := readResponse()
-		fmt.Print(line)
-		if strings.Contains(line, "resetting") {
-			fmt.Println("[+] Done! Rebooting the board.")
-			return nil
-		}
+	fmt.Println("[+] Flashing to eMMC")
+	if err := s.Run(colibriUpdate); err != nil {
+		return err
 	}
+	fmt.Println("\n[+] Done! Rebooting the board.")
+	return nil
 }
 
 func (d *colibri) exec(command string) error {
 	log.Debug(command)
-	if out, eut, err := d.conf.SSH.Run(command); err != nil {
+	if out, eut, err := d.ws.Run(command); err != nil {
 		log.Error("[-] Error executing: ", command, eut)
 		return err
 	} else if strings.TrimSpace(out) != "" {
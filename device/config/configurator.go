@@ -19,6 +19,7 @@ type (
 	Configurator struct {
 		storage map[string]interface{}
 		order   map[string]*CallbackFn
+		preset  map[string]bool
 	}
 
 	// cb is a function with an input parameter of configurator's `storage`
@@ -32,10 +33,11 @@ type (
 
 	// Interfaces represents network interfaces used to setup devices
 	Interfaces struct {
-		Address string
-		Gateway string
-		Netmask string
-		DNS     string
+		Name    string `json:"name,omitempty" yaml:"name,omitempty"`
+		Address string `json:"address" yaml:"address"`
+		Gateway string `json:"gateway" yaml:"gateway"`
+		Netmask string `json:"netmask" yaml:"netmask"`
+		DNS     string `json:"dns" yaml:"dns"`
 	}
 )
 
@@ -48,7 +50,7 @@ func New(ssh ssh_helper.Util) *Configurator {
 
 	storage["ssh"] = ssh
 
-	return &Configurator{storage, order}
+	return &Configurator{storage, order, make(map[string]bool)}
 }
 
 // NewDefault creates a default Configurator
@@ -59,7 +61,10 @@ func NewDefault(ssh ssh_helper.Util) *Configurator {
 	config.AddConfigFn(Wifi, NewCallbackFn(SetWifi, SaveWifi))
 	config.AddConfigFn(Interface, NewCallbackFn(SetInterface, SaveInterface))
 	config.AddConfigFn(DNS, NewCallbackFn(SetSecondaryDNS, SaveSecondaryDNS))
-	config.AddConfigFn("Hostname", NewCallbackFn(SetHostname, SaveHostname))
+	config.AddConfigFn(Hostname, NewCallbackFn(SetHostname, SaveHostname))
+	config.AddConfigFn(Accounts, NewCallbackFn(SetAccounts, SaveAccounts))
+	config.AddConfigFn(AuthorizedKeys, NewCallbackFn(SetAuthorizedKeys, SaveAuthorizedKeys))
+	config.AddConfigFn(Password, NewCallbackFn(SetPassword, SavePassword))
 	return config
 }
 
@@ -68,10 +73,14 @@ func NewCallbackFn(config cb, apply cb) *CallbackFn {
 	return &CallbackFn{config, apply}
 }
 
-// Setup triggers all CallbackFn Config functions
+// Setup triggers all CallbackFn Config functions except the ones preset by a profile
 func (c *Configurator) Setup() error {
 	var keys []string
 	for k := range c.order {
+		if c.preset[k] {
+			log.WithField("name", k).Debug("skipping preset config")
+			continue
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
@@ -87,14 +96,30 @@ func (c *Configurator) Setup() error {
 	return nil
 }
 
-// Write triggers all CallbackFn Apply functions
+// writeOrder is the order Write applies CallbackFn of NewDefault in. Accounts are created before AuthorizedKeys
+// and Password, which may configure the new users. Other CallbackFn are applied after them in the order of their names
+var writeOrder = []string{Locale, Keymap, Wifi, Interface, DNS, Hostname, Accounts, AuthorizedKeys, Password}
+
+// Write triggers all CallbackFn Apply functions in writeOrder
 func (c *Configurator) Write() error {
-	for _, o := range c.order {
-		if (*o).Apply == nil {
+	var keys, rest []string
+	for _, k := range writeOrder {
+		if _, ok := c.order[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	for k := range c.order {
+		if !containsString(writeOrder, k) {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range append(keys, rest...) {
+		if (*c.order[k]).Apply == nil {
 			continue
 		}
 
-		if err := o.Apply(c.storage); err != nil {
+		if err := c.order[k].Apply(c.storage); err != nil {
 			return err
 		}
 	}
@@ -102,6 +127,15 @@ func (c *Configurator) Write() error {
 	return nil
 }
 
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // AddConfigFn
 func (c *Configurator) AddConfigFn(name string, ccf *CallbackFn) {
 	c.order[name] = ccf
@@ -127,6 +161,12 @@ func (c *Configurator) StoreValue(name string, value interface{}) {
 	c.storage[name] = value
 }
 
+// Value returns value from storage
+func (c *Configurator) Value(name string) (interface{}, bool) {
+	v, ok := c.storage[name]
+	return v, ok
+}
+
 // SetLocale is a default method to with dialog to configure the locale
 func SetLocale(storage map[string]interface{}) error {
 
@@ -267,7 +307,7 @@ func SaveWifi(storage map[string]interface{}) error {
 		return errors.New(err.Error() + ":" + eut)
 	}
 
-	if _, ok := storage[Interface]; !ok {
+	if !hasStaticInterface(storage, "wlan0") {
 		log.Debug("Adding wlan0 to interfaces...")
 		fp := help.AddPathSuffix("unix", MountDir, IsaaxConfDir, "network", "interfaces.d", "wlan0")
 
@@ -284,6 +324,21 @@ func SaveWifi(storage map[string]interface{}) error {
 	return nil
 }
 
+// hasStaticInterface checks whether static configuration was set up for the named interface
+func hasStaticInterface(storage map[string]interface{}, name string) bool {
+	if n, ok := storage["InterfaceName"]; ok && n == name {
+		return true
+	}
+	if list, ok := storage[StaticInterfaces].([]Interfaces); ok {
+		for _, i := range list {
+			if i.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // SetInterface is a dialog asking to setup user Interfaces for the static ip functionality
 func SetInterface(storage map[string]interface{}) error {
 	log.WithField("type", "default").Debug("setInterface")
@@ -309,11 +364,13 @@ func SetInterface(storage map[string]interface{}) error {
 		//TODO: allow user to setup several static interfaces at once
 		switch device[num] {
 		case "eth0":
-			storage[Interface] = fmt.Sprintf(InterfaceETH, i.Address, i.Netmask, i.Gateway, i.DNS)
+			i.Name = "eth0"
+			storage[Interface] = FormatInterface(i)
 			storage["InterfaceName"] = "eth0"
 			fmt.Println("[+]  Ethernet interface configuration was updated")
 		case "wlan0":
-			storage[Interface] = fmt.Sprintf(InterfaceWLAN, i.Address, i.Netmask, i.Gateway, i.DNS)
+			i.Name = "wlan0"
+			storage[Interface] = FormatInterface(i)
 			fmt.Println("[+]  WiFi interface configuration was updated")
 			storage["InterfaceName"] = "wlan0"
 		}
@@ -325,6 +382,13 @@ func SetInterface(storage map[string]interface{}) error {
 
 // SaveInterface is a default method to save user Interfaces into the image
 func SaveInterface(storage map[string]interface{}) error {
+	if list, ok := storage[StaticInterfaces].([]Interfaces); ok {
+		for _, i := range list {
+			if err := saveInterfaceFile(storage, i.Name, FormatInterface(i)); err != nil {
+				return err
+			}
+		}
+	}
 
 	if _, ok := storage[Interface]; !ok {
 		return nil
@@ -333,14 +397,27 @@ func SaveInterface(storage map[string]interface{}) error {
 		return nil
 	}
 
+	return saveInterfaceFile(storage, storage["InterfaceName"].(string), storage[Interface])
+}
+
+// FormatInterface returns network/interfaces configuration of the static interface
+func FormatInterface(i Interfaces) string {
+	if i.Name == "wlan0" {
+		return fmt.Sprintf(InterfaceWLAN, i.Address, i.Netmask, i.Gateway, i.DNS)
+	}
+	return fmt.Sprintf(InterfaceETH, i.Address, i.Netmask, i.Gateway, i.DNS)
+}
+
+// saveInterfaceFile writes interface configuration into /etc/network/interfaces.d
+func saveInterfaceFile(storage map[string]interface{}, name string, data interface{}) error {
 	ssh, ok := storage["ssh"].(ssh_helper.Util)
 	if !ok {
 		return errors.New("Cannot get ssh config")
 	}
 
-	fp := help.AddPathSuffix("unix", MountDir, IsaaxConfDir, "network", "interfaces.d", storage["InterfaceName"].(string))
+	fp := help.AddPathSuffix("unix", MountDir, IsaaxConfDir, "network", "interfaces.d", name)
 
-	_, eut, err := ssh.Run(fmt.Sprintf(`echo "%s" > %s`, storage[Interface], fp))
+	_, eut, err := ssh.Run(fmt.Sprintf(`echo "%s" > %s`, data, fp))
 	if err != nil || strings.TrimSpace(eut) != "" {
 		log.WithField("eut", eut).Error(err)
 		return err
@@ -424,13 +501,10 @@ func SetHostname(storage map[string]interface{}) error {
 	if !ok {
 		return errors.New("Cannot get ssh config")
 	}
-	fp := help.AddPathSuffix("unix", MountDir, "/etc/hostname")
-	out, eut, err := ssh.Run("cat " + fp)
-	if err != nil || strings.TrimSpace(eut) != "" {
-		log.WithField("eut", eut).Error(err)
+	hostname, err := readHostname(ssh)
+	if err != nil {
 		return err
 	}
-	hostname := strings.TrimSpace(out)
 	fmt.Println("[+] Default hostname: ", hostname)
 
 	if dialogs.YesNoDialog("Do you want to change default hostname?") {
@@ -441,12 +515,20 @@ func SetHostname(storage map[string]interface{}) error {
 	return nil
 }
 
+// readHostname returns current hostname of the mounted image
+func readHostname(ssh ssh_helper.Util) (string, error) {
+	fp := help.AddPathSuffix("unix", MountDir, "/etc/hostname")
+	out, eut, err := ssh.Run("cat " + fp)
+	if err != nil || strings.TrimSpace(eut) != "" {
+		log.WithField("eut", eut).Error(err)
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
 // SaveHostname is a default method to save hostname into the image
 func SaveHostname(storage map[string]interface{}) error {
 
-	if _, ok := storage["OldHostname"]; !ok {
-		return nil
-	}
 	if _, ok := storage["NewHostname"]; !ok {
 		return nil
 	}
@@ -456,6 +538,15 @@ func SaveHostname(storage map[string]interface{}) error {
 		return errors.New("Cannot get ssh config")
 	}
 
+	if _, ok := storage["OldHostname"]; !ok {
+		// hostname was preset by a profile, so the current one wasn't read by SetHostname
+		hostname, err := readHostname(ssh)
+		if err != nil {
+			return err
+		}
+		storage["OldHostname"] = hostname
+	}
+
 	hosts := help.AddPathSuffix("unix", MountDir, "/etc/hosts")
 	hostname := help.AddPathSuffix("unix", MountDir, "/etc/hostname")
 	data := fmt.Sprintf("'s/%s/%s/g'", storage["OldHostname"], storage["NewHostname"])
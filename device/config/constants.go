@@ -9,6 +9,33 @@ const (
 	DNS       = "DNS"
 	SSH       = "SSH"
 	Camera    = "Camera"
+	Hostname  = "Hostname"
+
+	// User is the login of the image user, which is configured by AuthorizedKeys and Password
+	User           = "User"
+	AuthorizedKeys = "AuthorizedKeys"
+	Password       = "Password"
+	// PasswordLogin stores false when SSH password login has to be disabled
+	PasswordLogin = "PasswordLogin"
+
+	// Accounts stores a list of UserProfile created in the image, it's applied before AuthorizedKeys and Password
+	// so they can configure the new users
+	Accounts = "Accounts"
+	// DefaultUser is the login of the default image user, DefaultUserAction is applied to it
+	DefaultUser       = "DefaultUser"
+	DefaultUserAction = "DefaultUserAction"
+
+	// PasswordSeed replaces random salts of password hashes with ones derived from it and LastChange replaces today
+	// in /etc/shadow, -1 leaves it empty. Builds set them, so the same recipe produces the same accounts
+	PasswordSeed = "PasswordSeed"
+	LastChange   = "LastChange"
+
+	DefaultUserKeep   = "keep"
+	DefaultUserLock   = "lock"
+	DefaultUserRemove = "remove"
+
+	// StaticInterfaces stores a list of Interfaces preset by a profile
+	StaticInterfaces = "StaticInterfaces"
 
 	MountDir = "/tmp/isaax-sd/"
 
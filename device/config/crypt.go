@@ -0,0 +1,157 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"strings"
+)
+
+// cryptAlphabet is the base64 alphabet of crypt(3)
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptPrefix marks SHA-512 crypt(3) hashes
+const sha512CryptPrefix = "$6$"
+
+// sha512Rounds is the default number of rounds, it isn't written into the hash
+const sha512Rounds = 5000
+
+// sha512Order is the order of the digest bytes in the encoded hash
+var sha512Order = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// HashPassword returns SHA-512 crypt(3) hash of the password with a random salt used in /etc/shadow,
+// already hashed passwords are returned as is
+func HashPassword(password string) (string, error) {
+	if IsPasswordHash(password) {
+		return password, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return SHA512Crypt(password, cryptSalt(b)), nil
+}
+
+// SeededHashPassword is HashPassword with the salt derived from the seed, the same seed gives the same hash
+func SeededHashPassword(password, seed string) string {
+	if IsPasswordHash(password) {
+		return password
+	}
+	sum := sha256.Sum256([]byte(seed))
+	return SHA512Crypt(password, cryptSalt(sum[:16]))
+}
+
+// cryptSalt encodes the bytes with the crypt(3) alphabet
+func cryptSalt(b []byte) string {
+	salt := make([]byte, len(b))
+	for i, v := range b {
+		salt[i] = cryptAlphabet[int(v)%len(cryptAlphabet)]
+	}
+	return string(salt)
+}
+
+// IsPasswordHash checks whether the password is a crypt(3) hash like $6$salt$hash
+func IsPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$") && strings.Count(password, "$") >= 3
+}
+
+// SHA512Crypt implements SHA-512 crypt(3) with the default number of rounds, salt is truncated to 16 characters
+func SHA512Crypt(password, salt string) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	b := sum512(pw, s, pw)
+
+	h := sha512.New()
+	h.Write(pw)
+	h.Write(s)
+	i := len(pw)
+	for ; i > 64; i -= 64 {
+		h.Write(b)
+	}
+	h.Write(b[:i])
+	for i = len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pw)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range pw {
+		h.Write(pw)
+	}
+	p := repeat(h.Sum(nil), len(pw))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	ds := repeat(h.Sum(nil), len(s))
+
+	c := a
+	for r := 0; r < sha512Rounds; r++ {
+		h.Reset()
+		if r&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(ds)
+		}
+		if r%7 != 0 {
+			h.Write(p)
+		}
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte(sha512CryptPrefix + salt + "$")
+	for _, o := range sha512Order {
+		out = appendCrypt64(out, uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	out = appendCrypt64(out, uint(c[63]), 2)
+	return string(out)
+}
+
+func sum512(parts ...[]byte) []byte {
+	h := sha512.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// repeat repeats the digest up to n bytes
+func repeat(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		rest := n - len(out)
+		if rest > len(digest) {
+			rest = len(digest)
+		}
+		out = append(out, digest[:rest]...)
+	}
+	return out
+}
+
+func appendCrypt64(out []byte, v uint, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	assert := assert.New(t)
+
+	// test vectors of the SHA-crypt specification
+	assert.Equal("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		SHA512Crypt("Hello world!", "saltstring"))
+	// openssl passwd -6 -salt abcdefgh raspberry
+	assert.Equal("$6$abcdefgh$4o4.L3tiGL1RD7BsjaaWYcCVs87zOlvZK7S6SXQETuFMA2ELLDwmf3YDHidZ3I4E/fXmmOOWhAJHUSMf.eA6c1",
+		SHA512Crypt("raspberry", "abcdefgh"))
+
+	hash, err := HashPassword("raspberry")
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(hash, "$6$"))
+	assert.Equal(hash, SHA512Crypt("raspberry", strings.Split(hash, "$")[2]))
+	same, err := HashPassword(hash)
+	assert.NoError(err)
+	assert.Equal(hash, same)
+
+	// builds derive salts from the recipe, so they produce the same hashes
+	seeded := SeededHashPassword("raspberry", "recipe:pi")
+	assert.Equal(seeded, SeededHashPassword("raspberry", "recipe:pi"))
+	assert.NotEqual(seeded, SeededHashPassword("raspberry", "recipe:admin"))
+	assert.Equal(seeded, SHA512Crypt("raspberry", strings.Split(seeded, "$")[2]))
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/locale"
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Profile is a declarative set of configuration values, which are used instead of dialogs.
+	// DefaultUser is keep, lock or remove, it's applied to the default user of the image when Users are created
+	Profile struct {
+		Locale       string        `json:"locale,omitempty" yaml:"locale,omitempty"`
+		Keymap       string        `json:"keymap,omitempty" yaml:"keymap,omitempty"`
+		Wifi         *WifiProfile  `json:"wifi,omitempty" yaml:"wifi,omitempty"`
+		Interfaces   []Interfaces  `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+		Hostname     string        `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+		SecondaryDNS bool          `json:"secondary_dns,omitempty" yaml:"secondary_dns,omitempty"`
+		SSH          *SSHProfile   `json:"ssh,omitempty" yaml:"ssh,omitempty"`
+		Users        []UserProfile `json:"users,omitempty" yaml:"users,omitempty"`
+		DefaultUser  string        `json:"default_user,omitempty" yaml:"default_user,omitempty"`
+	}
+
+	// WifiProfile contains wireless network credentials
+	WifiProfile struct {
+		SSID string `json:"ssid" yaml:"ssid"`
+		PSK  string `json:"psk" yaml:"psk"`
+	}
+
+	// SSHProfile contains login settings of the image user, the default user of the image is used when User is empty.
+	// AuthorizedKeys are public keys or paths to .pub files, Password is a plain text password or a crypt(3) hash
+	SSHProfile struct {
+		User                 string   `json:"user,omitempty" yaml:"user,omitempty"`
+		AuthorizedKeys       []string `json:"authorized_keys,omitempty" yaml:"authorized_keys,omitempty"`
+		Password             string   `json:"password,omitempty" yaml:"password,omitempty"`
+		DisablePasswordLogin bool     `json:"disable_password_login,omitempty" yaml:"disable_password_login,omitempty"`
+	}
+
+	// UserProfile describes a user created in the image with a group of the same name, the password is locked when
+	// it's empty. Sudo is password or nopasswd
+	UserProfile struct {
+		Name           string   `json:"name" yaml:"name"`
+		UID            int      `json:"uid,omitempty" yaml:"uid,omitempty"`
+		Groups         []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+		Shell          string   `json:"shell,omitempty" yaml:"shell,omitempty"`
+		Password       string   `json:"password,omitempty" yaml:"password,omitempty"`
+		AuthorizedKeys []string `json:"authorized_keys,omitempty" yaml:"authorized_keys,omitempty"`
+		Sudo           string   `json:"sudo,omitempty" yaml:"sudo,omitempty"`
+	}
+)
+
+// LoadProfile reads profile from the yaml or json file, format is detected by the file extension
+func LoadProfile(path string) (*Profile, error) {
+	log.WithField("path", path).Debug("LoadProfile")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, p)
+	default:
+		// unknown keys are rejected the same way yaml.UnmarshalStrict does, a typo doesn't silently skip a setting
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(p)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse profile "+path)
+	}
+
+	if err := p.ResolveKeys(filepath.Dir(path)); err != nil {
+		return nil, errors.Wrap(err, "invalid profile "+path)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid profile "+path)
+	}
+
+	return p, nil
+}
+
+// Validate checks profile values the same way dialogs do
+func (p *Profile) Validate() error {
+	if p.Locale != "" {
+		if err := locale.ValidateLocale(p.Locale); err != nil {
+			return fmt.Errorf("locale %s: %s", p.Locale, err)
+		}
+	}
+
+	if p.Keymap != "" {
+		if err := locale.ValidateLayout(p.localePrefix(), p.Keymap); err != nil {
+			return fmt.Errorf("keymap %s: %s", p.Keymap, err)
+		}
+	}
+
+	if p.Wifi != nil && p.Wifi.SSID == "" {
+		return errors.New("wifi ssid is empty")
+	}
+
+	names := make(map[string]bool)
+	for _, i := range p.Interfaces {
+		if i.Name != "eth0" && i.Name != "wlan0" {
+			return fmt.Errorf("interface %q is not supported, use eth0 or wlan0", i.Name)
+		}
+		if names[i.Name] {
+			return fmt.Errorf("interface %s is defined twice", i.Name)
+		}
+		names[i.Name] = true
+
+		for field, ip := range map[string]string{"address": i.Address, "gateway": i.Gateway, "netmask": i.Netmask, "dns": i.DNS} {
+			if net.ParseIP(ip).To4() == nil {
+				return fmt.Errorf("interface %s: invalid %s %q", i.Name, field, ip)
+			}
+		}
+	}
+
+	if p.SSH != nil {
+		for _, k := range p.SSH.AuthorizedKeys {
+			if !isPublicKey(k) {
+				return fmt.Errorf("ssh: %q is not a public key", k)
+			}
+		}
+		if p.SSH.DisablePasswordLogin && len(p.SSH.AuthorizedKeys) == 0 {
+			return errors.New("ssh: password login can't be disabled without authorized keys")
+		}
+	}
+
+	names = make(map[string]bool)
+	for _, u := range p.Users {
+		if err := validateUser(u); err != nil {
+			return err
+		}
+		if names[u.Name] {
+			return fmt.Errorf("user %s is defined twice", u.Name)
+		}
+		names[u.Name] = true
+	}
+
+	switch p.DefaultUser {
+	case "", DefaultUserKeep:
+	case DefaultUserLock, DefaultUserRemove:
+		if len(p.Users) == 0 {
+			return fmt.Errorf("default_user %s requires new users", p.DefaultUser)
+		}
+		// ssh settings without a user configure the default user, which can't log in anymore
+		if p.SSH != nil && p.SSH.User == "" && (p.SSH.Password != "" || len(p.SSH.AuthorizedKeys) > 0) {
+			return fmt.Errorf("ssh: password and authorized_keys of the default user can't be set with default_user %s, "+
+				"set them in users or set ssh user", p.DefaultUser)
+		}
+	default:
+		return fmt.Errorf("default_user %q is not supported, use keep, lock or remove", p.DefaultUser)
+	}
+
+	return nil
+}
+
+// ResolveKeys replaces paths of public key files with the keys they contain, relative paths are resolved against dir
+func (p *Profile) ResolveKeys(dir string) error {
+	var err error
+	if p.SSH != nil {
+		if p.SSH.AuthorizedKeys, err = resolveKeys(dir, p.SSH.AuthorizedKeys); err != nil {
+			return errors.Wrap(err, "ssh")
+		}
+	}
+	for i, u := range p.Users {
+		if p.Users[i].AuthorizedKeys, err = resolveKeys(dir, u.AuthorizedKeys); err != nil {
+			return errors.Wrap(err, "user "+u.Name)
+		}
+	}
+	return nil
+}
+
+func resolveKeys(dir string, list []string) ([]string, error) {
+	var keys []string
+	for _, k := range list {
+		if !isPublicKey(k) && !filepath.IsAbs(k) && !strings.HasPrefix(k, "~/") {
+			k = filepath.Join(dir, k)
+		}
+		found, err := ReadPublicKeys(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	return keys, nil
+}
+
+// localePrefix returns language part of the locale used to search keyboard layouts
+func (p *Profile) localePrefix() string {
+	l := p.Locale
+	if i := strings.IndexAny(l, "_."); i >= 0 {
+		l = l[:i]
+	}
+	return l
+}
+
+// ApplyProfile stores profile values and marks corresponding CallbackFn as preset,
+// so their Config functions are not triggered during Setup
+func (c *Configurator) ApplyProfile(p *Profile) {
+	if p == nil {
+		return
+	}
+
+	if p.Locale != "" {
+		c.storage[Locale] = locale.GetLocale(p.Locale)[0].Locale
+		c.preset[Locale] = true
+	}
+
+	if p.Keymap != "" {
+		c.storage[Keymap] = fmt.Sprintf("KEYMAP=%s\n", p.Keymap)
+		c.preset[Keymap] = true
+	}
+
+	if p.Wifi != nil {
+		c.storage[Wifi+"_name"] = p.Wifi.SSID
+		c.storage[Wifi+"_pass"] = []byte(p.Wifi.PSK)
+		c.preset[Wifi] = true
+	}
+
+	if len(p.Interfaces) > 0 {
+		c.storage[StaticInterfaces] = p.Interfaces
+		c.preset[Interface] = true
+	}
+
+	if p.Hostname != "" {
+		c.storage["NewHostname"] = p.Hostname
+		c.preset[Hostname] = true
+	}
+
+	if p.SecondaryDNS {
+		c.storage[DNS] = true
+		c.preset[DNS] = true
+	}
+
+	if p.SSH != nil {
+		if p.SSH.User != "" {
+			c.storage[User] = p.SSH.User
+		}
+		if len(p.SSH.AuthorizedKeys) > 0 {
+			c.storage[AuthorizedKeys] = p.SSH.AuthorizedKeys
+			c.storage[PasswordLogin] = !p.SSH.DisablePasswordLogin
+			c.preset[AuthorizedKeys] = true
+		}
+		if p.SSH.Password != "" {
+			c.storage[Password] = p.SSH.Password
+			c.preset[Password] = true
+		}
+	}
+
+	if len(p.Users) > 0 {
+		c.storage[Accounts] = p.Users
+		c.storage[DefaultUserAction] = p.DefaultUser
+		c.preset[Accounts] = true
+	}
+}
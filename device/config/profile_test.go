@@ -0,0 +1,115 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlProfile = `
+locale: en_GB.utf8
+keymap: uk
+hostname: node-01
+secondary_dns: true
+wifi:
+  ssid: office
+  psk: secret
+interfaces:
+  - name: eth0
+    address: 192.168.0.100
+    netmask: 255.255.255.0
+    gateway: 192.168.0.1
+    dns: 192.168.0.1
+`
+
+func writeProfile(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "iotit-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	p := writeProfile(t, "board.yaml", yamlProfile)
+	defer os.RemoveAll(filepath.Dir(p))
+
+	profile, err := LoadProfile(p)
+	assert.NoError(err)
+	assert.Equal("en_GB.utf8", profile.Locale)
+	assert.Equal("office", profile.Wifi.SSID)
+	assert.Len(profile.Interfaces, 1)
+	assert.Equal("eth0", profile.Interfaces[0].Name)
+
+	j := writeProfile(t, "board.json", `{"hostname": "node-02", "wifi": {"ssid": "lab", "psk": "pass"}}`)
+	defer os.RemoveAll(filepath.Dir(j))
+
+	profile, err = LoadProfile(j)
+	assert.NoError(err)
+	assert.Equal("node-02", profile.Hostname)
+	assert.Equal("lab", profile.Wifi.SSID)
+
+	j = writeProfile(t, "typo.json", `{"hostname": "node-02", "wif": {"ssid": "lab", "psk": "pass"}}`)
+	defer os.RemoveAll(filepath.Dir(j))
+
+	_, err = LoadProfile(j)
+	assert.Error(err)
+}
+
+func TestProfileValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&Profile{Locale: "xx_XX"}).Validate())
+	assert.Error((&Profile{Wifi: &WifiProfile{}}).Validate())
+	assert.Error((&Profile{Interfaces: []Interfaces{{Name: "usb0"}}}).Validate())
+	assert.Error((&Profile{Interfaces: []Interfaces{{Name: "eth0", Address: "300.1.1.1"}}}).Validate())
+
+	// the locked or removed default user can't get a password or keys
+	users := []UserProfile{{Name: "admin"}}
+	assert.Error((&Profile{Users: users, DefaultUser: DefaultUserLock, SSH: &SSHProfile{Password: "secret"}}).Validate())
+	assert.Error((&Profile{Users: users, DefaultUser: DefaultUserRemove, SSH: &SSHProfile{AuthorizedKeys: []string{testKey}}}).Validate())
+	assert.NoError((&Profile{Users: users, DefaultUser: DefaultUserLock, SSH: &SSHProfile{User: "admin", Password: "secret"}}).Validate())
+	assert.NoError((&Profile{Users: users, DefaultUser: DefaultUserKeep, SSH: &SSHProfile{Password: "secret"}}).Validate())
+}
+
+func TestWriteOrder(t *testing.T) {
+	assert := assert.New(t)
+	c := New(nil)
+	var applied []string
+	for _, name := range []string{"port", Password, Accounts, AuthorizedKeys, Hostname, Locale} {
+		name := name
+		c.AddConfigFn(name, NewCallbackFn(nil, func(map[string]interface{}) error {
+			applied = append(applied, name)
+			return nil
+		}))
+	}
+	assert.NoError(c.Write())
+	assert.Equal([]string{Locale, Hostname, Accounts, AuthorizedKeys, Password, "port"}, applied)
+}
+
+func TestApplyProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewDefault(nil)
+	c.ApplyProfile(&Profile{
+		Keymap:   "jp",
+		Hostname: "node-03",
+		Wifi:     &WifiProfile{SSID: "office", PSK: "secret"},
+	})
+
+	assert.Equal("KEYMAP=jp\n", c.storage[Keymap])
+	assert.Equal("node-03", c.storage["NewHostname"])
+	assert.Equal([]byte("secret"), c.storage[Wifi+"_pass"])
+	assert.True(c.preset[Wifi])
+	assert.True(c.preset[Hostname])
+	assert.False(c.preset[Locale])
+}
@@ -0,0 +1,382 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/dialogs"
+	"github.com/xshellinc/tools/lib/help"
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+// imageFileEnd marks the end of the file content read by readImageFile
+const imageFileEnd = "iotit-eof"
+
+// keyTypes are prefixes of the supported public keys
+var keyTypes = []string{"ssh-rsa", "ssh-ed25519", "ssh-dss", "ecdsa-sha2-", "sk-ssh-ed25519@openssh.com", "sk-ecdsa-sha2-"}
+
+// passwdEntry is a line of /etc/passwd
+type passwdEntry struct {
+	Name string
+	UID  int
+	GID  int
+	Home string
+}
+
+// imageUser returns the user configured by callbacks, it's the default user of the image unless a profile sets it
+func imageUser(storage map[string]interface{}) string {
+	if u, ok := storage[User].(string); ok && u != "" {
+		return u
+	}
+	return "root"
+}
+
+// SetAuthorizedKeys is a dialog asking for SSH public key files of the image user
+func SetAuthorizedKeys(storage map[string]interface{}) error {
+	user := imageUser(storage)
+	if !dialogs.YesNoDialog(fmt.Sprintf("Would you like to add SSH public keys of %s?", user)) {
+		return nil
+	}
+
+	var keys []string
+	for {
+		file := dialogs.GetSingleAnswer("Public key file: ", dialogs.CreateValidatorFn(func(s string) error {
+			_, err := ReadPublicKeys(s)
+			return err
+		}))
+		list, _ := ReadPublicKeys(file)
+		keys = append(keys, list...)
+		if !dialogs.YesNoDialog("Add another key?") {
+			break
+		}
+	}
+	storage[AuthorizedKeys] = keys
+	storage[PasswordLogin] = !dialogs.YesNoDialog("Disable SSH password login?")
+	return nil
+}
+
+// SaveAuthorizedKeys adds keys to ~/.ssh/authorized_keys of the image user and disables SSH password login if requested
+func SaveAuthorizedKeys(storage map[string]interface{}) error {
+	keys, ok := storage[AuthorizedKeys].([]string)
+	if !ok || len(keys) == 0 {
+		return nil
+	}
+	ssh, ok := storage["ssh"].(ssh_helper.Util)
+	if !ok {
+		return errors.New("Cannot get ssh config")
+	}
+
+	passwd, err := readImageFile(ssh, "/etc/passwd")
+	if err != nil {
+		return err
+	}
+	u, err := lookupUser(passwd, imageUser(storage))
+	if err != nil {
+		return err
+	}
+
+	if err := installKeys(ssh, u, keys); err != nil {
+		return err
+	}
+
+	if login, ok := storage[PasswordLogin].(bool); ok && !login {
+		conf, err := readImageFile(ssh, "/etc/ssh/sshd_config")
+		if err != nil {
+			return err
+		}
+		if err := writeImageFile(ssh, "/etc/ssh/sshd_config", disablePasswordLogin(conf)); err != nil {
+			return err
+		}
+		fmt.Println("[+] SSH password login disabled")
+	}
+	return nil
+}
+
+// installKeys adds keys to ~/.ssh/authorized_keys of the user
+func installKeys(ssh ssh_helper.Util, u *passwdEntry, keys []string) error {
+	dir := help.AddPathSuffix("unix", MountDir, u.Home, ".ssh")
+	file := help.AddPathSuffix("unix", dir, "authorized_keys")
+	existing := ""
+	if name := help.AddPathSuffix("unix", u.Home, ".ssh", "authorized_keys"); imageFileExists(ssh, name) {
+		var err error
+		if existing, err = readImageFile(ssh, name); err != nil {
+			return err
+		}
+	}
+	data := mergeKeys(existing, keys)
+
+	command := fmt.Sprintf("mkdir -p %s && printf '%%s' %s > %s && chmod 700 %s && chmod 600 %s && chown -R %d:%d %s",
+		dir, shellQuote(data), file, dir, file, u.UID, u.GID, dir)
+	if err := runCommand(ssh, command); err != nil {
+		return err
+	}
+	fmt.Printf("[+] %d SSH keys added for %s\n", len(keys), u.Name)
+	return nil
+}
+
+// SetPassword is a dialog asking for a new password of the image user
+func SetPassword(storage map[string]interface{}) error {
+	user := imageUser(storage)
+	if !dialogs.YesNoDialog(fmt.Sprintf("Would you like to change the default password of %s?", user)) {
+		return nil
+	}
+	hash, err := askPassword()
+	if err != nil {
+		return err
+	}
+	storage[Password] = hash
+	return nil
+}
+
+// askPassword asks for a password twice and returns it's hash
+func askPassword() (string, error) {
+	for attempt := 0; attempt < dialogs.Retries; attempt++ {
+		pass := dialogs.Password()
+		if pass == "" {
+			fmt.Println("[-] Password is empty")
+			continue
+		}
+		fmt.Println("[?] Repeat the password")
+		if dialogs.Password() != pass {
+			fmt.Println("[-] Passwords don't match")
+			continue
+		}
+		return HashPassword(pass)
+	}
+	return "", errors.New("password isn't set")
+}
+
+// SavePassword writes the password hash of the image user into /etc/shadow
+func SavePassword(storage map[string]interface{}) error {
+	pass, ok := storage[Password].(string)
+	if !ok || pass == "" {
+		return nil
+	}
+	user := imageUser(storage)
+	hash, err := hashPassword(storage, user, pass)
+	if err != nil {
+		return err
+	}
+	ssh, ok := storage["ssh"].(ssh_helper.Util)
+	if !ok {
+		return errors.New("Cannot get ssh config")
+	}
+
+	shadow, err := readImageFile(ssh, "/etc/shadow")
+	if err != nil {
+		return err
+	}
+	if shadow, err = setShadowPassword(shadow, user, hash, lastChange(storage)); err != nil {
+		return err
+	}
+	if err := writeImageFile(ssh, "/etc/shadow", shadow); err != nil {
+		return err
+	}
+	fmt.Println("[+] Password of", user, "changed")
+	return nil
+}
+
+// hashPassword hashes the password of the user, the salt is derived from PasswordSeed and the user when it's set
+func hashPassword(storage map[string]interface{}, user, password string) (string, error) {
+	if seed, ok := storage[PasswordSeed].(string); ok && seed != "" {
+		return SeededHashPassword(password, seed+":"+user), nil
+	}
+	return HashPassword(password)
+}
+
+// lastChange returns the day of the last password change written into /etc/shadow
+func lastChange(storage map[string]interface{}) int {
+	if day, ok := storage[LastChange].(int); ok {
+		return day
+	}
+	return int(time.Now().Unix() / 86400)
+}
+
+// shadowDay formats the day of /etc/shadow, negative days are empty
+func shadowDay(day int) string {
+	if day < 0 {
+		return ""
+	}
+	return strconv.Itoa(day)
+}
+
+// ReadPublicKeys reads public keys from the file, a key itself is returned as is
+func ReadPublicKeys(s string) ([]string, error) {
+	if isPublicKey(s) {
+		return []string{strings.TrimSpace(s)}, nil
+	}
+	if strings.HasPrefix(s, "~/") {
+		s = filepath.Join(os.Getenv("HOME"), s[2:])
+	}
+	data, err := ioutil.ReadFile(s)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isPublicKey(line) {
+			return nil, fmt.Errorf("%s: not an SSH public key", s)
+		}
+		keys = append(keys, line)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no SSH public keys found", s)
+	}
+	return keys, nil
+}
+
+func isPublicKey(s string) bool {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, t := range keyTypes {
+		if strings.HasPrefix(fields[0], t) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeKeys appends keys missing in the authorized_keys content
+func mergeKeys(existing string, keys []string) string {
+	var lines []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(existing, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+		seen[strings.TrimSpace(line)] = true
+	}
+	for _, k := range keys {
+		if !seen[k] {
+			lines = append(lines, k)
+			seen[k] = true
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// lookupUser finds the user in /etc/passwd content
+func lookupUser(passwd, name string) (*passwdEntry, error) {
+	s := bufio.NewScanner(strings.NewReader(passwd))
+	for s.Scan() {
+		f := strings.Split(s.Text(), ":")
+		if len(f) < 7 || f[0] != name {
+			continue
+		}
+		uid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid of %s: %s", name, f[2])
+		}
+		gid, err := strconv.Atoi(f[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid of %s: %s", name, f[3])
+		}
+		return &passwdEntry{Name: name, UID: uid, GID: gid, Home: f[5]}, nil
+	}
+	return nil, fmt.Errorf("user %s not found in the image", name)
+}
+
+// setShadowPassword replaces the password hash and the last change day of the user in /etc/shadow content
+func setShadowPassword(shadow, user, hash string, days int) (string, error) {
+	lines := strings.Split(shadow, "\n")
+	for i, line := range lines {
+		f := strings.Split(line, ":")
+		if len(f) < 3 || f[0] != user {
+			continue
+		}
+		f[1] = hash
+		f[2] = shadowDay(days)
+		lines[i] = strings.Join(f, ":")
+		return strings.Join(lines, "\n"), nil
+	}
+	return "", fmt.Errorf("user %s not found in /etc/shadow", user)
+}
+
+// disablePasswordLogin turns off password and keyboard-interactive authentication in sshd_config content.
+// sshd uses the first value of an option, so they are put on top of the file before any Include,
+// the existing global ones are commented out
+func disablePasswordLogin(conf string) string {
+	options := []string{"PasswordAuthentication", "ChallengeResponseAuthentication", "KbdInteractiveAuthentication"}
+	var out []string
+	for _, o := range options {
+		out = append(out, o+" no")
+	}
+	inMatch := false
+	for _, line := range strings.Split(strings.TrimRight(conf, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "Match") {
+			inMatch = true
+		}
+		if !inMatch && len(fields) > 0 {
+			for _, o := range options {
+				if strings.EqualFold(fields[0], o) {
+					line = "#" + line
+					break
+				}
+			}
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// readImageFile reads the file of the mounted image. The content is followed by imageFileEnd,
+// so newlines easyssh adds to the output are cut off
+func readImageFile(ssh ssh_helper.Util, name string) (string, error) {
+	path := help.AddPathSuffix("unix", MountDir, name)
+	out, eut, err := ssh.Run(fmt.Sprintf("cat %s && printf '\\n%%s\\n' %s", path, imageFileEnd))
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %s %s", name, err, strings.TrimSpace(eut))
+	}
+	if eut = strings.TrimSpace(eut); eut != "" {
+		return "", fmt.Errorf("cannot read %s: %s", name, eut)
+	}
+	i := strings.LastIndex(out, "\n"+imageFileEnd+"\n")
+	if i < 0 {
+		return "", fmt.Errorf("cannot read %s: output is incomplete", name)
+	}
+	return out[:i], nil
+}
+
+// writeImageFile replaces content of the mounted image file keeping it's owner and mode
+func writeImageFile(ssh ssh_helper.Util, name, data string) error {
+	log.WithField("file", name).Debug("writeImageFile")
+	path := help.AddPathSuffix("unix", MountDir, name)
+	if err := runCommand(ssh, fmt.Sprintf("printf '%%s' %s > %s", shellQuote(data), path)); err != nil {
+		return fmt.Errorf("cannot write %s: %s", name, err)
+	}
+	return nil
+}
+
+// runCommand runs the command in the workspace, easyssh doesn't return exit codes, so stderr output is an error
+func runCommand(ssh ssh_helper.Util, command string) error {
+	_, eut, err := ssh.Run(command)
+	eut = strings.TrimSpace(eut)
+	if err != nil {
+		return errors.New(err.Error() + ":" + eut)
+	}
+	if eut != "" {
+		return errors.New(eut)
+	}
+	return nil
+}
+
+// shellQuote quotes the string for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
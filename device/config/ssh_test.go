@@ -0,0 +1,108 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGc2fWzJ5rR3aKj5q2n1a2Vu8xHq9d7v1yJx2v3q4w5e user@host"
+
+func TestLookupUser(t *testing.T) {
+	assert := assert.New(t)
+
+	passwd := "root:x:0:0:root:/root:/bin/bash\npi:x:1000:1000:,,,:/home/pi:/bin/bash\n"
+	u, err := lookupUser(passwd, "pi")
+	assert.NoError(err)
+	assert.Equal(&passwdEntry{Name: "pi", UID: 1000, GID: 1000, Home: "/home/pi"}, u)
+
+	_, err = lookupUser(passwd, "debian")
+	assert.Error(err)
+}
+
+func TestSetShadowPassword(t *testing.T) {
+	assert := assert.New(t)
+
+	shadow := "root:*:17000:0:99999:7:::\npi:$6$old$hash:17000:0:99999:7:::\n"
+	out, err := setShadowPassword(shadow, "pi", "$6$salt$new", 18000)
+	assert.NoError(err)
+	assert.Equal("root:*:17000:0:99999:7:::\npi:$6$salt$new:18000:0:99999:7:::\n", out)
+
+	out, err = setShadowPassword(shadow, "pi", "$6$salt$new", -1)
+	assert.NoError(err)
+	assert.Equal("root:*:17000:0:99999:7:::\npi:$6$salt$new::0:99999:7:::\n", out)
+
+	_, err = setShadowPassword(shadow, "debian", "$6$salt$new", 18000)
+	assert.Error(err)
+}
+
+func TestDisablePasswordLogin(t *testing.T) {
+	assert := assert.New(t)
+
+	conf := "Include /etc/ssh/sshd_config.d/*.conf\n#PasswordAuthentication yes\nPasswordAuthentication yes\nMatch User guest\n\tPasswordAuthentication yes\n"
+	assert.Equal("PasswordAuthentication no\nChallengeResponseAuthentication no\nKbdInteractiveAuthentication no\n"+
+		"Include /etc/ssh/sshd_config.d/*.conf\n#PasswordAuthentication yes\n#PasswordAuthentication yes\n"+
+		"Match User guest\n\tPasswordAuthentication yes\n", disablePasswordLogin(conf))
+}
+
+func TestMergeKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(testKey+"\n", mergeKeys("", []string{testKey, testKey}))
+	assert.Equal("ssh-rsa AAAA old\n"+testKey+"\n", mergeKeys("ssh-rsa AAAA old\n\n", []string{testKey}))
+}
+
+func TestProfileSSH(t *testing.T) {
+	assert := assert.New(t)
+
+	p := writeProfile(t, "board.yaml", "ssh:\n  user: admin\n  authorized_keys: [id.pub]\n  password: secret\n  disable_password_login: true\n")
+	defer os.RemoveAll(filepath.Dir(p))
+	assert.NoError(ioutil.WriteFile(filepath.Join(filepath.Dir(p), "id.pub"), []byte("# laptop\n"+testKey+"\n"), 0644))
+
+	profile, err := LoadProfile(p)
+	assert.NoError(err)
+	assert.Equal([]string{testKey}, profile.SSH.AuthorizedKeys)
+
+	c := NewDefault(nil)
+	c.StoreValue(User, "pi")
+	c.ApplyProfile(profile)
+	assert.Equal("admin", c.storage[User])
+	assert.Equal([]string{testKey}, c.storage[AuthorizedKeys])
+	assert.Equal(false, c.storage[PasswordLogin])
+	assert.Equal("secret", c.storage[Password])
+	assert.True(c.preset[AuthorizedKeys])
+	assert.True(c.preset[Password])
+
+	assert.Error((&Profile{SSH: &SSHProfile{DisablePasswordLogin: true}}).Validate())
+	assert.Error((&Profile{SSH: &SSHProfile{AuthorizedKeys: []string{"not a key"}}}).Validate())
+}
+
+// fakeSSH returns the output of the command like easyssh, which adds a newline to stdout and stderr
+type fakeSSH struct {
+	ssh_helper.Util
+	out, eut string
+}
+
+func (f *fakeSSH) Run(command string) (string, string, error) {
+	return f.out + "\n", f.eut + "\n", nil
+}
+
+func TestReadImageFile(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := readImageFile(&fakeSSH{out: "root:x:0:0::/root:/bin/sh\n\niotit-eof\n"}, "/etc/passwd")
+	assert.NoError(err)
+	assert.Equal("root:x:0:0::/root:/bin/sh\n", data)
+	data, err = readImageFile(&fakeSSH{out: "no newline\niotit-eof\n"}, "/etc/hostname")
+	assert.NoError(err)
+	assert.Equal("no newline", data)
+
+	_, err = readImageFile(&fakeSSH{eut: "cat: /etc/shadow: No such file or directory"}, "/etc/shadow")
+	assert.Error(err)
+	assert.Error(writeImageFile(&fakeSSH{eut: "sh: can't create /etc/shadow: Read-only file system"}, "/etc/shadow", "x"))
+	assert.NoError(writeImageFile(&fakeSSH{}, "/etc/shadow", "x"))
+}
@@ -0,0 +1,491 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/dialogs"
+	"github.com/xshellinc/tools/lib/help"
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+const (
+	firstUID     = 1000
+	defaultShell = "/bin/bash"
+	sudoersDir   = "/etc/sudoers.d"
+)
+
+var (
+	userName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	// nologinShells are checked in the image to lock accounts
+	nologinShells = []string{"/usr/sbin/nologin", "/sbin/nologin", "/bin/false"}
+)
+
+// accounts is the content of /etc/passwd, /etc/shadow, /etc/group and /etc/gshadow split into lines,
+// gshadow is nil when the image doesn't have it
+type accounts struct {
+	passwd  []string
+	shadow  []string
+	group   []string
+	gshadow []string
+}
+
+// SetAccounts is a dialog asking for new users and whether the default user has to be locked
+func SetAccounts(storage map[string]interface{}) error {
+	if !dialogs.YesNoDialog("Would you like to create a new user?") {
+		return nil
+	}
+
+	var users []UserProfile
+	for {
+		u := UserProfile{}
+		u.Name = dialogs.GetSingleAnswer("User name: ", dialogs.CreateValidatorFn(func(s string) error {
+			return validateUser(UserProfile{Name: s})
+		}))
+		hash, err := askPassword()
+		if err != nil {
+			return err
+		}
+		u.Password = hash
+		if dialogs.YesNoDialog(fmt.Sprintf("Allow %s to use sudo?", u.Name)) {
+			u.Sudo = "password"
+		}
+		users = append(users, u)
+		if !dialogs.YesNoDialog("Create another user?") {
+			break
+		}
+	}
+	storage[Accounts] = users
+
+	if def, ok := storage[DefaultUser].(string); ok && def != "" {
+		if dialogs.YesNoDialog(fmt.Sprintf("Would you like to lock the default user %s?", def)) {
+			storage[DefaultUserAction] = DefaultUserLock
+		}
+	}
+	return nil
+}
+
+// SaveAccounts creates users in the mounted image with their homes, keys and sudoers files,
+// then locks or removes the default user
+func SaveAccounts(storage map[string]interface{}) error {
+	users, _ := storage[Accounts].([]UserProfile)
+	if len(users) == 0 {
+		return nil
+	}
+	ssh, ok := storage["ssh"].(ssh_helper.Util)
+	if !ok {
+		return errors.New("Cannot get ssh config")
+	}
+
+	a, err := readAccounts(ssh)
+	if err != nil {
+		return err
+	}
+	days := lastChange(storage)
+	entries := make([]*passwdEntry, len(users))
+	for i, u := range users {
+		hash := "!"
+		if u.Password != "" {
+			if hash, err = hashPassword(storage, u.Name, u.Password); err != nil {
+				return err
+			}
+		}
+		if entries[i], err = a.addUser(u, hash, days); err != nil {
+			return err
+		}
+	}
+
+	def, _ := storage[DefaultUser].(string)
+	action, _ := storage[DefaultUserAction].(string)
+	if def != "" && (action == DefaultUserLock || action == DefaultUserRemove) && imageUser(storage) == def {
+		pass, _ := storage[Password].(string)
+		keys, _ := storage[AuthorizedKeys].([]string)
+		if pass != "" || len(keys) > 0 {
+			return fmt.Errorf("password and SSH keys of the default user %s can't be set with default_user %s", def, action)
+		}
+	}
+	var removed *passwdEntry
+	if def != "" {
+		switch action {
+		case DefaultUserLock:
+			if err := a.lockUser(def, findShell(ssh)); err != nil {
+				return err
+			}
+		case DefaultUserRemove:
+			if removed, err = a.removeUser(def); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := a.write(ssh); err != nil {
+		return err
+	}
+
+	for i, u := range users {
+		if err := createHome(ssh, entries[i]); err != nil {
+			return err
+		}
+		if len(u.AuthorizedKeys) > 0 {
+			if err := installKeys(ssh, entries[i], u.AuthorizedKeys); err != nil {
+				return err
+			}
+		}
+		if u.Sudo != "" {
+			if err := writeSudoers(ssh, u); err != nil {
+				return err
+			}
+		}
+		fmt.Println("[+] User", u.Name, "created")
+	}
+
+	if def == "" || (action != DefaultUserLock && action != DefaultUserRemove) {
+		return nil
+	}
+	// sudoers files of the default user, like 010_pi-nopasswd of Raspbian
+	command := fmt.Sprintf(`for f in %s/*; do [ -f "$f" ] && grep -qE '^%s[[:space:]]' "$f" && rm -f "$f"; done; true`,
+		help.AddPathSuffix("unix", MountDir, sudoersDir), def)
+	home := ""
+	if removed != nil {
+		if home = a.removableHome(removed); home != "" {
+			command += " && rm -rf " + shellQuote(help.AddPathSuffix("unix", MountDir, home))
+		}
+	}
+	if err := runCommand(ssh, command); err != nil {
+		return err
+	}
+	if removed != nil {
+		fmt.Println("[+] Default user", def, "removed")
+		if home == "" {
+			fmt.Println("[+] Home folder", removed.Home, "is kept")
+		}
+	} else {
+		fmt.Println("[+] Default user", def, "locked")
+	}
+	return nil
+}
+
+// validateUser checks the user profile
+func validateUser(u UserProfile) error {
+	if !userName.MatchString(u.Name) {
+		return fmt.Errorf("user name %q is invalid", u.Name)
+	}
+	if u.UID < 0 {
+		return fmt.Errorf("user %s: invalid uid %d", u.Name, u.UID)
+	}
+	if u.Shell != "" && !strings.HasPrefix(u.Shell, "/") {
+		return fmt.Errorf("user %s: shell %q isn't absolute", u.Name, u.Shell)
+	}
+	for _, g := range u.Groups {
+		if !userName.MatchString(g) {
+			return fmt.Errorf("user %s: group name %q is invalid", u.Name, g)
+		}
+	}
+	for _, k := range u.AuthorizedKeys {
+		if !isPublicKey(k) {
+			return fmt.Errorf("user %s: %q is not a public key", u.Name, k)
+		}
+	}
+	switch u.Sudo {
+	case "", "password", "nopasswd":
+	default:
+		return fmt.Errorf("user %s: sudo %q is not supported, use password or nopasswd", u.Name, u.Sudo)
+	}
+	return nil
+}
+
+// readAccounts reads account files of the mounted image
+func readAccounts(ssh ssh_helper.Util) (*accounts, error) {
+	a := &accounts{}
+	for name, lines := range map[string]*[]string{"/etc/passwd": &a.passwd, "/etc/shadow": &a.shadow, "/etc/group": &a.group} {
+		data, err := readImageFile(ssh, name)
+		if err != nil {
+			return nil, err
+		}
+		*lines = splitLines(data)
+	}
+	if imageFileExists(ssh, "/etc/gshadow") {
+		data, err := readImageFile(ssh, "/etc/gshadow")
+		if err != nil {
+			return nil, err
+		}
+		a.gshadow = splitLines(data)
+	}
+	return a, nil
+}
+
+// write saves account files into the mounted image
+func (a *accounts) write(ssh ssh_helper.Util) error {
+	files := map[string][]string{"/etc/passwd": a.passwd, "/etc/shadow": a.shadow, "/etc/group": a.group}
+	if a.gshadow != nil {
+		files["/etc/gshadow"] = a.gshadow
+	}
+	for name, lines := range files {
+		if err := writeImageFile(ssh, name, strings.Join(lines, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addUser adds the user with a group of the same name and adds it to the supplementary groups,
+// missing groups are created
+func (a *accounts) addUser(u UserProfile, hash string, days int) (*passwdEntry, error) {
+	if findLine(a.passwd, u.Name) >= 0 {
+		return nil, fmt.Errorf("user %s already exists in the image", u.Name)
+	}
+	if findLine(a.group, u.Name) >= 0 {
+		return nil, fmt.Errorf("group %s already exists in the image", u.Name)
+	}
+
+	uids := usedIDs(a.passwd)
+	gids := usedIDs(a.group)
+	uid := u.UID
+	if uid == 0 {
+		for uid = firstUID; uids[uid] || gids[uid]; uid++ {
+		}
+	} else if uids[uid] {
+		return nil, fmt.Errorf("uid %d of %s is already used in the image", uid, u.Name)
+	}
+	gid := uid
+	if gids[gid] {
+		gid = freeID(gids)
+	}
+
+	shell := u.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	e := &passwdEntry{Name: u.Name, UID: uid, GID: gid, Home: "/home/" + u.Name}
+	a.passwd = append(a.passwd, fmt.Sprintf("%s:x:%d:%d:,,,:%s:%s", e.Name, e.UID, e.GID, e.Home, shell))
+	a.shadow = append(a.shadow, fmt.Sprintf("%s:%s:%s:0:99999:7:::", e.Name, hash, shadowDay(days)))
+	a.addGroup(u.Name, gid)
+
+	for _, g := range u.Groups {
+		if findLine(a.group, g) < 0 {
+			a.addGroup(g, freeID(usedIDs(a.group)))
+		}
+		a.group = addMember(a.group, g, u.Name)
+		if a.gshadow != nil {
+			a.gshadow = addMember(a.gshadow, g, u.Name)
+		}
+	}
+	return e, nil
+}
+
+func (a *accounts) addGroup(name string, gid int) {
+	a.group = append(a.group, fmt.Sprintf("%s:x:%d:", name, gid))
+	if a.gshadow != nil {
+		a.gshadow = append(a.gshadow, name+":!::")
+	}
+}
+
+// lockUser locks the password, expires the account and disables the login shell,
+// so neither a password nor a key can be used to log in
+func (a *accounts) lockUser(name, shell string) error {
+	i := findLine(a.shadow, name)
+	j := findLine(a.passwd, name)
+	if i < 0 || j < 0 {
+		return fmt.Errorf("user %s not found in the image", name)
+	}
+	f := fields(a.shadow[i], 9)
+	if !strings.HasPrefix(f[1], "!") {
+		f[1] = "!" + f[1]
+	}
+	f[7] = "1"
+	a.shadow[i] = strings.Join(f, ":")
+
+	f = fields(a.passwd[j], 7)
+	f[6] = shell
+	a.passwd[j] = strings.Join(f, ":")
+	return nil
+}
+
+// removeUser removes the user, it's group when no one else is a member of it and it's group memberships.
+// Users with uid 0 can't be removed
+func (a *accounts) removeUser(name string) (*passwdEntry, error) {
+	i := findLine(a.passwd, name)
+	if i < 0 {
+		return nil, fmt.Errorf("user %s not found in the image", name)
+	}
+	e, err := lookupUser(a.passwd[i], name)
+	if err != nil {
+		return nil, err
+	}
+	if e.UID == 0 {
+		return nil, fmt.Errorf("user %s has uid 0, it can't be removed", name)
+	}
+	a.passwd = append(a.passwd[:i], a.passwd[i+1:]...)
+	if i := findLine(a.shadow, name); i >= 0 {
+		a.shadow = append(a.shadow[:i], a.shadow[i+1:]...)
+	}
+
+	a.group = removeMember(a.group, name)
+	if i := findLine(a.group, name); i >= 0 {
+		f := fields(a.group[i], 4)
+		if f[2] == strconv.Itoa(e.GID) && f[3] == "" {
+			a.group = append(a.group[:i], a.group[i+1:]...)
+			if j := findLine(a.gshadow, name); j >= 0 {
+				a.gshadow = append(a.gshadow[:j], a.gshadow[j+1:]...)
+			}
+		}
+	}
+	if a.gshadow != nil {
+		a.gshadow = removeMember(a.gshadow, name)
+	}
+	return e, nil
+}
+
+// removableHome returns the home folder of the removed user if it's /home/<name> and no remaining user has it,
+// otherwise it's empty and the folder is kept
+func (a *accounts) removableHome(e *passwdEntry) string {
+	if !userName.MatchString(e.Name) || e.Home != "/home/"+e.Name {
+		return ""
+	}
+	for _, l := range a.passwd {
+		if path.Clean(fields(l, 7)[5]) == e.Home {
+			return ""
+		}
+	}
+	return e.Home
+}
+
+// createHome copies /etc/skel into the home folder of the user
+func createHome(ssh ssh_helper.Util, e *passwdEntry) error {
+	home := help.AddPathSuffix("unix", MountDir, e.Home)
+	skel := help.AddPathSuffix("unix", MountDir, "/etc/skel")
+	command := fmt.Sprintf("mkdir -p %s && if [ -d %s ]; then cp -a %s/. %s; fi && chown -R %d:%d %s && chmod 755 %s",
+		home, skel, skel, home, e.UID, e.GID, home, home)
+	log.WithField("command", command).Debug("createHome")
+	return runCommand(ssh, command)
+}
+
+// writeSudoers adds a sudoers drop-in of the user
+func writeSudoers(ssh ssh_helper.Util, u UserProfile) error {
+	if !imageFileExists(ssh, "/etc/sudoers") {
+		return fmt.Errorf("user %s: sudo isn't installed in the image", u.Name)
+	}
+	rule := fmt.Sprintf("%s ALL=(ALL:ALL) ALL\n", u.Name)
+	if u.Sudo == "nopasswd" {
+		rule = fmt.Sprintf("%s ALL=(ALL:ALL) NOPASSWD: ALL\n", u.Name)
+	}
+	dir := help.AddPathSuffix("unix", MountDir, sudoersDir)
+	// sudo skips drop-ins with dots in their names
+	file := help.AddPathSuffix("unix", dir, "090_iotit-"+u.Name)
+	command := fmt.Sprintf("mkdir -p %s && printf '%%s' %s > %s && chmod 440 %s && chown 0:0 %s",
+		dir, shellQuote(rule), file, file, file)
+	return runCommand(ssh, command)
+}
+
+// findShell returns the first nologin shell found in the image
+func findShell(ssh ssh_helper.Util) string {
+	for _, s := range nologinShells {
+		if imageFileExists(ssh, s) {
+			return s
+		}
+	}
+	return nologinShells[0]
+}
+
+// imageFileExists checks the file of the mounted image
+func imageFileExists(ssh ssh_helper.Util, name string) bool {
+	out, _, err := ssh.Run(fmt.Sprintf("test -e %s && echo yes", help.AddPathSuffix("unix", MountDir, name)))
+	return err == nil && strings.TrimSpace(out) == "yes"
+}
+
+// splitLines splits file content dropping empty lines
+func splitLines(data string) []string {
+	var lines []string
+	for _, l := range strings.Split(data, "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// findLine returns index of the line starting with the name field
+func findLine(lines []string, name string) int {
+	for i, l := range lines {
+		if strings.HasPrefix(l, name+":") {
+			return i
+		}
+	}
+	return -1
+}
+
+// fields splits the line by colons padding it to n fields
+func fields(line string, n int) []string {
+	f := strings.Split(line, ":")
+	for len(f) < n {
+		f = append(f, "")
+	}
+	return f
+}
+
+// usedIDs returns ids from the third field of passwd or group lines
+func usedIDs(lines []string) map[int]bool {
+	ids := make(map[int]bool)
+	for _, l := range lines {
+		if id, err := strconv.Atoi(fields(l, 3)[2]); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func freeID(used map[int]bool) int {
+	id := firstUID
+	for used[id] {
+		id++
+	}
+	return id
+}
+
+// addMember adds the user to the member list of the group or gshadow line
+func addMember(lines []string, group, user string) []string {
+	i := findLine(lines, group)
+	if i < 0 {
+		return lines
+	}
+	f := fields(lines[i], 4)
+	members := splitMembers(f[3])
+	for _, m := range members {
+		if m == user {
+			return lines
+		}
+	}
+	f[3] = strings.Join(append(members, user), ",")
+	lines[i] = strings.Join(f, ":")
+	return lines
+}
+
+// removeMember removes the user from member lists of all groups
+func removeMember(lines []string, user string) []string {
+	for i, l := range lines {
+		f := fields(l, 4)
+		var members []string
+		for _, m := range splitMembers(f[3]) {
+			if m != user {
+				members = append(members, m)
+			}
+		}
+		if len(members) != len(splitMembers(f[3])) {
+			f[3] = strings.Join(members, ",")
+			lines[i] = strings.Join(f, ":")
+		}
+	}
+	return lines
+}
+
+func splitMembers(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
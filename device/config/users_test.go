@@ -0,0 +1,98 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAccounts() *accounts {
+	return &accounts{
+		passwd:  []string{"root:x:0:0:root:/root:/bin/bash", "pi:x:1000:1000:,,,:/home/pi:/bin/bash"},
+		shadow:  []string{"root:*:17000:0:99999:7:::", "pi:$6$old$hash:17000:0:99999:7:::"},
+		group:   []string{"root:x:0:", "sudo:x:27:pi", "video:x:44:pi", "pi:x:1000:"},
+		gshadow: []string{"root:*::", "sudo:*::pi", "video:*::pi", "pi:!::"},
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	assert := assert.New(t)
+
+	a := testAccounts()
+	e, err := a.addUser(UserProfile{Name: "admin", Groups: []string{"sudo", "docker"}}, "!", 18000)
+	assert.NoError(err)
+	assert.Equal(&passwdEntry{Name: "admin", UID: 1001, GID: 1001, Home: "/home/admin"}, e)
+	assert.Equal("admin:x:1001:1001:,,,:/home/admin:/bin/bash", a.passwd[2])
+	assert.Equal("admin:!:18000:0:99999:7:::", a.shadow[2])
+	assert.Equal([]string{"root:x:0:", "sudo:x:27:pi,admin", "video:x:44:pi", "pi:x:1000:", "admin:x:1001:", "docker:x:1002:admin"}, a.group)
+	assert.Equal([]string{"root:*::", "sudo:*::pi,admin", "video:*::pi", "pi:!::", "admin:!::", "docker:!::admin"}, a.gshadow)
+
+	_, err = a.addUser(UserProfile{Name: "pi"}, "!", 18000)
+	assert.Error(err)
+	_, err = a.addUser(UserProfile{Name: "ops", UID: 1000}, "!", 18000)
+	assert.Error(err)
+
+	a.gshadow = nil
+	e, err = a.addUser(UserProfile{Name: "ops", UID: 2000, Shell: "/bin/sh"}, "!", 18000)
+	assert.NoError(err)
+	assert.Equal(2000, e.GID)
+	assert.Equal("ops:x:2000:2000:,,,:/home/ops:/bin/sh", a.passwd[3])
+	assert.Nil(a.gshadow)
+}
+
+func TestLockUser(t *testing.T) {
+	assert := assert.New(t)
+
+	a := testAccounts()
+	assert.NoError(a.lockUser("pi", "/usr/sbin/nologin"))
+	assert.Equal("pi:!$6$old$hash:17000:0:99999:7::1:", a.shadow[1])
+	assert.Equal("pi:x:1000:1000:,,,:/home/pi:/usr/sbin/nologin", a.passwd[1])
+	assert.Error(a.lockUser("debian", "/usr/sbin/nologin"))
+}
+
+func TestRemoveUser(t *testing.T) {
+	assert := assert.New(t)
+
+	a := testAccounts()
+	e, err := a.removeUser("pi")
+	assert.NoError(err)
+	assert.Equal("/home/pi", e.Home)
+	assert.Equal([]string{"root:x:0:0:root:/root:/bin/bash"}, a.passwd)
+	assert.Equal([]string{"root:*:17000:0:99999:7:::"}, a.shadow)
+	assert.Equal([]string{"root:x:0:", "sudo:x:27:", "video:x:44:"}, a.group)
+	assert.Equal([]string{"root:*::", "sudo:*::", "video:*::"}, a.gshadow)
+	assert.Equal("/home/pi", a.removableHome(e))
+
+	_, err = a.removeUser("pi")
+	assert.Error(err)
+	_, err = a.removeUser("root")
+	assert.Error(err)
+
+	// homes outside of /home/<name> or used by other users are kept
+	a = testAccounts()
+	a.passwd = append(a.passwd, "kiosk:x:1001:1001:,,,:/home/pi:/bin/bash", "svc:x:1002:1002:,,,:/:/bin/false")
+	e, err = a.removeUser("pi")
+	assert.NoError(err)
+	assert.Equal("", a.removableHome(e))
+	e, err = a.removeUser("svc")
+	assert.NoError(err)
+	assert.Equal("", a.removableHome(e))
+}
+
+func TestProfileUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	users := []UserProfile{{Name: "admin", Sudo: "nopasswd"}}
+	assert.NoError((&Profile{Users: users, DefaultUser: DefaultUserLock}).Validate())
+	assert.Error((&Profile{DefaultUser: DefaultUserRemove}).Validate())
+	assert.Error((&Profile{Users: users, DefaultUser: "delete"}).Validate())
+	assert.Error((&Profile{Users: []UserProfile{{Name: "Admin"}}}).Validate())
+	assert.Error((&Profile{Users: []UserProfile{{Name: "admin", Sudo: "yes"}}}).Validate())
+	assert.Error((&Profile{Users: append(users, users...)}).Validate())
+
+	c := NewDefault(nil)
+	c.ApplyProfile(&Profile{Users: users, DefaultUser: DefaultUserRemove})
+	assert.Equal(users, c.storage[Accounts])
+	assert.Equal(DefaultUserRemove, c.storage[DefaultUserAction])
+	assert.True(c.preset[Accounts])
+}
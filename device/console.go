@@ -0,0 +1,95 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/iotit/device/console"
+	"github.com/xshellinc/tools/dialogs"
+)
+
+// ConsoleOptions of the serial console
+type ConsoleOptions struct {
+	Port       string
+	Baud       uint
+	Timestamps bool
+	// LogFile is appended with the same lines as printed
+	LogFile string
+	// Send lines are sent to the board once the port is opened
+	Send []string
+	// Input sends lines typed in the terminal to the board
+	Input bool
+	// Reset resets ESP modules with RTS to watch the boot log from the beginning
+	Reset bool
+	// Duration closes the console after the time, zero means until interrupted
+	Duration time.Duration
+	Quiet    bool
+}
+
+// Console attaches to the serial port of the board and prints its output until interrupted
+func Console(o *ConsoleOptions) error {
+	port, err := selectPort(o.Port, append(espChips, colibriChips...), o.Quiet)
+	if err != nil {
+		return err
+	}
+	sp, err := console.Open(port, o.Baud)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+
+	var out io.Writer = os.Stdout
+	if o.LogFile != "" {
+		f, err := os.OpenFile(o.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = io.MultiWriter(os.Stdout, f)
+	}
+
+	fmt.Println("[+] Connected to", dialogs.PrintColored(portDescription(port)), "press Ctrl+C to exit")
+
+	if o.Reset {
+		log.Debug("Resetting the module")
+		sp.SetDTR(false)
+		sp.SetRTS(true)
+		time.Sleep(100 * time.Millisecond)
+		sp.SetRTS(false)
+	}
+
+	for _, line := range o.Send {
+		if err := console.SendLine(sp, line); err != nil {
+			return err
+		}
+	}
+	if o.Input {
+		go func() {
+			if err := console.Send(sp, os.Stdin); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	var timeout <-chan time.Time
+	if o.Duration > 0 {
+		timeout = time.After(o.Duration)
+	}
+	go func() {
+		select {
+		case <-interrupt:
+		case <-timeout:
+		}
+		close(stop)
+	}()
+
+	return console.Monitor(sp, console.NewLineWriter(out, o.Timestamps), stop)
+}
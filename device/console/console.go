@@ -0,0 +1,144 @@
+// Package console is a line-buffered serial console used to watch boot logs and talk to boards
+package console
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xshellinc/go-serial"
+)
+
+// DefaultBaudRate is used by both ESP and Colibri boards
+const DefaultBaudRate = 115200
+
+// TimeFormat of the line timestamps
+const TimeFormat = "15:04:05.000"
+
+// Open opens the serial port with 8N1, reads return after 200ms of silence
+func Open(port string, baud uint) (serial.Serial, error) {
+	if baud == 0 {
+		baud = DefaultBaudRate
+	}
+	return serial.Open(serial.OpenOptions{
+		BaudRate:              baud,
+		DataBits:              8,
+		ParityMode:            serial.PARITY_NONE,
+		StopBits:              1,
+		InterCharacterTimeout: 200.0,
+		PortName:              port,
+	})
+}
+
+// idleFlush is the silence after which Monitor writes out an incomplete line
+var idleFlush = 2 * time.Second
+
+// LineWriter buffers output into lines and prefixes them with timestamps
+type LineWriter struct {
+	w          io.Writer
+	timestamps bool
+	now        func() time.Time
+	buf        []byte
+	partial    bool // the last written line is incomplete, it's continued without a timestamp
+	mu         sync.Mutex
+}
+
+// NewLineWriter creates LineWriter writing complete lines to w
+func NewLineWriter(w io.Writer, timestamps bool) *LineWriter {
+	return &LineWriter{w: w, timestamps: timestamps, now: time.Now}
+}
+
+// Write buffers p and writes out complete lines, carriage returns are dropped
+func (l *LineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, b := range p {
+		if b == '\r' {
+			continue
+		}
+		l.buf = append(l.buf, b)
+		if b == '\n' {
+			if err := l.flush(); err != nil {
+				return 0, err
+			}
+			l.partial = false
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out the incomplete line as is, e.g. a login prompt, the rest of it follows without a timestamp
+func (l *LineWriter) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) == 0 {
+		return nil
+	}
+	if err := l.flush(); err != nil {
+		return err
+	}
+	l.partial = true
+	return nil
+}
+
+func (l *LineWriter) flush() error {
+	line := l.buf
+	l.buf = l.buf[:0]
+	if l.timestamps && !l.partial {
+		line = append([]byte("["+l.now().Format(TimeFormat)+"] "), line...)
+	}
+	_, err := l.w.Write(line)
+	return err
+}
+
+// Monitor copies port output to out until stop is closed, incomplete lines are flushed
+// on exit or once the port is silent for idleFlush
+func Monitor(port io.Reader, out *LineWriter, stop <-chan struct{}) error {
+	buf := make([]byte, 4096)
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return out.Flush()
+		default:
+		}
+
+		n, err := port.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			last = time.Now()
+			continue
+		}
+		// nothing was read before the timeout
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if time.Since(last) >= idleFlush {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send writes lines from in to the port terminated with CR LF until in is closed
+func Send(port io.Writer, in io.Reader) error {
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		if err := SendLine(port, s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// SendLine writes the line to the port terminated with CR LF
+func SendLine(port io.Writer, line string) error {
+	_, err := port.Write([]byte(strings.TrimRight(line, "\r\n") + "\r\n"))
+	return err
+}
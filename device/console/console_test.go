@@ -0,0 +1,107 @@
+package console
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chunkReader returns one chunk per read and io.EOF once there are none, like a silent port
+type chunkReader struct {
+	chunks []string
+	stop   chan struct{}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		close(r.stop)
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestMonitor(t *testing.T) {
+	assert := assert.New(t)
+	out := &bytes.Buffer{}
+	w := NewLineWriter(out, true)
+	w.now = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 6000000, time.UTC) }
+
+	r := &chunkReader{chunks: []string{"rst:0x1 (POWERON", "_RESET)\r\nWi-Fi ", "connected\r\n", "login: "}, stop: make(chan struct{})}
+	assert.NoError(Monitor(r, w, r.stop))
+	assert.Equal("[03:04:05.006] rst:0x1 (POWERON_RESET)\n[03:04:05.006] Wi-Fi connected\n[03:04:05.006] login: ", out.String())
+
+	// an incomplete line is flushed after idleFlush and continued without a timestamp
+	out.Reset()
+	w = NewLineWriter(out, true)
+	w.now = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 6000000, time.UTC) }
+	defer func(d time.Duration) { idleFlush = d }(idleFlush)
+	idleFlush = 0
+	r = &chunkReader{chunks: []string{"Password", "", ": ok\r\n"}, stop: make(chan struct{})}
+	assert.NoError(Monitor(r, w, r.stop))
+	assert.Equal("[03:04:05.006] Password: ok\n", out.String())
+
+	sent := &bytes.Buffer{}
+	assert.NoError(Send(sent, bytes.NewBufferString("wifi start\nreboot\r\n")))
+	assert.Equal("wifi start\r\nreboot\r\n", sent.String())
+}
+
+// fakeBoard replies to written commands like U-Boot
+type fakeBoard struct {
+	replies map[string]string
+	pending string
+}
+
+func (b *fakeBoard) Write(p []byte) (int, error) {
+	b.pending += string(p) + b.replies[string(p)]
+	return len(p), nil
+}
+
+func (b *fakeBoard) Read(p []byte) (int, error) {
+	if b.pending == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	board := &fakeBoard{replies: map[string]string{
+		"run setupdate\r\n": "Colibri iMX6 # ",
+		"run update\r\n":    "writing...\r\nresetting ...\r\n",
+		"run bad\r\n":       "Unknown command 'bad' - try 'help'\r\n",
+	}}
+	out := &bytes.Buffer{}
+	s := NewSession(board, out)
+
+	script := &Script{
+		Name: "update",
+		Steps: []Step{
+			{Name: "setupdate", Send: "run setupdate\r\n", Expect: `iMX6 #`},
+			{Name: "update", Send: "run update\r\n", Expect: `resetting`, Echo: true},
+		},
+		Abort: []string{`Unknown command`},
+	}
+	assert.NoError(s.Run(script))
+	assert.Contains(out.String(), "writing...")
+
+	script.Steps = []Step{{Name: "bad", Send: "run bad\r\n", Expect: `iMX6 #`}}
+	err := s.Run(script)
+	if assert.IsType(&ExpectError{}, err) {
+		assert.Equal("Unknown command", err.(*ExpectError).Pattern)
+		assert.True(strings.HasPrefix(err.Error(), `update: step "bad" aborted on "Unknown command"`))
+	}
+
+	script.Steps = []Step{{Name: "prompt", Send: "\r\n", Expect: `login:`, Timeout: 50 * time.Millisecond, Retry: 1}}
+	err = s.Run(script)
+	if assert.Error(err) {
+		assert.Equal(`update: step "prompt" timed out after 50ms`, err.Error())
+	}
+}
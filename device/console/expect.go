@@ -0,0 +1,205 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTimeout of steps without one
+	DefaultTimeout = 30 * time.Second
+	// maxBuffer is the size of unmatched output kept to match patterns
+	maxBuffer = 64 * 1024
+)
+
+// Step sends text to the board and waits until its output matches the pattern
+type Step struct {
+	Name string
+	// Wait drops output received during the time before sending, e.g. repeated prompts
+	Wait time.Duration
+	// Send is written as is, lines should end with \r\n
+	Send string
+	// Expect is a regular expression, the step is done without waiting if it's empty
+	Expect  string
+	Timeout time.Duration
+	// Every resends Send with the interval until Expect matches, e.g. to stop autoboot
+	Every time.Duration
+	// Retry resends Send and waits again the number of times when Expect times out
+	Retry int
+	// Echo prints output received during the step
+	Echo bool
+}
+
+// Script is a sequence of steps, it fails once the output matches any of Abort patterns
+type Script struct {
+	Name  string
+	Steps []Step
+	Abort []string
+}
+
+// ExpectError describes the step which failed and the output received during it
+type ExpectError struct {
+	Script string
+	Step   string
+	// Pattern is the abort pattern which matched, it's empty on timeout
+	Pattern string
+	Timeout time.Duration
+	Output  string
+}
+
+func (e *ExpectError) Error() string {
+	reason := fmt.Sprintf("timed out after %s", e.Timeout)
+	if e.Pattern != "" {
+		reason = fmt.Sprintf("aborted on %q", e.Pattern)
+	}
+	msg := fmt.Sprintf("%s: step %q %s", e.Script, e.Step, reason)
+	if out := strings.TrimSpace(e.Output); out != "" {
+		lines := strings.Split(out, "\n")
+		if len(lines) > 5 {
+			lines = lines[len(lines)-5:]
+		}
+		msg += ", last output:\n" + strings.Join(lines, "\n")
+	}
+	return msg
+}
+
+// Session matches output of the board against patterns
+type Session struct {
+	rw io.ReadWriter
+	// Output receives output of steps with Echo
+	Output io.Writer
+	buf    []byte
+}
+
+// NewSession creates Session talking to the port, reads have to return after a timeout
+func NewSession(rw io.ReadWriter, echo io.Writer) *Session {
+	return &Session{rw: rw, Output: echo}
+}
+
+// Send writes the text to the board
+func (s *Session) Send(text string) error {
+	log.WithField("text", text).Debug("Send")
+	_, err := io.WriteString(s.rw, text)
+	return err
+}
+
+// Run runs steps of the script in order
+func (s *Session) Run(script *Script) error {
+	abort := make([]*regexp.Regexp, len(script.Abort))
+	for i, p := range script.Abort {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("%s: invalid abort pattern: %s", script.Name, err)
+		}
+		abort[i] = re
+	}
+
+	for _, step := range script.Steps {
+		log.WithField("step", step.Name).Debug(script.Name)
+		if err := s.run(step, abort); err != nil {
+			if e, ok := err.(*ExpectError); ok {
+				e.Script = script.Name
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) run(step Step, abort []*regexp.Regexp) error {
+	if step.Wait > 0 {
+		s.drain(step.Wait)
+	}
+	// only output received after sending is matched
+	s.buf = nil
+	if step.Expect == "" {
+		return s.Send(step.Send)
+	}
+	re, err := regexp.Compile(step.Expect)
+	if err != nil {
+		return fmt.Errorf("step %q: invalid pattern: %s", step.Name, err)
+	}
+
+	var timeoutErr error
+	for attempt := 0; attempt <= step.Retry; attempt++ {
+		if attempt > 0 {
+			log.WithField("attempt", attempt).Debug("Retrying ", step.Name)
+		}
+		if timeoutErr = s.expect(step, re, abort); timeoutErr == nil {
+			return nil
+		}
+		if e, ok := timeoutErr.(*ExpectError); !ok || e.Pattern != "" {
+			return timeoutErr
+		}
+	}
+	return timeoutErr
+}
+
+// drain reads and drops output for the duration
+func (s *Session) drain(d time.Duration) {
+	buf := make([]byte, 4096)
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		if n, err := s.rw.Read(buf); n == 0 || err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// expect sends the step text and reads output until the pattern or abort pattern matches or it times out
+func (s *Session) expect(step Step, re *regexp.Regexp, abort []*regexp.Regexp) error {
+	timeout := step.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	var sent time.Time
+	var received []byte
+
+	buf := make([]byte, 4096)
+	for {
+		if step.Send != "" && (sent.IsZero() || step.Every > 0 && time.Since(sent) >= step.Every) {
+			if err := s.Send(step.Send); err != nil {
+				return err
+			}
+			sent = time.Now()
+		}
+
+		n, err := s.rw.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n > 0 {
+			log.WithField("data", string(buf[:n])).Debug("Response")
+			received = append(received, buf[:n]...)
+			if step.Echo && s.Output != nil {
+				s.Output.Write(buf[:n])
+			}
+			s.buf = append(s.buf, buf[:n]...)
+			if len(s.buf) > maxBuffer {
+				s.buf = s.buf[len(s.buf)-maxBuffer:]
+			}
+			for _, a := range abort {
+				if a.Match(s.buf) {
+					s.buf = nil
+					return &ExpectError{Step: step.Name, Pattern: a.String(), Output: string(received)}
+				}
+			}
+			if loc := re.FindIndex(s.buf); loc != nil {
+				s.buf = s.buf[loc[1]:]
+				return nil
+			}
+		} else {
+			// don't spin on ports returning immediately
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if time.Now().After(deadline) {
+			return &ExpectError{Step: step.Name, Timeout: timeout, Output: string(received)}
+		}
+	}
+}
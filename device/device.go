@@ -3,7 +3,12 @@ package device
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/recipe"
 	"github.com/xshellinc/iotit/repo"
 	"github.com/xshellinc/tools/dialogs"
 	"github.com/xshellinc/tools/lib/help"
@@ -13,6 +18,8 @@ import (
 // CustomFlash custom method enum
 const customFlash = "Custom board"
 
+const espDevice = "Espressif ESP"
+
 // New returns new Flasher instance
 func New(c *cli.Context) Flasher {
 	args := c.Args()[:]
@@ -54,46 +61,50 @@ func New(c *cli.Context) Flasher {
 	return flasher
 }
 
-// ListItem is an item in supported devices list
+// ListItem is a device or it's model with images, it's used in list output
 type ListItem struct {
-	Title  string
-	Alias  string
-	Images map[string]string
-	Models []ListItem
+	Title  string      `json:"title" yaml:"title"`
+	Alias  string      `json:"alias,omitempty" yaml:"alias,omitempty"`
+	Images []ImageItem `json:"images,omitempty" yaml:"images,omitempty"`
+	Models []ListItem  `json:"models,omitempty" yaml:"models,omitempty"`
+}
+
+// ImageItem is an image of the device with it's default user
+type ImageItem struct {
+	Title   string   `json:"title" yaml:"title"`
+	Alias   string   `json:"alias,omitempty" yaml:"alias,omitempty"`
+	URL     string   `json:"url" yaml:"url"`
+	Mirrors []string `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
+	Hash    string   `json:"hash,omitempty" yaml:"hash,omitempty"`
+	HashURL string   `json:"hash_url,omitempty" yaml:"hash_url,omitempty"`
+	User    string   `json:"user,omitempty" yaml:"user,omitempty"`
+	Pass    string   `json:"pass,omitempty" yaml:"pass,omitempty"`
+}
+
+func imageItems(images []repo.DeviceImage) []ImageItem {
+	r := make([]ImageItem, len(images))
+	for i, img := range images {
+		r[i] = ImageItem{Title: img.Title, Alias: img.Alias, URL: img.URL, Mirrors: img.Mirrors,
+			Hash: img.Hash, HashURL: img.HashURL, User: img.User, Pass: img.Pass}
+	}
+	return r
 }
 
-// ListMapping - print supported devices from mapping.json file
+// ListMapping - returns supported devices from mapping.json file
 func ListMapping() []*ListItem {
 	list := []*ListItem{}
 	dm := repo.GetRepo()
-	fmt.Println("mapping.json version:", dm.Version)
 	for _, device := range dm.Devices {
 		r, e := repo.GetDeviceRepo(device.Name)
 		if e != nil {
 			continue
 		}
-		item := ListItem{}
-		item.Title = r.Name
-		if len(r.Alias) > 0 {
-			item.Alias = r.Alias
-		}
+		item := ListItem{Title: r.Name, Alias: r.Alias}
 		if len(r.Sub) == 0 {
-			item.Images = make(map[string]string)
-			for _, i := range r.Images {
-				item.Images[i.Title] = i.Alias
-			}
+			item.Images = imageItems(r.Images)
 		} else {
 			for _, sub := range r.Sub {
-				model := ListItem{}
-				model.Title = sub.Name
-				if len(sub.Alias) > 0 {
-					model.Alias = sub.Alias
-				}
-				model.Images = make(map[string]string)
-				for _, i := range sub.Images {
-					model.Images[i.Title] = i.Alias
-				}
-				item.Models = append(item.Models, model)
+				item.Models = append(item.Models, ListItem{Title: sub.Name, Alias: sub.Alias, Images: imageItems(sub.Images)})
 			}
 		}
 		list = append(list, &item)
@@ -108,8 +119,52 @@ func getFlasher(device, image string, c *cli.Context) (Flasher, error) {
 	port := c.String("port")
 	disk := c.String("disk")
 	quiet := c.Bool("quiet")
+	ws := c.String("workspace")
+	verify := !c.Bool("no-verify")
+
+	batch := batchOptions{AllRemovable: c.Bool("all-removable"), Hostname: c.String("hostname"), Start: c.Int("start")}
+	if disks := c.String("disks"); len(disks) > 0 {
+		batch.Disks = strings.Split(disks, ",")
+	}
+
+	var profile *config.Profile
+	if p := c.String("profile"); len(p) > 0 {
+		var err error
+		if profile, err = config.LoadProfile(p); err != nil {
+			return nil, err
+		}
+		fmt.Println("[+] Using configuration profile", p)
+	}
 
-	if device == customFlash {
+	if profile != nil && strings.Contains(profile.Hostname, "{n}") {
+		if batch.Hostname == "" {
+			batch.Hostname = profile.Hostname
+		}
+		// hostname template is stamped per disk, so the configured image keeps the default one
+		p := *profile
+		p.Hostname = ""
+		profile = &p
+	}
+	if batch.Hostname != "" && !batch.enabled() {
+		p := config.Profile{}
+		if profile != nil {
+			p = *profile
+		}
+		p.Hostname = batch.hostname(0)
+		profile = &p
+		batch.Hostname = ""
+	}
+
+	if fw := c.String("firmware"); fw != "" && device != customFlash {
+		var e error
+		if r, e = repo.GetDeviceRepo(device); e != nil {
+			return nil, e
+		}
+		// local firmware replaces images of the repository
+		r = selectDevice(r)
+		r.Image = repo.DeviceImage{Title: filepath.Base(fw), URL: fw}
+		fmt.Println("[+] Using firmware", fw)
+	} else if device == customFlash {
 		url := dialogs.GetSingleAnswer("Please provide image URL or path: ", dialogs.EmptyStringValidator)
 		r = &repo.DeviceMapping{Name: "Custom", Image: repo.DeviceImage{URL: url}}
 	} else {
@@ -134,30 +189,48 @@ func getFlasher(device, image string, c *cli.Context) (Flasher, error) {
 	if r.Type == "" {
 		r.Type = device
 	}
+	if c.String("firmware") != "" && r.Type != espDevice {
+		return nil, errors.New("--firmware is supported only by " + espDevice + " modules")
+	}
+
+	var overlays []recipe.Overlay
+	for _, o := range c.StringSlice("overlay") {
+		overlay, err := recipe.ParseOverlay(o)
+		if err != nil {
+			return nil, err
+		}
+		overlays = append(overlays, overlay)
+	}
+	if len(overlays) > 0 {
+		switch r.Type {
+		case "Toradex Colibri iMX6", "Intel® Edison", espDevice:
+			return nil, errors.New("--overlay is supported only by SD card images")
+		}
+	}
 
 	switch r.Type {
 	case "Raspberry Pi":
-		i := &raspberryPi{&sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c}, Disk: disk}}
+		i := &raspberryPi{&sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c, profile: profile, workspace: ws}, Disk: disk, batch: batch, verify: verify, overlays: overlays}}
 		i.device = device
 		i.devRepo = r
 		return i, nil
 	case "Beaglebone":
-		i := &beagleBone{&sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c}, Disk: disk}}
+		i := &beagleBone{&sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c, profile: profile, workspace: ws}, Disk: disk, batch: batch, verify: verify, overlays: overlays}}
 		i.device = device
 		i.devRepo = r
 		return i, nil
 	case "Toradex Colibri iMX6":
-		i := &colibri{&flasher{Quiet: quiet, CLI: c}, port, disk}
+		i := &colibri{&flasher{Quiet: quiet, CLI: c, profile: profile}, port, disk}
 		i.device = device
 		i.devRepo = r
 		return i, nil
 	case "Intel® Edison":
-		i := &edison{flasher: &flasher{Quiet: quiet, CLI: c}, IP: port}
+		i := &edison{flasher: &flasher{Quiet: quiet, CLI: c, profile: profile}, IP: port}
 		i.device = device
 		i.devRepo = r
 		return i, nil
-	case "Espressif ESP":
-		i := &serialFlasher{&flasher{Quiet: quiet, CLI: c}, port}
+	case espDevice:
+		i := &serialFlasher{&flasher{Quiet: quiet, CLI: c, profile: profile}, port}
 		i.device = device
 		i.devRepo = r
 		return i, nil
@@ -166,7 +239,7 @@ func getFlasher(device, image string, c *cli.Context) (Flasher, error) {
 	case "ASUS Tinker Board":
 		fallthrough
 	default:
-		i := &sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c}, Disk: disk}
+		i := &sdFlasher{flasher: &flasher{Quiet: quiet, CLI: c, profile: profile, workspace: ws}, Disk: disk, batch: batch, verify: verify, overlays: overlays}
 		i.device = device
 		i.devRepo = r
 		return i, nil
@@ -45,7 +45,7 @@ func (d *edison) Write() error {
 		break
 	}
 
-	if err := d.conf.Stop(d.Quiet); err != nil {
+	if err := d.ws.Stop(d.Quiet); err != nil {
 		log.Error(err)
 	}
 
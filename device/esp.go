@@ -0,0 +1,267 @@
+package device
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/esp-flasher/esp"
+	"github.com/xshellinc/esp-flasher/esp/rom_client"
+	"github.com/xshellinc/esp-flasher/esp32"
+	"github.com/xshellinc/tools/dialogs"
+)
+
+// flashCryptConf enables encryption of all flash address bits, it's the ESP-IDF default
+const flashCryptConf = 0xF
+
+// fuses burned to enable flash encryption in release mode, the firmware can't be read back
+// or replaced with a plaintext one through the serial bootloader
+var releaseFuses = []string{"download_dis_encrypt", "download_dis_decrypt", "download_dis_cache", "JTAG_disable"}
+
+// EncryptOptions are options of burning the flash encryption or secure boot key
+type EncryptOptions struct {
+	// Generate creates a random key if the key file doesn't exist
+	Generate bool
+	// Release protects the key and disables JTAG and the serial bootloader decryption and cache,
+	// by default only the key and the fuses enabling encryption or secure boot are burned
+	Release bool
+	// Confirm is the MAC address of the module confirming burning eFuses without dialogs
+	Confirm string
+	// DryRun prints eFuses which would be changed
+	DryRun bool
+}
+
+// connectESP32 connects to the ROM bootloader of the ESP32 module on the port
+func connectESP32(port string) (*rom_client.ROMClient, error) {
+	port, err := selectPort(port, espChips, false)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("[+] Using ", dialogs.PrintColored(portDescription(port)))
+	return rom_client.ConnectToROM(esp.ChipESP32, &esp.FlashOpts{ControlPort: port})
+}
+
+// ESPEfuseDump prints eFuses of the ESP32 module on the port
+func ESPEfuseDump(port string) error {
+	rc, err := connectESP32(port)
+	if err != nil {
+		return err
+	}
+	defer rc.Disconnect()
+
+	blocks, fuses, _, err := esp32.ReadFuses(rc)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		fmt.Println(b)
+	}
+	fmt.Println()
+	for _, f := range fuses {
+		fmt.Println(f)
+	}
+	return nil
+}
+
+// ESPEncryptFlash burns the flash encryption key of the ESP32 module on the port and enables flash encryption
+func ESPEncryptFlash(port, keyFile string, opts *EncryptOptions) error {
+	if err := burnKey(port, keyFile, opts, setEncryptionFuses); err != nil || opts.DryRun {
+		return err
+	}
+	fmt.Println("[+] Flash encryption is enabled, flash firmware with --encrypt-key", keyFile)
+	return nil
+}
+
+// ESPSecureBoot burns the secure boot key of the ESP32 module on the port and enables reflashable secure boot
+func ESPSecureBoot(port, keyFile string, opts *EncryptOptions) error {
+	if err := burnKey(port, keyFile, opts, setSecureBootFuses); err != nil || opts.DryRun {
+		return err
+	}
+	fmt.Println("[+] Secure boot is enabled, flash firmware with --secure-boot-key", keyFile)
+	return nil
+}
+
+// burnKey reads or generates the key, sets eFuses of the module with set and burns them after the confirmation
+func burnKey(port, keyFile string, opts *EncryptOptions, set func(map[string]*esp32.Fuse, []byte, bool) error) error {
+	key, err := readKey(keyFile, opts.Generate)
+	if err != nil {
+		return err
+	}
+
+	rc, err := connectESP32(port)
+	if err != nil {
+		return err
+	}
+	defer rc.Disconnect()
+
+	blocks, list, fuses, err := esp32.ReadFuses(rc)
+	if err != nil {
+		return err
+	}
+	mac := fuses[esp32.MACAddressFuseName].MACAddressString()
+	if err := set(fuses, key, opts.Release); err != nil {
+		return err
+	}
+
+	fmt.Println("[+] eFuses of", mac, "to burn:")
+	for _, f := range list {
+		switch {
+		case f.IsKey() && f.HasDiffs():
+			fmt.Printf("    %-21s: %s\n", f.Name(), keyFile)
+		case f.HasDiffs():
+			fmt.Println("   ", f)
+		}
+	}
+	if opts.DryRun {
+		fmt.Println("[+] Dry run, eFuses are not burned")
+		return nil
+	}
+	if !confirmBurn(mac, opts.Confirm) {
+		return errors.New("burning eFuses is not confirmed")
+	}
+
+	for _, b := range blocks {
+		if b.HasDiffs() {
+			if err := b.WriteDiffs(); err != nil {
+				return err
+			}
+		}
+	}
+	return esp32.ProgramFuses(rc)
+}
+
+// readKey reads 32 bytes key or generates a new one when it's allowed
+func readKey(file string, generate bool) ([]byte, error) {
+	key, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && generate {
+		key = make([]byte, esp32.KeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(file, key, 0600); err != nil {
+			return nil, err
+		}
+		fmt.Println("[+] Generated key", file, "keep it secret, it's needed to flash the module again")
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != esp32.KeyLen {
+		return nil, fmt.Errorf("%s: key must be %d bytes, got %d", file, esp32.KeyLen, len(key))
+	}
+	return key, nil
+}
+
+// setEncryptionFuses sets the key, encryption config and counter, in release mode it also protects the key
+// and disables bootloader decryption and JTAG
+func setEncryptionFuses(fuses map[string]*esp32.Fuse, key []byte, release bool) error {
+	cnt, err := fuses["flash_crypt_cnt"].Value(false)
+	if err != nil {
+		return err
+	}
+	if ones(cnt)%2 == 1 {
+		return errors.New("flash encryption is already enabled")
+	}
+
+	k := fuses["flash_encryption_key"]
+	if err := setKey(k, key); err != nil {
+		return err
+	}
+	if err := fuses["flash_crypt_config"].SetValue(big.NewInt(flashCryptConf)); err != nil {
+		return err
+	}
+	// odd number of set bits enables encryption, the next bit is set
+	next := new(big.Int).SetBit(cnt, cnt.BitLen(), 1)
+	if err := fuses["flash_crypt_cnt"].SetValue(next); err != nil {
+		return err
+	}
+	if !release {
+		return nil
+	}
+
+	for _, name := range releaseFuses {
+		if err := fuses[name].SetValue(big.NewInt(1)); err != nil {
+			return err
+		}
+	}
+	if err := k.SetReadDisable(); err != nil {
+		return err
+	}
+	if err := k.SetWriteDisable(); err != nil {
+		return err
+	}
+	return fuses["flash_crypt_cnt"].SetWriteDisable()
+}
+
+// setSecureBootFuses sets the secure boot key and abstract_done_0, in release mode it also protects the key
+// and disables JTAG
+func setSecureBootFuses(fuses map[string]*esp32.Fuse, key []byte, release bool) error {
+	done := fuses["abstract_done_0"]
+	if v, err := done.Value(false); err != nil {
+		return err
+	} else if v.Sign() != 0 {
+		return errors.New("secure boot is already enabled")
+	}
+
+	k := fuses["secure_boot_key"]
+	if err := setKey(k, key); err != nil {
+		return err
+	}
+	if err := done.SetValue(big.NewInt(1)); err != nil {
+		return err
+	}
+	if !release {
+		return nil
+	}
+
+	if err := fuses["JTAG_disable"].SetValue(big.NewInt(1)); err != nil {
+		return err
+	}
+	if err := k.SetReadDisable(); err != nil {
+		return err
+	}
+	return k.SetWriteDisable()
+}
+
+// setKey sets the value of the key fuse which isn't burned yet
+func setKey(k *esp32.Fuse, key []byte) error {
+	if !k.IsReadable() || !k.IsWritable() {
+		return fmt.Errorf("%s is already burned and protected", k.Name())
+	}
+	if v, _ := k.Value(false); v.Sign() != 0 {
+		return fmt.Errorf("%s is already burned", k.Name())
+	}
+	return k.SetKeyValue(key)
+}
+
+func ones(v *big.Int) int {
+	n := 0
+	for i := 0; i < v.BitLen(); i++ {
+		n += int(v.Bit(i))
+	}
+	return n
+}
+
+// confirmBurn asks twice before burning eFuses, the second time the MAC address of the module is typed.
+// Without dialogs the MAC address must be passed explicitly
+func confirmBurn(mac, confirm string) bool {
+	if confirm != "" {
+		if !strings.EqualFold(confirm, mac) {
+			log.WithField("mac", mac).Error("confirmation doesn't match")
+			fmt.Println("[-] Confirmation", confirm, "doesn't match the module", mac)
+			return false
+		}
+		return true
+	}
+	if !dialogs.YesNoDialog("Burning eFuses is irreversible, the module accepts only firmware encrypted or signed with the key after it. Proceed?") {
+		return false
+	}
+	answer := dialogs.GetSingleAnswer("Type the MAC address of the module ("+mac+") to confirm: ", dialogs.EmptyStringValidator)
+	return strings.EqualFold(strings.TrimSpace(answer), mac)
+}
@@ -0,0 +1,353 @@
+package device
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/esp-flasher/esp"
+	espFlasher "github.com/xshellinc/esp-flasher/esp/flasher"
+	"github.com/xshellinc/esp-flasher/esp/rom_client"
+	"github.com/xshellinc/esp-flasher/esp32"
+	"github.com/xshellinc/iotit/device/firmware"
+	"github.com/xshellinc/tools/dialogs"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+const (
+	espBaudRate   = 460800
+	espChunkSize  = 64 * 1024
+	espSectorSize = 4096
+)
+
+// ESPOptions select the module for read, write and erase commands
+type ESPOptions struct {
+	Port string
+	// Chip is esp32 or esp8266
+	Chip  string
+	Quiet bool
+}
+
+// BackupInfo describes the module which flash was saved
+type BackupInfo struct {
+	Chip      string    `json:"chip"`
+	MAC       string    `json:"mac"`
+	FlashID   string    `json:"flash_id"`
+	FlashSize int       `json:"flash_size"`
+	File      string    `json:"file"`
+	SHA256    string    `json:"sha256"`
+	Created   time.Time `json:"created"`
+}
+
+// espSession is a connection to the flasher stub running on the module
+type espSession struct {
+	chip      esp.ChipType
+	rc        *rom_client.ROMClient
+	fc        *espFlasher.FlasherClient
+	mac       string
+	flashID   uint32
+	flashSize int
+}
+
+func espChip(name string) (esp.ChipType, error) {
+	switch strings.ToLower(name) {
+	case "", "esp32":
+		return esp.ChipESP32, nil
+	case "esp8266":
+		return esp.ChipESP8266, nil
+	}
+	return 0, fmt.Errorf("unsupported chip %s, it's esp32 or esp8266", name)
+}
+
+// connectFlasher reads MAC address with the ROM bootloader, then runs the flasher stub and detects the flash size
+func connectFlasher(o *ESPOptions) (*espSession, error) {
+	ct, err := espChip(o.Chip)
+	if err != nil {
+		return nil, err
+	}
+	port, err := selectPort(o.Port, espChips, o.Quiet)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("[+] Using ", dialogs.PrintColored(portDescription(port)))
+
+	s := &espSession{chip: ct}
+	if s.rc, err = rom_client.ConnectToROM(ct, &esp.FlashOpts{ControlPort: port}); err != nil {
+		return nil, err
+	}
+	if s.mac, err = readMAC(s.rc, ct); err != nil {
+		log.Error(err)
+	}
+	if s.fc, err = espFlasher.NewFlasherClient(ct, s.rc, espBaudRate); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.flashID, err = s.fc.GetFlashChipID(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	// JEDEC ID, the capacity is a power of two
+	if exp := s.flashID & 0xFF; exp >= 19 && exp <= 32 {
+		s.flashSize = 1 << exp
+	} else {
+		s.Close()
+		return nil, fmt.Errorf("invalid flash chip id: 0x%06x", s.flashID)
+	}
+	fmt.Printf("[+] %s %s, flash %s\n", ct, s.mac, firmwareSize(s.flashSize))
+	return s, nil
+}
+
+func (s *espSession) Close() {
+	s.rc.Disconnect()
+}
+
+// readMAC reads MAC address from eFuses the same way esptool does
+func readMAC(rc *rom_client.ROMClient, ct esp.ChipType) (string, error) {
+	if ct == esp.ChipESP32 {
+		_, _, fuses, err := esp32.ReadFuses(rc)
+		if err != nil {
+			return "", err
+		}
+		return fuses[esp32.MACAddressFuseName].MACAddressString(), nil
+	}
+
+	var regs [4]uint32
+	for i, reg := range []uint32{0x3ff00050, 0x3ff00054, 0x3ff00058, 0x3ff0005c} {
+		v, err := rc.ReadReg(reg)
+		if err != nil {
+			return "", err
+		}
+		regs[i] = v
+	}
+	var oui []byte
+	switch {
+	case regs[3] != 0:
+		oui = []byte{byte(regs[3] >> 16), byte(regs[3] >> 8), byte(regs[3])}
+	case (regs[1]>>16)&0xFF == 0:
+		oui = []byte{0x18, 0xfe, 0x34}
+	case (regs[1]>>16)&0xFF == 1:
+		oui = []byte{0xac, 0xd0, 0x74}
+	default:
+		return "", errors.New("unknown OUI of the MAC address")
+	}
+	mac := append(oui, byte(regs[1]>>8), byte(regs[1]), byte(regs[0]>>24))
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]), nil
+}
+
+func firmwareSize(n int) string {
+	return fmt.Sprintf("%dMB", n>>20)
+}
+
+// region checks the flash region, zero length means up to the end of the flash
+func (s *espSession) region(offset, length uint32) (uint32, error) {
+	if length == 0 && int(offset) < s.flashSize {
+		length = uint32(s.flashSize) - offset
+	}
+	if int(offset)+int(length) > s.flashSize {
+		return 0, fmt.Errorf("0x%x + %d exceeds the flash size %d", offset, length, s.flashSize)
+	}
+	return length, nil
+}
+
+// read reads the flash region into w in chunks showing progress
+func (s *espSession) read(offset, length uint32, w io.Writer) error {
+	bar := pb.New64(int64(length)).SetUnits(pb.U_BYTES)
+	bar.Prefix("Reading")
+	bar.Start()
+	defer bar.Finish()
+
+	buf := make([]byte, espChunkSize)
+	for done := uint32(0); done < length; {
+		n := length - done
+		if n > espChunkSize {
+			n = espChunkSize
+		}
+		if err := s.fc.Read(offset+done, buf[:n]); err != nil {
+			return fmt.Errorf("read 0x%x: %s", offset+done, err)
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		done += n
+		bar.Add(int(n))
+	}
+	return nil
+}
+
+// write erases sectors and writes data in chunks showing progress
+func (s *espSession) write(offset uint32, data []byte) error {
+	bar := pb.New64(int64(len(data))).SetUnits(pb.U_BYTES)
+	bar.Prefix("Writing")
+	bar.Start()
+	defer bar.Finish()
+
+	for done := 0; done < len(data); done += espChunkSize {
+		end := done + espChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := s.fc.Write(offset+uint32(done), data[done:end], true); err != nil {
+			return fmt.Errorf("write 0x%x: %s", offset+uint32(done), err)
+		}
+		bar.Add(end - done)
+	}
+	return nil
+}
+
+// ESPRead saves the flash region of the module into the file, zero length reads up to the end of the flash
+func ESPRead(o *ESPOptions, offset, length uint32, file string) error {
+	s, err := connectFlasher(o)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if length, err = s.region(offset, length); err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.read(offset, length, f); err != nil {
+		return err
+	}
+	fmt.Printf("[+] Saved %d bytes at 0x%x to %s\n", length, offset, file)
+	return f.Close()
+}
+
+// ESPWrite writes the file to the flash of the module at the offset, e.g. a backup at 0
+func ESPWrite(o *ESPOptions, offset uint32, file string) error {
+	if offset%espSectorSize != 0 {
+		return fmt.Errorf("offset 0x%x is not aligned to %d bytes sectors", offset, espSectorSize)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	s, err := connectFlasher(o)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if _, err := s.region(offset, uint32(len(data))); err != nil {
+		return err
+	}
+	if !o.Quiet && !dialogs.YesNoDialog(fmt.Sprintf("Overwrite %d bytes at 0x%x of %s?", len(data), offset, s.mac)) {
+		return errors.New("writing is aborted")
+	}
+	if err := s.write(offset, data); err != nil {
+		return err
+	}
+	fmt.Printf("[+] Written %s at 0x%x\n", file, offset)
+	return s.fc.BootFirmware()
+}
+
+// ESPErase erases the whole flash or the region like `0x9000:0x6000` (offset:length)
+func ESPErase(o *ESPOptions, region string) error {
+	var offset, length uint32
+	if region != "" {
+		i := strings.Index(region, ":")
+		if i < 0 {
+			return fmt.Errorf("invalid region %q, it's offset:length", region)
+		}
+		var err error
+		if offset, err = firmware.ParseOffset(region[:i]); err != nil {
+			return err
+		}
+		if length, err = firmware.ParseOffset(region[i+1:]); err != nil {
+			return err
+		}
+		if offset%espSectorSize != 0 || length%espSectorSize != 0 || length == 0 {
+			return fmt.Errorf("region %s is not aligned to %d bytes sectors", region, espSectorSize)
+		}
+	}
+
+	s, err := connectFlasher(o)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	what := "the whole flash"
+	if region != "" {
+		if _, err := s.region(offset, length); err != nil {
+			return err
+		}
+		what = fmt.Sprintf("%d bytes at 0x%x", length, offset)
+	}
+	if !o.Quiet && !dialogs.YesNoDialog(fmt.Sprintf("Erase %s of %s?", what, s.mac)) {
+		return errors.New("erasing is aborted")
+	}
+
+	if region == "" {
+		fmt.Println("[+] Erasing flash...")
+		if err := s.fc.EraseChip(); err != nil {
+			return err
+		}
+	} else {
+		data := make([]byte, length)
+		for i := range data {
+			data[i] = 0xFF
+		}
+		if err := s.write(offset, data); err != nil {
+			return err
+		}
+	}
+	fmt.Println("[+] Erased", what)
+	return nil
+}
+
+// ESPBackup saves the whole flash and the module info into the dir, files are named by the MAC address
+func ESPBackup(o *ESPOptions, dir string) (*BackupInfo, error) {
+	s, err := connectFlasher(o)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := strings.Replace(s.mac, ":", "", -1)
+	if name == "" {
+		name = "esp"
+	}
+	name += "-" + time.Now().Format("20060102-150405")
+	info := &BackupInfo{Chip: strings.ToLower(s.chip.String()), MAC: s.mac, FlashID: fmt.Sprintf("%06x", s.flashID),
+		FlashSize: s.flashSize, File: name + ".bin", Created: time.Now()}
+
+	f, err := os.Create(filepath.Join(dir, info.File))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if err := s.read(0, uint32(s.flashSize), io.MultiWriter(f, h)); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	info.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), data, 0644); err != nil {
+		return nil, err
+	}
+	fmt.Println("[+] Flash of", s.mac, "is saved to", filepath.Join(dir, info.File))
+	return info, nil
+}
@@ -0,0 +1,184 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/esp-flasher/common"
+	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/firmware"
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+// Provisioning modes of ESP modules: firmware shell commands over serial after flashing,
+// NVS partition or config.json in the file system flashed with the firmware
+const (
+	provisionShell  = "shell"
+	provisionNVS    = "nvs"
+	provisionSPIFFS = "spiffs"
+)
+
+// espConfigFile is written to the root of the file system in spiffs mode
+const espConfigFile = "config.json"
+
+// provisionValue is a provisioned value with it's NVS type, only `--set` values are parsed by firmware.Value
+type provisionValue struct {
+	typ   string
+	value interface{}
+}
+
+// Provisioned keys
+const (
+	keyWifiSSID = "wifi_ssid"
+	keyWifiPass = "wifi_pass"
+	keyDeviceID = "device_id"
+)
+
+func (d *serialFlasher) provisionMode() string {
+	if m := d.CLI.String("provision"); m != "" {
+		return m
+	}
+	return provisionShell
+}
+
+// flagOffset parses offset or size flag, zero means it's taken from the partition table
+func (d *serialFlasher) flagOffset(name string) (uint32, error) {
+	if v := d.CLI.String(name); v != "" {
+		return firmware.ParseOffset(v)
+	}
+	return 0, nil
+}
+
+// fileSystem returns file system image set by the fs flags or nil
+func (d *serialFlasher) fileSystem() (*firmware.FS, error) {
+	fs := &firmware.FS{Dir: d.CLI.String("fs-dir"), Type: d.CLI.String("fs-type")}
+	if fs.Type == "" {
+		fs.Type = firmware.SPIFFS
+	}
+	var err error
+	if fs.Offset, err = d.flagOffset("fs-offset"); err != nil {
+		return nil, err
+	}
+	if fs.Size, err = d.flagOffset("fs-size"); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// provision adds the file system image and provisioned values to the firmware
+func (d *serialFlasher) provision(fw *common.FirmwareBundle) error {
+	mode := d.provisionMode()
+	fs, err := d.fileSystem()
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case provisionShell:
+	case provisionNVS:
+		values, err := d.provisionValues()
+		if err != nil {
+			return err
+		}
+		ns := d.CLI.String("nvs-namespace")
+		nvs := &firmware.NVS{}
+		for _, k := range sortedKeys(values) {
+			if err := nvs.SetValue(ns, k, values[k].typ, values[k].value); err != nil {
+				return err
+			}
+		}
+		offset, err := d.flagOffset("nvs-offset")
+		if err != nil {
+			return err
+		}
+		size, err := d.flagOffset("nvs-size")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[+] Writing %d values to NVS namespace %s\n", len(values), ns)
+		if err := firmware.AddNVS(fw, nvs, offset, size); err != nil {
+			return err
+		}
+	case provisionSPIFFS:
+		values, err := d.provisionValues()
+		if err != nil {
+			return err
+		}
+		data, err := configJSON(values)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("[+] Writing %d values to %s\n", len(values), espConfigFile)
+		fs.Files = map[string][]byte{espConfigFile: data}
+	default:
+		return fmt.Errorf("unknown provisioning mode %q, it's one of %s, %s or %s", mode, provisionShell, provisionNVS, provisionSPIFFS)
+	}
+
+	if fs.Dir == "" && len(fs.Files) == 0 {
+		return nil
+	}
+	fmt.Printf("[+] Building %s image\n", fs.Type)
+	return firmware.AddFS(fw, fs)
+}
+
+// provisionValues collects Wi-Fi credentials from the profile or dialogs, device ID and `--set key=value` values.
+// Credentials and device ID are strings as is, so a password like `u8:1` isn't parsed as a number
+func (d *serialFlasher) provisionValues() (map[string]provisionValue, error) {
+	values := map[string]provisionValue{}
+	if !d.Quiet || d.profile != nil {
+		c := config.New(ssh_helper.New("", "", "", ""))
+		c.AddConfigFn(config.Wifi, config.NewCallbackFn(setWifi, func(storage map[string]interface{}) error {
+			if name, ok := storage[config.Wifi+"_name"]; ok {
+				values[keyWifiSSID] = provisionValue{"string", fmt.Sprint(name)}
+				values[keyWifiPass] = provisionValue{"string", string(storage[config.Wifi+"_pass"].([]byte))}
+			}
+			return nil
+		}))
+		c.ApplyProfile(d.profile)
+		if !d.Quiet {
+			if err := c.Setup(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.Write(); err != nil {
+			return nil, err
+		}
+	}
+	if id := d.CLI.String("device-id"); id != "" {
+		values[keyDeviceID] = provisionValue{"string", id}
+	}
+	for _, kv := range d.CLI.StringSlice("set") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid value %q, it's key=value", kv)
+		}
+		t, v, err := firmware.Value(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", kv[:i], err)
+		}
+		values[kv[:i]] = provisionValue{t, v}
+	}
+	log.WithField("keys", sortedKeys(values)).Debug("Provisioning")
+	return values, nil
+}
+
+// configJSON encodes values, typed integers are written as numbers
+func configJSON(values map[string]provisionValue) ([]byte, error) {
+	m := map[string]interface{}{}
+	for k, v := range values {
+		m[k] = v.value
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
+
+func sortedKeys(m map[string]provisionValue) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/iotit/device/archive"
+	"github.com/xshellinc/tools/lib/help"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// Exporter saves the configured image into a file instead of writing it to a disk
+type Exporter interface {
+	Export(output string) error
+}
+
+// Export saves the configured image to the output file compressed by it's suffix (.gz, .xz or .zst)
+// and writes sha256 of the file into the output.sha256 sidecar in the sha256sum format
+func (d *sdFlasher) Export(output string) error {
+	if d.ws == nil {
+		return errors.New("image isn't configured")
+	}
+	if err := archive.CheckOutput(output); err != nil {
+		return err
+	}
+
+	log.Debug("Downloading image from workspace")
+	src := help.AddPathSuffix("unix", d.ws.TmpDir(), d.img)
+	var img string
+	job := help.NewBackgroundJob()
+	go func() {
+		defer job.Close()
+		var err error
+		if img, err = d.ws.Fetch(src, help.GetTempDir()); err != nil {
+			job.Error(err)
+		}
+	}()
+	if err := help.WaitJobAndSpin("Copying files", job); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	sum, err := exportImage(img, output)
+	if img != src {
+		// the copy fetched from the virtual machine isn't needed anymore
+		os.Remove(img)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.ws.Stop(d.Quiet); err != nil {
+		log.Error(err)
+	}
+	fmt.Println("[+] Image saved to", output)
+	fmt.Printf("[+] sha256: %x\n", sum)
+	return nil
+}
+
+// exportImage compresses the image into the output file showing progress
+func exportImage(img, output string) ([]byte, error) {
+	in, err := os.Open(img)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	bar := pb.New64(fi.Size()).SetUnits(pb.U_BYTES)
+	bar.Prefix("Saving")
+	bar.Start()
+	defer bar.Finish()
+	return archive.WriteFile(output, bar.NewProxyReader(in))
+}
@@ -0,0 +1,222 @@
+// Package firmware loads ESP firmware bundles from zip archives, build directories and manifests
+package firmware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/esp-flasher/common"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// bundleManifest is a manifest of the zip firmware bundles, it's also used in unpacked bundle directories
+	bundleManifest = "manifest.json"
+	// idfFlasherArgs is written by ESP-IDF into the build directory
+	idfFlasherArgs = "flasher_args.json"
+)
+
+type (
+	// Manifest lists binaries of the firmware with their flash offsets
+	Manifest struct {
+		Name     string `json:"name" yaml:"name"`
+		Platform string `json:"platform" yaml:"platform"`
+		Version  string `json:"version,omitempty" yaml:"version,omitempty"`
+		Parts    []Part `json:"parts" yaml:"parts"`
+	}
+
+	// Part is a binary written at the offset, File is relative to the manifest
+	Part struct {
+		Name    string `json:"name" yaml:"name"`
+		File    string `json:"file" yaml:"file"`
+		Offset  Offset `json:"offset" yaml:"offset"`
+		Encrypt bool   `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+	}
+
+	// Offset is a flash address written as a decimal or 0x prefixed hex number
+	Offset uint32
+
+	// idfArgs is a part of ESP-IDF flasher_args.json
+	idfArgs struct {
+		FlashFiles map[string]string `json:"flash_files"`
+		Extra      struct {
+			Chip string `json:"chip"`
+		} `json:"extra_esptool_args"`
+	}
+)
+
+// ParseOffset parses decimal or 0x prefixed hex numbers
+func ParseOffset(s string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %q", s)
+	}
+	return uint32(n), nil
+}
+
+// UnmarshalJSON accepts numbers and strings
+func (o *Offset) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	n, err := ParseOffset(s)
+	*o = Offset(n)
+	return err
+}
+
+// UnmarshalYAML accepts numbers and strings
+func (o *Offset) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	n, err := ParseOffset(s)
+	*o = Offset(n)
+	return err
+}
+
+// Load loads the firmware from a zip bundle (path or URL), a build directory or a manifest file.
+// Directories are recognized by `manifest.json` of unpacked bundles or ESP-IDF `flasher_args.json`
+func Load(src string) (*common.FirmwareBundle, error) {
+	log.WithField("src", src).Debug("Load firmware")
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") || strings.ToLower(filepath.Ext(src)) == ".zip" {
+		return common.NewZipFirmwareBundle(src)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadManifest(src)
+	}
+	for _, dir := range []string{src, filepath.Join(src, "build")} {
+		for _, name := range []string{bundleManifest, idfFlasherArgs} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return loadManifest(filepath.Join(dir, name))
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: neither %s nor %s is found", src, bundleManifest, idfFlasherArgs)
+}
+
+// loadManifest loads iotit manifest, ESP-IDF flasher_args.json or manifest.json of the unpacked bundle
+func loadManifest(path string) (*common.FirmwareBundle, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+
+	m := &Manifest{}
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case filepath.Base(path) == idfFlasherArgs:
+		args := &idfArgs{}
+		if err = json.Unmarshal(data, args); err == nil {
+			m, err = args.manifest(filepath.Base(dir))
+		}
+	case ext == ".yaml" || ext == ".yml":
+		err = yaml.UnmarshalStrict(data, m)
+	default:
+		// unpacked bundles list parts in an object, iotit manifests in an array
+		var probe struct {
+			Parts json.RawMessage `json:"parts"`
+		}
+		if err = json.Unmarshal(data, &probe); err == nil && strings.HasPrefix(strings.TrimSpace(string(probe.Parts)), "{") {
+			return loadBundleDir(dir, data)
+		}
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse manifest "+path)
+	}
+	return m.Bundle(dir)
+}
+
+// manifest converts flash_files of ESP-IDF into the manifest
+func (a *idfArgs) manifest(name string) (*Manifest, error) {
+	m := &Manifest{Name: name, Platform: a.Extra.Chip}
+	for offset, file := range a.FlashFiles {
+		n, err := ParseOffset(offset)
+		if err != nil {
+			return nil, err
+		}
+		m.Parts = append(m.Parts, Part{Name: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), File: file, Offset: Offset(n)})
+	}
+	sort.Slice(m.Parts, func(i, j int) bool { return m.Parts[i].Offset < m.Parts[j].Offset })
+	return m, nil
+}
+
+// Bundle reads binaries of the manifest relative to the dir
+func (m *Manifest) Bundle(dir string) (*common.FirmwareBundle, error) {
+	if m.Platform == "" {
+		return nil, errors.New("platform of the firmware is not set")
+	}
+	if len(m.Parts) == 0 {
+		return nil, errors.New("firmware has no parts")
+	}
+	fw := &common.FirmwareBundle{Blobs: map[string][]byte{}}
+	fw.Name, fw.Platform, fw.Version = m.Name, m.Platform, m.Version
+	fw.Parts = map[string]*common.FirmwarePart{}
+	for _, p := range m.Parts {
+		if p.Name == "" {
+			p.Name = strings.TrimSuffix(filepath.Base(p.File), filepath.Ext(p.File))
+		}
+		if _, ok := fw.Parts[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate part %s", p.Name)
+		}
+		file := p.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fw.Blobs[p.Name] = data
+		fw.Parts[p.Name] = &common.FirmwarePart{Name: p.Name, Src: p.Name, ESPFlashAddress: uint32(p.Offset), ESP32Encrypt: p.Encrypt}
+	}
+	return fw, nil
+}
+
+// loadBundleDir loads unpacked zip bundle, sources of the parts are files in the dir
+func loadBundleDir(dir string, manifest []byte) (*common.FirmwareBundle, error) {
+	fw := &common.FirmwareBundle{Blobs: map[string][]byte{}}
+	if err := json.Unmarshal(manifest, &fw.FirmwareManifest); err != nil {
+		return nil, errors.Wrap(err, "cannot parse manifest "+filepath.Join(dir, bundleManifest))
+	}
+	for n, p := range fw.Parts {
+		p.Name = n
+		if p.Src == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, p.Src))
+		if err != nil {
+			return nil, err
+		}
+		fw.Blobs[p.Src] = data
+	}
+	return fw, nil
+}
+
+// Encrypt marks parts of the firmware encrypted unless some of them are marked in the manifest,
+// file system and NVS images added later are written in plaintext
+func Encrypt(fw *common.FirmwareBundle) {
+	for _, p := range fw.Parts {
+		if p.ESP32Encrypt {
+			return
+		}
+	}
+	for _, p := range fw.Parts {
+		p.ESP32Encrypt = true
+	}
+}
@@ -0,0 +1,163 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xshellinc/esp-flasher/common"
+)
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "firmware")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	table := make([]byte, 3*partitionEntrySize)
+	for i, p := range []Partition{{"factory", 0, 0, 0x10000, 0x100000}, {"spiffs", partitionTypeData, subtypeSPIFFS, 0x110000, 0xF0000}} {
+		e := table[i*partitionEntrySize:]
+		binary.LittleEndian.PutUint16(e, partitionMagic)
+		e[2], e[3] = p.Type, p.SubType
+		binary.LittleEndian.PutUint32(e[4:], p.Offset)
+		binary.LittleEndian.PutUint32(e[8:], p.Size)
+		copy(e[12:28], p.Label)
+	}
+	os.MkdirAll(filepath.Join(dir, "build", "partition_table"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "build", "partition_table", "partition-table.bin"), table, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "build", "app.bin"), []byte{0xe9, 1, 2, 3}, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "build", idfFlasherArgs), []byte(`{"flash_files": {"0x8000": "partition_table/partition-table.bin",
+		"0x10000": "app.bin"}, "extra_esptool_args": {"chip": "esp32"}}`), 0644)
+
+	fw, err := Load(dir)
+	if assert.NoError(err) {
+		assert.Equal("esp32", fw.Platform)
+		assert.Equal(uint32(0x10000), fw.Parts["app"].ESPFlashAddress)
+		assert.Equal(uint32(0x8000), fw.Parts["partition-table"].ESPFlashAddress)
+
+		fs := &FS{Dir: dir, Type: SPIFFS}
+		assert.NoError(fs.locate(fw))
+		assert.Equal(uint32(0x110000), fs.Offset)
+		assert.Equal(uint32(0xF0000), fs.Size)
+	}
+
+	manifest := filepath.Join(dir, "firmware.yaml")
+	ioutil.WriteFile(manifest, []byte("platform: esp8266\nparts:\n  - file: build/app.bin\n    offset: 0x0\n  - name: data\n    file: build/app.bin\n    offset: 0x300000\n"), 0644)
+	fw, err = Load(manifest)
+	if assert.NoError(err) {
+		assert.Equal("esp8266", fw.Platform)
+		assert.Equal(uint32(0x300000), fw.Parts["data"].ESPFlashAddress)
+		data, err := fw.GetPartData("app")
+		assert.NoError(err)
+		assert.Equal([]byte{0xe9, 1, 2, 3}, data)
+	}
+
+	ioutil.WriteFile(manifest, []byte("platform: esp8266\nparts:\n  - file: build/app.bin\n    offset: 12k\n"), 0644)
+	_, err = Load(manifest)
+	assert.Error(err)
+}
+
+func TestNVS(t *testing.T) {
+	assert := assert.New(t)
+	n := &NVS{}
+	assert.NoError(n.Set("iotit", "wifi_ssid", "office"))
+	assert.NoError(n.Set("iotit", "port", "u16:8080"))
+	assert.Error(n.Set("iotit", "offset", "i8:300"))
+	assert.Error(n.Set("iotit", "a_very_long_key_name", "x"))
+
+	data, err := n.Bytes(3 * nvsPageSize)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(data, 3*nvsPageSize)
+	assert.Equal(uint32(nvsPageActive), binary.LittleEndian.Uint32(data))
+	assert.Equal(uint8(nvsVersion), data[8])
+	assert.Equal(crc32.Update(0xFFFFFFFF, crc32.IEEETable, data[4:28]), binary.LittleEndian.Uint32(data[28:]))
+	// namespace, string with it's data entry and u16 are written, the rest is empty
+	assert.Equal([]byte{0xAA, 0xFF}, data[32:34])
+
+	ns := data[nvsFirstEntry:]
+	assert.Equal([]byte{0, nvsTypeU8, 1, nvsNoChunk}, ns[:4])
+	assert.Equal("iotit", string(bytes.TrimRight(ns[8:24], "\x00")))
+	assert.Equal(uint8(1), ns[24])
+
+	s := data[nvsFirstEntry+nvsEntrySize:]
+	assert.Equal([]byte{1, nvsTypeString, 2, nvsNoChunk}, s[:4])
+	assert.Equal(uint16(7), binary.LittleEndian.Uint16(s[24:]))
+	assert.Equal("office\x00", string(s[32:39]))
+	crc := crc32.Update(0xFFFFFFFF, crc32.IEEETable, s[:4])
+	assert.Equal(crc32.Update(crc, crc32.IEEETable, s[8:32]), binary.LittleEndian.Uint32(s[4:]))
+
+	u := data[nvsFirstEntry+3*nvsEntrySize:]
+	assert.Equal([]byte{1, 0x02, 1, nvsNoChunk}, u[:4])
+	assert.Equal([]byte{0x90, 0x1F, 0xFF}, u[24:27])
+
+	_, err = n.Bytes(2 * nvsPageSize)
+	assert.Error(err)
+}
+
+func TestNVSSetValue(t *testing.T) {
+	assert := assert.New(t)
+	n := &NVS{}
+	// strings are kept as is, not parsed as typed values
+	assert.NoError(n.SetValue("iotit", "wifi_pass", "string", "u8:123"))
+	assert.Equal("u8:123\x00", string(n.items[0].value))
+	assert.Error(n.SetValue("iotit", "port", "u16", 8080))
+}
+
+func TestSecureBootDigest(t *testing.T) {
+	assert := assert.New(t)
+	key := make([]byte, sbKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	iv := bytes.Repeat([]byte{0xA5}, sbIVSize)
+	image := []byte{imageMagic, 3, 2, 0x20}
+	for i := 0; i < 200; i++ {
+		image = append(image, byte(i))
+	}
+
+	// the digest is the one of `espsecure.py digest_secure_bootloader --iv` for the same key, iv and image
+	data, err := SecureBootDigest(key, iv, image)
+	if assert.NoError(err) {
+		assert.Len(data, bootloaderOffset+256)
+		assert.Equal(iv, data[:sbIVSize])
+		assert.Equal("411e5afce04d74928c2fe2943522dc3e654f373b1418569299aa6421431f5d0d"+
+			"288802074869138f390f73fbb0c0ff76cec72485b9d17292f71f1aa261af17be", hex.EncodeToString(data[sbIVSize:sbIVSize+64]))
+		assert.Equal(bytes.Repeat([]byte{0xFF}, bootloaderOffset-sbIVSize-64), data[sbIVSize+64:bootloaderOffset])
+		assert.Equal(image, data[bootloaderOffset:bootloaderOffset+len(image)])
+		assert.Equal(bytes.Repeat([]byte{0xFF}, 256-len(image)), data[bootloaderOffset+len(image):])
+	}
+	_, err = SecureBootDigest(key[1:], iv, image)
+	assert.Error(err)
+
+	// the appended SHA-256 digest isn't covered when it's in the last block
+	hashed := append(append([]byte{}, image[:imageHashAppended]...), 1)
+	hashed = append(hashed, bytes.Repeat([]byte{0}, 256-len(hashed))...)
+	data, err = SecureBootDigest(key, iv, append(hashed, bytes.Repeat([]byte{1}, imageDigestSize)...))
+	if assert.NoError(err) {
+		assert.Len(data, bootloaderOffset+256)
+	}
+
+	fw := &common.FirmwareBundle{Blobs: map[string][]byte{"bootloader": image}, FirmwareManifest: common.FirmwareManifest{
+		Parts: map[string]*common.FirmwarePart{"bootloader": {Name: "bootloader", Src: "bootloader", ESPFlashAddress: bootloaderOffset, ESP32Encrypt: true}}}}
+	params, err := AddSecureBootDigest(fw, key)
+	if assert.NoError(err) {
+		// the flasher keeps flash params of the bootloader and writes them into the IV
+		assert.Equal("0x0220", params)
+		p := fw.Parts["bootloader"]
+		assert.Equal(uint32(0), p.ESPFlashAddress)
+		assert.True(p.ESP32Encrypt)
+		data, _ := fw.GetPartData("bootloader")
+		assert.Equal(image[2:4], data[2:4])
+		assert.Equal(image, data[bootloaderOffset:bootloaderOffset+len(image)])
+	}
+	_, err = AddSecureBootDigest(fw, key)
+	assert.Error(err)
+}
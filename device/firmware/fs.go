@@ -0,0 +1,203 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/esp-flasher/common"
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// File system types, images are built with mkspiffs and mklittlefs tools
+const (
+	SPIFFS   = "spiffs"
+	LittleFS = "littlefs"
+)
+
+const (
+	fsPart      = "fs"
+	fsBlockSize = 4096
+	fsPageSize  = 256
+
+	partitionMagic     = 0xAA50
+	partitionEntrySize = 32
+	partitionTypeData  = 0x01
+	subtypeSPIFFS      = 0x82
+	subtypeLittleFS    = 0x83
+)
+
+// FS is a file system image built from the host directory and additional Files,
+// zero offset and size are taken from the partition table
+type FS struct {
+	Dir    string
+	Type   string
+	Offset uint32
+	Size   uint32
+	Files  map[string][]byte
+}
+
+// Partition is an entry of the ESP32 partition table
+type Partition struct {
+	Label   string
+	Type    uint8
+	SubType uint8
+	Offset  uint32
+	Size    uint32
+}
+
+// ParsePartitions parses binary partition table
+func ParsePartitions(data []byte) []Partition {
+	var parts []Partition
+	for i := 0; i+partitionEntrySize <= len(data); i += partitionEntrySize {
+		e := data[i : i+partitionEntrySize]
+		if binary.LittleEndian.Uint16(e) != partitionMagic {
+			break
+		}
+		label := e[12:28]
+		if n := bytes.IndexByte(label, 0); n >= 0 {
+			label = label[:n]
+		}
+		parts = append(parts, Partition{
+			Label:   string(label),
+			Type:    e[2],
+			SubType: e[3],
+			Offset:  binary.LittleEndian.Uint32(e[4:]),
+			Size:    binary.LittleEndian.Uint32(e[8:]),
+		})
+	}
+	return parts
+}
+
+// partitions returns partition table of the firmware, it's a part starting with the magic bytes
+func partitions(fw *common.FirmwareBundle) []Partition {
+	for name := range fw.Parts {
+		data, err := fw.GetPartData(name)
+		if err == nil && len(data) >= 2 && binary.LittleEndian.Uint16(data) == partitionMagic {
+			return ParsePartitions(data)
+		}
+	}
+	return nil
+}
+
+// locate fills offset and size of the file system from the spiffs or littlefs data partition
+func (f *FS) locate(fw *common.FirmwareBundle) error {
+	if f.Offset != 0 && f.Size != 0 {
+		return nil
+	}
+	for _, p := range partitions(fw) {
+		if p.Type == partitionTypeData && (p.SubType == subtypeSPIFFS || p.SubType == subtypeLittleFS) {
+			if f.Offset == 0 {
+				f.Offset = p.Offset
+			}
+			if f.Size == 0 {
+				f.Size = p.Size
+			}
+			log.WithField("partition", p.Label).Debug("File system partition")
+			return nil
+		}
+	}
+	return errors.New("file system partition is not found, set it's offset and size")
+}
+
+// Build creates the file system image with mkspiffs or mklittlefs
+func (f *FS) Build() ([]byte, error) {
+	tool := "mk" + f.Type
+	if f.Type != SPIFFS && f.Type != LittleFS {
+		return nil, fmt.Errorf("unsupported file system: %s", f.Type)
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("%s is not found, install it to build %s images", tool, f.Type)
+	}
+	if f.Dir != "" {
+		if info, err := os.Stat(f.Dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", f.Dir)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "iotit-fs")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	img := filepath.Join(tmp, f.Type+".bin")
+
+	dir := f.Dir
+	if len(f.Files) > 0 || dir == "" {
+		dir = filepath.Join(tmp, "root")
+		if err := f.stage(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := help.ExecCmd(tool, []string{"-c", dir, "-b", strconv.Itoa(fsBlockSize), "-p", strconv.Itoa(fsPageSize),
+		"-s", strconv.FormatUint(uint64(f.Size), 10), img})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", tool, out)
+	}
+	return ioutil.ReadFile(img)
+}
+
+// stage copies the directory and writes additional files into the dir
+func (f *FS) stage(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if f.Dir != "" {
+		err := filepath.Walk(f.Dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(f.Dir, p)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return os.MkdirAll(filepath.Join(dir, rel), 0755)
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, rel), data, 0644)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for name, data := range f.Files {
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, "/")))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddFS builds the file system image and adds it to the firmware
+func AddFS(fw *common.FirmwareBundle, f *FS) error {
+	if err := f.locate(fw); err != nil {
+		return err
+	}
+	if _, ok := fw.Parts[fsPart]; ok {
+		return fmt.Errorf("firmware already has %s part", fsPart)
+	}
+	data, err := f.Build()
+	if err != nil {
+		return err
+	}
+	fw.Blobs[fsPart+".bin"] = data
+	fw.Parts[fsPart] = &common.FirmwarePart{Name: fsPart, Src: fsPart + ".bin", ESPFlashAddress: f.Offset}
+	return nil
+}
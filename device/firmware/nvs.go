@@ -0,0 +1,248 @@
+package firmware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xshellinc/esp-flasher/common"
+)
+
+// NVS partition layout of ESP-IDF, version 2 of the page format
+const (
+	nvsPart        = "nvs"
+	nvsPageSize    = 4096
+	nvsEntrySize   = 32
+	nvsEntries     = 126
+	nvsFirstEntry  = 64
+	nvsKeySize     = 15
+	nvsVersion     = 0xFE
+	nvsPageActive  = 0xFFFFFFFE
+	nvsPageFull    = 0xFFFFFFFC
+	nvsNoChunk     = 0xFF
+	nvsMaxString   = (nvsEntries - 1) * nvsEntrySize
+	subtypeNVS     = 0x02
+	nvsTypeString  = 0x21
+	nvsTypeU8      = 0x01
+	nvsNamespaceNS = 0
+)
+
+// nvsTypes are integer types of NVS entries, the low nibble is the size in bytes
+var nvsTypes = map[string]uint8{
+	"u8": 0x01, "i8": 0x11, "u16": 0x02, "i16": 0x12, "u32": 0x04, "i32": 0x14, "u64": 0x08, "i64": 0x18,
+}
+
+type nvsItem struct {
+	ns    uint8
+	key   string
+	typ   uint8
+	value []byte
+}
+
+// NVS is a set of key/values written into an ESP-IDF NVS partition image
+type NVS struct {
+	namespaces []string
+	items      []nvsItem
+}
+
+// Value parses `type:value` strings, where type is one of u8, i8, u16, i16, u32, i32, u64, i64 or string,
+// values without a known type prefix are strings. Integers are returned as int64 or uint64
+func Value(s string) (string, interface{}, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "string", s, nil
+	}
+	t := strings.ToLower(s[:i])
+	if t == "string" {
+		return t, s[i+1:], nil
+	}
+	typ, ok := nvsTypes[t]
+	if !ok {
+		return "string", s, nil
+	}
+	bits := int(typ&0x0F) * 8
+	if t[0] == 'i' {
+		n, err := strconv.ParseInt(s[i+1:], 0, bits)
+		return t, n, errors.Wrapf(err, "invalid %s value", t)
+	}
+	n, err := strconv.ParseUint(s[i+1:], 0, bits)
+	return t, n, errors.Wrapf(err, "invalid %s value", t)
+}
+
+// Set adds the value parsed by Value to the namespace
+func (n *NVS) Set(namespace, key, value string) error {
+	t, v, err := Value(value)
+	if err != nil {
+		return err
+	}
+	return n.SetValue(namespace, key, t, v)
+}
+
+// SetValue adds the value of the type returned by Value to the namespace, strings are added with "string" type as is
+func (n *NVS) SetValue(namespace, key, t string, v interface{}) error {
+	if namespace == "" || len(namespace) > nvsKeySize {
+		return fmt.Errorf("invalid NVS namespace %q, it's 1 to %d characters", namespace, nvsKeySize)
+	}
+	if key == "" || len(key) > nvsKeySize {
+		return fmt.Errorf("invalid NVS key %q, it's 1 to %d characters", key, nvsKeySize)
+	}
+
+	ns := -1
+	for i, name := range n.namespaces {
+		if name == namespace {
+			ns = i
+		}
+	}
+	if ns < 0 {
+		n.namespaces = append(n.namespaces, namespace)
+		ns = len(n.namespaces) - 1
+	}
+	item := nvsItem{ns: uint8(ns + 1), key: key}
+
+	switch v := v.(type) {
+	case string:
+		if len(v)+1 > nvsMaxString {
+			return fmt.Errorf("NVS value of %s is longer than %d bytes", key, nvsMaxString-1)
+		}
+		item.typ, item.value = nvsTypeString, append([]byte(v), 0)
+	case int64:
+		item.typ, item.value = nvsTypes[t], make([]byte, 8)
+		binary.LittleEndian.PutUint64(item.value, uint64(v))
+	case uint64:
+		item.typ, item.value = nvsTypes[t], make([]byte, 8)
+		binary.LittleEndian.PutUint64(item.value, v)
+	default:
+		return fmt.Errorf("NVS value of %s has unsupported type %T", key, v)
+	}
+
+	for i, o := range n.items {
+		if o.ns == item.ns && o.key == key {
+			n.items[i] = item
+			return nil
+		}
+	}
+	n.items = append(n.items, item)
+	return nil
+}
+
+// nvsWriter fills pages of the partition image entry by entry
+type nvsWriter struct {
+	data  []byte
+	page  int
+	entry int
+}
+
+func (w *nvsWriter) nextPage() error {
+	if w.page >= 0 {
+		binary.LittleEndian.PutUint32(w.data[w.page*nvsPageSize:], nvsPageFull)
+	}
+	w.page++
+	w.entry = 0
+	// the last page is left empty, NVS needs it for the garbage collection
+	if (w.page+2)*nvsPageSize > len(w.data) {
+		return errors.New("NVS partition is too small for the values")
+	}
+	h := w.data[w.page*nvsPageSize:]
+	binary.LittleEndian.PutUint32(h, nvsPageActive)
+	binary.LittleEndian.PutUint32(h[4:], uint32(w.page))
+	h[8] = nvsVersion
+	binary.LittleEndian.PutUint32(h[28:], crc32.Update(0xFFFFFFFF, crc32.IEEETable, h[4:28]))
+	return nil
+}
+
+// write writes the entry header with the key and 8 bytes of data followed by the payload entries
+func (w *nvsWriter) write(ns, typ uint8, key string, data, payload []byte) error {
+	span := 1 + (len(payload)+nvsEntrySize-1)/nvsEntrySize
+	if w.entry+span > nvsEntries {
+		if err := w.nextPage(); err != nil {
+			return err
+		}
+	}
+	page := w.data[w.page*nvsPageSize:]
+	e := page[nvsFirstEntry+w.entry*nvsEntrySize:]
+	e[0], e[1], e[2], e[3] = ns, typ, uint8(span), nvsNoChunk
+	copy(e[8:24], make([]byte, 16))
+	copy(e[8:24], key)
+	copy(e[24:32], data)
+	crc := crc32.Update(0xFFFFFFFF, crc32.IEEETable, e[:4])
+	crc = crc32.Update(crc, crc32.IEEETable, e[8:32])
+	binary.LittleEndian.PutUint32(e[4:], crc)
+	copy(e[nvsEntrySize:], payload)
+
+	// entry state bitmap, 2 bits per entry: 11 empty, 10 written
+	for i := w.entry; i < w.entry+span; i++ {
+		page[nvsEntrySize+i/4] &^= 1 << uint(i%4*2)
+	}
+	w.entry += span
+	return nil
+}
+
+// Bytes generates the partition image of the size, it's a multiple of 4096 bytes
+func (n *NVS) Bytes(size uint32) ([]byte, error) {
+	if size%nvsPageSize != 0 || size < 3*nvsPageSize {
+		return nil, fmt.Errorf("NVS partition size %d is not a multiple of %d or less than 3 pages", size, nvsPageSize)
+	}
+	w := &nvsWriter{data: bytes.Repeat([]byte{0xFF}, int(size)), page: -1}
+	if err := w.nextPage(); err != nil {
+		return nil, err
+	}
+	for i, ns := range n.namespaces {
+		if err := w.write(nvsNamespaceNS, nvsTypeU8, ns, []byte{uint8(i + 1)}, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, it := range n.items {
+		var err error
+		if it.typ == nvsTypeString {
+			data := make([]byte, 8)
+			binary.LittleEndian.PutUint16(data, uint16(len(it.value)))
+			binary.LittleEndian.PutUint16(data[2:], 0xFFFF)
+			binary.LittleEndian.PutUint32(data[4:], crc32.Update(0xFFFFFFFF, crc32.IEEETable, it.value))
+			err = w.write(it.ns, it.typ, it.key, data, it.value)
+		} else {
+			data := bytes.Repeat([]byte{0xFF}, 8)
+			copy(data, it.value[:it.typ&0x0F])
+			err = w.write(it.ns, it.typ, it.key, data, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w.data, nil
+}
+
+// AddNVS generates NVS image and adds it to the firmware, zero offset and size are taken from the nvs partition
+func AddNVS(fw *common.FirmwareBundle, n *NVS, offset, size uint32) error {
+	if offset == 0 || size == 0 {
+		var found *Partition
+		for _, p := range partitions(fw) {
+			if p.Type == partitionTypeData && p.SubType == subtypeNVS && (found == nil || p.Label == nvsPart) {
+				p := p
+				found = &p
+			}
+		}
+		if found != nil && offset == 0 {
+			offset = found.Offset
+		}
+		if found != nil && size == 0 {
+			size = found.Size
+		}
+	}
+	if offset == 0 || size == 0 {
+		return errors.New("NVS partition is not found, set it's offset and size")
+	}
+	if _, ok := fw.Parts[nvsPart]; ok {
+		return fmt.Errorf("firmware already has %s part", nvsPart)
+	}
+	data, err := n.Bytes(size)
+	if err != nil {
+		return err
+	}
+	fw.Blobs[nvsPart+".bin"] = data
+	fw.Parts[nvsPart] = &common.FirmwarePart{Name: nvsPart, Src: nvsPart + ".bin", ESPFlashAddress: offset}
+	return nil
+}
@@ -0,0 +1,115 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/xshellinc/esp-flasher/common"
+)
+
+// ESP32 secure boot V1 layout, the ROM bootloader checks the digest at 0x0 before loading the bootloader at 0x1000
+const (
+	bootloaderOffset = 0x1000
+	sbBlockSize      = 128
+	sbIVSize         = 128
+	sbKeySize        = 32
+	imageMagic       = 0xE9
+	// hash_appended byte of the extended image header
+	imageHashAppended = 23
+	imageDigestSize   = 32
+)
+
+// SecureBootDigest returns the reflashable secure boot digest of the bootloader image followed by the image,
+// it's written at 0x0. The algorithm is the one of `espsecure.py digest_secure_bootloader`
+func SecureBootDigest(key, iv, image []byte) ([]byte, error) {
+	if len(key) != sbKeySize {
+		return nil, fmt.Errorf("secure boot key must be %d bytes, got %d", sbKeySize, len(key))
+	}
+	if len(iv) != sbIVSize {
+		return nil, fmt.Errorf("secure boot IV must be %d bytes, got %d", sbIVSize, len(iv))
+	}
+	// the ROM reads whole 128 bytes blocks and doesn't check the appended SHA-256 digest
+	if len(image) > imageHashAppended && image[0] == imageMagic && image[imageHashAppended] == 1 &&
+		len(image)%sbBlockSize <= imageDigestSize {
+		image = image[:len(image)-len(image)%sbBlockSize]
+	}
+	// the rest of the last block is unwritten flash
+	if n := len(image) % sbBlockSize; n != 0 {
+		image = append(append([]byte{}, image...), bytes.Repeat([]byte{0xFF}, sbBlockSize-n)...)
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	plain := append(append([]byte{}, iv...), image...)
+	block := make([]byte, aes.BlockSize)
+	for i := 0; i < len(plain); i += aes.BlockSize {
+		// hardware reverses blocks in and out of AES and bytes of words fed into SHA-512
+		copy(block, plain[i:i+aes.BlockSize])
+		reverse(block)
+		c.Encrypt(block, block)
+		reverse(block)
+		for w := 0; w < aes.BlockSize; w += 4 {
+			reverse(block[w : w+4])
+		}
+		h.Write(block)
+	}
+
+	out := make([]byte, 0, bootloaderOffset+len(image))
+	out = append(out, iv...)
+	digest := h.Sum(nil)
+	for w := 0; w < len(digest); w += 4 {
+		reverse(digest[w : w+4])
+	}
+	out = append(out, digest...)
+	out = append(out, bytes.Repeat([]byte{0xFF}, bootloaderOffset-len(out))...)
+	return append(out, image...), nil
+}
+
+// AddSecureBootDigest replaces the bootloader at 0x1000 with the digest and the bootloader at 0x0. It returns flash
+// params of the bootloader header which must be kept while flashing, the digest covers the header. The flasher writes
+// flash params into bytes 2 and 3 of the image at 0x0, so they're the same in the IV
+func AddSecureBootDigest(fw *common.FirmwareBundle, key []byte) (string, error) {
+	var boot *common.FirmwarePart
+	for _, p := range fw.Parts {
+		if p.ESPFlashAddress == bootloaderOffset {
+			boot = p
+		}
+	}
+	if boot == nil {
+		return "", fmt.Errorf("bootloader at 0x%x is not found", bootloaderOffset)
+	}
+	image, err := fw.GetPartData(boot.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(image) <= imageHashAppended || image[0] != imageMagic {
+		return "", fmt.Errorf("%s is not an ESP32 image", boot.Name)
+	}
+
+	iv := make([]byte, sbIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	iv[2], iv[3] = image[2], image[3]
+	data, err := SecureBootDigest(key, iv, image)
+	if err != nil {
+		return "", err
+	}
+	boot.Src = boot.Name + "-digest.bin"
+	boot.ChecksumSHA1 = ""
+	boot.ESPFlashAddress = 0
+	fw.Blobs[boot.Src] = data
+	return fmt.Sprintf("0x%02x%02x", image[2], image[3]), nil
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
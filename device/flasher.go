@@ -1,24 +1,25 @@
 package device
 
 import (
-	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
-	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/xshellinc/go-virtualbox"
+	"github.com/xshellinc/iotit/device/archive"
 	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/workspace"
 	"github.com/xshellinc/iotit/repo"
-	"github.com/xshellinc/iotit/vbox"
 	"github.com/xshellinc/tools/dialogs"
 	"github.com/xshellinc/tools/lib/help"
+	"gopkg.in/cheggaaa/pb.v1"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -29,15 +30,18 @@ type Flasher interface {
 	Write() error
 }
 
-// flasher contains virtualbox machine, ssh connection, repository, currently selected device and image name
+// flasher contains workspace, repository, currently selected device and image name
 type flasher struct {
 	Quiet   bool
-	vbox    *virtualbox.Machine
-	conf    *vbox.Config
+	ws      workspace.Workspace
 	devRepo *repo.DeviceMapping
 	CLI     *cli.Context
+	profile *config.Profile
+
+	workspace string
 
 	img     string
+	source  string
 	folder  string
 	device  string
 	mounted bool
@@ -45,9 +49,14 @@ type flasher struct {
 
 var retries = 0
 
-// validates given image path and downloads image archive to os tmp folder
+// validates given image path and downloads image archive to os tmp folder,
+// the image is verified against it's digest while it's downloaded or before the cached one is reused
 func (d *flasher) DownloadImage() (fileName, filePath string, err error) {
-	wg := &sync.WaitGroup{}
+	digest, err := d.devRepo.Image.Digest()
+	if err != nil {
+		return "", "", fmt.Errorf("image digest: %s", err)
+	}
+
 	if !help.ValidURL(d.devRepo.Image.URL) {
 		// local file path given
 		filePath = d.devRepo.Image.URL
@@ -58,84 +67,110 @@ func (d *flasher) DownloadImage() (fileName, filePath string, err error) {
 			return "", "", errors.New("Invalid image location")
 		}
 		fmt.Printf("[+] Using local image file for "+dialogs.PrintColored("%s")+"\n", d.device)
-		return fileName, filePath, err
+		if digest != nil {
+			fmt.Printf("[+] Calculating %s of the image\n", digest.Name())
+			if ok, err := digest.HashFile(filePath); err != nil {
+				return "", "", err
+			} else if !ok {
+				return "", "", fmt.Errorf("wrong %s hash", digest.Name())
+			}
+			fmt.Printf("[+] %s verified\n", digest.Name())
+		}
+		return fileName, filePath, nil
+	}
+
+	var h hash.Hash
+	if digest != nil {
+		h = digest.New()
+	}
+	// corrupted cached image is downloaded once again
+	for attempt := 0; attempt < 2; attempt++ {
+		if h != nil {
+			h.Reset()
+		}
+		if filePath, err = d.download(h); err != nil {
+			return "", "", err
+		}
+		if digest == nil {
+			break
+		}
+		log.WithField("sum", fmt.Sprintf("%x", h.Sum(nil))).WithField("hash", digest).Debug("comparing")
+		if digest.Matches(h.Sum(nil)) {
+			fmt.Printf("[+] %s verified\n", digest.Name())
+			repo.SetCacheStatus(filePath, digest.String(), repo.HashOK)
+			break
+		}
+		fmt.Printf("[-] %s of %s doesn't match, the image is corrupted\n", digest.Name(), filepath.Base(filePath))
+		repo.RemoveCacheEntry(&repo.CacheEntry{Path: filePath})
+		err = fmt.Errorf("wrong %s hash", digest.Name())
 	}
-	// download image over http
-	fmt.Println("[+] Starting download", d.devRepo.Image.Title)
-	log.WithField("url", d.devRepo.Image.URL).WithField("dir", d.devRepo.Dir()).Debug("download")
-	name, bar, err := help.DownloadFromUrlWithAttemptsAsync(d.devRepo.Image.URL, d.devRepo.Dir(), 3, wg)
 	if err != nil {
 		return "", "", err
 	}
-	fileName = name
-	filePath = filepath.Join(d.devRepo.Dir(), fileName)
-
-	bar.Prefix(fmt.Sprintf("[+] Download %-15s", fileName))
-	bar.Start()
-	wg.Wait()
-	bar.Finish()
-	time.Sleep(time.Second * 2)
-	return fileName, filePath, err
-}
 
-// Prepare method inits virtualbox, downloads os image and uploads it into vm
-func (d *flasher) Prepare() error {
-	log.Debug("Prepare")
-	if err := vbox.CheckVBInstalled(); err != nil {
-		return err
+	fileName = filepath.Base(filePath)
+	hashTag := d.devRepo.Image.Hash
+	if digest != nil {
+		hashTag = digest.String()
 	}
-
-	d.conf = vbox.NewConfig(d.device)
-	log.Debug("configuring virtual box")
-	var err error
-	if d.vbox, err = d.conf.GetVbox(d.device, d.Quiet); err != nil {
-		return err
+	if err := repo.TouchCache(filePath, d.devRepo.Image.URL, hashTag); err != nil {
+		log.Error(err)
 	}
+	return fileName, filePath, nil
+}
 
-	if d.vbox.State != virtualbox.Running {
-		fmt.Printf(`[+] Using virtual machine
-	Name - `+dialogs.PrintColored("%s")+`
-	Description - `+dialogs.PrintColored("%s")+"\n", d.vbox.Name, d.vbox.Description)
-
-		if err := d.startVM(); err != nil {
-			return err
-		}
+// download downloads the image over http or reuses the cached one, writing it into the hash
+func (d *flasher) download(h hash.Hash) (string, error) {
+	fmt.Println("[+] Starting download", d.devRepo.Image.Title)
+	log.WithField("url", d.devRepo.Image.URL).WithField("dir", d.devRepo.Dir()).Debug("download")
+	connections := 1
+	if d.CLI != nil && d.CLI.Int("connections") > 0 {
+		connections = d.CLI.Int("connections")
 	}
-
-	help.DeleteHost(filepath.Join(help.UserHomeDir(), ".ssh", "known_hosts"), "localhost")
-
-	return d.prepareImage()
+	// the bar renders Total in the background, so it's started once the total is known and a mirror
+	// of another size starts a new one. Segments report progress concurrently
+	var (
+		bar *pb.ProgressBar
+		mu  sync.Mutex
+	)
+	defer func() {
+		if bar != nil {
+			bar.Finish()
+		}
+	}()
+	return repo.Download(d.devRepo.Image.URLs(), d.devRepo.Dir(), &repo.DownloadOptions{
+		Connections: connections,
+		Hash:        h,
+		Progress: func(written, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if bar == nil || bar.Total != total {
+				if bar != nil {
+					bar.Finish()
+				}
+				bar = pb.New64(total).SetUnits(pb.U_BYTES)
+				bar.ShowBar = false
+				bar.Prefix(fmt.Sprintf("[+] Download %-15s", repo.FileName(d.devRepo.Image.URL)))
+				bar.Start()
+			}
+			bar.Set64(written)
+		},
+	})
 }
 
-func (d *flasher) startVM() error {
-	job := help.NewBackgroundJob()
-	if err := d.vbox.Start(); err != nil {
+// Prepare method starts the workspace, downloads os image and uploads it into the workspace
+func (d *flasher) Prepare() error {
+	log.Debug("Prepare")
+	var err error
+	if d.ws, err = workspace.New(d.workspace, d.device, d.Quiet); err != nil {
 		return err
 	}
 
-	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		defer job.Close()
-		for {
-			select {
-			case <-ticker.C:
-				_, eut, err := d.conf.SSH.Run("whoami")
-				if err == nil && strings.TrimSpace(eut) == "" {
-					return
-				}
-			case <-time.After(180 * time.Second):
-				job.Error(errors.New("Cannot connect to vbox via ssh"))
-			}
-		}
-	}()
-
-	if err := help.WaitJobAndSpin("Starting", job); err != nil {
+	if err := d.ws.Start(); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Second)
-	return nil
+	return d.prepareImage()
 }
 
 func (d *flasher) prepareImage() error {
@@ -149,26 +184,7 @@ func (d *flasher) prepareImage() error {
 	} else {
 		return err
 	}
-
-	if len(d.devRepo.Image.Hash) > 0 {
-		fmt.Println("[+] Calculating SHA256 of the downloaded image")
-		f, err := os.Open(filePath)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			return err
-		}
-		hash := fmt.Sprintf("%x", h.Sum(nil))
-		log.WithField("sum", hash).WithField("hash", d.devRepo.Image.Hash).Debug("comparing")
-		if hash != d.devRepo.Image.Hash {
-			return fmt.Errorf("wrong SHA256 hash")
-		}
-		fmt.Println("[+] SHA256 verified")
-	}
+	d.source = filePath
 
 	if err := d.uploadImage(fileName, filePath); err != nil {
 		return err
@@ -184,9 +200,9 @@ func (d *flasher) prepareImage() error {
 }
 
 func (d *flasher) uploadImage(fileName, filePath string) error {
-	if _, eut, err := d.conf.SSH.Run("ls " + config.TmpDir + fileName); err != nil || len(strings.TrimSpace(eut)) > 0 {
+	if _, eut, err := d.ws.Run("ls " + d.ws.TmpDir() + fileName); err != nil || len(strings.TrimSpace(eut)) > 0 {
 		fmt.Printf("[+] Uploading %s to virtual machine\n", fileName)
-		if err := d.conf.SSH.Scp(filePath, config.TmpDir); err != nil {
+		if err := d.ws.Scp(filePath, d.ws.TmpDir()); err != nil {
 			return err
 		}
 	}
@@ -195,28 +211,90 @@ func (d *flasher) uploadImage(fileName, filePath string) error {
 	return nil
 }
 
+// hasTool checks that the program is installed in the workspace, ssh doesn't report exit codes, so the path
+// printed by `command -v` is checked
+func (d *flasher) hasTool(tool string) bool {
+	out, _, err := d.ws.Run("command -v " + tool)
+	return err == nil && strings.TrimSpace(out) != ""
+}
+
+// extractOnHost decompresses the image with Go readers of the archive package and uploads the raw image.
+// The local workspace links uploaded files, so the image is extracted right into it's folder
+func (d *flasher) extractOnHost(fileName, localPath string, format archive.Format) error {
+	r, _, err := archive.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir := d.ws.TmpDir()
+	if d.workspace != workspace.Local {
+		if dir, err = ioutil.TempDir("", "iotit-extract"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+	img := archive.ImageName(strings.TrimSuffix(fileName, ".zip"), format)
+	f, err := os.Create(filepath.Join(dir, img))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if d.workspace != workspace.Local {
+		fmt.Printf("[+] Uploading %s to virtual machine\n", img)
+		if err := d.ws.Scp(f.Name(), d.ws.TmpDir()); err != nil {
+			return err
+		}
+	}
+	d.img = img
+	return nil
+}
+
 func (d *flasher) extractImage(fileName, localPath string) error {
-	if strings.HasSuffix(fileName, ".img") {
+	format, err := archive.DetectFile(localPath)
+	if err != nil {
+		return err
+	}
+	log.WithField("format", format).Debug("archive format detected")
+	if format == archive.Raw && !help.HasAnySuffixes(fileName, ".tar", ".7z") {
 		d.img = fileName
 		return nil
 	}
 
 	if strings.HasSuffix(fileName, ".zip") {
 		if files, err := help.GetZipFiles(help.AddPathSuffix(runtime.GOOS, d.devRepo.Dir(), fileName)); err == nil && len(files) == 1 {
-			if _, eut, err := d.conf.SSH.Run("ls " + config.TmpDir + files[0].Name); err == nil && len(strings.TrimSpace(eut)) == 0 {
+			if _, eut, err := d.ws.Run("ls " + d.ws.TmpDir() + files[0].Name); err == nil && len(strings.TrimSpace(eut)) == 0 {
 				log.Debug("Image file already extracted")
 				d.img = files[0].Name
 			}
 		}
 	}
 
-	d.conf.SSH.Run("rm -rf " + config.TmpDir + "*.img")
+	d.ws.Run("rm -rf " + d.ws.TmpDir() + "*.img")
+	if tool := archive.Tool(fileName, format); tool != "" && !d.hasTool(tool) {
+		if archive.IsTar(fileName) {
+			return fmt.Errorf("%s is not installed in the workspace, it's required to extract %s", tool, fileName)
+		}
+		fmt.Printf("[+] %s is not installed in the workspace, extracting %s on the host\n", tool, fileName)
+		return d.extractOnHost(fileName, localPath, format)
+	}
 	fmt.Printf("[+] Extracting %s \n", fileName)
-	command := fmt.Sprintf(help.GetExtractCommand(fileName), help.AddPathSuffix("unix", config.TmpDir, fileName), config.TmpDir)
+	extract := archive.ExtractCommand(fileName, format)
+	if extract == "" {
+		extract = help.GetExtractCommand(fileName)
+	}
+	command := fmt.Sprintf(extract, help.AddPathSuffix("unix", d.ws.TmpDir(), fileName), d.ws.TmpDir())
 
 	log.WithField("command", command).Debug("Extracting an image...")
-	d.conf.SSH.SetTimer(help.SshExtendedCommandTimeout)
-	out, eut, err := d.conf.SSH.Run(command)
+	d.ws.SetTimer(help.SshExtendedCommandTimeout)
+	out, eut, err := d.ws.Run(command)
 	out = strings.TrimSpace(out)
 	eut = strings.TrimSpace(eut)
 
@@ -228,7 +306,7 @@ func (d *flasher) extractImage(fileName, localPath string) error {
 				fmt.Println("[-] CRC error, re-trying...")
 				log.WithField("filePath", filePath).Info("Trying to download and extract image again")
 				help.DeleteFile(filePath)
-				d.conf.SSH.Run("rm " + config.TmpDir + fileName)
+				d.ws.Run("rm " + d.ws.TmpDir() + fileName)
 				retries++
 				return d.prepareImage()
 			}
@@ -269,7 +347,7 @@ func (d *flasher) extractImage(fileName, localPath string) error {
 		}
 	}
 
-	if out, _, err := d.conf.SSH.Run("ls -1 " + config.TmpDir); err == nil && len(strings.TrimSpace(out)) > 0 {
+	if out, _, err := d.ws.Run("ls -1 " + d.ws.TmpDir()); err == nil && len(strings.TrimSpace(out)) > 0 {
 		log.WithField("command", "ls -1").Debug(out)
 		for _, raw := range strings.Split(strings.TrimSpace(out), "\n") {
 			s := strings.TrimSpace(raw)
@@ -305,8 +383,10 @@ func (d *flasher) Flash() error {
 
 // Done prints out final success message
 func (d *flasher) Done() error {
-	if err := d.conf.Stop(d.Quiet); err != nil {
-		log.Error(err)
+	if d.ws != nil {
+		if err := d.ws.Stop(d.Quiet); err != nil {
+			log.Error(err)
+		}
 	}
 	fmt.Println("\t\t ...                      .................    ..                ")
 	fmt.Println("\t\t ...                      .................   ....    ...        ")
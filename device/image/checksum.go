@@ -0,0 +1,49 @@
+package image
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues raw CRC32C calculation the same way linux crc32c_le does, without final inversion
+func crc32c(seed uint32, data ...[]byte) uint32 {
+	for _, d := range data {
+		seed = ^crc32.Update(^seed, castagnoli, d)
+	}
+	return seed
+}
+
+var crc16Table = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		c := uint16(i)
+		for j := 0; j < 8; j++ {
+			if c&1 != 0 {
+				c = c>>1 ^ 0xA001
+			} else {
+				c >>= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// crc16 is CRC-16/ARC used by ext4 uninit_bg group descriptors
+func crc16(crc uint16, data ...[]byte) uint16 {
+	for _, d := range data {
+		for _, b := range d {
+			crc = crc>>8 ^ crc16Table[byte(crc)^b]
+		}
+	}
+	return crc
+}
+
+// le32 returns little endian representation of v
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,987 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	extMagic   = 0xEF53
+	extRootIno = 2
+
+	extIncompatFiletype   = 0x2
+	extIncompatRecover    = 0x4
+	extIncompatMetaBG     = 0x10
+	extIncompatExtents    = 0x40
+	extIncompat64bit      = 0x80
+	extIncompatMMP        = 0x100
+	extIncompatFlexBG     = 0x200
+	extIncompatEAInode    = 0x400
+	extIncompatCsumSeed   = 0x2000
+	extIncompatLargeDir   = 0x4000
+	extIncompatInlineData = 0x8000
+	extIncompatEncrypt    = 0x10000
+	extIncompatCasefold   = 0x20000
+
+	// extIncompatSupported are features which don't change on-disk layout of the parts used here
+	extIncompatSupported = extIncompatFiletype | extIncompatRecover | extIncompatExtents | extIncompat64bit |
+		extIncompatMMP | extIncompatFlexBG | extIncompatEAInode | extIncompatCsumSeed | extIncompatLargeDir |
+		extIncompatInlineData | extIncompatEncrypt | extIncompatCasefold
+
+	extRoCompatGdtCsum      = 0x10
+	extRoCompatMetadataCsum = 0x400
+
+	// extRoCompatWritable are read-only compatible features which are kept consistent when writing:
+	// sparse_super, large_file, btree_dir, huge_file, gdt_csum, dir_nlink, extra_isize, metadata_csum,
+	// project, verity and orphan_present
+	extRoCompatWritable = 0x1 | 0x2 | 0x4 | 0x8 | extRoCompatGdtCsum | 0x20 | 0x40 | extRoCompatMetadataCsum |
+		0x2000 | 0x8000 | 0x10000
+
+	// inode flags
+	extEncryptFl    = 0x800
+	extIndexFl      = 0x1000
+	extHugeFileFl   = 0x40000
+	extExtentsFl    = 0x80000
+	extInlineDataFl = 0x10000000
+	extCasefoldFl   = 0x40000000
+
+	// block group flags
+	extInodeUninit = 0x1
+	extBlockUninit = 0x2
+
+	extModeDir     = 0x4000
+	extModeFile    = 0x8000
+	extModeSymlink = 0xA000
+	extModeMask    = 0xF000
+
+	extExtentMagic = 0xF30A
+	extMaxExtent   = 32768
+)
+
+// ext is ext2, ext3 or ext4 filesystem
+type ext struct {
+	dev *section
+	sb  []byte
+	gdt []byte
+
+	blockSize      int64
+	inodeSize      int64
+	descSize       int64
+	groups         uint32
+	blocksPerGroup uint32
+	inodesPerGroup uint32
+	inodesCount    uint32
+	firstDataBlock uint64
+	blocksCount    uint64
+	incompat       uint32
+	roCompat       uint32
+	seed           uint32
+
+	// readOnly is set when the filesystem can be read but not modified safely
+	readOnly error
+}
+
+// inode is a raw on-disk inode
+type inode struct {
+	num uint32
+	raw []byte
+}
+
+// extent is a run of physical blocks mapped to the file starting with the logical block
+type extent struct {
+	logical uint32
+	start   uint64
+	length  uint32
+	uninit  bool
+}
+
+// gdField is a group descriptor field split into low and high parts
+type gdField struct {
+	lo, hi, size int
+}
+
+var (
+	gdBlockBitmap     = gdField{0, 32, 4}
+	gdInodeBitmap     = gdField{4, 36, 4}
+	gdInodeTable      = gdField{8, 40, 4}
+	gdFreeBlocks      = gdField{12, 44, 2}
+	gdFreeInodes      = gdField{14, 46, 2}
+	gdUsedDirs        = gdField{16, 48, 2}
+	gdBlockBitmapCsum = gdField{24, 56, 2}
+	gdInodeBitmapCsum = gdField{26, 58, 2}
+	gdItableUnused    = gdField{28, 50, 2}
+)
+
+const (
+	gdFlags    = 18
+	gdChecksum = 30
+)
+
+var errCorrupted = errors.New("ext: filesystem is corrupted")
+
+func openExt(dev *section) (*ext, error) {
+	if dev.size < 2048 {
+		return nil, errNoMagic
+	}
+	sb := make([]byte, 1024)
+	if _, err := dev.ReadAt(sb, 1024); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != extMagic {
+		return nil, errNoMagic
+	}
+
+	e := &ext{dev: dev, sb: sb}
+	e.incompat = binary.LittleEndian.Uint32(sb[96:])
+	e.roCompat = binary.LittleEndian.Uint32(sb[100:])
+	if unknown := e.incompat &^ extIncompatSupported; unknown != 0 {
+		return nil, fmt.Errorf("ext: %s: incompatible features 0x%x", ErrUnsupported, unknown)
+	}
+
+	logBlock := binary.LittleEndian.Uint32(sb[24:])
+	if logBlock > 6 {
+		return nil, errCorrupted
+	}
+	e.blockSize = 1024 << logBlock
+	e.inodeSize = 128
+	if binary.LittleEndian.Uint32(sb[76:]) >= 1 {
+		e.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	e.descSize = 32
+	if e.incompat&extIncompat64bit != 0 {
+		e.descSize = int64(binary.LittleEndian.Uint16(sb[254:]))
+	}
+	e.blocksPerGroup = binary.LittleEndian.Uint32(sb[32:])
+	e.inodesPerGroup = binary.LittleEndian.Uint32(sb[40:])
+	e.inodesCount = binary.LittleEndian.Uint32(sb[0:])
+	e.firstDataBlock = uint64(binary.LittleEndian.Uint32(sb[20:]))
+	e.blocksCount = uint64(binary.LittleEndian.Uint32(sb[4:]))
+	if e.incompat&extIncompat64bit != 0 {
+		e.blocksCount |= uint64(binary.LittleEndian.Uint32(sb[336:])) << 32
+	}
+
+	if e.inodeSize < 128 || e.inodeSize&(e.inodeSize-1) != 0 || e.inodeSize > e.blockSize ||
+		e.descSize < 32 || e.blocksPerGroup == 0 || e.inodesPerGroup == 0 ||
+		e.blocksPerGroup > uint32(e.blockSize)*8 || e.inodesPerGroup > uint32(e.blockSize)*8 ||
+		e.firstDataBlock >= e.blocksCount {
+		return nil, errCorrupted
+	}
+	if int64(e.blocksCount)*e.blockSize > dev.size {
+		return nil, fmt.Errorf("ext: %s: filesystem is larger than partition", ErrUnsupported)
+	}
+	e.groups = uint32((e.blocksCount - e.firstDataBlock + uint64(e.blocksPerGroup) - 1) / uint64(e.blocksPerGroup))
+
+	if e.roCompat&extRoCompatMetadataCsum != 0 {
+		if binary.LittleEndian.Uint32(sb[1020:]) != crc32c(^uint32(0), sb[:1020]) {
+			return nil, errors.New("ext: superblock checksum mismatch")
+		}
+		if e.incompat&extIncompatCsumSeed != 0 {
+			e.seed = binary.LittleEndian.Uint32(sb[624:])
+		} else {
+			e.seed = crc32c(^uint32(0), sb[104:120])
+		}
+	}
+
+	e.gdt = make([]byte, int64(e.groups)*e.descSize)
+	if _, err := dev.ReadAt(e.gdt, e.gdtOffset()); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case e.incompat&extIncompatMetaBG != 0:
+		e.readOnly = fmt.Errorf("ext: %s: meta_bg", ErrUnsupported)
+	case e.incompat&extIncompatRecover != 0:
+		e.readOnly = errors.New("ext: journal needs recovery, run e2fsck first")
+	case e.incompat&extIncompatMMP != 0:
+		e.readOnly = fmt.Errorf("ext: %s: mmp", ErrUnsupported)
+	case e.roCompat&^extRoCompatWritable != 0:
+		e.readOnly = fmt.Errorf("ext: %s: read-only features 0x%x", ErrUnsupported, e.roCompat&^extRoCompatWritable)
+	}
+	return e, nil
+}
+
+// Type returns ext4 if extents are enabled, ext3 for the journaled filesystem and ext2 otherwise
+func (e *ext) Type() string {
+	switch {
+	case e.incompat&extIncompatExtents != 0:
+		return "ext4"
+	case binary.LittleEndian.Uint32(e.sb[92:])&0x4 != 0:
+		return "ext3"
+	}
+	return "ext2"
+}
+
+func (e *ext) metadataCsum() bool {
+	return e.roCompat&extRoCompatMetadataCsum != 0
+}
+
+// gdtOffset returns offset of the primary group descriptors table which follows the superblock
+func (e *ext) gdtOffset() int64 {
+	return int64(e.firstDataBlock+1) * e.blockSize
+}
+
+// flush writes superblock updating it's checksum
+func (e *ext) flush() error {
+	if e.metadataCsum() {
+		binary.LittleEndian.PutUint32(e.sb[1020:], crc32c(^uint32(0), e.sb[:1020]))
+	}
+	_, err := e.dev.WriteAt(e.sb, 1024)
+	return err
+}
+
+func (e *ext) addFreeBlocks(delta int64) {
+	v := uint64(binary.LittleEndian.Uint32(e.sb[12:]))
+	if e.incompat&extIncompat64bit != 0 {
+		v |= uint64(binary.LittleEndian.Uint32(e.sb[344:])) << 32
+	}
+	v = uint64(int64(v) + delta)
+	binary.LittleEndian.PutUint32(e.sb[12:], uint32(v))
+	if e.incompat&extIncompat64bit != 0 {
+		binary.LittleEndian.PutUint32(e.sb[344:], uint32(v>>32))
+	}
+}
+
+func (e *ext) addFreeInodes(delta int64) {
+	binary.LittleEndian.PutUint32(e.sb[16:], uint32(int64(binary.LittleEndian.Uint32(e.sb[16:]))+delta))
+}
+
+func (e *ext) desc(g uint32) []byte {
+	return e.gdt[int64(g)*e.descSize : int64(g+1)*e.descSize]
+}
+
+func (e *ext) get(g uint32, f gdField) uint64 {
+	d := e.desc(g)
+	v, hi := uint64(0), uint64(0)
+	if f.size == 4 {
+		v = uint64(binary.LittleEndian.Uint32(d[f.lo:]))
+		if e.descSize >= 64 {
+			hi = uint64(binary.LittleEndian.Uint32(d[f.hi:]))
+		}
+	} else {
+		v = uint64(binary.LittleEndian.Uint16(d[f.lo:]))
+		if e.descSize >= 64 {
+			hi = uint64(binary.LittleEndian.Uint16(d[f.hi:]))
+		}
+	}
+	return v | hi<<uint(8*f.size)
+}
+
+func (e *ext) set(g uint32, f gdField, v uint64) {
+	d := e.desc(g)
+	if f.size == 4 {
+		binary.LittleEndian.PutUint32(d[f.lo:], uint32(v))
+		if e.descSize >= 64 {
+			binary.LittleEndian.PutUint32(d[f.hi:], uint32(v>>32))
+		}
+	} else {
+		binary.LittleEndian.PutUint16(d[f.lo:], uint16(v))
+		if e.descSize >= 64 {
+			binary.LittleEndian.PutUint16(d[f.hi:], uint16(v>>16))
+		}
+	}
+}
+
+func (e *ext) groupFlags(g uint32) uint16 {
+	return binary.LittleEndian.Uint16(e.desc(g)[gdFlags:])
+}
+
+// writeDesc updates group descriptor checksum and writes it to the disk
+func (e *ext) writeDesc(g uint32) error {
+	d := e.desc(g)
+	switch {
+	case e.metadataCsum():
+		binary.LittleEndian.PutUint16(d[gdChecksum:], 0)
+		binary.LittleEndian.PutUint16(d[gdChecksum:], uint16(crc32c(e.seed, le32(g), d)))
+	case e.roCompat&extRoCompatGdtCsum != 0:
+		crc := crc16(0xFFFF, e.sb[104:120], le32(g), d[:gdChecksum])
+		if len(d) > gdChecksum+2 {
+			crc = crc16(crc, d[gdChecksum+2:])
+		}
+		binary.LittleEndian.PutUint16(d[gdChecksum:], crc)
+	}
+	_, err := e.dev.WriteAt(d, e.gdtOffset()+int64(g)*e.descSize)
+	return err
+}
+
+func (e *ext) readBitmap(g uint32, f gdField) ([]byte, error) {
+	b := make([]byte, e.blockSize)
+	_, err := e.dev.ReadAt(b, int64(e.get(g, f))*e.blockSize)
+	return b, err
+}
+
+// writeBitmap writes bitmap block and updates it's checksum in the group descriptor
+func (e *ext) writeBitmap(g uint32, f, csum gdField, bits uint32, b []byte) error {
+	if _, err := e.dev.WriteAt(b, int64(e.get(g, f))*e.blockSize); err != nil {
+		return err
+	}
+	if e.metadataCsum() {
+		e.set(g, csum, uint64(crc32c(e.seed, b[:bits/8])))
+	}
+	return nil
+}
+
+func (e *ext) readBlock(n uint64) ([]byte, error) {
+	if n < e.firstDataBlock || n >= e.blocksCount {
+		return nil, fmt.Errorf("ext: block %d is out of range", n)
+	}
+	b := make([]byte, e.blockSize)
+	_, err := e.dev.ReadAt(b, int64(n)*e.blockSize)
+	return b, err
+}
+
+func (e *ext) writeBlock(n uint64, b []byte) error {
+	if n < e.firstDataBlock || n >= e.blocksCount {
+		return fmt.Errorf("ext: block %d is out of range", n)
+	}
+	_, err := e.dev.WriteAt(b, int64(n)*e.blockSize)
+	return err
+}
+
+func (e *ext) inodeOffset(num uint32) (int64, error) {
+	if num == 0 || num > e.inodesCount {
+		return 0, fmt.Errorf("ext: inode %d is out of range", num)
+	}
+	g := (num - 1) / e.inodesPerGroup
+	i := (num - 1) % e.inodesPerGroup
+	return int64(e.get(g, gdInodeTable))*e.blockSize + int64(i)*e.inodeSize, nil
+}
+
+func (e *ext) readInode(num uint32) (*inode, error) {
+	off, err := e.inodeOffset(num)
+	if err != nil {
+		return nil, err
+	}
+	in := &inode{num: num, raw: make([]byte, e.inodeSize)}
+	if _, err := e.dev.ReadAt(in.raw, off); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// writeInode updates inode checksum and writes it to the inode table
+func (e *ext) writeInode(in *inode) error {
+	off, err := e.inodeOffset(in.num)
+	if err != nil {
+		return err
+	}
+	if e.metadataCsum() {
+		hi := e.inodeSize > 128 && binary.LittleEndian.Uint16(in.raw[128:]) >= 4
+		binary.LittleEndian.PutUint16(in.raw[124:], 0)
+		if hi {
+			binary.LittleEndian.PutUint16(in.raw[130:], 0)
+		}
+		c := crc32c(e.inodeSeed(in), in.raw)
+		binary.LittleEndian.PutUint16(in.raw[124:], uint16(c))
+		if hi {
+			binary.LittleEndian.PutUint16(in.raw[130:], uint16(c>>16))
+		}
+	}
+	_, err = e.dev.WriteAt(in.raw, off)
+	return err
+}
+
+// inodeSeed is a checksum seed of the inode metadata blocks
+func (e *ext) inodeSeed(in *inode) uint32 {
+	return crc32c(e.seed, le32(in.num), in.raw[100:104])
+}
+
+func (in *inode) mode() uint16 {
+	return binary.LittleEndian.Uint16(in.raw[0:])
+}
+
+func (in *inode) flags() uint32 {
+	return binary.LittleEndian.Uint32(in.raw[32:])
+}
+
+func (in *inode) isDir() bool {
+	return in.mode()&extModeMask == extModeDir
+}
+
+func (in *inode) size() int64 {
+	return int64(binary.LittleEndian.Uint32(in.raw[4:])) | int64(binary.LittleEndian.Uint32(in.raw[108:]))<<32
+}
+
+func (in *inode) setSize(n int64) {
+	binary.LittleEndian.PutUint32(in.raw[4:], uint32(n))
+	binary.LittleEndian.PutUint32(in.raw[108:], uint32(n>>32))
+}
+
+func (in *inode) links() uint16 {
+	return binary.LittleEndian.Uint16(in.raw[26:])
+}
+
+func (in *inode) setLinks(n uint16) {
+	binary.LittleEndian.PutUint16(in.raw[26:], n)
+}
+
+func (in *inode) modTime() time.Time {
+	return time.Unix(int64(binary.LittleEndian.Uint32(in.raw[16:])), 0)
+}
+
+// touch sets change and modification times, access time is also set if atime is true
+func (in *inode) touch(atime bool) {
+	now := time.Now()
+	fields := []int{12, 16}
+	if atime {
+		fields = append(fields, 8)
+	}
+	for _, f := range fields {
+		binary.LittleEndian.PutUint32(in.raw[f:], uint32(now.Unix()))
+	}
+
+	if len(in.raw) <= 128 {
+		return
+	}
+	extra := int(binary.LittleEndian.Uint16(in.raw[128:]))
+	// ctime, mtime and atime nanoseconds are stored in the extra space
+	for i, f := range []int{132, 136, 140} {
+		if f+4 <= 128+extra && (i < 2 || atime) {
+			binary.LittleEndian.PutUint32(in.raw[f:], uint32(now.Nanosecond())<<2)
+		}
+	}
+}
+
+// checkInode refuses inodes which are stored in a way not supported here
+func (e *ext) checkInode(in *inode) error {
+	if f := in.flags(); f&(extInlineDataFl|extEncryptFl|extCasefoldFl) != 0 {
+		return fmt.Errorf("ext: inode %d: %s: inline data, encryption or casefolding", in.num, ErrUnsupported)
+	}
+	return nil
+}
+
+// extents returns data extents of the inode and blocks used by the mapping itself
+func (e *ext) extents(in *inode) ([]extent, []uint64, error) {
+	if err := e.checkInode(in); err != nil {
+		return nil, nil, err
+	}
+	var (
+		out  []extent
+		meta []uint64
+	)
+	if in.flags()&extExtentsFl != 0 {
+		err := e.walkExtents(in.raw[40:100], 0, &out, &meta)
+		return out, meta, err
+	}
+
+	logical := uint32(0)
+	for i := 0; i < 12; i++ {
+		addBlock(&out, logical, uint64(binary.LittleEndian.Uint32(in.raw[40+4*i:])))
+		logical++
+	}
+	for level := 1; level <= 3; level++ {
+		ptr := binary.LittleEndian.Uint32(in.raw[40+4*(11+level):])
+		if err := e.walkIndirect(ptr, level, &logical, &out, &meta); err != nil {
+			return nil, nil, err
+		}
+	}
+	return out, meta, nil
+}
+
+func (e *ext) walkExtents(node []byte, level int, out *[]extent, meta *[]uint64) error {
+	if binary.LittleEndian.Uint16(node) != extExtentMagic || level > 5 {
+		return errCorrupted
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	depth := binary.LittleEndian.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return errCorrupted
+	}
+
+	for i := 0; i < entries; i++ {
+		ent := node[12+12*i:]
+		if depth == 0 {
+			x := extent{
+				logical: binary.LittleEndian.Uint32(ent),
+				start:   uint64(binary.LittleEndian.Uint16(ent[6:]))<<32 | uint64(binary.LittleEndian.Uint32(ent[8:])),
+				length:  uint32(binary.LittleEndian.Uint16(ent[4:])),
+			}
+			if x.length > extMaxExtent {
+				x.length -= extMaxExtent
+				x.uninit = true
+			}
+			*out = append(*out, x)
+			continue
+		}
+
+		b := uint64(binary.LittleEndian.Uint16(ent[8:]))<<32 | uint64(binary.LittleEndian.Uint32(ent[4:]))
+		*meta = append(*meta, b)
+		blk, err := e.readBlock(b)
+		if err != nil {
+			return err
+		}
+		if err := e.walkExtents(blk, level+1, out, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ext) walkIndirect(ptr uint32, level int, logical *uint32, out *[]extent, meta *[]uint64) error {
+	per := uint32(e.blockSize / 4)
+	if ptr == 0 {
+		span := uint32(1)
+		for i := 0; i < level; i++ {
+			span *= per
+		}
+		*logical += span
+		return nil
+	}
+
+	*meta = append(*meta, uint64(ptr))
+	blk, err := e.readBlock(uint64(ptr))
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < per; i++ {
+		p := binary.LittleEndian.Uint32(blk[4*i:])
+		if level > 1 {
+			if err := e.walkIndirect(p, level-1, logical, out, meta); err != nil {
+				return err
+			}
+			continue
+		}
+		addBlock(out, *logical, uint64(p))
+		*logical++
+	}
+	return nil
+}
+
+// addBlock appends block to the extents merging it with the last one when possible
+func addBlock(out *[]extent, logical uint32, b uint64) {
+	if b == 0 {
+		return
+	}
+	if n := len(*out); n > 0 {
+		last := &(*out)[n-1]
+		if last.logical+last.length == logical && last.start+uint64(last.length) == b {
+			last.length++
+			return
+		}
+	}
+	*out = append(*out, extent{logical: logical, start: b, length: 1})
+}
+
+// readData reads inode content
+func (e *ext) readData(in *inode) ([]byte, error) {
+	size := in.size()
+	if size > e.dev.size {
+		return nil, errCorrupted
+	}
+	exts, _, err := e.extents(in)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	for _, x := range exts {
+		off := int64(x.logical) * e.blockSize
+		if x.uninit || off >= size {
+			continue
+		}
+		n := int64(x.length) * e.blockSize
+		if off+n > size {
+			n = size - off
+		}
+		if x.start < e.firstDataBlock || x.start+uint64(x.length) > e.blocksCount {
+			return nil, errCorrupted
+		}
+		if _, err := e.dev.ReadAt(data[off:off+n], int64(x.start)*e.blockSize); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// freeRuns returns free block runs of the group
+func (e *ext) freeRuns(g uint32) ([]extent, error) {
+	if e.groupFlags(g)&extBlockUninit != 0 || e.get(g, gdFreeBlocks) == 0 {
+		return nil, nil
+	}
+	bm, err := e.readBitmap(g, gdBlockBitmap)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []extent
+	first := e.firstDataBlock + uint64(g)*uint64(e.blocksPerGroup)
+	for bit := uint32(0); bit < e.blocksPerGroup && first+uint64(bit) < e.blocksCount; bit++ {
+		if bm[bit/8]&(1<<(bit%8)) != 0 {
+			continue
+		}
+		b := first + uint64(bit)
+		if n := len(runs); n > 0 && runs[n-1].start+uint64(runs[n-1].length) == b {
+			runs[n-1].length++
+			continue
+		}
+		runs = append(runs, extent{start: b, length: 1})
+	}
+	return runs, nil
+}
+
+// allocBlocks allocates n blocks preferring a single contiguous run, logical numbers start with 0
+func (e *ext) allocBlocks(n uint64) ([]extent, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	var picked []extent
+	for g := uint32(0); g < e.groups && picked == nil; g++ {
+		runs, err := e.freeRuns(g)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range runs {
+			if uint64(r.length) >= n {
+				r.length = uint32(n)
+				picked = []extent{r}
+				break
+			}
+		}
+	}
+
+	if picked == nil {
+		total := uint64(0)
+		for g := uint32(0); g < e.groups && total < n; g++ {
+			runs, err := e.freeRuns(g)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range runs {
+				if total+uint64(r.length) > n {
+					r.length = uint32(n - total)
+				}
+				picked = append(picked, r)
+				if total += uint64(r.length); total == n {
+					break
+				}
+			}
+		}
+		if total < n {
+			return nil, fmt.Errorf("ext: no space left, %d blocks required", n)
+		}
+	}
+
+	logical := uint32(0)
+	for i := range picked {
+		picked[i].logical = logical
+		logical += picked[i].length
+	}
+	return picked, e.markBlocks(picked, true)
+}
+
+// markBlocks marks blocks as used or free updating bitmaps and counters
+func (e *ext) markBlocks(runs []extent, used bool) error {
+	bitmaps := make(map[uint32][]byte)
+	deltas := make(map[uint32]int64)
+	total := int64(0)
+
+	for _, r := range runs {
+		for b := r.start; b < r.start+uint64(r.length); b++ {
+			if b < e.firstDataBlock || b >= e.blocksCount {
+				return fmt.Errorf("ext: block %d is out of range", b)
+			}
+			g := uint32((b - e.firstDataBlock) / uint64(e.blocksPerGroup))
+			bit := uint32((b - e.firstDataBlock) % uint64(e.blocksPerGroup))
+			bm, ok := bitmaps[g]
+			if !ok {
+				if e.groupFlags(g)&extBlockUninit != 0 {
+					return fmt.Errorf("ext: block %d belongs to uninitialized group", b)
+				}
+				var err error
+				if bm, err = e.readBitmap(g, gdBlockBitmap); err != nil {
+					return err
+				}
+				bitmaps[g] = bm
+			}
+
+			set := bm[bit/8]&(1<<(bit%8)) != 0
+			switch {
+			case used && set:
+				return fmt.Errorf("ext: block %d is already in use", b)
+			case used:
+				bm[bit/8] |= 1 << (bit % 8)
+				deltas[g]--
+			case set:
+				bm[bit/8] &^= 1 << (bit % 8)
+				deltas[g]++
+			}
+		}
+	}
+
+	for g, bm := range bitmaps {
+		if err := e.writeBitmap(g, gdBlockBitmap, gdBlockBitmapCsum, e.blocksPerGroup, bm); err != nil {
+			return err
+		}
+		e.set(g, gdFreeBlocks, uint64(int64(e.get(g, gdFreeBlocks))+deltas[g]))
+		if err := e.writeDesc(g); err != nil {
+			return err
+		}
+		total += deltas[g]
+	}
+	e.addFreeBlocks(total)
+	return nil
+}
+
+// allocInode allocates the first free inode
+func (e *ext) allocInode(dir bool) (uint32, error) {
+	first := uint32(11)
+	if binary.LittleEndian.Uint32(e.sb[76:]) >= 1 {
+		first = binary.LittleEndian.Uint32(e.sb[84:])
+	}
+
+	for g := uint32(0); g < e.groups; g++ {
+		if e.groupFlags(g)&extInodeUninit != 0 || e.get(g, gdFreeInodes) == 0 {
+			continue
+		}
+		bm, err := e.readBitmap(g, gdInodeBitmap)
+		if err != nil {
+			return 0, err
+		}
+		for i := uint32(0); i < e.inodesPerGroup; i++ {
+			num := g*e.inodesPerGroup + i + 1
+			if num < first || bm[i/8]&(1<<(i%8)) != 0 {
+				continue
+			}
+
+			bm[i/8] |= 1 << (i % 8)
+			if err := e.writeBitmap(g, gdInodeBitmap, gdInodeBitmapCsum, e.inodesPerGroup, bm); err != nil {
+				return 0, err
+			}
+			e.set(g, gdFreeInodes, e.get(g, gdFreeInodes)-1)
+			if dir {
+				e.set(g, gdUsedDirs, e.get(g, gdUsedDirs)+1)
+			}
+			// inodes after itable_unused are not checked by e2fsck and may be not zeroed
+			if e.metadataCsum() || e.roCompat&extRoCompatGdtCsum != 0 {
+				if unused := e.get(g, gdItableUnused); uint64(i) >= uint64(e.inodesPerGroup)-unused {
+					e.set(g, gdItableUnused, uint64(e.inodesPerGroup-i-1))
+				}
+			}
+			if err := e.writeDesc(g); err != nil {
+				return 0, err
+			}
+			e.addFreeInodes(-1)
+			return num, nil
+		}
+	}
+	return 0, errors.New("ext: no free inodes left")
+}
+
+// freeInode releases inode allocated by allocInode
+func (e *ext) freeInode(num uint32, dir bool) error {
+	g := (num - 1) / e.inodesPerGroup
+	i := (num - 1) % e.inodesPerGroup
+	bm, err := e.readBitmap(g, gdInodeBitmap)
+	if err != nil {
+		return err
+	}
+	bm[i/8] &^= 1 << (i % 8)
+	if err := e.writeBitmap(g, gdInodeBitmap, gdInodeBitmapCsum, e.inodesPerGroup, bm); err != nil {
+		return err
+	}
+	e.set(g, gdFreeInodes, e.get(g, gdFreeInodes)+1)
+	if dir {
+		e.set(g, gdUsedDirs, e.get(g, gdUsedDirs)-1)
+	}
+	e.addFreeInodes(1)
+	return e.writeDesc(g)
+}
+
+// newInode returns zeroed inode with the mode and current timestamps
+func (e *ext) newInode(num uint32, mode uint16) *inode {
+	in := &inode{num: num, raw: make([]byte, e.inodeSize)}
+	binary.LittleEndian.PutUint16(in.raw[0:], mode)
+	binary.LittleEndian.PutUint32(in.raw[100:], uint32(time.Now().UnixNano()))
+	if e.incompat&extIncompatExtents != 0 {
+		binary.LittleEndian.PutUint32(in.raw[32:], extExtentsFl)
+	}
+	if e.inodeSize > 128 {
+		extra := binary.LittleEndian.Uint16(e.sb[348:])
+		if extra == 0 || int64(extra) > e.inodeSize-128 {
+			extra = 32
+			if int64(extra) > e.inodeSize-128 {
+				extra = uint16(e.inodeSize - 128)
+			}
+		}
+		binary.LittleEndian.PutUint16(in.raw[128:], extra)
+		if extra >= 20 {
+			binary.LittleEndian.PutUint32(in.raw[144:], uint32(time.Now().Unix()))
+		}
+	}
+	in.touch(true)
+	return in
+}
+
+// setBlocks builds data mapping of the inode from extents, which must start with logical block 0 without holes,
+// mapping blocks are allocated when extents don't fit the inode
+func (e *ext) setBlocks(in *inode, exts []extent) error {
+	for i := range in.raw[40:100] {
+		in.raw[40+i] = 0
+	}
+
+	var (
+		meta []extent
+		err  error
+		data uint64
+	)
+	for _, x := range exts {
+		data += uint64(x.length)
+	}
+	if in.flags()&extExtentsFl != 0 {
+		meta, err = e.setExtents(in, exts)
+	} else {
+		meta, err = e.setBlockMap(in, exts)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, x := range meta {
+		data += uint64(x.length)
+	}
+	sectors := data * uint64(e.blockSize/512)
+	binary.LittleEndian.PutUint32(in.raw[28:], uint32(sectors))
+	binary.LittleEndian.PutUint16(in.raw[116:], uint16(sectors>>32))
+	binary.LittleEndian.PutUint32(in.raw[32:], in.flags()&^extHugeFileFl)
+	return nil
+}
+
+func (e *ext) setExtents(in *inode, exts []extent) ([]extent, error) {
+	// split runs longer than maximal initialized extent
+	var split []extent
+	for _, x := range exts {
+		for x.length > extMaxExtent {
+			split = append(split, extent{logical: x.logical, start: x.start, length: extMaxExtent})
+			x.logical += extMaxExtent
+			x.start += extMaxExtent
+			x.length -= extMaxExtent
+		}
+		split = append(split, x)
+	}
+
+	header := func(b []byte, entries, max, depth int) {
+		binary.LittleEndian.PutUint16(b[0:], extExtentMagic)
+		binary.LittleEndian.PutUint16(b[2:], uint16(entries))
+		binary.LittleEndian.PutUint16(b[4:], uint16(max))
+		binary.LittleEndian.PutUint16(b[6:], uint16(depth))
+	}
+	leaves := func(b []byte) {
+		for i, x := range split {
+			ent := b[12+12*i:]
+			binary.LittleEndian.PutUint32(ent[0:], x.logical)
+			binary.LittleEndian.PutUint16(ent[4:], uint16(x.length))
+			binary.LittleEndian.PutUint16(ent[6:], uint16(x.start>>32))
+			binary.LittleEndian.PutUint32(ent[8:], uint32(x.start))
+		}
+	}
+
+	root := in.raw[40:100]
+	if len(split) <= 4 {
+		header(root, len(split), 4, 0)
+		leaves(root)
+		return nil, nil
+	}
+
+	max := int(e.blockSize-12) / 12
+	if len(split) > max {
+		return nil, fmt.Errorf("ext: %s: file is too fragmented", ErrUnsupported)
+	}
+	meta, err := e.allocBlocks(1)
+	if err != nil {
+		return nil, err
+	}
+	blk := make([]byte, e.blockSize)
+	header(blk, len(split), max, 0)
+	leaves(blk)
+	if e.metadataCsum() {
+		binary.LittleEndian.PutUint32(blk[12+12*max:], crc32c(e.inodeSeed(in), blk[:12+12*max]))
+	}
+	if err := e.writeBlock(meta[0].start, blk); err != nil {
+		return nil, err
+	}
+
+	header(root, 1, 4, 1)
+	binary.LittleEndian.PutUint32(root[16:], uint32(meta[0].start))
+	binary.LittleEndian.PutUint16(root[20:], uint16(meta[0].start>>32))
+	return meta, nil
+}
+
+func (e *ext) setBlockMap(in *inode, exts []extent) ([]extent, error) {
+	var ptrs []uint32
+	for _, x := range exts {
+		if x.start+uint64(x.length) > 1<<32 {
+			return nil, fmt.Errorf("ext: block %d can't be mapped without extents", x.start)
+		}
+		for i := uint32(0); i < x.length; i++ {
+			ptrs = append(ptrs, uint32(x.start)+i)
+		}
+	}
+
+	per := int(e.blockSize / 4)
+	direct := ptrs
+	if len(direct) > 12 {
+		direct = ptrs[:12]
+	}
+	for i, p := range direct {
+		binary.LittleEndian.PutUint32(in.raw[40+4*i:], p)
+	}
+	rest := ptrs[len(direct):]
+	if len(rest) == 0 {
+		return nil, nil
+	}
+	if len(rest) > per+per*per {
+		return nil, fmt.Errorf("ext: %s: file is too large for the block map", ErrUnsupported)
+	}
+
+	n := 1
+	if len(rest) > per {
+		n += 1 + (len(rest)-per+per-1)/per
+	}
+	meta, err := e.allocBlocks(uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []uint32
+	for _, x := range meta {
+		for i := uint32(0); i < x.length; i++ {
+			blocks = append(blocks, uint32(x.start)+i)
+		}
+	}
+
+	// writeIndirect fills a block with pointers and returns the rest
+	writeIndirect := func(b uint32, ptrs []uint32) ([]uint32, error) {
+		blk := make([]byte, e.blockSize)
+		i := 0
+		for ; i < per && i < len(ptrs); i++ {
+			binary.LittleEndian.PutUint32(blk[4*i:], ptrs[i])
+		}
+		return ptrs[i:], e.writeBlock(uint64(b), blk)
+	}
+
+	binary.LittleEndian.PutUint32(in.raw[40+4*12:], blocks[0])
+	if rest, err = writeIndirect(blocks[0], rest); err != nil || len(rest) == 0 {
+		return meta, err
+	}
+
+	binary.LittleEndian.PutUint32(in.raw[40+4*13:], blocks[1])
+	if _, err := writeIndirect(blocks[1], blocks[2:]); err != nil {
+		return nil, err
+	}
+	for _, b := range blocks[2:] {
+		if rest, err = writeIndirect(b, rest); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// freeData releases data and mapping blocks
+func (e *ext) freeData(exts []extent, meta []uint64) error {
+	runs := append([]extent{}, exts...)
+	for _, b := range meta {
+		runs = append(runs, extent{start: b, length: 1})
+	}
+	return e.markBlocks(runs, false)
+}
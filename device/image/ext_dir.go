@@ -0,0 +1,725 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ext directory entry file types
+const (
+	extTypeFile    = 1
+	extTypeDir     = 2
+	extTypeSymlink = 7
+
+	extDirTail = 12
+)
+
+// dirent is a parsed directory entry
+type dirent struct {
+	inode uint32
+	name  string
+}
+
+// recLen returns aligned directory entry size for the name
+func recLen(name int) int {
+	return (8 + name + 3) &^ 3
+}
+
+// tailSize returns size of the checksum entry at the end of directory blocks
+func (e *ext) tailSize() int {
+	if e.metadataCsum() {
+		return extDirTail
+	}
+	return 0
+}
+
+// dirBlocks returns physical blocks of the directory by logical numbers
+func (e *ext) dirBlocks(dir *inode) ([]uint64, error) {
+	exts, _, err := e.extents(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := dir.size() / e.blockSize
+	if n > int64(e.blocksCount) {
+		return nil, errCorrupted
+	}
+	blocks := make([]uint64, n)
+	for _, x := range exts {
+		for i := uint32(0); i < x.length; i++ {
+			if l := int64(x.logical + i); l < n {
+				blocks[l] = x.start + uint64(i)
+			}
+		}
+	}
+	for _, b := range blocks {
+		if b == 0 {
+			return nil, fmt.Errorf("ext: directory %d has holes", dir.num)
+		}
+	}
+	return blocks, nil
+}
+
+// entries parses directory block
+func (e *ext) entries(b []byte) ([]dirent, error) {
+	var out []dirent
+	for off := 0; off < len(b); {
+		rec := int(binary.LittleEndian.Uint16(b[off+4:]))
+		nameLen := int(b[off+6])
+		if e.incompat&extIncompatFiletype == 0 {
+			nameLen = int(binary.LittleEndian.Uint16(b[off+6:]))
+		}
+		if rec < 8 || off+rec > len(b) || 8+nameLen > rec {
+			return nil, errCorrupted
+		}
+		if ino := binary.LittleEndian.Uint32(b[off:]); ino != 0 {
+			out = append(out, dirent{ino, string(b[off+8 : off+8+nameLen])})
+		}
+		off += rec
+	}
+	return out, nil
+}
+
+// readDirectory returns all entries of the directory
+func (e *ext) readDirectory(dir *inode) ([]dirent, error) {
+	blocks, err := e.dirBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []dirent
+	for _, b := range blocks {
+		blk, err := e.readBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		ents, err := e.entries(blk)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ents...)
+	}
+	return out, nil
+}
+
+func (e *ext) lookupEntry(dir *inode, name string) (uint32, error) {
+	ents, err := e.readDirectory(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range ents {
+		if d.name == name {
+			return d.inode, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", name, ErrNotFound)
+}
+
+// resolve returns inode of the path following symbolic links, the last element is followed if follow is true
+func (e *ext) resolve(name string, follow bool) (*inode, error) {
+	root, err := e.readInode(extRootIno)
+	if err != nil {
+		return nil, err
+	}
+	stack := []*inode{root}
+	parts := splitPath(name)
+	links := 0
+
+	for len(parts) > 0 {
+		p := parts[0]
+		parts = parts[1:]
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		cur := stack[len(stack)-1]
+		if !cur.isDir() {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+		num, err := e.lookupEntry(cur, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, ErrNotFound)
+		}
+		child, err := e.readInode(num)
+		if err != nil {
+			return nil, err
+		}
+
+		if child.mode()&extModeMask == extModeSymlink && (len(parts) > 0 || follow) {
+			if links++; links > 8 {
+				return nil, fmt.Errorf("%s: too many levels of symbolic links", name)
+			}
+			target, err := e.readLink(child)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(target, "/") {
+				stack = stack[:1]
+			}
+			parts = append(strings.Split(target, "/"), parts...)
+			continue
+		}
+		stack = append(stack, child)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// readLink returns target of the symbolic link, short targets are stored in the inode itself
+func (e *ext) readLink(in *inode) (string, error) {
+	size := in.size()
+	sectors := binary.LittleEndian.Uint32(in.raw[28:])
+	if acl := binary.LittleEndian.Uint32(in.raw[104:]); acl != 0 {
+		sectors -= uint32(e.blockSize / 512)
+	}
+	if size < 60 && sectors == 0 && in.flags()&extInlineDataFl == 0 {
+		return string(in.raw[40 : 40+size]), nil
+	}
+	data, err := e.readData(in)
+	return string(data), err
+}
+
+// parent resolves parent directory of the path and returns the base name
+func (e *ext) parent(name string) (*inode, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return nil, "", fmt.Errorf("%s: invalid file name", name)
+	}
+	base := parts[len(parts)-1]
+	if len(base) > 255 {
+		return nil, "", fmt.Errorf("%s: file name is too long", name)
+	}
+	dir, err := e.resolve(strings.Join(parts[:len(parts)-1], "/"), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", fmt.Errorf("%s: not a directory", name)
+	}
+	return dir, base, nil
+}
+
+// ReadFile returns content of the file
+func (e *ext) ReadFile(name string) ([]byte, error) {
+	in, err := e.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if in.isDir() {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+	return e.readData(in)
+}
+
+// ReadDir lists directory
+func (e *ext) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, err := e.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+	ents, err := e.readDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []os.FileInfo
+	for _, d := range ents {
+		if d.name == "." || d.name == ".." {
+			continue
+		}
+		in, err := e.readInode(d.inode)
+		if err != nil {
+			return nil, err
+		}
+		fi := &fileInfo{name: d.name, size: in.size(), mode: os.FileMode(in.mode() & 0777), modTime: in.modTime()}
+		switch in.mode() & extModeMask {
+		case extModeDir:
+			fi.mode |= os.ModeDir
+		case extModeSymlink:
+			fi.mode |= os.ModeSymlink
+		}
+		out = append(out, fi)
+	}
+	return out, nil
+}
+
+// WriteFile replaces the file content or creates a new file
+func (e *ext) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if e.readOnly != nil {
+		return e.readOnly
+	}
+	dir, base, err := e.parent(name)
+	if err != nil {
+		return err
+	}
+
+	var in *inode
+	if _, err := e.lookupEntry(dir, base); err == nil {
+		if in, err = e.resolve(name, true); err != nil {
+			return err
+		}
+		if in.mode()&extModeMask != extModeFile {
+			return fmt.Errorf("%s: not a regular file", name)
+		}
+		if err := e.checkInode(in); err != nil {
+			return err
+		}
+	}
+
+	n := (int64(len(data)) + e.blockSize - 1) / e.blockSize
+	exts, err := e.allocBlocks(uint64(n))
+	if err != nil {
+		return err
+	}
+	for _, x := range exts {
+		buf := make([]byte, int64(x.length)*e.blockSize)
+		copy(buf, data[int64(x.logical)*e.blockSize:])
+		if _, err := e.dev.WriteAt(buf, int64(x.start)*e.blockSize); err != nil {
+			return err
+		}
+	}
+
+	if in != nil {
+		oldExts, oldMeta, err := e.extents(in)
+		if err != nil {
+			return err
+		}
+		if err := e.setBlocks(in, exts); err != nil {
+			return err
+		}
+		in.setSize(int64(len(data)))
+		in.touch(false)
+		if err := e.writeInode(in); err != nil {
+			return err
+		}
+		if err := e.freeData(oldExts, oldMeta); err != nil {
+			return err
+		}
+		return e.flush()
+	}
+
+	num, err := e.allocInode(false)
+	if err != nil {
+		return err
+	}
+	in = e.newInode(num, extModeFile|uint16(perm&0777))
+	in.setLinks(1)
+	in.setSize(int64(len(data)))
+	if err := e.setBlocks(in, exts); err != nil {
+		return err
+	}
+	if err := e.writeInode(in); err != nil {
+		return err
+	}
+	if err := e.addEntry(dir, base, num, extTypeFile); err != nil {
+		e.rollback(in, false)
+		return err
+	}
+	return e.flush()
+}
+
+// Mkdir creates a new directory
+func (e *ext) Mkdir(name string, perm os.FileMode) error {
+	if e.readOnly != nil {
+		return e.readOnly
+	}
+	dir, base, err := e.parent(name)
+	if err != nil {
+		return err
+	}
+	if _, err := e.lookupEntry(dir, base); err == nil {
+		return fmt.Errorf("%s: %s", name, os.ErrExist)
+	}
+
+	num, err := e.allocInode(true)
+	if err != nil {
+		return err
+	}
+	exts, err := e.allocBlocks(1)
+	if err != nil {
+		return err
+	}
+
+	in := e.newInode(num, extModeDir|uint16(perm&0777))
+	in.setLinks(2)
+	in.setSize(e.blockSize)
+	if err := e.setBlocks(in, exts); err != nil {
+		return err
+	}
+
+	blk := e.emptyDirBlock()
+	e.putEntry(blk, 0, recLen(1), num, ".", extTypeDir)
+	e.putEntry(blk, recLen(1), len(blk)-e.tailSize()-recLen(1), dir.num, "..", extTypeDir)
+	e.dirChecksum(in, blk)
+	if err := e.writeBlock(exts[0].start, blk); err != nil {
+		return err
+	}
+	if err := e.writeInode(in); err != nil {
+		return err
+	}
+
+	if err := e.addEntry(dir, base, num, extTypeDir); err != nil {
+		e.rollback(in, true)
+		return err
+	}
+	if dir.links() < 65000 {
+		dir.setLinks(dir.links() + 1)
+	}
+	if err := e.writeInode(dir); err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// rollback releases inode and it's blocks when it wasn't linked into the directory
+func (e *ext) rollback(in *inode, dir bool) {
+	if exts, meta, err := e.extents(in); err == nil {
+		e.freeData(exts, meta)
+	}
+	e.freeInode(in.num, dir)
+	e.flush()
+}
+
+// emptyDirBlock returns directory block with a single unused entry and the checksum tail
+func (e *ext) emptyDirBlock() []byte {
+	blk := make([]byte, e.blockSize)
+	binary.LittleEndian.PutUint16(blk[4:], uint16(len(blk)-e.tailSize()))
+	if e.metadataCsum() {
+		t := blk[len(blk)-extDirTail:]
+		binary.LittleEndian.PutUint16(t[4:], extDirTail)
+		t[7] = 0xDE
+	}
+	return blk
+}
+
+func (e *ext) putEntry(b []byte, off, rec int, num uint32, name string, typ byte) {
+	binary.LittleEndian.PutUint32(b[off:], num)
+	binary.LittleEndian.PutUint16(b[off+4:], uint16(rec))
+	b[off+6] = byte(len(name))
+	b[off+7] = 0
+	if e.incompat&extIncompatFiletype != 0 {
+		b[off+7] = typ
+	}
+	copy(b[off+8:], name)
+}
+
+func (e *ext) dirChecksum(dir *inode, b []byte) {
+	if e.metadataCsum() {
+		binary.LittleEndian.PutUint32(b[len(b)-4:], crc32c(e.inodeSeed(dir), b[:len(b)-extDirTail]))
+	}
+}
+
+// addEntry links inode into the directory, hashed directories are updated in place
+// in the leaf block selected by the name hash
+func (e *ext) addEntry(dir *inode, name string, num uint32, typ byte) error {
+	if err := e.checkInode(dir); err != nil {
+		return err
+	}
+	blocks, err := e.dirBlocks(dir)
+	if err != nil {
+		return err
+	}
+
+	candidates := blocks
+	if dir.flags()&extIndexFl != 0 {
+		leaf, err := e.dxLeaf(dir, blocks, name)
+		if err != nil {
+			return err
+		}
+		candidates = []uint64{blocks[leaf]}
+	}
+	for _, b := range candidates {
+		ok, err := e.insertEntry(dir, b, name, num, typ)
+		if err != nil || ok {
+			if ok {
+				dir.touch(false)
+				err = e.writeInode(dir)
+			}
+			return err
+		}
+	}
+	if dir.flags()&extIndexFl != 0 {
+		return fmt.Errorf("ext: %s: hashed directory block is full", ErrUnsupported)
+	}
+
+	// append a new block to the linear directory
+	exts, meta, err := e.extents(dir)
+	if err != nil {
+		return err
+	}
+	x, err := e.allocBlocks(1)
+	if err != nil {
+		return err
+	}
+	blk := e.emptyDirBlock()
+	e.putEntry(blk, 0, len(blk)-e.tailSize(), num, name, typ)
+	e.dirChecksum(dir, blk)
+	if err := e.writeBlock(x[0].start, blk); err != nil {
+		return err
+	}
+
+	x[0].logical = uint32(len(blocks))
+	if err := e.setBlocks(dir, mergeExtents(append(exts, x[0]))); err != nil {
+		return err
+	}
+	dir.setSize(dir.size() + e.blockSize)
+	dir.touch(false)
+	if err := e.writeInode(dir); err != nil {
+		return err
+	}
+	if len(meta) > 0 {
+		return e.freeData(nil, meta)
+	}
+	return nil
+}
+
+// insertEntry puts entry into the free space of the directory block
+func (e *ext) insertEntry(dir *inode, b uint64, name string, num uint32, typ byte) (bool, error) {
+	blk, err := e.readBlock(b)
+	if err != nil {
+		return false, err
+	}
+	limit := len(blk) - e.tailSize()
+	if e.metadataCsum() {
+		t := blk[limit:]
+		if binary.LittleEndian.Uint32(t) != 0 || binary.LittleEndian.Uint16(t[4:]) != extDirTail || t[7] != 0xDE {
+			return false, fmt.Errorf("ext: %s: directory block without checksum", ErrUnsupported)
+		}
+	}
+
+	need := recLen(len(name))
+	for off := 0; off < limit; {
+		rec := int(binary.LittleEndian.Uint16(blk[off+4:]))
+		if rec < 8 || off+rec > limit {
+			return false, errCorrupted
+		}
+		used := 0
+		if binary.LittleEndian.Uint32(blk[off:]) != 0 {
+			used = recLen(int(blk[off+6]))
+		}
+		if rec-used >= need {
+			if used > 0 {
+				binary.LittleEndian.PutUint16(blk[off+4:], uint16(used))
+				off += used
+				rec -= used
+			}
+			e.putEntry(blk, off, rec, num, name, typ)
+			e.dirChecksum(dir, blk)
+			return true, e.writeBlock(b, blk)
+		}
+		off += rec
+	}
+	return false, nil
+}
+
+// mergeExtents joins adjacent extents
+func mergeExtents(exts []extent) []extent {
+	var out []extent
+	for _, x := range exts {
+		if n := len(out); n > 0 && !x.uninit && !out[n-1].uninit &&
+			out[n-1].logical+out[n-1].length == x.logical && out[n-1].start+uint64(out[n-1].length) == x.start {
+			out[n-1].length += x.length
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// dxLeaf walks htree index and returns logical number of the leaf block for the name
+func (e *ext) dxLeaf(dir *inode, blocks []uint64, name string) (int, error) {
+	root, err := e.readBlock(blocks[0])
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(root[24:]) != 0 || root[29] != 8 {
+		return 0, fmt.Errorf("ext: %s: directory index of %d", ErrUnsupported, dir.num)
+	}
+	version := root[28]
+	// signed and unsigned variants depend on the platform which created the filesystem
+	if version <= 2 && binary.LittleEndian.Uint32(e.sb[352:])&0x2 != 0 {
+		version += 3
+	}
+	hash, err := dxHash([]byte(name), version, e.sb[236:252])
+	if err != nil {
+		return 0, err
+	}
+
+	levels := int(root[30])
+	blk, off := root, 32
+	for level := 0; ; level++ {
+		count := int(binary.LittleEndian.Uint16(blk[off+2:]))
+		if count == 0 || off+8*count > len(blk) {
+			return 0, errCorrupted
+		}
+		pick := 0
+		for i := 1; i < count; i++ {
+			if binary.LittleEndian.Uint32(blk[off+8*i:]) > hash {
+				break
+			}
+			pick = i
+		}
+		logical := int(binary.LittleEndian.Uint32(blk[off+8*pick+4:]) & 0x0FFFFFFF)
+		if logical >= len(blocks) {
+			return 0, errCorrupted
+		}
+		if level == levels {
+			return logical, nil
+		}
+		if blk, err = e.readBlock(blocks[logical]); err != nil {
+			return 0, err
+		}
+		off = 8
+	}
+}
+
+// dxHash calculates directory index hash, versions 3-5 are unsigned variants of 0-2
+func dxHash(name []byte, version byte, seed []byte) (uint32, error) {
+	buf := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	for i := 0; i < 16; i++ {
+		if seed[i] != 0 {
+			for j := range buf {
+				buf[j] = binary.LittleEndian.Uint32(seed[4*j:])
+			}
+			break
+		}
+	}
+
+	var hash uint32
+	unsigned := version >= 3
+	switch version {
+	case 0, 3:
+		hash = dxHackHash(name, unsigned)
+	case 1, 4:
+		for p := name; len(p) > 0; {
+			halfMD4(&buf, str2hashbuf(p, 8, unsigned))
+			if len(p) <= 32 {
+				break
+			}
+			p = p[32:]
+		}
+		hash = buf[1]
+	case 2, 5:
+		for p := name; len(p) > 0; {
+			tea(&buf, str2hashbuf(p, 4, unsigned))
+			if len(p) <= 16 {
+				break
+			}
+			p = p[16:]
+		}
+		hash = buf[0]
+	default:
+		return 0, fmt.Errorf("ext: %s: hash version %d", ErrUnsupported, version)
+	}
+
+	hash &^= 1
+	if hash == 0x7FFFFFFF<<1 {
+		hash = (0x7FFFFFFF - 1) << 1
+	}
+	return hash, nil
+}
+
+func dxHackHash(name []byte, unsigned bool) uint32 {
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for _, c := range name {
+		v := int32(int8(c))
+		if unsigned {
+			v = int32(c)
+		}
+		hash := hash1 + (hash0 ^ uint32(v*7152373))
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1, hash0 = hash0, hash
+	}
+	return hash0 << 1
+}
+
+func str2hashbuf(p []byte, num int, unsigned bool) []uint32 {
+	out := make([]uint32, 0, num)
+	pad := uint32(len(p)) | uint32(len(p))<<8
+	pad |= pad << 16
+	val := pad
+	n := len(p)
+	if n > num*4 {
+		n = num * 4
+	}
+	for i := 0; i < n; i++ {
+		c := int32(int8(p[i]))
+		if unsigned {
+			c = int32(p[i])
+		}
+		val = uint32(c) + val<<8
+		if i%4 == 3 {
+			out = append(out, val)
+			val = pad
+			num--
+		}
+	}
+	if num--; num >= 0 {
+		out = append(out, val)
+	}
+	for num--; num >= 0; num-- {
+		out = append(out, pad)
+	}
+	return out
+}
+
+func rol32(v uint32, s uint) uint32 {
+	return v<<s | v>>(32-s)
+}
+
+func halfMD4(buf *[4]uint32, in []uint32) {
+	const (
+		k2 = 0x5A827999
+		k3 = 0x6ED9EBA1
+	)
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+	rounds := []struct {
+		fn   func(x, y, z uint32) uint32
+		k    uint32
+		idx  [8]int
+		bits [4]uint
+	}{
+		{f, 0, [8]int{0, 1, 2, 3, 4, 5, 6, 7}, [4]uint{3, 7, 11, 19}},
+		{g, k2, [8]int{1, 3, 5, 7, 0, 2, 4, 6}, [4]uint{3, 5, 9, 13}},
+		{h, k3, [8]int{3, 7, 2, 6, 1, 5, 0, 4}, [4]uint{3, 9, 11, 15}},
+	}
+	for _, r := range rounds {
+		for i := 0; i < 8; i += 4 {
+			a = rol32(a+r.fn(b, c, d)+in[r.idx[i]]+r.k, r.bits[0])
+			d = rol32(d+r.fn(a, b, c)+in[r.idx[i+1]]+r.k, r.bits[1])
+			c = rol32(c+r.fn(d, a, b)+in[r.idx[i+2]]+r.k, r.bits[2])
+			b = rol32(b+r.fn(c, d, a)+in[r.idx[i+3]]+r.k, r.bits[3])
+		}
+	}
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+func tea(buf *[4]uint32, in []uint32) {
+	var sum uint32
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+	for n := 0; n < 16; n++ {
+		sum += 0x9E3779B9
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+	buf[0] += b0
+	buf[1] += b1
+}
@@ -0,0 +1,854 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT directory entry attributes
+const (
+	fatAttrReadOnly = 0x01
+	fatAttrHidden   = 0x02
+	fatAttrSystem   = 0x04
+	fatAttrVolumeID = 0x08
+	fatAttrDir      = 0x10
+	fatAttrArchive  = 0x20
+	fatAttrLFN      = 0x0F
+
+	fatEntrySize = 32
+	// fatLowerBase and fatLowerExt are NT flags used to keep lowercase 8.3 names without LFN entries
+	fatLowerBase = 0x08
+	fatLowerExt  = 0x10
+)
+
+// fat is a FAT12, FAT16 or FAT32 filesystem
+type fat struct {
+	dev *section
+
+	bits        int
+	sectorSize  int64
+	clusterSize int64
+	fatStart    int64
+	fatSize     int64
+	fats        int
+	rootStart   int64
+	rootSize    int64
+	rootCluster uint32
+	dataStart   int64
+	clusters    uint32
+	fsInfo      int64
+
+	table []uint32
+}
+
+// fatEntry is a parsed directory entry
+type fatEntry struct {
+	name    string
+	short   [11]byte
+	attr    byte
+	cluster uint32
+	size    uint32
+	modTime time.Time
+	// first is a slot of the first LFN entry, slot is the position of the short entry
+	first int
+	slot  int
+}
+
+// fatDir is a loaded directory with the disk offsets of it's clusters
+type fatDir struct {
+	cluster uint32
+	data    []byte
+	chunks  []int64
+	chunk   int64
+}
+
+func openFAT(dev *section) (*fat, error) {
+	bs := make([]byte, 512)
+	if _, err := dev.ReadAt(bs, 0); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xAA || (bs[0] != 0xEB && bs[0] != 0xE9) {
+		return nil, errNoMagic
+	}
+
+	f := &fat{dev: dev}
+	f.sectorSize = int64(binary.LittleEndian.Uint16(bs[11:]))
+	spc := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:]))
+	f.fats = int(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:]))
+	total := int64(binary.LittleEndian.Uint16(bs[19:]))
+	f.fatSize = int64(binary.LittleEndian.Uint16(bs[22:]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+	if f.fatSize == 0 {
+		f.fatSize = int64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+
+	switch f.sectorSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, errNoMagic
+	}
+	if spc == 0 || spc&(spc-1) != 0 || reserved == 0 || f.fats == 0 || f.fatSize == 0 {
+		return nil, errNoMagic
+	}
+
+	f.clusterSize = spc * f.sectorSize
+	f.fatStart = reserved * f.sectorSize
+	f.fatSize *= f.sectorSize
+	f.rootStart = f.fatStart + int64(f.fats)*f.fatSize
+	f.rootSize = rootEntries * fatEntrySize
+	f.rootSize = (f.rootSize + f.sectorSize - 1) / f.sectorSize * f.sectorSize
+	f.dataStart = f.rootStart + f.rootSize
+	if total*f.sectorSize > dev.size || f.dataStart >= total*f.sectorSize {
+		return nil, fmt.Errorf("fat: %s: filesystem is larger than partition", ErrUnsupported)
+	}
+	f.clusters = uint32((total*f.sectorSize - f.dataStart) / f.clusterSize)
+
+	switch {
+	case f.clusters < 4085:
+		f.bits = 12
+	case f.clusters < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+		f.fsInfo = int64(binary.LittleEndian.Uint16(bs[48:])) * f.sectorSize
+	}
+
+	if err := f.loadTable(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Type returns fat12, fat16 or fat32
+func (f *fat) Type() string {
+	return "fat" + strconv.Itoa(f.bits)
+}
+
+func (f *fat) loadTable() error {
+	raw := make([]byte, f.fatSize)
+	if _, err := f.dev.ReadAt(raw, f.fatStart); err != nil {
+		return err
+	}
+	f.table = make([]uint32, f.clusters+2)
+	for c := range f.table {
+		switch f.bits {
+		case 12:
+			v := binary.LittleEndian.Uint16(raw[c*3/2:])
+			if c&1 == 1 {
+				v >>= 4
+			}
+			f.table[c] = uint32(v & 0xFFF)
+		case 16:
+			f.table[c] = uint32(binary.LittleEndian.Uint16(raw[c*2:]))
+		case 32:
+			f.table[c] = binary.LittleEndian.Uint32(raw[c*4:]) & 0x0FFFFFFF
+		}
+	}
+	return nil
+}
+
+// eoc returns end of chain marker
+func (f *fat) eoc() uint32 {
+	switch f.bits {
+	case 12:
+		return 0xFFF
+	case 16:
+		return 0xFFFF
+	}
+	return 0x0FFFFFFF
+}
+
+func (f *fat) isEOC(v uint32) bool {
+	return v >= f.eoc()&^7
+}
+
+// setEntry updates FAT entry in memory and in all FAT copies
+func (f *fat) setEntry(c, v uint32) error {
+	f.table[c] = v
+	for i := 0; i < f.fats; i++ {
+		base := f.fatStart + int64(i)*f.fatSize
+		switch f.bits {
+		case 12:
+			off := base + int64(c)*3/2
+			b := make([]byte, 2)
+			if _, err := f.dev.ReadAt(b, off); err != nil {
+				return err
+			}
+			old := binary.LittleEndian.Uint16(b)
+			if c&1 == 1 {
+				old = old&0x000F | uint16(v)<<4
+			} else {
+				old = old&0xF000 | uint16(v)&0xFFF
+			}
+			binary.LittleEndian.PutUint16(b, old)
+			if _, err := f.dev.WriteAt(b, off); err != nil {
+				return err
+			}
+		case 16:
+			b := make([]byte, 2)
+			binary.LittleEndian.PutUint16(b, uint16(v))
+			if _, err := f.dev.WriteAt(b, base+int64(c)*2); err != nil {
+				return err
+			}
+		case 32:
+			off := base + int64(c)*4
+			b := make([]byte, 4)
+			if _, err := f.dev.ReadAt(b, off); err != nil {
+				return err
+			}
+			// the highest 4 bits are reserved and must be preserved
+			binary.LittleEndian.PutUint32(b, binary.LittleEndian.Uint32(b)&0xF0000000|v&0x0FFFFFFF)
+			if _, err := f.dev.WriteAt(b, off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// chain returns clusters of the chain starting with c
+func (f *fat) chain(c uint32) ([]uint32, error) {
+	var out []uint32
+	for c >= 2 && !f.isEOC(c) {
+		if c >= uint32(len(f.table)) || len(out) > len(f.table) {
+			return nil, fmt.Errorf("fat: broken cluster chain at %d", c)
+		}
+		out = append(out, c)
+		c = f.table[c]
+	}
+	return out, nil
+}
+
+func (f *fat) clusterOffset(c uint32) int64 {
+	return f.dataStart + int64(c-2)*f.clusterSize
+}
+
+// allocate finds n free clusters and links them into a chain
+func (f *fat) allocate(n int) ([]uint32, error) {
+	var out []uint32
+	for c := uint32(2); c < uint32(len(f.table)) && len(out) < n; c++ {
+		if f.table[c] == 0 {
+			out = append(out, c)
+		}
+	}
+	if len(out) < n {
+		return nil, fmt.Errorf("fat: no space left, %d clusters required", n)
+	}
+	for i, c := range out {
+		next := f.eoc()
+		if i+1 < len(out) {
+			next = out[i+1]
+		}
+		if err := f.setEntry(c, next); err != nil {
+			return nil, err
+		}
+	}
+	return out, f.updateFSInfo(-n)
+}
+
+func (f *fat) free(c uint32) error {
+	clusters, err := f.chain(c)
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		if err := f.setEntry(c, 0); err != nil {
+			return err
+		}
+	}
+	return f.updateFSInfo(len(clusters))
+}
+
+// updateFSInfo adjusts FAT32 free clusters counter if it's known
+func (f *fat) updateFSInfo(delta int) error {
+	if f.bits != 32 || f.fsInfo == 0 || delta == 0 {
+		return nil
+	}
+	b := make([]byte, 512)
+	if _, err := f.dev.ReadAt(b, f.fsInfo); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b) != 0x41615252 || binary.LittleEndian.Uint32(b[484:]) != 0x61417272 {
+		return nil
+	}
+	count := binary.LittleEndian.Uint32(b[488:])
+	if count == 0xFFFFFFFF {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(b[488:], uint32(int64(count)+int64(delta)))
+	_, err := f.dev.WriteAt(b[488:492], f.fsInfo+488)
+	return err
+}
+
+// readDir loads directory starting with cluster, 0 is a root directory
+func (f *fat) readDir(cluster uint32) (*fatDir, error) {
+	if cluster == 0 && f.bits == 32 {
+		cluster = f.rootCluster
+	}
+	d := &fatDir{cluster: cluster}
+	if cluster == 0 {
+		d.data = make([]byte, f.rootSize)
+		d.chunks = []int64{f.rootStart}
+		d.chunk = f.rootSize
+		_, err := f.dev.ReadAt(d.data, f.rootStart)
+		return d, err
+	}
+
+	clusters, err := f.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+	d.chunk = f.clusterSize
+	d.data = make([]byte, int64(len(clusters))*f.clusterSize)
+	for i, c := range clusters {
+		off := f.clusterOffset(c)
+		d.chunks = append(d.chunks, off)
+		if _, err := f.dev.ReadAt(d.data[int64(i)*f.clusterSize:int64(i+1)*f.clusterSize], off); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// writeSlots writes directory entries starting with the slot back to the disk
+func (f *fat) writeSlots(d *fatDir, slot, n int) error {
+	for i := slot; i < slot+n; i++ {
+		pos := int64(i) * fatEntrySize
+		if _, err := f.dev.WriteAt(d.data[pos:pos+fatEntrySize], d.chunks[pos/d.chunk]+pos%d.chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries parses directory entries joining long file names
+func (d *fatDir) entries() []*fatEntry {
+	var (
+		out   []*fatEntry
+		lfn   []uint16
+		first = -1
+	)
+	for slot := 0; slot*fatEntrySize < len(d.data); slot++ {
+		e := d.data[slot*fatEntrySize : (slot+1)*fatEntrySize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == 0xE5 {
+			lfn, first = nil, -1
+			continue
+		}
+		if e[11] == fatAttrLFN {
+			if e[0]&0x40 != 0 {
+				lfn, first = nil, slot
+			}
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[i:]))
+				}
+			}
+			lfn = append(part, lfn...)
+			continue
+		}
+		if e[11]&fatAttrVolumeID != 0 {
+			lfn, first = nil, -1
+			continue
+		}
+
+		entry := &fatEntry{attr: e[11], slot: slot, first: slot}
+		copy(entry.short[:], e[:11])
+		entry.cluster = uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+		entry.size = binary.LittleEndian.Uint32(e[28:])
+		entry.modTime = fatTime(binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]))
+		entry.name = shortName(e[:11], e[12])
+		if lfn != nil && first >= 0 {
+			for i, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			entry.name = string(utf16.Decode(lfn))
+			entry.first = first
+		}
+		lfn, first = nil, -1
+		out = append(out, entry)
+	}
+	return out
+}
+
+func (d *fatDir) find(name string) *fatEntry {
+	for _, e := range d.entries() {
+		if strings.EqualFold(e.name, name) || strings.EqualFold(shortName(e.short[:], 0), name) {
+			return e
+		}
+	}
+	return nil
+}
+
+// lookup resolves path into the directory entry, nil entry is returned for the root directory
+func (f *fat) lookup(name string) (*fatDir, *fatEntry, error) {
+	parts := splitPath(name)
+	d, err := f.readDir(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var e *fatEntry
+	for i, p := range parts {
+		if e = d.find(p); e == nil {
+			return d, nil, fmt.Errorf("%s: %s", name, ErrNotFound)
+		}
+		if i == len(parts)-1 {
+			break
+		}
+		if e.attr&fatAttrDir == 0 {
+			return nil, nil, fmt.Errorf("%s: not a directory", p)
+		}
+		if d, err = f.readDir(e.cluster); err != nil {
+			return nil, nil, err
+		}
+	}
+	return d, e, nil
+}
+
+// ReadFile returns content of the file
+func (f *fat) ReadFile(name string) ([]byte, error) {
+	_, e, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.attr&fatAttrDir != 0 {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+
+	clusters, err := f.chain(e.cluster)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(clusters))*f.clusterSize < int64(e.size) {
+		return nil, fmt.Errorf("%s: cluster chain is shorter than file size", name)
+	}
+	data := make([]byte, e.size)
+	for i, c := range clusters {
+		start := int64(i) * f.clusterSize
+		if start >= int64(e.size) {
+			break
+		}
+		end := start + f.clusterSize
+		if end > int64(e.size) {
+			end = int64(e.size)
+		}
+		if _, err := f.dev.ReadAt(data[start:end], f.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// ReadDir lists directory
+func (f *fat) ReadDir(name string) ([]os.FileInfo, error) {
+	d, e, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		if e.attr&fatAttrDir == 0 {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+		if d, err = f.readDir(e.cluster); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []os.FileInfo
+	for _, e := range d.entries() {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		fi := &fileInfo{name: e.name, size: int64(e.size), mode: 0755, modTime: e.modTime}
+		if e.attr&fatAttrDir != 0 {
+			fi.mode |= os.ModeDir
+		} else if e.attr&fatAttrReadOnly != 0 {
+			fi.mode = 0444
+		}
+		out = append(out, fi)
+	}
+	return out, nil
+}
+
+// WriteFile replaces the file content or creates a new file
+func (f *fat) WriteFile(name string, data []byte, perm os.FileMode) error {
+	parent, base, err := f.parent(name)
+	if err != nil {
+		return err
+	}
+
+	n := (int64(len(data)) + f.clusterSize - 1) / f.clusterSize
+	clusters, err := f.allocate(int(n))
+	if err != nil {
+		return err
+	}
+	for i, c := range clusters {
+		buf := make([]byte, f.clusterSize)
+		copy(buf, data[int64(i)*f.clusterSize:])
+		if _, err := f.dev.WriteAt(buf, f.clusterOffset(c)); err != nil {
+			return err
+		}
+	}
+	first := uint32(0)
+	if len(clusters) > 0 {
+		first = clusters[0]
+	}
+
+	attr := byte(fatAttrArchive)
+	if perm&0200 == 0 {
+		attr |= fatAttrReadOnly
+	}
+
+	if e := parent.find(base); e != nil {
+		if e.attr&fatAttrDir != 0 {
+			return fmt.Errorf("%s: is a directory", name)
+		}
+		if err := f.free(e.cluster); err != nil {
+			return err
+		}
+		f.setEntry32(parent, e.slot, first, uint32(len(data)), attr)
+		return f.writeSlots(parent, e.slot, 1)
+	}
+
+	return f.createEntry(parent, base, attr, first, uint32(len(data)))
+}
+
+// Mkdir creates a new directory
+func (f *fat) Mkdir(name string, perm os.FileMode) error {
+	parent, base, err := f.parent(name)
+	if err != nil {
+		return err
+	}
+	if parent.find(base) != nil {
+		return fmt.Errorf("%s: %s", name, os.ErrExist)
+	}
+
+	clusters, err := f.allocate(1)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, f.clusterSize)
+	parentCluster := parent.cluster
+	if parentCluster == f.rootCluster {
+		parentCluster = 0
+	}
+	for i, n := range []string{".", ".."} {
+		e := buf[i*fatEntrySize : (i+1)*fatEntrySize]
+		copy(e, []byte(fmt.Sprintf("%-11s", n)))
+		c := clusters[0]
+		if n == ".." {
+			c = parentCluster
+		}
+		fillEntry(e, fatAttrDir, c, 0)
+	}
+	if _, err := f.dev.WriteAt(buf, f.clusterOffset(clusters[0])); err != nil {
+		return err
+	}
+
+	return f.createEntry(parent, base, fatAttrDir, clusters[0], 0)
+}
+
+// parent loads parent directory of the path and returns the base name
+func (f *fat) parent(name string) (*fatDir, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return nil, "", fmt.Errorf("%s: invalid file name", name)
+	}
+	base := parts[len(parts)-1]
+	if len(base) > 255 || strings.ContainsAny(base, `"*/:<>?\|`) {
+		return nil, "", fmt.Errorf("%s: invalid file name", name)
+	}
+
+	dir := "/" + strings.Join(parts[:len(parts)-1], "/")
+	d, e, err := f.lookup(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if e != nil {
+		if e.attr&fatAttrDir == 0 {
+			return nil, "", fmt.Errorf("%s: not a directory", dir)
+		}
+		if d, err = f.readDir(e.cluster); err != nil {
+			return nil, "", err
+		}
+	}
+	return d, base, nil
+}
+
+// setEntry32 updates cluster, size and modification time of the short entry
+func (f *fat) setEntry32(d *fatDir, slot int, cluster, size uint32, attr byte) {
+	e := d.data[slot*fatEntrySize : (slot+1)*fatEntrySize]
+	e[11] = e[11]&^(fatAttrReadOnly|fatAttrArchive) | attr
+	fillEntry(e, e[11], cluster, size)
+}
+
+// fillEntry sets attributes, cluster, size and timestamps of the short entry
+func fillEntry(e []byte, attr byte, cluster, size uint32) {
+	date, tm := dosTime(time.Now())
+	e[11] = attr
+	binary.LittleEndian.PutUint16(e[14:], tm)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], tm)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+}
+
+// createEntry adds short and long file name entries into the directory
+func (f *fat) createEntry(d *fatDir, name string, attr byte, cluster, size uint32) error {
+	existing := make(map[string]bool)
+	for _, e := range d.entries() {
+		existing[string(e.short[:])] = true
+	}
+	short, ntres, lfn := makeShortName(name, existing)
+
+	var slots [][]byte
+	if lfn {
+		u := utf16.Encode([]rune(name))
+		u = append(u, 0)
+		for len(u)%13 != 0 {
+			u = append(u, 0xFFFF)
+		}
+		sum := lfnChecksum(short[:])
+		count := len(u) / 13
+		for ord := count; ord >= 1; ord-- {
+			e := make([]byte, fatEntrySize)
+			e[0] = byte(ord)
+			if ord == count {
+				e[0] |= 0x40
+			}
+			e[11] = fatAttrLFN
+			e[13] = sum
+			chars := u[(ord-1)*13 : ord*13]
+			k := 0
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					binary.LittleEndian.PutUint16(e[i:], chars[k])
+					k++
+				}
+			}
+			slots = append(slots, e)
+		}
+	}
+	e := make([]byte, fatEntrySize)
+	copy(e, short[:])
+	e[12] = ntres
+	fillEntry(e, attr, cluster, size)
+	slots = append(slots, e)
+
+	slot, err := f.freeSlots(d, len(slots))
+	if err != nil {
+		return err
+	}
+	for i, s := range slots {
+		copy(d.data[(slot+i)*fatEntrySize:], s)
+	}
+	n := len(slots)
+	// keep end of directory marker after new entries
+	if end := (slot + n) * fatEntrySize; end < len(d.data) && d.data[end] != 0 && d.data[end] != 0xE5 && f.endOfDir(d, slot) {
+		d.data[end] = 0
+		n++
+	}
+	return f.writeSlots(d, slot, n)
+}
+
+// endOfDir checks whether the slot was at or after the end of directory marker
+func (f *fat) endOfDir(d *fatDir, slot int) bool {
+	for i := 0; i < slot; i++ {
+		if d.data[i*fatEntrySize] == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// freeSlots finds n consecutive free directory slots extending the directory if needed
+func (f *fat) freeSlots(d *fatDir, n int) (int, error) {
+	run := 0
+	total := len(d.data) / fatEntrySize
+	for slot := 0; slot < total; slot++ {
+		b := d.data[slot*fatEntrySize]
+		if b == 0 {
+			// everything after the end marker is free
+			if total-slot >= n {
+				return slot, nil
+			}
+			run = total - slot
+			break
+		}
+		if b == 0xE5 {
+			run++
+			if run == n {
+				return slot - n + 1, nil
+			}
+			continue
+		}
+		run = 0
+	}
+
+	if d.cluster == 0 {
+		return 0, fmt.Errorf("fat: root directory is full")
+	}
+	// extend directory with zeroed clusters
+	need := int64(n-run)*fatEntrySize + f.clusterSize - 1
+	clusters, err := f.allocate(int(need / f.clusterSize))
+	if err != nil {
+		return 0, err
+	}
+	last, err := f.chain(d.cluster)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.setEntry(last[len(last)-1], clusters[0]); err != nil {
+		return 0, err
+	}
+	for _, c := range clusters {
+		off := f.clusterOffset(c)
+		if _, err := f.dev.WriteAt(make([]byte, f.clusterSize), off); err != nil {
+			return 0, err
+		}
+		d.chunks = append(d.chunks, off)
+		d.data = append(d.data, make([]byte, f.clusterSize)...)
+	}
+	return total - run, nil
+}
+
+// makeShortName returns 8.3 name, NT case flags and whether long name entries are required
+func makeShortName(name string, existing map[string]bool) ([11]byte, byte, bool) {
+	var short [11]byte
+	for i := range short {
+		short[i] = ' '
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+
+	if len(base) <= 8 && len(ext) <= 3 && validShort(base) && validShort(ext) {
+		var ntres byte
+		caseOK := true
+		for _, p := range []struct {
+			s    string
+			flag byte
+		}{{base, fatLowerBase}, {ext, fatLowerExt}} {
+			switch {
+			case p.s == strings.ToUpper(p.s):
+			case p.s == strings.ToLower(p.s):
+				ntres |= p.flag
+			default:
+				caseOK = false
+			}
+		}
+		copy(short[:8], strings.ToUpper(base))
+		copy(short[8:], strings.ToUpper(ext))
+		if caseOK && !existing[string(short[:])] {
+			return short, ntres, false
+		}
+	}
+
+	clean := func(s string, max int) string {
+		out := ""
+		for _, r := range strings.ToUpper(s) {
+			if len(out) == max {
+				break
+			}
+			switch {
+			case r == ' ' || r == '.':
+			case r > 0x7F || !validShort(string(r)):
+				out += "_"
+			default:
+				out += string(r)
+			}
+		}
+		return out
+	}
+	b := clean(strings.TrimLeft(base, "."), 8)
+	e := clean(ext, 3)
+	for i := 1; i < 1000000; i++ {
+		tail := "~" + strconv.Itoa(i)
+		nb := b
+		if len(nb)+len(tail) > 8 {
+			nb = nb[:8-len(tail)]
+		}
+		for j := range short {
+			short[j] = ' '
+		}
+		copy(short[:8], nb+tail)
+		copy(short[8:], e)
+		if !existing[string(short[:])] {
+			break
+		}
+	}
+	return short, 0, true
+}
+
+func validShort(s string) bool {
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("!#$%&'()-@^_`{}~", r) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func lfnChecksum(short []byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// shortName formats 8.3 name applying NT lowercase flags
+func shortName(raw []byte, ntres byte) string {
+	base := string(bytes.TrimRight(raw[:8], " "))
+	ext := string(bytes.TrimRight(raw[8:11], " "))
+	if len(base) > 0 && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+	if ntres&fatLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if ntres&fatLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func dosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+func fatTime(date, tm uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
@@ -0,0 +1,65 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hostsToken matches names and addresses of /etc/hosts entries
+var hostsToken = regexp.MustCompile(`\S+`)
+
+// ExpandHostname replaces {n} of the hostname template with the number
+func ExpandHostname(template string, n int) string {
+	return strings.Replace(template, "{n}", strconv.Itoa(n), -1)
+}
+
+// SetHostname writes the hostname into /etc/hostname of the root partition and replaces
+// the old one on 127.0.1.1 line of /etc/hosts
+func SetHostname(img *Image, hostname string) error {
+	fs, _, err := img.Find("/etc/hostname")
+	if err != nil {
+		return fmt.Errorf("cannot set hostname: %s", err)
+	}
+	data, err := fs.ReadFile("/etc/hostname")
+	if err != nil {
+		return err
+	}
+	if err := fs.WriteFile("/etc/hostname", []byte(hostname+"\n"), 0644); err != nil {
+		return err
+	}
+
+	old := string(bytes.TrimSpace(data))
+	if old == "" {
+		return nil
+	}
+	hosts, err := fs.ReadFile("/etc/hosts")
+	if err != nil {
+		// images without /etc/hosts resolve the hostname by other means
+		return nil
+	}
+	return fs.WriteFile("/etc/hosts", replaceHosts(hosts, old, hostname), 0644)
+}
+
+// replaceHosts replaces names equal to old on 127.0.1.1 lines, other entries and comments are kept as is
+func replaceHosts(data []byte, old, hostname string) []byte {
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		entry, comment := line, ""
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			entry, comment = line[:j], line[j:]
+		}
+		if f := strings.Fields(entry); len(f) == 0 || f[0] != "127.0.1.1" {
+			continue
+		}
+		lines[i] = hostsToken.ReplaceAllStringFunc(entry, func(s string) string {
+			if s == old {
+				return hostname
+			}
+			return s
+		}) + comment
+	}
+	return []byte(strings.Join(lines, ""))
+}
@@ -0,0 +1,331 @@
+// Package image reads and writes files inside of raw disk images without mounting them.
+// It parses MBR and GPT partition tables and supports FAT12/16/32 and ext2/3/4 filesystems.
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SectorSize is a logical sector size of the partition table
+const SectorSize = 512
+
+var (
+	// ErrNotFound is returned when the file doesn't exist inside of the image
+	ErrNotFound = errors.New("file not found")
+	// ErrUnsupported is returned when the filesystem uses features which can't be handled safely
+	ErrUnsupported = errors.New("unsupported filesystem")
+)
+
+// FileSystem is a filesystem inside of the image partition
+type FileSystem interface {
+	// Type returns filesystem type like fat32 or ext4
+	Type() string
+	ReadFile(name string) ([]byte, error)
+	// WriteFile creates or replaces the file, parent directory must exist
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+}
+
+// Partition is an entry of the MBR or GPT partition table
+type Partition struct {
+	Number int
+	// Start and Size are in bytes
+	Start int64
+	Size  int64
+	// Type is MBR partition type like 0x0c or GPT partition type GUID
+	Type string
+	// Name is GPT partition name
+	Name string
+}
+
+// String returns human readable partition description
+func (p Partition) String() string {
+	return fmt.Sprintf("%d: %s start=%d size=%d %s", p.Number, p.Type, p.Start, p.Size, p.Name)
+}
+
+// Image is a raw disk image file
+type Image struct {
+	Partitions []Partition
+	// Scheme is either mbr or gpt
+	Scheme string
+
+	f storage
+}
+
+// storage is a backing store of the image, either a file or an overlay
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Open opens image file for reading and writing and parses it's partition table
+func Open(name string) (*Image, error) {
+	return open(name, os.O_RDWR)
+}
+
+// OpenReadOnly opens image file for reading only
+func OpenReadOnly(name string) (*Image, error) {
+	return open(name, os.O_RDONLY)
+}
+
+func open(name string, flag int) (*Image, error) {
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := newImage(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.WithField("image", name).WithField("scheme", img.Scheme).Debugf("partitions: %v", img.Partitions)
+	return img, nil
+}
+
+func newImage(s storage) (*Image, error) {
+	img := &Image{f: s}
+	if err := img.readPartitions(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Close closes image file
+func (img *Image) Close() error {
+	return img.f.Close()
+}
+
+// Partition returns partition by it's number starting from 1
+func (img *Image) Partition(n int) (*Partition, error) {
+	for i := range img.Partitions {
+		if img.Partitions[i].Number == n {
+			return &img.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("partition %d not found", n)
+}
+
+// FileSystem detects and opens filesystem of the partition
+func (img *Image) FileSystem(p *Partition) (FileSystem, error) {
+	s := &section{img.f, p.Start, p.Size}
+	if fs, err := openExt(s); err == nil {
+		return fs, nil
+	} else if err != errNoMagic {
+		return nil, err
+	}
+	if fs, err := openFAT(s); err == nil {
+		return fs, nil
+	} else if err != errNoMagic {
+		return nil, err
+	}
+	return nil, fmt.Errorf("partition %d: %s", p.Number, ErrUnsupported)
+}
+
+// Find returns the first filesystem which contains the file, it is used to find boot and root partitions
+func (img *Image) Find(name string) (FileSystem, *Partition, error) {
+	for i := range img.Partitions {
+		fs, err := img.FileSystem(&img.Partitions[i])
+		if err != nil {
+			log.WithField("partition", img.Partitions[i].Number).Debug(err)
+			continue
+		}
+		if _, err := fs.ReadFile(name); err == nil {
+			return fs, &img.Partitions[i], nil
+		}
+		if _, err := fs.ReadDir(name); err == nil {
+			return fs, &img.Partitions[i], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s: %s", name, ErrNotFound)
+}
+
+// errNoMagic is returned when partition doesn't contain the filesystem of the probed type
+var errNoMagic = errors.New("filesystem magic not found")
+
+func (img *Image) readPartitions() error {
+	mbr := make([]byte, SectorSize)
+	if _, err := img.f.ReadAt(mbr, 0); err != nil {
+		return fmt.Errorf("cannot read partition table: %s", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return errors.New("partition table not found")
+	}
+
+	img.Scheme = "mbr"
+	for i := 0; i < 4; i++ {
+		e := mbr[446+16*i : 446+16*(i+1)]
+		typ := e[4]
+		if typ == 0xEE {
+			img.Scheme = "gpt"
+			img.Partitions = nil
+			return img.readGPT()
+		}
+		start := int64(binary.LittleEndian.Uint32(e[8:]))
+		size := int64(binary.LittleEndian.Uint32(e[12:]))
+		if typ == 0 || size == 0 {
+			continue
+		}
+		if typ == 0x05 || typ == 0x0F || typ == 0x85 {
+			if err := img.readExtended(start); err != nil {
+				return err
+			}
+			continue
+		}
+		img.Partitions = append(img.Partitions, Partition{
+			Number: i + 1,
+			Start:  start * SectorSize,
+			Size:   size * SectorSize,
+			Type:   fmt.Sprintf("0x%02x", typ),
+		})
+	}
+	return nil
+}
+
+// readExtended follows the chain of extended boot records, logical partitions are numbered from 5
+func (img *Image) readExtended(base int64) error {
+	ebr := make([]byte, SectorSize)
+	next := int64(0)
+	for n := 5; n < 128; n++ {
+		if _, err := img.f.ReadAt(ebr, (base+next)*SectorSize); err != nil {
+			return fmt.Errorf("cannot read extended partition: %s", err)
+		}
+		if ebr[510] != 0x55 || ebr[511] != 0xAA {
+			return errors.New("invalid extended boot record")
+		}
+		if typ := ebr[446+4]; typ != 0 {
+			img.Partitions = append(img.Partitions, Partition{
+				Number: n,
+				Start:  (base + next + int64(binary.LittleEndian.Uint32(ebr[446+8:]))) * SectorSize,
+				Size:   int64(binary.LittleEndian.Uint32(ebr[446+12:])) * SectorSize,
+				Type:   fmt.Sprintf("0x%02x", typ),
+			})
+		}
+		link := ebr[446+16:]
+		if link[4] == 0 {
+			return nil
+		}
+		next = int64(binary.LittleEndian.Uint32(link[8:]))
+	}
+	return errors.New("too many logical partitions")
+}
+
+func (img *Image) readGPT() error {
+	hdr := make([]byte, SectorSize)
+	if _, err := img.f.ReadAt(hdr, SectorSize); err != nil {
+		return fmt.Errorf("cannot read GPT header: %s", err)
+	}
+	if string(hdr[:8]) != "EFI PART" {
+		return errors.New("GPT header not found")
+	}
+
+	lba := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	count := int(binary.LittleEndian.Uint32(hdr[80:]))
+	size := int(binary.LittleEndian.Uint32(hdr[84:]))
+	if size < 128 || count > 1024 {
+		return fmt.Errorf("invalid GPT entries: %d of %d bytes", count, size)
+	}
+
+	entries := make([]byte, count*size)
+	if _, err := img.f.ReadAt(entries, lba*SectorSize); err != nil {
+		return fmt.Errorf("cannot read GPT entries: %s", err)
+	}
+
+	for i := 0; i < count; i++ {
+		e := entries[i*size : (i+1)*size]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		img.Partitions = append(img.Partitions, Partition{
+			Number: i + 1,
+			Start:  first * SectorSize,
+			Size:   (last - first + 1) * SectorSize,
+			Type:   guid(e[:16]),
+			Name:   utf16String(e[56:128]),
+		})
+	}
+	return nil
+}
+
+// guid formats mixed-endian GUID bytes
+func guid(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// utf16String decodes zero terminated UTF-16LE string
+func utf16String(b []byte) string {
+	var u []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// section is a partition region of the image file
+type section struct {
+	f     storage
+	start int64
+	size  int64
+}
+
+func (s *section) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.size {
+		return 0, fmt.Errorf("read at %d is out of partition bounds", off)
+	}
+	n, err := s.f.ReadAt(p, s.start+off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *section) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.size {
+		return 0, fmt.Errorf("write at %d is out of partition bounds", off)
+	}
+	return s.f.WriteAt(p, s.start+off)
+}
+
+// splitPath returns cleaned path elements
+func splitPath(name string) []string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// fileInfo implements os.FileInfo for image files
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,364 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testImage unpacks fixture into the temporary file
+func testImage(t *testing.T, name string) string {
+	f, err := os.Open(filepath.Join("testdata", name+".gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.TempFile("", "iotit-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		t.Fatal(err)
+	}
+	return out.Name()
+}
+
+// fsck runs e2fsck in read-only mode on the partition when it's available
+func fsck(t *testing.T, name string, p *Partition) {
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Log("e2fsck not found, skipping consistency check")
+		return
+	}
+	src, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "iotit-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, io.NewSectionReader(src, p.Start, p.Size)); err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+
+	out, err := exec.Command("e2fsck", "-fn", dst.Name()).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+func TestPartitions(t *testing.T) {
+	assert := assert.New(t)
+	name := testImage(t, "disk.img")
+	defer os.Remove(name)
+
+	img, err := OpenReadOnly(name)
+	assert.NoError(err)
+	defer img.Close()
+	assert.Equal("mbr", img.Scheme)
+	if assert.Len(img.Partitions, 3) {
+		assert.Equal([]int{1, 2, 5}, []int{img.Partitions[0].Number, img.Partitions[1].Number, img.Partitions[2].Number})
+		assert.Equal("0x0e", img.Partitions[0].Type)
+		assert.Equal(int64(1024*1024), img.Partitions[0].Start)
+	}
+
+	types := []string{"fat16", "ext4", "ext2"}
+	for i, typ := range types {
+		fs, err := img.FileSystem(&img.Partitions[i])
+		if assert.NoError(err) {
+			assert.Equal(typ, fs.Type())
+		}
+	}
+
+	gpt := testImage(t, "gpt.img")
+	defer os.Remove(gpt)
+	img, err = OpenReadOnly(gpt)
+	assert.NoError(err)
+	defer img.Close()
+	assert.Equal("gpt", img.Scheme)
+	if assert.Len(img.Partitions, 1) {
+		assert.Equal("C12A7328-F81F-11D2-BA4B-00A0C93EC93B", img.Partitions[0].Type)
+		assert.Equal("boot", img.Partitions[0].Name)
+	}
+}
+
+func TestFAT(t *testing.T) {
+	for _, c := range []struct{ image, typ string }{{"disk.img", "fat16"}, {"gpt.img", "fat32"}} {
+		t.Run(c.typ, func(t *testing.T) {
+			assert := assert.New(t)
+			name := testImage(t, c.image)
+			defer os.Remove(name)
+
+			img, err := Open(name)
+			if !assert.NoError(err) {
+				return
+			}
+			defer img.Close()
+			fs, p, err := img.Find("cmdline.txt")
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(1, p.Number)
+			assert.Equal(c.typ, fs.Type())
+
+			data, err := fs.ReadFile("/cmdline.txt")
+			assert.NoError(err)
+			assert.Contains(string(data), "root=/dev/mmcblk0p2")
+			data, err = fs.ReadFile("config.txt")
+			assert.NoError(err)
+			assert.Equal("dtparam=audio=on\n", string(data))
+			data, err = fs.ReadFile("Kernel Image.bin")
+			assert.NoError(err)
+			assert.Len(data, 256*9)
+
+			_, err = fs.ReadFile("missing.txt")
+			assert.Error(err)
+
+			// replace, create short, long and nested files
+			big := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+			assert.NoError(fs.WriteFile("config.txt", []byte("enable_uart=1\n"), 0644))
+			assert.NoError(fs.WriteFile("ssh", nil, 0644))
+			assert.NoError(fs.WriteFile("wpa_supplicant.conf", big, 0644))
+			assert.NoError(fs.Mkdir("overlays", 0755))
+			for i := 0; i < 40; i++ {
+				assert.NoError(fs.WriteFile(fmt.Sprintf("overlays/overlay-number-%d.dtbo", i), []byte{byte(i)}, 0644))
+			}
+
+			fs, err = img.FileSystem(p)
+			assert.NoError(err)
+			data, err = fs.ReadFile("CONFIG.TXT")
+			assert.NoError(err)
+			assert.Equal("enable_uart=1\n", string(data))
+			data, err = fs.ReadFile("wpa_supplicant.conf")
+			assert.NoError(err)
+			assert.Equal(big, data)
+			data, err = fs.ReadFile("ssh")
+			assert.NoError(err)
+			assert.Empty(data)
+			data, err = fs.ReadFile("overlays/overlay-number-39.dtbo")
+			assert.NoError(err)
+			assert.Equal([]byte{39}, data)
+
+			list, err := fs.ReadDir("overlays")
+			assert.NoError(err)
+			assert.Len(list, 40)
+			list, err = fs.ReadDir("/")
+			assert.NoError(err)
+			names := map[string]bool{}
+			for _, fi := range list {
+				names[fi.Name()] = true
+			}
+			assert.True(names["wpa_supplicant.conf"] && names["overlays"] && names["config.txt"], names)
+		})
+	}
+}
+
+func TestExt(t *testing.T) {
+	for _, n := range []int{2, 5} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			assert := assert.New(t)
+			name := testImage(t, "disk.img")
+			defer os.Remove(name)
+
+			img, err := Open(name)
+			if !assert.NoError(err) {
+				return
+			}
+			p, err := img.Partition(n)
+			assert.NoError(err)
+			fs, err := img.FileSystem(p)
+			if !assert.NoError(err) {
+				return
+			}
+
+			data, err := fs.ReadFile("/etc/hostname")
+			assert.NoError(err)
+			assert.Equal("raspberrypi\n", string(data))
+			data, err = fs.ReadFile("/etc/hostname.link")
+			assert.NoError(err)
+			assert.Equal("raspberrypi\n", string(data))
+			data, err = fs.ReadFile("/home/pi/blob")
+			assert.NoError(err)
+			assert.Len(data, 20000)
+			list, err := fs.ReadDir("/usr/bin")
+			assert.NoError(err)
+			assert.Len(list, 400)
+
+			big := bytes.Repeat([]byte("iotit"), 100000)
+			assert.NoError(fs.WriteFile("/etc/hostname", []byte("node-1\n"), 0644))
+			assert.NoError(fs.WriteFile("/home/pi/blob", big, 0600))
+			assert.NoError(fs.WriteFile("/usr/bin/iotit-tool", []byte("#!/bin/sh\n"), 0755))
+			assert.NoError(fs.Mkdir("/home/pi/.ssh", 0700))
+			assert.NoError(fs.WriteFile("/home/pi/.ssh/authorized_keys", []byte("ssh-ed25519 AAAA\n"), 0600))
+			for i := 0; i < 100; i++ {
+				assert.NoError(fs.WriteFile(fmt.Sprintf("/etc/generated-file-with-long-name-%d.conf", i), []byte{byte(i)}, 0644))
+			}
+			assert.Error(fs.Mkdir("/etc", 0755))
+			assert.Error(fs.WriteFile("/missing/file", nil, 0644))
+			assert.NoError(img.Close())
+
+			img, err = OpenReadOnly(name)
+			assert.NoError(err)
+			defer img.Close()
+			fs, err = img.FileSystem(p)
+			assert.NoError(err)
+			data, err = fs.ReadFile("/etc/hostname.link")
+			assert.NoError(err)
+			assert.Equal("node-1\n", string(data))
+			data, err = fs.ReadFile("/home/pi/blob")
+			assert.NoError(err)
+			assert.Equal(big, data)
+			data, err = fs.ReadFile("/home/pi/.ssh/authorized_keys")
+			assert.NoError(err)
+			assert.Equal("ssh-ed25519 AAAA\n", string(data))
+			data, err = fs.ReadFile("/etc/generated-file-with-long-name-99.conf")
+			assert.NoError(err)
+			assert.Equal([]byte{99}, data)
+			list, err = fs.ReadDir("/usr/bin")
+			assert.NoError(err)
+			assert.Len(list, 401)
+
+			fsck(t, name, p)
+		})
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	assert := assert.New(t)
+	name := testImage(t, "disk.img")
+	defer os.Remove(name)
+	base, err := ioutil.ReadFile(name)
+	assert.NoError(err)
+
+	o, err := NewOverlay(name)
+	if !assert.NoError(err) {
+		return
+	}
+	defer o.Close()
+	assert.Equal(int64(len(base)), o.Size())
+
+	img, err := o.Image()
+	if !assert.NoError(err) {
+		return
+	}
+	fs, p, err := img.Find("/etc/hostname")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(2, p.Number)
+	assert.NoError(fs.WriteFile("/etc/hostname", []byte("node-1\n"), 0644))
+	assert.NoError(img.Close())
+
+	// base image is not modified
+	data, err := ioutil.ReadFile(name)
+	assert.NoError(err)
+	assert.True(bytes.Equal(base, data))
+
+	// reader returns modified image
+	data, err = ioutil.ReadAll(o.Reader())
+	assert.NoError(err)
+	assert.Len(data, len(base))
+	assert.NoError(ioutil.WriteFile(name, data, 0644))
+	img, err = OpenReadOnly(name)
+	if !assert.NoError(err) {
+		return
+	}
+	defer img.Close()
+	fs, err = img.FileSystem(p)
+	assert.NoError(err)
+	data, err = fs.ReadFile("/etc/hostname")
+	assert.NoError(err)
+	assert.Equal("node-1\n", string(data))
+	fsck(t, name, p)
+}
+
+func TestExpandHostname(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		template string
+		n        int
+		want     string
+	}{
+		{"node-{n}", 1, "node-1"},
+		{"node-{n}", 12, "node-12"},
+		{"{n}-rack-{n}", 3, "3-rack-3"},
+		{"node", 5, "node"},
+		{"node-{N}", 5, "node-{N}"},
+	} {
+		assert.Equal(c.want, ExpandHostname(c.template, c.n), c.template)
+	}
+}
+
+func TestReplaceHosts(t *testing.T) {
+	for _, c := range []struct{ name, hosts, want string }{
+		{"raspbian", "127.0.0.1\tlocalhost\n::1\t\tlocalhost ip6-localhost\n\n127.0.1.1\traspberrypi\n",
+			"127.0.0.1\tlocalhost\n::1\t\tlocalhost ip6-localhost\n\n127.0.1.1\tnode-1\n"},
+		{"aliases", "127.0.1.1 raspberrypi.local raspberrypi raspberrypi-old\n",
+			"127.0.1.1 raspberrypi.local node-1 raspberrypi-old\n"},
+		{"other addresses", "10.0.0.1 raspberrypi\n127.0.0.1 localhost raspberrypi\n127.0.1.1 raspberrypi",
+			"10.0.0.1 raspberrypi\n127.0.0.1 localhost raspberrypi\n127.0.1.1 node-1"},
+		{"comments", "# 127.0.1.1 raspberrypi\n127.0.1.1 raspberrypi # raspberrypi\n",
+			"# 127.0.1.1 raspberrypi\n127.0.1.1 node-1 # raspberrypi\n"},
+		{"whitespace", "  127.0.1.1 \t raspberrypi\t\traspberrypi \r\n", "  127.0.1.1 \t node-1\t\tnode-1 \r\n"},
+		{"address only", "127.0.1.1\n", "127.0.1.1\n"},
+		{"empty", "", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, string(replaceHosts([]byte(c.hosts), "raspberrypi", "node-1")))
+		})
+	}
+}
+
+func TestSetHostname(t *testing.T) {
+	assert := assert.New(t)
+	name := testImage(t, "disk.img")
+	defer os.Remove(name)
+
+	img, err := Open(name)
+	if !assert.NoError(err) {
+		return
+	}
+	fs, p, err := img.Find("/etc/hostname")
+	if !assert.NoError(err) {
+		return
+	}
+	// fixture has no /etc/hosts, hostname alone is set
+	assert.NoError(SetHostname(img, "node-1"))
+	_, err = fs.ReadFile("/etc/hosts")
+	assert.Error(err)
+
+	hosts := "127.0.0.1\tlocalhost\n127.0.1.1\tnode-1 node-10\n"
+	assert.NoError(fs.WriteFile("/etc/hosts", []byte(hosts), 0644))
+	assert.NoError(SetHostname(img, "node-2"))
+	assert.NoError(img.Close())
+
+	img, err = OpenReadOnly(name)
+	if !assert.NoError(err) {
+		return
+	}
+	defer img.Close()
+	fs, err = img.FileSystem(p)
+	assert.NoError(err)
+	data, err := fs.ReadFile("/etc/hostname")
+	assert.NoError(err)
+	assert.Equal("node-2\n", string(data))
+	data, err = fs.ReadFile("/etc/hosts")
+	assert.NoError(err)
+	assert.Equal("127.0.0.1\tlocalhost\n127.0.1.1\tnode-2 node-10\n", string(data))
+	fsck(t, name, p)
+}
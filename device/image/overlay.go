@@ -0,0 +1,115 @@
+package image
+
+import (
+	"io"
+	"os"
+)
+
+// overlayBlock is a granularity of the overlay modifications
+const overlayBlock = 4096
+
+// Overlay is a copy-on-write layer over the image file. Modifications are kept in memory,
+// so the same image can be customized differently for every disk without copying it
+type Overlay struct {
+	f      *os.File
+	size   int64
+	blocks map[int64][]byte
+}
+
+// NewOverlay opens image file read-only as a base of the overlay
+func NewOverlay(name string) (*Overlay, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Overlay{f: f, size: fi.Size(), blocks: make(map[int64][]byte)}, nil
+}
+
+// Image parses partitions of the overlay, closing the returned image doesn't close the overlay
+func (o *Overlay) Image() (*Image, error) {
+	return newImage(overlayStorage{o})
+}
+
+// Size returns image size in bytes
+func (o *Overlay) Size() int64 {
+	return o.size
+}
+
+// Reader returns reader of the modified image content
+func (o *Overlay) Reader() io.Reader {
+	return io.NewSectionReader(o, 0, o.size)
+}
+
+// Close closes base image file
+func (o *Overlay) Close() error {
+	return o.f.Close()
+}
+
+// ReadAt reads base image replacing modified blocks
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.f.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for b := off / overlayBlock * overlayBlock; b < off+int64(n); b += overlayBlock {
+		if blk, ok := o.blocks[b]; ok {
+			copyBlock(p[:n], off, blk, b)
+		}
+	}
+	return n, err
+}
+
+// WriteAt stores modification in memory
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > o.size {
+		return 0, io.ErrShortWrite
+	}
+	for b := off / overlayBlock * overlayBlock; b < off+int64(len(p)); b += overlayBlock {
+		blk, ok := o.blocks[b]
+		if !ok {
+			blk = make([]byte, overlayBlock)
+			if _, err := o.f.ReadAt(blk, b); err != nil && err != io.EOF {
+				return 0, err
+			}
+			o.blocks[b] = blk
+		}
+		// copy the part of p which belongs to the block
+		start, end := b, b+overlayBlock
+		if start < off {
+			start = off
+		}
+		if end > off+int64(len(p)) {
+			end = off + int64(len(p))
+		}
+		copy(blk[start-b:end-b], p[start-off:end-off])
+	}
+	return len(p), nil
+}
+
+// copyBlock copies overlapping part of the block at offset b into p read at offset off
+func copyBlock(p []byte, off int64, blk []byte, b int64) {
+	start, end := b, b+int64(len(blk))
+	if start < off {
+		start = off
+	}
+	if end > off+int64(len(p)) {
+		end = off + int64(len(p))
+	}
+	if start < end {
+		copy(p[start-off:end-off], blk[start-b:end-b])
+	}
+}
+
+// overlayStorage doesn't close the overlay when the image is closed
+type overlayStorage struct {
+	*Overlay
+}
+
+func (overlayStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/xshellinc/iotit/workstation"
+	"github.com/xshellinc/tools/dialogs"
+)
+
+// chips of USB serial adapters used by the boards, other ports are offered only if none of these is connected
+var (
+	espChips     = []string{workstation.ChipCP210x, workstation.ChipCH340, workstation.ChipFTDI, workstation.ChipEspressif}
+	colibriChips = []string{workstation.ChipFTDI, workstation.ChipToradex}
+)
+
+// errNoPorts is returned when no serial ports are connected
+var errNoPorts = errors.New("no serial ports found")
+
+// selectPort resolves the port name, USB serial number or `auto` into the port name,
+// several connected ports of the preferred chips are offered in a dialog, it's an error in quiet mode
+func selectPort(spec string, chips []string, quiet bool) (string, error) {
+	ports, err := workstation.ListPorts()
+	if err != nil {
+		return "", err
+	}
+	if spec != "" && !strings.EqualFold(spec, "auto") {
+		p, err := workstation.FindPort(ports, spec)
+		if err != nil {
+			return "", err
+		}
+		return p.Name, nil
+	}
+
+	if preferred := workstation.FilterPorts(ports, chips...); len(preferred) > 0 {
+		ports = preferred
+	}
+	switch {
+	case len(ports) == 0:
+		return "", errNoPorts
+	case len(ports) == 1:
+		return ports[0].Name, nil
+	case quiet:
+		// the wrong board could be flashed, so it has to be chosen explicitly
+		names := make([]string, len(ports))
+		for i, p := range ports {
+			names[i] = p.Name
+		}
+		return "", fmt.Errorf("%d serial ports found (%s), choose one with --port", len(ports), strings.Join(names, ", "))
+	}
+
+	names := make([]string, len(ports))
+	for i, p := range ports {
+		names[i] = p.String()
+	}
+	i := dialogs.SelectOneDialog("Select serial port: ", names)
+	return ports[i].Name, nil
+}
+
+// portDescription returns description of the port for messages
+func portDescription(name string) string {
+	ports, err := workstation.ListPorts()
+	if err == nil {
+		for _, p := range ports {
+			if p.Name == name {
+				return p.String()
+			}
+		}
+	}
+	return name
+}
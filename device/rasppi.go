@@ -32,13 +32,20 @@ func (d *raspberryPi) prepare() error {
 // Configure overrides sdFlasher Configure() method with custom config
 func (d *raspberryPi) Configure() error {
 	log.WithField("device", "raspi").Debug("Configure")
+	// workspace is already prepared when the image is detected by sdFlasher
+	if d.ws == nil {
+		if err := d.prepare(); err != nil {
+			return err
+		}
+	}
 
 	job := help.NewBackgroundJob()
-	c := config.NewDefault(d.conf.SSH) // create config with default callbacks
+	c := d.newConfigurator() // create config with default callbacks
 	// replace default interface configuration with custom raspi configurator
 	c.SetConfigFn(config.Interface, config.NewCallbackFn(setInterface, saveInterface))
 	c.AddConfigFn(config.SSH, config.NewCallbackFn(enablePiSSH, nil))
 	c.AddConfigFn(config.Camera, config.NewCallbackFn(enablePiCamera, nil))
+	c.ApplyProfile(d.profile)
 
 	go func() {
 		defer job.Close()
@@ -64,17 +71,17 @@ func (d *raspberryPi) Configure() error {
 			}
 		}
 	} else {
-		if err := touchSSH(d.conf.SSH); err != nil {
+		if err := touchSSH(d.ws); err != nil {
 			fmt.Println("[-] Error:", err.Error())
 		}
 	}
 
 	// write configs that were setup above
-	if err := c.Write(); err != nil {
+	if err := d.writeConfig(c); err != nil {
 		return err
 	}
 
-	if err := d.UnmountImg(); err != nil {
+	if err := d.customizeImage(map[string]string{partRootfs: config.MountDir, partBoot: bootMount}); err != nil {
 		return err
 	}
 
@@ -82,6 +89,10 @@ func (d *raspberryPi) Configure() error {
 		return err
 	}
 
+	if err := d.UnmountImg(); err != nil {
+		return err
+	}
+
 	fmt.Println("[+] Image configured")
 	return nil
 }
@@ -137,9 +148,8 @@ func setInterface(storage map[string]interface{}) error {
 			config.AskInterfaceParams(&i)
 		}
 
-		mask, _ := net.IPMask(net.ParseIP(i.Netmask).To4()).Size()
-
-		storage[config.Interface] = fmt.Sprintf(interfaceConfig, device[num], i.Address+"/"+strconv.Itoa(mask), i.Gateway, i.DNS)
+		i.Name = device[num]
+		storage[config.Interface] = formatInterface(i)
 
 		switch device[num] {
 		case "eth0":
@@ -153,11 +163,26 @@ func setInterface(storage map[string]interface{}) error {
 	return nil
 }
 
+// formatInterface returns dhcpcd.conf configuration of the static interface
+func formatInterface(i config.Interfaces) string {
+	mask, _ := net.IPMask(net.ParseIP(i.Netmask).To4()).Size()
+	return fmt.Sprintf(interfaceConfig, i.Name, i.Address+"/"+strconv.Itoa(mask), i.Gateway, i.DNS)
+}
+
 // saveInterface is a custom method and it saves Interfaces value into /etc/dhcpcd.conf
 func saveInterface(storage map[string]interface{}) error {
 	log.WithField("type", "raspi").Debug("saveInterface")
 
-	if _, ok := storage[config.Interface]; !ok {
+	data := ""
+	if list, ok := storage[config.StaticInterfaces].([]config.Interfaces); ok {
+		for _, i := range list {
+			data += formatInterface(i)
+		}
+	}
+	if s, ok := storage[config.Interface].(string); ok {
+		data += s
+	}
+	if data == "" {
 		return nil
 	}
 
@@ -167,7 +192,7 @@ func saveInterface(storage map[string]interface{}) error {
 	}
 
 	fp := help.AddPathSuffix("unix", config.MountDir, config.IsaaxConfDir, "dhcpcd.conf")
-	command := fmt.Sprintf(`echo "%s" >> %s`, storage[config.Interface], fp)
+	command := fmt.Sprintf(`echo "%s" >> %s`, data, fp)
 	log.WithField("type", "raspi").WithField("command", command).Debug("save interface")
 	_, eut, err := ssh.Run(command)
 	if err != nil {
@@ -219,7 +244,7 @@ gpu_mem=128
 	return nil
 }
 
-// MountBoot is a method to attach image to loop and mount it
+// MountBoot is a method to mount boot partition of the image attached by MountImg
 func (d *raspberryPi) MountBoot() error {
 	log.Debug("Creating tmp folder")
 	if err := d.exec(fmt.Sprintf("mkdir -p %s", bootMount)); err != nil {
@@ -227,7 +252,7 @@ func (d *raspberryPi) MountBoot() error {
 	}
 
 	log.Debug("Mounting boot partition")
-	command := fmt.Sprintf("mount -o rw /dev/loop0p1 %s", bootMount)
+	command := fmt.Sprintf("mount -o rw /dev/%s%s %s", d.loop, raspiBoot, bootMount)
 	log.WithField("cmd", command).Debug("Mounting boot folder")
 	if err := d.exec(command); err != nil {
 		return err
@@ -235,24 +260,15 @@ func (d *raspberryPi) MountBoot() error {
 	return nil
 }
 
-// UnmountBoot is a method to unlink image folder and detach image from the loop
+// UnmountBoot is a method to unlink boot folder, image is detached from the loop by UnmountImg
 func (d *raspberryPi) UnmountBoot() error {
 	log.Debug("Unlinking boot folder")
 	command := fmt.Sprintf("umount %s", bootMount)
-	if err := d.exec(command); err != nil {
-		return err
-	}
-
-	log.Debug("Detaching image")
-	command = "losetup -D" // -D detaches all loop devices
-	if err := d.exec(command); err != nil {
-		return err
-	}
-	return nil
+	return d.exec(command)
 }
 
 func (d *raspberryPi) exec(command string) error {
-	if out, eut, err := d.conf.SSH.Run(command); err != nil {
+	if out, eut, err := d.ws.Run(command); err != nil {
 		log.Error("[-] Error executing: ", command, eut)
 		return err
 	} else if strings.TrimSpace(out) != "" {
@@ -0,0 +1,233 @@
+package recipe
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/xshellinc/iotit/device/config"
+)
+
+// Image partitions which overlays are copied into
+const (
+	PartRootfs = "rootfs"
+	PartBoot   = "boot"
+)
+
+// OverlayManifest is a file in the overlay root setting owners and modes of the paths, it isn't copied.
+// Each line is `path uid:gid [mode]`, e.g. `/home/pi/.ssh 1000:1000 0700`
+const OverlayManifest = "overlay.manifest"
+
+// templateSuffix marks files rendered with text/template, the suffix is removed in the image
+const templateSuffix = ".tmpl"
+
+// Overlay is a host folder copied into the image partition
+type Overlay struct {
+	Partition string
+	Dir       string
+}
+
+// Vars are values of the device available in the overlay templates, e.g. {{.Hostname}}
+type Vars struct {
+	Device     string
+	Image      string
+	Hostname   string
+	IP         string
+	SSID       string
+	Interfaces map[string]config.Interfaces
+}
+
+// owner of the path set by the overlay manifest
+type owner struct {
+	uid, gid int
+	mode     int64
+}
+
+// ParseOverlay parses `partition=dir` overlay option
+func ParseOverlay(s string) (Overlay, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return Overlay{}, fmt.Errorf("invalid overlay %q, it's %s=dir or %s=dir", s, PartRootfs, PartBoot)
+	}
+	o := Overlay{Partition: s[:i], Dir: s[i+1:]}
+	return o, o.Validate()
+}
+
+// Validate checks the partition name and the folder
+func (o Overlay) Validate() error {
+	if o.Partition != PartRootfs && o.Partition != PartBoot {
+		return fmt.Errorf("unknown overlay partition %q, use %s or %s", o.Partition, PartRootfs, PartBoot)
+	}
+	fi, err := os.Stat(o.Dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("overlay %s isn't a folder", o.Dir)
+	}
+	return nil
+}
+
+// OverlayTar writes the folder into the tar archive keeping modes and symlinks, files are owned by root
+// unless the overlay manifest sets owners. Folders are archived only if the manifest lists them,
+// others are created by tar with default modes. Templates are rendered with vars
+func OverlayTar(w io.Writer, dir string, vars *Vars) error {
+	owners, err := readOverlayManifest(filepath.Join(dir, OverlayManifest))
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	entries, err := sortedDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range entries {
+		if n == OverlayManifest {
+			continue
+		}
+		if err := addOverlay(tw, filepath.Join(dir, n), n, owners, vars); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addOverlay(tw *tar.Writer, src, name string, owners map[string]owner, vars *Vars) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	isTemplate := fi.Mode().IsRegular() && strings.HasSuffix(name, templateSuffix)
+	if isTemplate {
+		name = strings.TrimSuffix(name, templateSuffix)
+	}
+
+	h := &tar.Header{Name: name, Mode: int64(fi.Mode() & os.ModePerm), ModTime: epoch}
+	o, hasOwner := owners["/"+name]
+	if hasOwner {
+		h.Uid, h.Gid = o.uid, o.gid
+		if o.mode >= 0 {
+			h.Mode = o.mode
+		}
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		if h.Linkname, err = os.Readlink(src); err != nil {
+			return err
+		}
+		h.Typeflag = tar.TypeSymlink
+		return tw.WriteHeader(h)
+	case fi.IsDir():
+		// folders existing in the image like /etc keep their modes unless the manifest sets them
+		if hasOwner {
+			h.Typeflag = tar.TypeDir
+			h.Name += "/"
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+		}
+		entries, err := sortedDir(src)
+		if err != nil {
+			return err
+		}
+		for _, n := range entries {
+			if err := addOverlay(tw, filepath.Join(src, n), path.Join(name, n), owners, vars); err != nil {
+				return err
+			}
+		}
+		return nil
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s: only files, folders and symlinks can be copied", src)
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if isTemplate {
+		t, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, vars); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	h.Typeflag = tar.TypeReg
+	h.Size = int64(len(data))
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// readOverlayManifest reads owners and modes of the paths, the manifest is optional
+func readOverlayManifest(file string) (map[string]owner, error) {
+	owners := make(map[string]owner)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return owners, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected `path uid:gid [mode]`", OverlayManifest, n)
+		}
+		o := owner{mode: -1}
+		ids := strings.SplitN(fields[1], ":", 2)
+		if o.uid, err = strconv.Atoi(ids[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid uid %q", OverlayManifest, n, ids[0])
+		}
+		o.gid = o.uid
+		if len(ids) == 2 {
+			if o.gid, err = strconv.Atoi(ids[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid gid %q", OverlayManifest, n, ids[1])
+			}
+		}
+		if len(fields) == 3 {
+			m, err := strconv.ParseUint(fields[2], 8, 32)
+			if err != nil || m > 07777 {
+				return nil, fmt.Errorf("%s:%d: invalid mode %q", OverlayManifest, n, fields[2])
+			}
+			o.mode = int64(m)
+		}
+		owners[path.Clean("/"+fields[0])] = o
+	}
+	return owners, s.Err()
+}
+
+func sortedDir(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,277 @@
+// Package recipe reads reproducible image build recipes: a base image of mapping.json
+// and ordered configuration, file and shell steps applied to it
+package recipe
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xshellinc/iotit/device/config"
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Recipe describes how the image is built
+	Recipe struct {
+		Device    string `yaml:"device"`
+		Image     string `yaml:"image"`
+		Workspace string `yaml:"workspace,omitempty"`
+		// Output is the image file, .gz, .xz or .zst suffix compresses it
+		Output string `yaml:"output"`
+		Steps  []Step `yaml:"steps"`
+
+		// Dir is the recipe folder, relative paths are resolved against it
+		Dir string `yaml:"-"`
+		// Hash is sha256 of the recipe and the host files it refers to
+		Hash string `yaml:"-"`
+	}
+
+	// Step is one of configuration values, files or overlay folders copied into the image or shell script run in the image
+	Step struct {
+		Name   string          `yaml:"name,omitempty"`
+		Config *config.Profile `yaml:"config,omitempty"`
+		Files  []File          `yaml:"files,omitempty"`
+		// Overlay maps partitions to host folders
+		Overlay map[string]string `yaml:"overlay,omitempty"`
+		Run     string            `yaml:"run,omitempty"`
+	}
+
+	// File is written to the image root partition with the content or copied from the host file or folder
+	File struct {
+		Path    string `yaml:"path"`
+		Content string `yaml:"content,omitempty"`
+		Src     string `yaml:"src,omitempty"`
+		// Mode is an octal permission string like "0755"
+		Mode string `yaml:"mode,omitempty"`
+	}
+)
+
+// Load reads and validates the recipe
+func Load(path string) (*Recipe, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recipe{}
+	if err := yaml.UnmarshalStrict(data, r); err != nil {
+		return nil, fmt.Errorf("cannot parse recipe %s: %s", path, err)
+	}
+	if r.Dir, err = filepath.Abs(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	for i, s := range r.Steps {
+		if s.Config == nil {
+			continue
+		}
+		if err := s.Config.ResolveKeys(r.Dir); err != nil {
+			return nil, fmt.Errorf("invalid recipe %s: step %d: %s", path, i+1, err)
+		}
+	}
+	if err := r.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid recipe %s: %s", path, err)
+	}
+
+	h := sha256.New()
+	h.Write(data)
+	for _, s := range r.Steps {
+		if s.Config == nil {
+			continue
+		}
+		// keys may come from files outside of the recipe
+		if s.Config.SSH != nil {
+			h.Write([]byte(strings.Join(s.Config.SSH.AuthorizedKeys, "\n")))
+		}
+		for _, u := range s.Config.Users {
+			h.Write([]byte(strings.Join(u.AuthorizedKeys, "\n")))
+		}
+	}
+	for _, src := range r.sources() {
+		if err := hashTree(h, src, filepath.Base(src)); err != nil {
+			return nil, err
+		}
+	}
+	r.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	return r, nil
+}
+
+// Validate checks the recipe steps
+func (r *Recipe) Validate() error {
+	if r.Device == "" {
+		return errors.New("device is empty")
+	}
+	if r.Image == "" {
+		return errors.New("image is empty")
+	}
+	for i, s := range r.Steps {
+		kinds := 0
+		if s.Config != nil {
+			kinds++
+			if err := s.Config.Validate(); err != nil {
+				return fmt.Errorf("step %d: %s", i+1, err)
+			}
+		}
+		if len(s.Files) > 0 {
+			kinds++
+		}
+		if s.Run != "" {
+			kinds++
+		}
+		if len(s.Overlay) > 0 {
+			kinds++
+		}
+		if kinds != 1 {
+			return fmt.Errorf("step %d: it has to be one of config, files, overlay or run", i+1)
+		}
+		for _, o := range r.Overlays(s) {
+			if err := o.Validate(); err != nil {
+				return fmt.Errorf("step %d: %s", i+1, err)
+			}
+		}
+		for _, f := range s.Files {
+			if !strings.HasPrefix(f.Path, "/") {
+				return fmt.Errorf("step %d: file path %q isn't absolute", i+1, f.Path)
+			}
+			if f.Src != "" && f.Content != "" {
+				return fmt.Errorf("step %d: %s has both content and src", i+1, f.Path)
+			}
+			if _, err := f.mode(0644); err != nil {
+				return fmt.Errorf("step %d: %s: %s", i+1, f.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Profile merges configuration values of the first n steps, later steps override earlier ones.
+// Config steps are applied in order, it's the configuration of the image the step n sees
+func (r *Recipe) Profile(n int) *config.Profile {
+	if n > len(r.Steps) {
+		n = len(r.Steps)
+	}
+	var p *config.Profile
+	for _, s := range r.Steps[:n] {
+		if s.Config == nil {
+			continue
+		}
+		if p == nil {
+			p = &config.Profile{}
+		}
+		c := s.Config
+		if c.Locale != "" {
+			p.Locale = c.Locale
+		}
+		if c.Keymap != "" {
+			p.Keymap = c.Keymap
+		}
+		if c.Wifi != nil {
+			p.Wifi = c.Wifi
+		}
+		if len(c.Interfaces) > 0 {
+			p.Interfaces = c.Interfaces
+		}
+		if c.Hostname != "" {
+			p.Hostname = c.Hostname
+		}
+		if c.SecondaryDNS {
+			p.SecondaryDNS = true
+		}
+		if c.SSH != nil {
+			p.SSH = c.SSH
+		}
+		if len(c.Users) > 0 {
+			p.Users = append(p.Users, c.Users...)
+		}
+		if c.DefaultUser != "" {
+			p.DefaultUser = c.DefaultUser
+		}
+	}
+	return p
+}
+
+// Path resolves the path relative to the recipe folder
+func (r *Recipe) Path(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.Dir, path)
+}
+
+// Overlays returns overlays of the step sorted by partition with folders resolved against the recipe folder
+func (r *Recipe) Overlays(s Step) []Overlay {
+	var list []Overlay
+	for _, part := range []string{PartRootfs, PartBoot} {
+		if dir, ok := s.Overlay[part]; ok {
+			list = append(list, Overlay{Partition: part, Dir: r.Path(dir)})
+		}
+	}
+	for part, dir := range s.Overlay {
+		if part != PartRootfs && part != PartBoot {
+			list = append(list, Overlay{Partition: part, Dir: r.Path(dir)})
+		}
+	}
+	return list
+}
+
+// sources returns host files and folders used by the steps
+func (r *Recipe) sources() []string {
+	var list []string
+	for _, s := range r.Steps {
+		for _, o := range r.Overlays(s) {
+			list = append(list, o.Dir)
+		}
+		for _, f := range s.Files {
+			if f.Src != "" {
+				list = append(list, r.Path(f.Src))
+			}
+		}
+	}
+	return list
+}
+
+// mode parses the file mode, def is used when it's not set
+func (f *File) mode(def os.FileMode) (os.FileMode, error) {
+	if f.Mode == "" {
+		return def, nil
+	}
+	m, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid mode %q", f.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// hashTree writes names, modes and contents of the files into the hash in the sorted order
+func hashTree(h io.Writer, path, name string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%s %o\n", filepath.ToSlash(name), fi.Mode()&os.ModePerm)
+	if !fi.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	}
+
+	names, err := sortedDir(path)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := hashTree(h, filepath.Join(path, n), filepath.Join(name, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
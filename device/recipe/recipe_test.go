@@ -0,0 +1,148 @@
+package recipe
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRecipe = `device: raspi
+image: lite
+output: golden.img.xz
+steps:
+  - config:
+      hostname: first
+      wifi: {ssid: office, psk: secret}
+  - name: motd
+    files:
+      - path: /etc/motd
+        content: "hello\n"
+      - path: /opt/app
+        src: app
+        mode: "0755"
+  - run: echo done > $ROOT/etc/done
+  - config:
+      hostname: golden
+`
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "recipe")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "recipe.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte(testRecipe), 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "app", "bin"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "app", "bin", "run"), []byte("#!/bin/sh\n"), 0644))
+
+	r, err := Load(path)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(r.Steps, 4)
+	assert.Equal(filepath.Join(dir, "golden.img.xz"), r.Path(r.Output))
+	p := r.Profile(len(r.Steps))
+	assert.Equal("golden", p.Hostname)
+	assert.Equal("office", p.Wifi.SSID)
+	// the run step sees only the configuration applied before it
+	assert.Equal("first", r.Profile(2).Hostname)
+	assert.Nil(r.Profile(0))
+
+	// recipe hash covers the host files
+	hash := r.Hash
+	r, err = Load(path)
+	assert.NoError(err)
+	assert.Equal(hash, r.Hash)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "app", "bin", "run"), []byte("#!/bin/bash\n"), 0644))
+	r, err = Load(path)
+	assert.NoError(err)
+	assert.NotEqual(hash, r.Hash)
+
+	// archives of the same files are identical
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.NoError(Tar(a, r.Dir, r.Steps[1].Files))
+	assert.NoError(Tar(b, r.Dir, r.Steps[1].Files))
+	assert.Equal(a.Bytes(), b.Bytes())
+
+	modes := map[string]int64{}
+	tr := tar.NewReader(a)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		assert.Equal(0, h.Uid)
+		modes[h.Name] = h.Mode
+	}
+	// folders aren't archived, so existing ones keep their modes in the image
+	assert.Equal(map[string]int64{"etc/motd": 0644, "opt/app/bin/run": 0755}, modes)
+
+	assert.NoError(ioutil.WriteFile(path, []byte("device: raspi\nimage: lite\nsteps:\n  - run: ls\n    files: [{path: /a}]\n"), 0644))
+	_, err = Load(path)
+	assert.Error(err)
+	assert.NoError(ioutil.WriteFile(path, []byte("device: raspi\nimage: lite\nsteps:\n  - files: [{path: a, content: x}]\n"), 0644))
+	_, err = Load(path)
+	assert.Error(err)
+}
+
+func TestOverlayTar(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "overlay")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "home", "pi", ".ssh"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "home", "pi", ".ssh", "config"), []byte("Host *\n"), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "etc.conf.tmpl"), []byte("{{.Hostname}} {{.IP}}\n"), 0644))
+	assert.NoError(os.Symlink("/etc/etc.conf", filepath.Join(dir, "link")))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, OverlayManifest), []byte("# owners\n/home/pi 1000:1000\n/home/pi/.ssh 1000 0700\n"), 0644))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(OverlayTar(buf, dir, &Vars{Hostname: "sensor-1", IP: "10.0.0.5"}))
+
+	type entry struct {
+		uid, gid int
+		mode     int64
+		content  string
+	}
+	entries := map[string]entry{}
+	tr := tar.NewReader(buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		data, _ := ioutil.ReadAll(tr)
+		e := entry{h.Uid, h.Gid, h.Mode, string(data)}
+		if h.Typeflag == tar.TypeSymlink {
+			e.content = "-> " + h.Linkname
+		}
+		entries[h.Name] = e
+	}
+	assert.Equal(map[string]entry{
+		"etc.conf":            {0, 0, 0644, "sensor-1 10.0.0.5\n"},
+		"home/pi/":            {1000, 1000, 0755, ""},
+		"home/pi/.ssh/":       {1000, 1000, 0700, ""},
+		"home/pi/.ssh/config": {0, 0, 0600, "Host *\n"},
+		"link":                {0, 0, 0777, "-> /etc/etc.conf"},
+	}, entries)
+
+	// missing template values are errors
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "bad.tmpl"), []byte("{{.Missing}}"), 0644))
+	assert.Error(OverlayTar(&bytes.Buffer{}, dir, &Vars{}))
+
+	_, err = ParseOverlay("data=" + dir)
+	assert.Error(err)
+	o, err := ParseOverlay("boot=" + dir)
+	assert.NoError(err)
+	assert.Equal(PartBoot, o.Partition)
+}
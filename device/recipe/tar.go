@@ -0,0 +1,97 @@
+package recipe
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// epoch is modification time of all archived files, so the same files produce the same archive
+var epoch = time.Unix(0, 0)
+
+// Tar writes the files into the tar archive owned by root, relative src paths are resolved against dir.
+// The archive is extracted into the mounted partition with `tar xf archive -C mountpoint`
+func Tar(w io.Writer, dir string, files []File) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		name := strings.TrimPrefix(path.Clean(f.Path), "/")
+		if f.Src == "" {
+			mode, err := f.mode(0644)
+			if err != nil {
+				return err
+			}
+			if err := writeEntry(tw, name, mode, []byte(f.Content)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		src := f.Src
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(dir, src)
+		}
+		if err := addTree(tw, src, name, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addTree adds the host file or folder to the archive, files keep their permissions unless mode is set.
+// Like overlays, folders are created by tar, so existing folders of the image like /etc keep their modes,
+// only empty ones are archived
+func addTree(tw *tar.Writer, src, name string, f File) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target,
+			Mode: 0777, ModTime: epoch})
+	case fi.IsDir():
+		names, err := sortedDir(src)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/",
+				Mode: int64(fi.Mode() & os.ModePerm), ModTime: epoch})
+		}
+		for _, n := range names {
+			if err := addTree(tw, filepath.Join(src, n), path.Join(name, n), f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	mode, err := f.mode(fi.Mode() & os.ModePerm)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeEntry(tw, name, mode, data)
+}
+
+func writeEntry(tw *tar.Writer, name string, mode os.FileMode, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(mode), Size: int64(len(data)),
+		ModTime: epoch}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
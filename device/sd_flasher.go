@@ -2,13 +2,13 @@ package device
 
 import (
 	"fmt"
-	"path/filepath"
 	"strings"
 
 	"regexp"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/recipe"
 	"github.com/xshellinc/iotit/workstation"
 	"github.com/xshellinc/tools/dialogs"
 	"github.com/xshellinc/tools/lib/help"
@@ -19,6 +19,24 @@ type sdFlasher struct {
 	*flasher
 	Disk       string
 	configured bool
+	loop       string
+	batch      batchOptions
+	verify     bool
+	overlays   []recipe.Overlay
+	// customize runs build recipe steps on the mounted partitions
+	customize func(mounts map[string]string) error
+	login     sshLogin
+	// seed and lastChange make password hashes and /etc/shadow of builds reproducible, see config.PasswordSeed
+	seed       string
+	lastChange int
+}
+
+// sshLogin describes how to log in to the board after the image was configured
+type sshLogin struct {
+	user            string
+	passwordChanged bool
+	keys            bool
+	noPassword      bool
 }
 
 // MountImg is a method to attach image to loop and mount it
@@ -29,14 +47,12 @@ func (d *sdFlasher) MountImg(loopMount string) error {
 		return fmt.Errorf("image not found, please check if the repo is valid")
 	}
 
-	d.execOverSSH("losetup -D", nil)
-	command := fmt.Sprintf("losetup -f -P %s", help.AddPathSuffix("unix", config.TmpDir, d.img))
-	if err := d.execOverSSH(command, nil); err != nil {
+	if err := d.attachImg(); err != nil {
 		return err
 	}
 
 	log.Debug("creating tmp folder")
-	command = fmt.Sprintf("mkdir -p %s", config.MountDir)
+	command := fmt.Sprintf("mkdir -p %s", config.MountDir)
 	if err := d.execOverSSH(command, nil); err != nil {
 		return err
 	}
@@ -45,7 +61,7 @@ func (d *sdFlasher) MountImg(loopMount string) error {
 
 	if loopMount != "" {
 		log.Debug("mounting sd folder on ", loopMount)
-		if err := d.mount("loop0"+loopMount, config.MountDir); err != nil {
+		if err := d.mount(d.loop+loopMount, config.MountDir); err != nil {
 			return err
 		}
 
@@ -54,8 +70,8 @@ func (d *sdFlasher) MountImg(loopMount string) error {
 	}
 
 	log.Debug("empty loopMount, trying to detect linux partition")
-	command = fmt.Sprintf("ls /dev/loop0p*")
-	compiler, _ := regexp.Compile(`loop0p[\d]+`)
+	command = fmt.Sprintf("ls /dev/%sp*", d.loop)
+	compiler, _ := regexp.Compile(d.loop + `p[\d]+`)
 
 	out := ""
 	if err := d.execOverSSH(command, &out); err != nil {
@@ -111,40 +127,85 @@ func (d *sdFlasher) MountImg(loopMount string) error {
 // UnmountImg is a method to unlink image folder and detach image from the loop
 func (d *sdFlasher) UnmountImg() error {
 	if d.mounted {
-		return nil
+		log.Debug("Unmounting image folder")
+		command := fmt.Sprintf("umount %s", config.MountDir)
+		if err := d.execOverSSH(command, nil); err != nil {
+			return err
+		}
+		d.mounted = false
 	}
-	log.Debug("Unmounting image folder")
-	command := fmt.Sprintf("umount %s", config.MountDir)
-	if err := d.execOverSSH(command, nil); err != nil {
+
+	return d.detachImg()
+}
+
+// attachImg attaches image to the first free loop device with partitions scanning
+func (d *sdFlasher) attachImg() error {
+	if err := d.detachImg(); err != nil {
+		return err
+	}
+
+	img := help.AddPathSuffix("unix", d.ws.TmpDir(), d.img)
+	// loop devices left from the previous runs
+	out := ""
+	if err := d.execOverSSH(fmt.Sprintf("losetup -j %s", img), &out); err != nil {
 		return err
 	}
+	for _, loop := range regexp.MustCompile(`/dev/loop\d+`).FindAllString(out, -1) {
+		d.execOverSSH("losetup -d "+loop, nil)
+	}
+
+	out = ""
+	if err := d.execOverSSH(fmt.Sprintf("losetup -f -P --show %s", img), &out); err != nil {
+		return err
+	}
+	loop := regexp.MustCompile(`/dev/(loop\d+)`).FindStringSubmatch(out)
+	if loop == nil {
+		return fmt.Errorf("cannot attach %s to a loop device: %s", d.img, out)
+	}
+	d.loop = loop[1]
+	log.WithField("loop", d.loop).Debug("image attached")
+	return nil
+}
 
+// detachImg detaches image from the loop device
+func (d *sdFlasher) detachImg() error {
+	if d.loop == "" {
+		return nil
+	}
 	log.Debug("Detaching image loop device")
-	command = "losetup -D"
-	if err := d.execOverSSH(command, nil); err != nil {
+	if err := d.execOverSSH("losetup -d /dev/"+d.loop, nil); err != nil {
 		return err
 	}
+	d.loop = ""
 	return nil
 }
 
 // Flash method is used to flash image to the sdcard
 func (d *sdFlasher) Write() error {
-	if !d.Quiet {
+	if d.ws == nil {
+		// image wasn't configured, so it's written from the host
+		return d.writeArchive()
+	}
+
+	if d.batch.enabled() {
+		if err := d.selectDisks(); err != nil {
+			return err
+		}
+	} else if !d.Quiet {
 		if !dialogs.YesNoDialog("Proceed to image flashing?") {
 			log.Debug("Aborted")
 			return nil
 		}
 	}
 
-	help.DeleteFile(filepath.Join(help.GetTempDir(), d.img))
-
-	log.Debug("Downloading image from vbox")
+	log.Debug("Downloading image from workspace")
 
+	var img string
 	job := help.NewBackgroundJob()
 	go func() {
 		defer job.Close()
-		if err := d.conf.SSH.ScpFrom(help.AddPathSuffix("unix", config.TmpDir, d.img), filepath.Join(help.GetTempDir(), d.img)); err != nil {
-
+		var err error
+		if img, err = d.ws.Fetch(help.AddPathSuffix("unix", d.ws.TmpDir(), d.img), help.GetTempDir()); err != nil {
 			job.Error(err)
 		}
 	}()
@@ -153,8 +214,18 @@ func (d *sdFlasher) Write() error {
 		return err
 	}
 
+	if d.batch.enabled() {
+		err := d.writeBatch(img)
+		if err := d.ws.Stop(d.Quiet); err != nil {
+			log.Error(err)
+		}
+		if err != nil {
+			return err
+		}
+		return d.Done()
+	}
+
 	w := workstation.NewWorkStation(d.Disk)
-	img := filepath.Join(help.GetTempDir(), d.img)
 
 	log.WithField("img", img).Debug("Writing image to disk")
 	if job, err := w.WriteToDisk(img); err != nil {
@@ -163,6 +234,11 @@ func (d *sdFlasher) Write() error {
 		if err := help.WaitJobAndSpin("Flashing", job); err != nil {
 			return err
 		}
+		if d.verify {
+			if err := verifyDisk(w, img); err != nil {
+				return err
+			}
+		}
 	}
 
 	if err := w.Unmount(); err != nil {
@@ -172,13 +248,33 @@ func (d *sdFlasher) Write() error {
 		log.Error("Error parsing mount option ", "error msg:", err.Error())
 	}
 
-	if err := d.conf.Stop(d.Quiet); err != nil {
+	if err := d.ws.Stop(d.Quiet); err != nil {
 		log.Error(err)
 	}
 
 	return d.Done()
 }
 
+// verifyDisk reads back the written disk and compares it with the image
+func verifyDisk(w workstation.WorkStation, img string) error {
+	job, err := w.Verify(img)
+	if err != nil {
+		return err
+	}
+	if err := help.WaitJobAndSpin("Verifying", job); err != nil {
+		return verifyError(err)
+	}
+	return nil
+}
+
+// verifyError adds a hint to the content mismatch error
+func verifyError(err error) error {
+	if _, ok := err.(*workstation.MismatchError); ok {
+		return fmt.Errorf("%s, the SD card may be counterfeit or worn out", err)
+	}
+	return err
+}
+
 // Configure method overrides generic flasher method
 // and includes logic of mounting configuring and flashing the device into the sdCard
 func (d *sdFlasher) Configure() error {
@@ -187,7 +283,8 @@ func (d *sdFlasher) Configure() error {
 	}
 
 	log.WithField("device", "SD").Debug("Configure")
-	c := config.NewDefault(d.conf.SSH)
+	c := d.newConfigurator()
+	c.ApplyProfile(d.profile)
 
 	if err := d.MountImg(""); err != nil {
 		return err
@@ -199,6 +296,12 @@ func (d *sdFlasher) Configure() error {
 	}
 
 	if !d.mounted {
+		if err := d.UnmountImg(); err != nil {
+			log.Error(err)
+		}
+		if len(d.overlays) > 0 || d.customize != nil {
+			return fmt.Errorf("image can't be customized, no linux partitions were found")
+		}
 		if !dialogs.YesNoDialog("IoTit can't configure this image because no linux partitions were found inside. Do you want to proceed to image writing anyway?") {
 			return fmt.Errorf("Aborted")
 		}
@@ -209,14 +312,18 @@ func (d *sdFlasher) Configure() error {
 			if err := c.Setup(); err != nil {
 				return err
 			}
-
-			// write configs that were setup above
-			if err := c.Write(); err != nil {
-				return err
-			}
 		}
 	}
 
+	// write configs that were setup above or preset by the profile
+	if err := d.writeConfig(c); err != nil {
+		return err
+	}
+
+	if err := d.customizeImage(map[string]string{partRootfs: config.MountDir}); err != nil {
+		return err
+	}
+
 	if err := d.UnmountImg(); err != nil {
 		return err
 	}
@@ -256,16 +363,77 @@ func (d *sdFlasher) Done() error {
 
 	fmt.Println("\n\t\t Flashing Complete!")
 	fmt.Printf("\t\t Please insert your sd card into your %s\n", d.device)
-	if d.devRepo.Image.User != "" {
+	user := d.devRepo.Image.User
+	if d.login.user != "" {
+		user = d.login.user
+	}
+	if user != "" {
+		pass := d.devRepo.Image.Pass
+		if d.login.passwordChanged {
+			pass = "(changed)"
+		} else if user != d.devRepo.Image.User {
+			pass = "(unchanged)"
+		}
 		fmt.Println("\t\t ssh to your board with the following credentials")
-		fmt.Printf("\t\t ssh username: "+dialogs.PrintColored("%s")+" password: "+dialogs.PrintColored("%s")+"\n",
-			d.devRepo.Image.User, d.devRepo.Image.Pass)
+		if d.login.noPassword {
+			fmt.Printf("\t\t ssh username: "+dialogs.PrintColored("%s")+" password login is disabled\n", user)
+		} else {
+			fmt.Printf("\t\t ssh username: "+dialogs.PrintColored("%s")+" password: "+dialogs.PrintColored("%s")+"\n", user, pass)
+		}
+		if d.login.keys {
+			fmt.Println("\t\t your SSH keys are authorized for this user")
+		}
 	}
 	fmt.Println("\t\t If you have any questions or suggestions feel free to make an issue at https://github.com/xshellinc/iotit/issues/ or tweet us @isaax_iot")
 
 	return nil
 }
 
+// newConfigurator creates the default configurator with the default user of the image
+func (d *sdFlasher) newConfigurator() *config.Configurator {
+	c := config.NewDefault(d.ws)
+	c.StoreValue(config.User, d.devRepo.Image.User)
+	c.StoreValue(config.DefaultUser, d.devRepo.Image.User)
+	if d.seed != "" {
+		c.StoreValue(config.PasswordSeed, d.seed)
+		c.StoreValue(config.LastChange, d.lastChange)
+	}
+	return c
+}
+
+// writeConfig writes configuration into the image and remembers login settings for Done
+func (d *sdFlasher) writeConfig(c *config.Configurator) error {
+	if err := c.Write(); err != nil {
+		return err
+	}
+	d.login = sshLogin{}
+	if v, ok := c.Value(config.User); ok {
+		d.login.user, _ = v.(string)
+	}
+	if v, ok := c.Value(config.Password); ok {
+		pass, _ := v.(string)
+		d.login.passwordChanged = pass != ""
+	}
+	if v, ok := c.Value(config.AuthorizedKeys); ok {
+		keys, _ := v.([]string)
+		d.login.keys = len(keys) > 0
+	}
+	if v, ok := c.Value(config.PasswordLogin); ok && d.login.keys {
+		login, _ := v.(bool)
+		d.login.noPassword = !login
+	}
+
+	// the default user can't be used anymore, so the first new user is shown
+	action, _ := c.Value(config.DefaultUserAction)
+	users, _ := c.Value(config.Accounts)
+	if list, ok := users.([]config.UserProfile); ok && len(list) > 0 && d.login.user == d.devRepo.Image.User &&
+		(action == config.DefaultUserLock || action == config.DefaultUserRemove) {
+		u := list[0]
+		d.login = sshLogin{user: u.Name, passwordChanged: u.Password != "", keys: len(u.AuthorizedKeys) > 0, noPassword: u.Password == ""}
+	}
+	return nil
+}
+
 func (d *sdFlasher) mount(loop, mount string) error {
 	mountCommand := fmt.Sprintf("mount -o rw /dev/%s %s", loop, mount)
 	err := d.execOverSSH(mountCommand, nil)
@@ -288,7 +456,7 @@ func (d *sdFlasher) mount(loop, mount string) error {
 			log.Error("block info not found")
 			return fmt.Errorf("block info not found")
 		}
-		command = "apk add e2fsprogs-extra"
+		command = "which resize2fs || apk add e2fsprogs-extra"
 		if err := d.execOverSSH(command, nil); err != nil {
 			log.WithField("c", command).Error(err)
 			return err
@@ -311,7 +479,7 @@ func (d *sdFlasher) mount(loop, mount string) error {
 
 func (d *sdFlasher) execOverSSH(command string, outp *string) error {
 	log.WithField("command", command).Debug("execOverSSH")
-	if out, eut, err := d.conf.SSH.Run(command); err != nil {
+	if out, eut, err := d.ws.Run(command); err != nil {
 		log.Error("[-] Error executing: ", command, eut)
 		return err
 	} else if strings.TrimSpace(eut) != "" {
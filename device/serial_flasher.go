@@ -1,14 +1,14 @@
 package device
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"github.com/xshellinc/esp-flasher/common"
 	"github.com/xshellinc/esp-flasher/esp"
 	espFlasher "github.com/xshellinc/esp-flasher/esp/flasher"
-	"github.com/xshellinc/esp-flasher/serialport"
 	"github.com/xshellinc/go-serial"
 	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/device/firmware"
 	"github.com/xshellinc/tools/dialogs"
 	"github.com/xshellinc/tools/lib/ssh_helper"
 	"strings"
@@ -23,15 +23,13 @@ type serialFlasher struct {
 
 func (d *serialFlasher) Prepare() error {
 	log.Debug("Prepare")
-	if len(d.Port) == 0 {
-		fmt.Println("[+] Enumerating serial ports...")
-		port, err := serialport.GetPort("auto")
-		if err != nil {
-			return err
-		}
-		d.Port = port
+	fmt.Println("[+] Enumerating serial ports...")
+	port, err := selectPort(d.Port, espChips, d.Quiet)
+	if err != nil {
+		return err
 	}
-	fmt.Println("[+] Using ", dialogs.PrintColored(d.Port))
+	d.Port = port
+	fmt.Println("[+] Using ", dialogs.PrintColored(portDescription(d.Port)))
 	return nil
 }
 
@@ -39,6 +37,16 @@ func (d *serialFlasher) Prepare() error {
 func (d *serialFlasher) Flash() error {
 	log.Debug("Serial flasher")
 
+	if d.CLI.Bool("burn-key") {
+		// fail before touching the module, burning eFuses can't be confirmed without dialogs otherwise
+		if d.CLI.String("encrypt-key") == "" && d.CLI.String("secure-boot-key") == "" {
+			return errors.New("--burn-key requires --encrypt-key or --secure-boot-key")
+		}
+		if d.Quiet && d.CLI.String("confirm") == "" {
+			return errors.New("--burn-key in quiet mode requires --confirm with the MAC address of the module")
+		}
+	}
+
 	if err := d.Prepare(); err != nil {
 		return err
 	}
@@ -46,9 +54,11 @@ func (d *serialFlasher) Flash() error {
 	if err := d.Write(); err != nil {
 		return err
 	}
-	time.Sleep(time.Second * 3) // wait for the module to boot
-	if err := d.Configure(); err != nil {
-		return err
+	if d.provisionMode() == provisionShell {
+		time.Sleep(time.Second * 3) // wait for the module to boot
+		if err := d.Configure(); err != nil {
+			return err
+		}
 	}
 
 	return d.Done()
@@ -59,11 +69,11 @@ func (d *serialFlasher) Configure() error {
 	log.WithField("device", "serial").Debug("Configure")
 	fmt.Println("[+] Configuring...")
 
-	if len(d.Port) == 0 {
-		d.Prepare()
+	if err := d.Prepare(); err != nil {
+		return err
 	}
 
-	if !d.Quiet {
+	if !d.Quiet || d.profile != nil {
 		c := config.New(ssh_helper.New("", "", "", ""))
 		commonOpts := serial.OpenOptions{
 			BaudRate:              115200,
@@ -81,9 +91,13 @@ func (d *serialFlasher) Configure() error {
 
 		c.StoreValue("port", sc)
 		c.AddConfigFn(config.Wifi, config.NewCallbackFn(setWifi, saveWifi))
+		c.ApplyProfile(d.profile)
 
-		if err := c.Setup(); err != nil {
-			return err
+		// only the profile is applied in quiet mode, dialogs of Setup would wait for input
+		if !d.Quiet {
+			if err := c.Setup(); err != nil {
+				return err
+			}
 		}
 
 		if err := c.Write(); err != nil {
@@ -97,6 +111,35 @@ func (d *serialFlasher) Configure() error {
 
 // Flash method is used to flash image to the sdcard
 func (d *serialFlasher) Write() error {
+	fw, err := firmware.Load(d.devRepo.Image.URL)
+	if err != nil {
+		return err
+	}
+	key := d.CLI.String("encrypt-key")
+	if key != "" {
+		if !strings.EqualFold(fw.Platform, "esp32") {
+			return fmt.Errorf("flash encryption isn't supported by %s", fw.Platform)
+		}
+		firmware.Encrypt(fw)
+	}
+	sbKey := d.CLI.String("secure-boot-key")
+	var flashParams string
+	if sbKey != "" {
+		if !strings.EqualFold(fw.Platform, "esp32") {
+			return fmt.Errorf("secure boot isn't supported by %s", fw.Platform)
+		}
+		k, err := readKey(sbKey, false)
+		if err != nil {
+			return err
+		}
+		if flashParams, err = firmware.AddSecureBootDigest(fw, k); err != nil {
+			return err
+		}
+	}
+	if err := d.provision(fw); err != nil {
+		return err
+	}
+
 	if !d.Quiet {
 		if !dialogs.YesNoDialog("Proceed to firmware flashing?") {
 			log.Debug("Flash aborted")
@@ -109,10 +152,23 @@ func (d *serialFlasher) Write() error {
 	espFlashOpts.BaudRate = 460800
 	espFlashOpts.BootFirmware = true
 	espFlashOpts.MinimizeWrites = true
-
-	fw, err := common.NewZipFirmwareBundle(d.devRepo.Image.URL)
-	if err != nil {
-		return err
+	espFlashOpts.FlashParams = flashParams
+	if key != "" {
+		espFlashOpts.ESP32EncryptionKeyFile = key
+		espFlashOpts.ESP32FlashCryptConf = flashCryptConf
+	}
+	if d.CLI.Bool("burn-key") {
+		opts := &EncryptOptions{Release: d.CLI.Bool("release"), Confirm: d.CLI.String("confirm")}
+		if key != "" {
+			if err := ESPEncryptFlash(d.Port, key, opts); err != nil {
+				return err
+			}
+		}
+		if sbKey != "" {
+			if err := ESPSecureBoot(d.Port, sbKey, opts); err != nil {
+				return err
+			}
+		}
 	}
 
 	log.Infof("Loaded %s/%s version %s (%s)\n", fw.Name, fw.Platform, fw.Version, fw.BuildID)
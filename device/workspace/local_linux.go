@@ -0,0 +1,190 @@
+package workspace
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// default command timeout in seconds, the same as ssh_helper uses
+const localTimeout = 30
+
+// local runs commands on the linux host with sudo, images are attached to host loop devices
+type local struct {
+	dir     string
+	timer   int
+	timeout int
+	// sudo is set when the host user isn't root
+	sudo bool
+}
+
+func newLocal() (Workspace, error) {
+	dir := filepath.Join(help.GetTempDir(), "iotit") + string(filepath.Separator)
+	return &local{dir: dir, timer: localTimeout, timeout: localTimeout, sudo: os.Geteuid() != 0}, nil
+}
+
+// Start checks required tools and asks for sudo password once
+func (l *local) Start() error {
+	for _, tool := range []string{"losetup", "mount", "umount"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s is required to configure images locally: %s", tool, err)
+		}
+	}
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Println("[+] Using local workspace", l.dir)
+	if l.sudo {
+		fmt.Println("[+] You may need to enter your user password")
+		cmd := exec.Command("sudo", "-v")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("sudo is required to configure images locally: %s", err)
+		}
+	}
+	return nil
+}
+
+// Stop does nothing for the local workspace
+func (l *local) Stop(quiet bool) error {
+	return nil
+}
+
+// TmpDir returns private host folder for images
+func (l *local) TmpDir() string {
+	return l.dir
+}
+
+// Fetch returns the same path, because workspace files are already on the host
+func (l *local) Fetch(src, dstDir string) (string, error) {
+	if !help.Exists(src) {
+		return "", fmt.Errorf("%s not found", src)
+	}
+	return src, nil
+}
+
+// SetTimer sets a timeout for the next command execution
+func (l *local) SetTimer(timeout int) {
+	l.timer = timeout
+}
+
+// command returns shell command, which is run with sudo if needed
+func (l *local) command(ctx context.Context, command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if l.sudo {
+		cmd = exec.CommandContext(ctx, "sudo", "sh", "-c", command)
+		cmd.Stdin = os.Stdin
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	// children of the killed shell keep output pipes open, they're closed so timeouts aren't waiting for them
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+// Run executes command on the host
+func (l *local) Run(command string) (string, string, error) {
+	timeout := time.Duration(l.timer) * time.Second
+	l.timer = l.timeout
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.WithField("command", command).Debug("local run")
+	out, eut := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := l.command(ctx, command)
+	cmd.Stdout, cmd.Stderr = out, eut
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command timed out after %s: %s", timeout, command)
+	} else if e := strings.TrimSpace(eut.String()); err != nil && e != "" {
+		// callers match error messages of the commands like they do with ssh stderr
+		err = fmt.Errorf("%s (%s)", e, err)
+	}
+
+	return out.String(), eut.String(), err
+}
+
+// Stream executes command and streams it's output line by line
+func (l *local) Stream(command string) (chan string, chan string, chan bool, error) {
+	timeout := time.Duration(l.timer) * time.Second
+	l.timer = l.timeout
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmd := l.command(ctx, command)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	outCh, errCh, done := make(chan string), make(chan string), make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			errCh <- s.Text()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			outCh <- s.Text()
+		}
+	}()
+	go func() {
+		defer cancel()
+		// pipes have to be read to the end before Wait closes them
+		wg.Wait()
+		done <- cmd.Wait() == nil
+		close(outCh)
+		close(errCh)
+		close(done)
+	}()
+
+	return outCh, errCh, done, nil
+}
+
+// Scp links host file into the workspace folder instead of copying it
+func (l *local) Scp(src, dst string) error {
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	link := filepath.Join(dst, filepath.Base(src))
+	os.Remove(link)
+	return os.Symlink(abs, link)
+}
+
+// ScpFrom copies workspace file to the host destination
+func (l *local) ScpFrom(src, dst string) error {
+	return help.Copy(src, dst)
+}
+
+// ScpFromServer is the same as ScpFrom for the local workspace
+func (l *local) ScpFromServer(src, dst string) error {
+	return l.ScpFrom(src, dst)
+}
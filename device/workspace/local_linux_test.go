@@ -0,0 +1,157 @@
+package workspace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLocal returns local workspace in the temporary folder which runs commands without sudo
+func testLocal(t *testing.T) *local {
+	dir, err := ioutil.TempDir("", "iotit-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &local{dir: dir + string(filepath.Separator), timer: localTimeout, timeout: localTimeout}
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	ws, err := New(Local, "", true)
+	if assert.NoError(err) {
+		l := ws.(*local)
+		assert.True(strings.HasSuffix(l.TmpDir(), "iotit"+string(filepath.Separator)), l.TmpDir())
+		assert.Equal(os.Geteuid() != 0, l.sudo)
+		assert.Equal(localTimeout, l.timer)
+	}
+	_, err = New("docker", "", true)
+	assert.Error(err)
+}
+
+func TestLocalCommand(t *testing.T) {
+	for _, c := range []struct {
+		sudo  bool
+		args  []string
+		stdin bool
+	}{
+		{false, []string{"sh", "-c", "losetup -f -P --show /tmp/iotit/disk.img"}, false},
+		{true, []string{"sudo", "sh", "-c", "losetup -f -P --show /tmp/iotit/disk.img"}, true},
+	} {
+		l := &local{sudo: c.sudo}
+		cmd := l.command(context.Background(), "losetup -f -P --show /tmp/iotit/disk.img")
+		assert.Equal(t, c.args, cmd.Args)
+		// sudo may ask for the password
+		assert.Equal(t, c.stdin, cmd.Stdin == os.Stdin)
+		assert.NotZero(t, cmd.WaitDelay)
+	}
+}
+
+func TestLocalRun(t *testing.T) {
+	for _, c := range []struct {
+		name, command, out, eut, err string
+		timer                        int
+	}{
+		{"output", "echo /dev/loop3", "/dev/loop3\n", "", "", 0},
+		{"warning", "echo warning >&2", "", "warning\n", "", 0},
+		{"stderr", "echo 'umount: /mnt: not mounted.' >&2; exit 32", "", "umount: /mnt: not mounted.\n",
+			"umount: /mnt: not mounted. (exit status 32)", 0},
+		{"exit code", "exit 1", "", "", "exit status 1", 0},
+		{"timeout", "sleep 10", "", "", "command timed out after 1s: sleep 10", 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			l := testLocal(t)
+			defer os.RemoveAll(l.dir)
+			if c.timer != 0 {
+				l.SetTimer(c.timer)
+			}
+
+			start := time.Now()
+			out, eut, err := l.Run(c.command)
+			assert.True(time.Since(start) < 5*time.Second, "command wasn't stopped in time")
+			assert.Equal(c.out, out)
+			assert.Equal(c.eut, eut)
+			if c.err == "" {
+				assert.NoError(err)
+			} else if assert.Error(err) {
+				assert.Equal(c.err, err.Error())
+			}
+			// the timer is applied to the single command
+			assert.Equal(l.timeout, l.timer)
+		})
+	}
+}
+
+func TestLocalStream(t *testing.T) {
+	assert := assert.New(t)
+	l := testLocal(t)
+	defer os.RemoveAll(l.dir)
+
+	outCh, errCh, done, err := l.Stream("echo 1; echo warning >&2; echo 2; exit 1")
+	if !assert.NoError(err) {
+		return
+	}
+	var out, eut []string
+	ok := true
+	for finished := false; !finished; {
+		select {
+		case s := <-outCh:
+			out = append(out, s)
+		case s := <-errCh:
+			eut = append(eut, s)
+		case ok = <-done:
+			finished = true
+		}
+	}
+	assert.Equal([]string{"1", "2"}, out)
+	assert.Equal([]string{"warning"}, eut)
+	assert.False(ok)
+	// channels are closed after the command exits
+	_, open := <-outCh
+	assert.False(open)
+}
+
+func TestLocalFiles(t *testing.T) {
+	assert := assert.New(t)
+	l := testLocal(t)
+	defer os.RemoveAll(l.dir)
+	assert.NoError(l.Start())
+
+	src := filepath.Join(l.dir, "host")
+	assert.NoError(os.Mkdir(src, 0755))
+	for _, name := range []string{"disk.img", "other.img"} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644))
+	}
+
+	// images are linked into the workspace, stale links of the previous runs are replaced
+	link := filepath.Join(l.TmpDir(), "disk.img")
+	assert.NoError(os.Symlink(filepath.Join(src, "other.img"), link))
+	assert.NoError(l.Scp(filepath.Join(src, "disk.img"), l.TmpDir()))
+	target, err := os.Readlink(link)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(src, "disk.img"), target)
+	assert.True(filepath.IsAbs(target))
+
+	path, err := l.Fetch(link, "/unused")
+	assert.NoError(err)
+	assert.Equal(link, path)
+	_, err = l.Fetch(filepath.Join(l.TmpDir(), "missing.img"), "/unused")
+	assert.Error(err)
+
+	dst := filepath.Join(src, "copy.img")
+	assert.NoError(l.ScpFromServer(link, dst))
+	data, err := ioutil.ReadFile(dst)
+	assert.NoError(err)
+	assert.Equal("disk.img", string(data))
+
+	// nothing is left running, the workspace folder is kept for the next run
+	assert.NoError(l.Stop(true))
+	_, err = os.Stat(l.TmpDir())
+	assert.NoError(err)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package workspace
+
+import (
+	"errors"
+	"runtime"
+)
+
+func newLocal() (Workspace, error) {
+	return nil, errors.New("local workspace is not supported on " + runtime.GOOS + ", use " + VirtualBox)
+}
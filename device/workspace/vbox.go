@@ -0,0 +1,113 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/go-virtualbox"
+	"github.com/xshellinc/iotit/device/config"
+	"github.com/xshellinc/iotit/vbox"
+	"github.com/xshellinc/tools/dialogs"
+	"github.com/xshellinc/tools/lib/help"
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+// virtualBox runs commands inside of the iotit-box VM over ssh
+type virtualBox struct {
+	ssh_helper.Util
+
+	conf    *vbox.Config
+	machine *virtualbox.Machine
+	device  string
+	quiet   bool
+}
+
+func newVirtualBox(device string, quiet bool) *virtualBox {
+	return &virtualBox{device: device, quiet: quiet}
+}
+
+// Start inits virtualbox and starts VM if it's not running yet
+func (v *virtualBox) Start() error {
+	if err := vbox.CheckVBInstalled(); err != nil {
+		return err
+	}
+
+	v.conf = vbox.NewConfig(v.device)
+	v.Util = v.conf.SSH
+	log.Debug("configuring virtual box")
+	var err error
+	if v.machine, err = v.conf.GetVbox(v.device, v.quiet); err != nil {
+		return err
+	}
+
+	if v.machine.State != virtualbox.Running {
+		fmt.Printf(`[+] Using virtual machine
+	Name - `+dialogs.PrintColored("%s")+`
+	Description - `+dialogs.PrintColored("%s")+"\n", v.machine.Name, v.machine.Description)
+
+		if err := v.startVM(); err != nil {
+			return err
+		}
+	}
+
+	help.DeleteHost(filepath.Join(help.UserHomeDir(), ".ssh", "known_hosts"), "localhost")
+	return nil
+}
+
+func (v *virtualBox) startVM() error {
+	job := help.NewBackgroundJob()
+	if err := v.machine.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		defer job.Close()
+		for {
+			select {
+			case <-ticker.C:
+				_, eut, err := v.Run("whoami")
+				if err == nil && strings.TrimSpace(eut) == "" {
+					return
+				}
+			case <-time.After(180 * time.Second):
+				job.Error(errors.New("Cannot connect to vbox via ssh"))
+			}
+		}
+	}()
+
+	if err := help.WaitJobAndSpin("Starting", job); err != nil {
+		return err
+	}
+
+	time.Sleep(time.Second)
+	return nil
+}
+
+// Stop powers off VM
+func (v *virtualBox) Stop(quiet bool) error {
+	if v.conf == nil {
+		return nil
+	}
+	return v.conf.Stop(quiet)
+}
+
+// TmpDir returns VM tmp folder
+func (v *virtualBox) TmpDir() string {
+	return config.TmpDir
+}
+
+// Fetch copies file from the VM into the host folder
+func (v *virtualBox) Fetch(src, dstDir string) (string, error) {
+	dst := filepath.Join(dstDir, filepath.Base(src))
+	help.DeleteFile(dst)
+	if err := v.ScpFrom(src, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
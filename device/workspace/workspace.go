@@ -0,0 +1,40 @@
+package workspace
+
+import (
+	"fmt"
+
+	"github.com/xshellinc/tools/lib/ssh_helper"
+)
+
+// Workspace kinds
+const (
+	VirtualBox = "vbox"
+	Local      = "local"
+)
+
+// Workspace is an environment where images are uploaded, extracted, mounted and configured.
+// It embeds ssh_helper.Util, so commands are executed inside of the workspace the same way they're run over ssh
+type Workspace interface {
+	ssh_helper.Util
+
+	// Start prepares workspace to run commands
+	Start() error
+	// Stop releases workspace resources
+	Stop(quiet bool) error
+	// TmpDir returns workspace directory where images are uploaded and extracted
+	TmpDir() string
+	// Fetch makes workspace file available on the host and returns it's local path
+	Fetch(src, dstDir string) (string, error)
+}
+
+// New returns workspace of the specified kind
+func New(kind, device string, quiet bool) (Workspace, error) {
+	switch kind {
+	case "", VirtualBox:
+		return newVirtualBox(device, quiet), nil
+	case Local:
+		return newLocal()
+	}
+
+	return nil, fmt.Errorf("unknown workspace %q, use %s or %s", kind, VirtualBox, Local)
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	stdlog "log"
+	"path/filepath"
 	"runtime"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xshellinc/iotit/device"
+	"github.com/xshellinc/iotit/device/firmware"
+	"github.com/xshellinc/iotit/device/workspace"
 	// "github.com/xshellinc/iotit/repo"
 	"github.com/xshellinc/iotit/repo"
 	"github.com/xshellinc/iotit/workstation"
@@ -17,6 +24,7 @@ import (
 	"github.com/xshellinc/tools/lib/help"
 	"github.com/xshellinc/tools/lib/sudo"
 	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
 )
 
 const progName = "iotit"
@@ -74,8 +82,36 @@ func main() {
 			Flags: []cli.Flag{
 				cli.BoolFlag{Name: "quiet, unattended, q", Usage: "Suppress questions and assume default answers"},
 				cli.StringFlag{Name: "disk, d", Usage: "External disk or usb device"},
-				cli.StringFlag{Name: "port, p", Usage: "Serial port for connected device. " +
-					"If set to 'auto' first port will be used."},
+				cli.StringFlag{Name: "port, p", Usage: "Serial port or USB serial number of connected device. " +
+					"If set to 'auto' the connected port of the known chips is used, several ones are asked or rejected with --quiet."},
+				cli.StringFlag{Name: "profile", Usage: "Configuration profile (yaml or json) used instead of dialogs"},
+				cli.StringFlag{Name: "workspace", Value: workspace.VirtualBox, Usage: "Where SD card images are configured: " +
+					"'vbox' virtual machine or 'local' loop devices (linux only)"},
+				cli.StringFlag{Name: "disks", Usage: "Comma separated list of removable disks to write the image to concurrently"},
+				cli.BoolFlag{Name: "all-removable", Usage: "Write the image to all removable disks concurrently"},
+				cli.StringFlag{Name: "hostname", Usage: "Hostname template for batch flashing, {n} is replaced with the disk number"},
+				cli.IntFlag{Name: "start", Value: 1, Usage: "Number of the first disk in the hostname template"},
+				cli.BoolFlag{Name: "no-verify", Usage: "Skip reading back the written disk and comparing it with the image"},
+				cli.IntFlag{Name: "connections", Value: 1, Usage: "Number of parallel connections to download the image"},
+				cli.StringSliceFlag{Name: "overlay", Usage: "Copy the host folder into the image partition: rootfs=./dir or boot=./dir, " +
+					"*.tmpl files are rendered with the device values"},
+				cli.StringFlag{Name: "firmware", Usage: "ESP firmware zip bundle, build directory or manifest used instead of repository images"},
+				cli.StringFlag{Name: "fs-dir", Usage: "Directory to build an ESP file system image from"},
+				cli.StringFlag{Name: "fs-type", Value: firmware.SPIFFS, Usage: "File system image type: 'spiffs' or 'littlefs'"},
+				cli.StringFlag{Name: "fs-offset", Usage: "Flash offset of the file system image, default is taken from the partition table"},
+				cli.StringFlag{Name: "fs-size", Usage: "Size of the file system image, default is taken from the partition table"},
+				cli.StringFlag{Name: "provision", Value: "shell", Usage: "How ESP modules are configured: 'shell' commands over serial " +
+					"after flashing, 'nvs' partition or 'spiffs' config.json flashed with the firmware"},
+				cli.StringFlag{Name: "device-id", Usage: "Device ID provisioned to ESP modules"},
+				cli.StringSliceFlag{Name: "set", Usage: "Provisioned key=value, values may be typed like u32:42"},
+				cli.StringFlag{Name: "nvs-namespace", Value: "iotit", Usage: "NVS namespace of provisioned values"},
+				cli.StringFlag{Name: "nvs-offset", Usage: "Flash offset of the NVS partition, default is taken from the partition table"},
+				cli.StringFlag{Name: "nvs-size", Usage: "Size of the NVS partition, default is taken from the partition table"},
+				cli.StringFlag{Name: "encrypt-key", Usage: "ESP32 flash encryption key file, firmware is encrypted with it while flashing"},
+				cli.StringFlag{Name: "secure-boot-key", Usage: "ESP32 secure boot key file, the bootloader is flashed with its digest at 0x0"},
+				cli.BoolFlag{Name: "burn-key", Usage: "Burn --encrypt-key and --secure-boot-key into eFuses before flashing, it's irreversible"},
+				cli.BoolFlag{Name: "release", Usage: "Protect burned keys and disable bootloader decryption, cache and JTAG, it's irreversible"},
+				cli.StringFlag{Name: "confirm", Usage: "MAC address of the module confirming burning eFuses without dialogs"},
 			},
 			ArgsUsage: "[device image]",
 			Action: func(c *cli.Context) error {
@@ -100,8 +136,19 @@ func main() {
 			Usage:   "Configure image or device",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "disk, d", Usage: "External disk or usb device"},
-				cli.StringFlag{Name: "port, p", Usage: "Serial port for connected device. " +
-					"If set to 'auto' first port will be used."},
+				cli.StringFlag{Name: "port, p", Usage: "Serial port or USB serial number of connected device. " +
+					"If set to 'auto' the connected port of the known chips is used, several ones are asked or rejected with --quiet."},
+				cli.BoolFlag{Name: "quiet, unattended, q", Usage: "Suppress questions and assume default answers"},
+				cli.StringFlag{Name: "profile", Usage: "Configuration profile (yaml or json) used instead of dialogs"},
+				cli.StringFlag{Name: "workspace", Value: workspace.VirtualBox, Usage: "Where SD card images are configured: " +
+					"'vbox' virtual machine or 'local' loop devices (linux only)"},
+				cli.StringFlag{Name: "hostname", Usage: "Hostname template for batch flashing, {n} is replaced with the disk number"},
+				cli.IntFlag{Name: "start", Value: 1, Usage: "Number of the first disk in the hostname template"},
+				cli.IntFlag{Name: "connections", Value: 1, Usage: "Number of parallel connections to download the image"},
+				cli.StringSliceFlag{Name: "overlay", Usage: "Copy the host folder into the image partition: rootfs=./dir or boot=./dir, " +
+					"*.tmpl files are rendered with the device values"},
+				cli.StringFlag{Name: "output", Usage: "Save the configured image to the file instead of a disk, " +
+					".gz, .xz or .zst suffix compresses it, sha256 is written to the .sha256 file"},
 			},
 			ArgsUsage: "[device image]",
 			Action: func(c *cli.Context) error {
@@ -109,9 +156,41 @@ func main() {
 				if flasher == nil {
 					return nil
 				}
+				output := c.String("output")
+				exporter, ok := flasher.(device.Exporter)
+				if output != "" && !ok {
+					return cli.NewExitError("--output is supported only by SD card images", 1)
+				}
 				if err := flasher.Configure(); err != nil {
 					return err
 				}
+				if output != "" {
+					if err := exporter.Export(output); err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "build",
+			Usage:     "Build the image from the recipe",
+			ArgsUsage: "recipe.yaml",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "output", Usage: "Image file overriding the recipe output"},
+				cli.StringFlag{Name: "workspace", Value: workspace.VirtualBox, Usage: "Where images are configured: " +
+					"'vbox' virtual machine or 'local' loop devices (linux only), overrides the recipe workspace"},
+				cli.IntFlag{Name: "connections", Value: 1, Usage: "Number of parallel connections to download the image"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					cli.ShowCommandHelp(c, "build")
+					return nil
+				}
+				opts := &device.BuildOptions{Version: version, Output: c.String("output")}
+				if err := device.Build(c, c.Args().First(), opts); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
 				return nil
 			},
 		},
@@ -123,8 +202,14 @@ func main() {
 				cli.BoolFlag{Name: "flash, f", Usage: "Flash ready image"},
 				cli.StringFlag{Name: "image, i", Usage: "Image path"},
 				cli.StringFlag{Name: "disk, d", Usage: "External disk or usb device"},
-				cli.StringFlag{Name: "port, p", Usage: "Serial port for connected device. " +
-					"If set to 'auto' first port will be used."},
+				cli.StringFlag{Name: "port, p", Usage: "Serial port or USB serial number of connected device. " +
+					"If set to 'auto' the connected port of the known chips is used, several ones are asked or rejected with --quiet."},
+				cli.StringFlag{Name: "disks", Usage: "Comma separated list of removable disks to write the image to concurrently"},
+				cli.BoolFlag{Name: "all-removable", Usage: "Write the image to all removable disks concurrently"},
+				cli.StringFlag{Name: "hostname", Usage: "Hostname template for batch flashing, {n} is replaced with the disk number"},
+				cli.IntFlag{Name: "start", Value: 1, Usage: "Number of the first disk in the hostname template"},
+				cli.BoolFlag{Name: "no-verify", Usage: "Skip reading back the written disk and comparing it with the image"},
+				cli.IntFlag{Name: "connections", Value: 1, Usage: "Number of parallel connections to download the image"},
 			},
 			ArgsUsage: "[device image]",
 			Action: func(c *cli.Context) error {
@@ -138,6 +223,260 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "esp",
+			Usage: "Manage ESP modules",
+			Subcommands: []cli.Command{
+				{
+					Name:  "efuse",
+					Usage: "ESP32 eFuses",
+					Subcommands: []cli.Command{
+						{
+							Name:  "dump",
+							Usage: "Print eFuse blocks and values",
+							Flags: []cli.Flag{espPortFlag},
+							Action: func(c *cli.Context) error {
+								if err := device.ESPEfuseDump(c.String("port")); err != nil {
+									return cli.NewExitError(err.Error(), 1)
+								}
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "encrypt-flash",
+					Usage: "Burn the flash encryption key into ESP32 eFuses and enable flash encryption, it's irreversible",
+					Flags: []cli.Flag{
+						espPortFlag,
+						cli.StringFlag{Name: "key, k", Usage: "Flash encryption key file, 32 bytes"},
+						cli.BoolFlag{Name: "generate", Usage: "Generate a random key if the key file doesn't exist"},
+						cli.BoolFlag{Name: "release", Usage: "Protect the key and disable bootloader decryption, cache and JTAG, it's irreversible"},
+						cli.StringFlag{Name: "confirm", Usage: "MAC address of the module confirming burning eFuses without dialogs"},
+						cli.BoolFlag{Name: "dry-run, n", Usage: "Only print eFuses which would be burned"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("key") == "" {
+							return cli.NewExitError("key file is not set", 1)
+						}
+						opts := &device.EncryptOptions{Generate: c.Bool("generate"), Release: c.Bool("release"),
+							Confirm: c.String("confirm"), DryRun: c.Bool("dry-run")}
+						if err := device.ESPEncryptFlash(c.String("port"), c.String("key"), opts); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "secure-boot",
+					Usage: "Burn the secure boot key into ESP32 eFuses and enable reflashable secure boot, it's irreversible",
+					Flags: []cli.Flag{
+						espPortFlag,
+						cli.StringFlag{Name: "key, k", Usage: "Secure boot key file, 32 bytes"},
+						cli.BoolFlag{Name: "generate", Usage: "Generate a random key if the key file doesn't exist"},
+						cli.BoolFlag{Name: "release", Usage: "Protect the key and disable JTAG, it's irreversible"},
+						cli.StringFlag{Name: "confirm", Usage: "MAC address of the module confirming burning eFuses without dialogs"},
+						cli.BoolFlag{Name: "dry-run, n", Usage: "Only print eFuses which would be burned"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("key") == "" {
+							return cli.NewExitError("key file is not set", 1)
+						}
+						opts := &device.EncryptOptions{Generate: c.Bool("generate"), Release: c.Bool("release"),
+							Confirm: c.String("confirm"), DryRun: c.Bool("dry-run")}
+						if err := device.ESPSecureBoot(c.String("port"), c.String("key"), opts); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "read",
+					Usage:     "Save the flash region into the file, zero length reads up to the end of the flash",
+					ArgsUsage: "offset length file",
+					Flags:     []cli.Flag{espPortFlag, espChipFlag},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 3 {
+							cli.ShowCommandHelp(c, "read")
+							return nil
+						}
+						offset, err := firmware.ParseOffset(c.Args().Get(0))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						length, err := firmware.ParseOffset(c.Args().Get(1))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						if err := device.ESPRead(espOptions(c), offset, length, c.Args().Get(2)); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "write",
+					Usage:     "Write the file to the flash at the offset, e.g. restore a backup at 0",
+					ArgsUsage: "offset file",
+					Flags:     []cli.Flag{espPortFlag, espChipFlag, espQuietFlag},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 2 {
+							cli.ShowCommandHelp(c, "write")
+							return nil
+						}
+						offset, err := firmware.ParseOffset(c.Args().Get(0))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						if err := device.ESPWrite(espOptions(c), offset, c.Args().Get(1)); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "erase",
+					Usage: "Erase the whole flash or its region",
+					Flags: []cli.Flag{
+						espPortFlag,
+						espChipFlag,
+						espQuietFlag,
+						cli.StringFlag{Name: "region, r", Usage: "Region to erase as offset:length, e.g. 0x9000:0x6000"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := device.ESPErase(espOptions(c), c.String("region")); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "backup",
+					Usage:     "Save the whole flash with the chip info and MAC address, to clone it with `esp write 0`",
+					ArgsUsage: "[dir]",
+					Flags:     []cli.Flag{espPortFlag, espChipFlag},
+					Action: func(c *cli.Context) error {
+						dir := c.Args().First()
+						if dir == "" {
+							dir = "."
+						}
+						if _, err := device.ESPBackup(espOptions(c), dir); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "console",
+			Usage: "Attach to the serial console of the board",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "port, p", Value: "auto", Usage: "Serial port or USB serial number of the board"},
+				cli.UintFlag{Name: "baud, b", Value: 115200, Usage: "Baud rate"},
+				cli.BoolFlag{Name: "timestamps, t", Usage: "Prefix lines with the time they were received"},
+				cli.StringFlag{Name: "log, l", Usage: "Append the output to the file"},
+				cli.StringSliceFlag{Name: "send, s", Usage: "Line sent to the board once connected, can be repeated"},
+				cli.BoolFlag{Name: "input, i", Usage: "Send lines typed in the terminal to the board"},
+				cli.BoolFlag{Name: "reset", Usage: "Reset ESP module to watch the boot log from the beginning"},
+				cli.DurationFlag{Name: "duration, d", Usage: "Exit after the duration, e.g. 30s"},
+				cli.BoolFlag{Name: "quiet, q", Usage: "Don't show dialogs, --port is required when more than one port is connected"},
+			},
+			Action: func(c *cli.Context) error {
+				opts := &device.ConsoleOptions{
+					Port:       c.String("port"),
+					Baud:       c.Uint("baud"),
+					Timestamps: c.Bool("timestamps"),
+					LogFile:    c.String("log"),
+					Send:       c.StringSlice("send"),
+					Input:      c.Bool("input"),
+					Reset:      c.Bool("reset"),
+					Duration:   c.Duration("duration"),
+					Quiet:      c.Bool("quiet"),
+				}
+				if err := device.Console(opts); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "Compare SD card content with the image",
+			ArgsUsage: "image disk",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 2 {
+					cli.ShowCommandHelp(c, "verify")
+					return nil
+				}
+				w := workstation.NewWorkStation(c.Args().Get(1))
+				job, err := w.Verify(c.Args().Get(0))
+				if err == nil {
+					err = help.WaitJobAndSpin("Verifying", job)
+				}
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "write-raw",
+			Usage:  "Write standard input to the raw disk, it's executed with sudo by iotit itself",
+			Hidden: true,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "disk, d", Usage: "Raw disk device"},
+				cli.BoolFlag{Name: "skip-zero", Usage: "Zero blocks containing only zeros with BLKZEROOUT instead of writing them"},
+			},
+			Action: func(c *cli.Context) error {
+				if _, err := workstation.WriteRaw(c.String("disk"), os.Stdin, 0,
+					&workstation.WriteOptions{SkipZero: c.Bool("skip-zero")}); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "sign-mapping",
+			Usage:     "Validate and sign mapping.json, the signature is written next to it with .sig suffix",
+			ArgsUsage: "[mapping.json]",
+			Hidden:    true,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "key, k", Usage: "Base64 encoded ed25519 private key", EnvVar: "MAPPING_PRIVATE_KEY"},
+				cli.BoolFlag{Name: "generate", Usage: "Generate a new key pair"},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Bool("generate") {
+					pub, priv, err := repo.GenerateKey()
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					fmt.Println("Public key: ", pub)
+					fmt.Println("Private key:", priv)
+					return nil
+				}
+				file := "mapping.json"
+				if c.NArg() > 0 {
+					file = c.Args().First()
+				}
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				if _, err := repo.ParseDeviceCollectionStrict(data); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				sig, err := repo.Sign(data, c.String("key"))
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				if err := ioutil.WriteFile(file+".sig", sig, 0644); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				fmt.Println("[+] Signature is written to", file+".sig")
+				return nil
+			},
+		},
 		{
 			Name:    "update",
 			Aliases: []string{"u"},
@@ -146,10 +485,184 @@ func main() {
 				if err := repo.DownloadDevicesRepository(); err != nil {
 					return err
 				}
+				if err := repo.UpdateSources(); err != nil {
+					return err
+				}
 				fmt.Println("[+] Mapping file updated successfully.")
 				return nil
 			},
 		},
+		{
+			Name:  "repo",
+			Usage: "Manage additional image repositories, they take precedence over the default one in the order they were added",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add repository from mapping.json URL or local path",
+					ArgsUsage: "name url|path",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "key, k", Usage: "Base64 encoded ed25519 public key to verify mapping.json.sig of the repository"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 2 {
+							return cli.NewExitError("name and url or path of the repository are required", 1)
+						}
+						s, err := repo.AddSource(c.Args().Get(0), c.Args().Get(1), c.String("key"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						fmt.Printf("[+] Repository %s added: %s\n", s.Name, s.URL)
+						return nil
+					},
+				},
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List repositories in the order of precedence",
+					Action: func(c *cli.Context) error {
+						sources, err := repo.Sources()
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "NAME\tLOCATION\tSIGNED")
+						for _, s := range sources {
+							fmt.Fprintf(w, "%s\t%s\t%t\n", s.Name, s.URL, s.PublicKey != "")
+						}
+						fmt.Fprintf(w, "%s\t%s\t%t\n", repo.DefaultSource, repo.ImagesRepo, repo.MappingPublicKey != "")
+						return w.Flush()
+					},
+				},
+				{
+					Name:      "remove",
+					Aliases:   []string{"rm"},
+					Usage:     "Remove repository",
+					ArgsUsage: "name",
+					Action: func(c *cli.Context) error {
+						if err := repo.RemoveSource(c.Args().First()); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						fmt.Println("[+] Repository removed")
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Manage downloaded images and virtual machine archives",
+			Subcommands: []cli.Command{
+				{
+					Name:    "list",
+					Aliases: []string{"ls"},
+					Usage:   "List cached files, recently used first",
+					Action: func(c *cli.Context) error {
+						entries, err := repo.CacheEntries()
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						var total int64
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "FILE\tSIZE\tLAST USED\tHASH\tURL")
+						for _, e := range entries {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Name(), workstation.FormatBytes(e.Size),
+								e.Used.Format("2006-01-02 15:04"), e.HashStatus(), e.URL)
+							total += e.Size
+						}
+						fmt.Fprintf(w, "TOTAL\t%s\t\t\t\n", workstation.FormatBytes(total))
+						return w.Flush()
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "Remove files unused longer than --older-than and least recently used ones exceeding --max-size",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "max-size", Usage: "Size limit of the cache, e.g. 10G"},
+						cli.StringFlag{Name: "older-than", Usage: "Age limit of the files, e.g. 30d or 12h"},
+						cli.BoolFlag{Name: "dry-run, n", Usage: "Only print files to be removed"},
+					},
+					Action: func(c *cli.Context) error {
+						var size int64
+						var age time.Duration
+						var err error
+						if c.String("max-size") == "" && c.String("older-than") == "" {
+							return cli.NewExitError("--max-size or --older-than is required", 1)
+						}
+						if c.String("max-size") != "" {
+							if size, err = repo.ParseSize(c.String("max-size")); err != nil {
+								return cli.NewExitError(err.Error(), 1)
+							}
+						}
+						if c.String("older-than") != "" {
+							if age, err = repo.ParseAge(c.String("older-than")); err != nil {
+								return cli.NewExitError(err.Error(), 1)
+							}
+						}
+						pruned, err := repo.PruneCache(size, age, c.Bool("dry-run"))
+						printRemoved(pruned, c.Bool("dry-run"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "clear",
+					Usage: "Remove all cached files",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "quiet, unattended, q", Usage: "Suppress questions and assume default answers"},
+					},
+					Action: func(c *cli.Context) error {
+						if !c.Bool("quiet") && !dialogs.YesNoDialog("Remove all cached images and virtual machine archives?") {
+							return nil
+						}
+						removed, err := repo.ClearCache()
+						printRemoved(removed, false)
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "verify",
+					Usage:     "Verify cached files against hashes from the repositories",
+					ArgsUsage: "[file...]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "delete", Usage: "Remove files which don't match their hashes"},
+					},
+					Action: func(c *cli.Context) error {
+						entries, err := repo.CacheEntries()
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						failed := 0
+						for _, e := range entries {
+							if c.NArg() > 0 && !cacheSelected(e, c.Args()) {
+								continue
+							}
+							status, err := e.Verify()
+							if err != nil {
+								status = err.Error()
+							}
+							fmt.Printf("[+] %s: %s\n", e.Name(), status)
+							if err != nil || status == repo.HashMismatch {
+								failed++
+								if c.Bool("delete") && status == repo.HashMismatch {
+									if err := repo.RemoveCacheEntry(e); err != nil {
+										fmt.Println("[-]", err)
+									}
+								}
+							}
+						}
+						if failed > 0 {
+							return cli.NewExitError(fmt.Sprintf("%d files failed verification", failed), 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:    "list",
 			Aliases: []string{"ls"},
@@ -158,42 +671,14 @@ func main() {
 				{
 					Name:  "devices",
 					Usage: "List supported devices and images",
+					Flags: []cli.Flag{formatFlag},
 					Action: func(c *cli.Context) error {
-						list := device.ListMapping()
-						fmt.Println("Devices and images listed as \"name (" + dialogs.PrintColored("alias") + ")\"")
-						for _, item := range list {
-							fmt.Print("Type: " + item.Title)
-							if len(item.Alias) > 0 {
-								fmt.Print(" (" + dialogs.PrintColored(item.Alias) + ")")
-							}
-							fmt.Println()
-							if len(item.Models) == 0 {
-								fmt.Print("\tImages: ")
-								for title, alias := range item.Images {
-									fmt.Print(title)
-									if len(alias) > 0 {
-										fmt.Print(" (" + dialogs.PrintColored(alias) + ") ")
-									}
-								}
-								fmt.Println()
-							} else {
-								for _, sub := range item.Models {
-									fmt.Print("\tModel: " + sub.Title)
-									if len(sub.Alias) > 0 {
-										fmt.Print(" (" + dialogs.PrintColored(sub.Alias) + ")")
-									}
-									fmt.Println()
-									fmt.Print("\t\tImages: ")
-									for title, alias := range sub.Images {
-										fmt.Print(title)
-										if len(alias) > 0 {
-											fmt.Print(" (" + dialogs.PrintColored(alias) + ") ")
-										}
-									}
-									fmt.Println()
-								}
-							}
+						out := &deviceList{Version: repo.GetRepo().Version, Devices: device.ListMapping()}
+						if ok, err := printFormatted(c, out); ok || err != nil {
+							return err
 						}
+
+						printDevices(os.Stdout, out)
 						fmt.Println(dialogs.PrintColored("Examples"))
 						fmt.Println("\tiotit flash raspi lite")
 						fmt.Println("\tiotit flash nanopi2 android")
@@ -204,10 +689,38 @@ func main() {
 				{
 					Name:  "disks",
 					Usage: "List external disks",
+					Flags: []cli.Flag{formatFlag},
 					Action: func(c *cli.Context) error {
 						w := workstation.NewWorkStation("")
-						w.PrintDisks()
-						return nil
+						if c.String("format") == "text" {
+							w.PrintDisks()
+							return nil
+						}
+						disks, err := w.Disks()
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						info := make([]*workstation.DiskInfo, len(disks))
+						for i, d := range disks {
+							info[i] = d.Info()
+						}
+						_, err = printFormatted(c, info)
+						return err
+					},
+				},
+				{
+					Name:  "ports",
+					Usage: "List serial ports",
+					Flags: []cli.Flag{formatFlag},
+					Action: func(c *cli.Context) error {
+						ports, err := workstation.ListPorts()
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						if ok, err := printFormatted(c, ports); ok || err != nil {
+							return err
+						}
+						return printPorts(os.Stdout, ports)
 					},
 				},
 			},
@@ -385,3 +898,128 @@ func tailLog(numLines int) bool {
 	}
 	return false
 }
+
+// printRemoved prints removed cache entries and their total size
+func printRemoved(entries []*repo.CacheEntry, dryRun bool) {
+	var total int64
+	for _, e := range entries {
+		if dryRun {
+			fmt.Printf("[+] Would remove %s (%s)\n", e.Name(), workstation.FormatBytes(e.Size))
+		} else {
+			fmt.Printf("[+] Removed %s (%s)\n", e.Name(), workstation.FormatBytes(e.Size))
+		}
+		total += e.Size
+	}
+	fmt.Printf("[+] %d files, %s\n", len(entries), workstation.FormatBytes(total))
+}
+
+// cacheSelected returns true if the cache entry is given by it's name or file name
+func cacheSelected(e *repo.CacheEntry, names []string) bool {
+	for _, n := range names {
+		if n == e.Name() || n == filepath.Base(e.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+var formatFlag = cli.StringFlag{Name: "format, o", Value: "text", Usage: "Output format: text, json or yaml"}
+
+var espPortFlag = cli.StringFlag{Name: "port, p", Value: "auto", Usage: "Serial port or USB serial number of the ESP module"}
+
+var espChipFlag = cli.StringFlag{Name: "chip", Value: "esp32", Usage: "ESP chip: esp32 or esp8266"}
+
+var espQuietFlag = cli.BoolFlag{Name: "quiet, q", Usage: "Don't ask for confirmation"}
+
+func espOptions(c *cli.Context) *device.ESPOptions {
+	return &device.ESPOptions{Port: c.String("port"), Chip: c.String("chip"), Quiet: c.Bool("quiet")}
+}
+
+// deviceList is the output of list devices
+type deviceList struct {
+	Version string             `json:"version" yaml:"version"`
+	Devices []*device.ListItem `json:"devices" yaml:"devices"`
+}
+
+// printFormatted prints v in json or yaml format, it returns false for the text format
+func printFormatted(c *cli.Context, v interface{}) (bool, error) {
+	return writeFormatted(os.Stdout, c.String("format"), v)
+}
+
+// writeFormatted writes v in json or yaml format, it returns false for the text format
+func writeFormatted(w io.Writer, format string, v interface{}) (bool, error) {
+	var data []byte
+	var err error
+	switch format {
+	case "text":
+		return false, nil
+	case "json":
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(v)
+	default:
+		return true, cli.NewExitError("unknown format: "+format, 1)
+	}
+	if err != nil {
+		return true, cli.NewExitError(err.Error(), 1)
+	}
+	_, err = w.Write(data)
+	return true, err
+}
+
+// printDevices prints devices and their images, aliases are colored
+func printDevices(w io.Writer, list *deviceList) {
+	fmt.Fprintln(w, "mapping.json version:", list.Version)
+	fmt.Fprintln(w, "Devices and images listed as \"name ("+dialogs.PrintColored("alias")+")\"")
+	for _, item := range list.Devices {
+		fmt.Fprint(w, "Type: "+item.Title)
+		if len(item.Alias) > 0 {
+			fmt.Fprint(w, " ("+dialogs.PrintColored(item.Alias)+")")
+		}
+		fmt.Fprintln(w)
+		if len(item.Models) == 0 {
+			fmt.Fprint(w, "\tImages: ")
+			printImages(w, item.Images)
+			continue
+		}
+		for _, sub := range item.Models {
+			fmt.Fprint(w, "\tModel: "+sub.Title)
+			if len(sub.Alias) > 0 {
+				fmt.Fprint(w, " ("+dialogs.PrintColored(sub.Alias)+")")
+			}
+			fmt.Fprintln(w)
+			fmt.Fprint(w, "\t\tImages: ")
+			printImages(w, sub.Images)
+		}
+	}
+}
+
+// printImages prints image titles and aliases in one line
+func printImages(w io.Writer, images []device.ImageItem) {
+	for _, i := range images {
+		fmt.Fprint(w, i.Title)
+		if len(i.Alias) > 0 {
+			fmt.Fprint(w, " ("+dialogs.PrintColored(i.Alias)+") ")
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// printPorts prints serial ports in a table
+func printPorts(out io.Writer, ports []*workstation.Port) error {
+	if len(ports) == 0 {
+		fmt.Fprintln(out, "[-] No serial ports found")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tVID:PID\tCHIP\tSERIAL\tMANUFACTURER\tPRODUCT")
+	for _, p := range ports {
+		id := ""
+		if p.VID != "" {
+			id = p.VID + ":" + p.PID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, id, p.Chip, p.Serial, p.Manufacturer, p.Product)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xshellinc/iotit/device"
+	"github.com/xshellinc/iotit/workstation"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// golden compares the output with testdata/name, colors are removed so files are the same on all platforms
+func golden(t *testing.T, name string, out []byte) {
+	out = bytes.Replace(bytes.Replace(out, []byte("\x1b[33m"), nil, -1), []byte("\x1b[0m"), nil, -1)
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, out, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(want), string(out), name)
+}
+
+var testDevices = &deviceList{Version: "1.2.0", Devices: []*device.ListItem{
+	{Title: "Raspberry Pi", Alias: "raspi", Images: []device.ImageItem{
+		{Title: "Raspbian Lite", Alias: "lite", URL: "https://example.com/raspbian_lite.zip",
+			HashURL: "https://example.com/raspbian_lite.zip.sha256", User: "pi", Pass: "raspberry"},
+		{Title: "Raspbian", URL: "https://example.com/raspbian.zip", Mirrors: []string{"https://mirror.example.com/raspbian.zip"},
+			Hash: "sha256:0123456789abcdef"},
+	}},
+	{Title: "NanoPi", Models: []device.ListItem{
+		{Title: "NanoPi 2", Alias: "nanopi2", Images: []device.ImageItem{{Title: "Android", Alias: "android", URL: "https://example.com/android.img.xz"}}},
+		{Title: "NanoPi NEO", Images: []device.ImageItem{{Title: "Ubuntu", URL: "https://example.com/ubuntu.img.zip", User: "root"}}},
+	}},
+	{Title: "ESP32", Alias: "esp32"},
+}}
+
+var testPorts = []*workstation.Port{
+	{Name: "/dev/ttyS0"},
+	{Name: "/dev/ttyUSB0", VID: "10c4", PID: "ea60", Manufacturer: "Silicon Labs", Product: "CP2102 USB to UART Bridge Controller",
+		Serial: "0001", Chip: workstation.ChipCP210x},
+	{Name: "/dev/ttyUSB1", VID: "1a86", PID: "7523", Product: "USB2.0-Serial", Chip: workstation.ChipCH340},
+}
+
+var testDisks = []*workstation.DiskInfo{
+	{Name: "sdb", Path: "/dev/sdb", RawPath: "/dev/sdb", Size: 15931539456, Removable: true},
+	{Name: "disk2", Path: "/dev/disk2", RawPath: "/dev/rdisk2", Size: 31914983424, Removable: true},
+}
+
+func TestListFormats(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"devices", testDevices},
+		{"ports", testPorts},
+		{"ports-empty", []*workstation.Port{}},
+		{"disks", testDisks},
+	} {
+		for _, format := range []string{"json", "yaml"} {
+			b := &bytes.Buffer{}
+			ok, err := writeFormatted(b, format, c.v)
+			assert.True(t, ok)
+			assert.NoError(t, err)
+			golden(t, c.name+"."+format, b.Bytes())
+		}
+	}
+
+	b := &bytes.Buffer{}
+	ok, err := writeFormatted(b, "text", testPorts)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+	assert.Empty(t, b.String())
+	ok, err = writeFormatted(b, "xml", testPorts)
+	assert.True(t, ok)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "unknown format: xml"), err.Error())
+	}
+}
+
+func TestListText(t *testing.T) {
+	b := &bytes.Buffer{}
+	printDevices(b, testDevices)
+	golden(t, "devices.txt", b.Bytes())
+
+	b.Reset()
+	assert.NoError(t, printPorts(b, testPorts))
+	golden(t, "ports.txt", b.Bytes())
+
+	b.Reset()
+	assert.NoError(t, printPorts(b, nil))
+	golden(t, "ports-empty.txt", b.Bytes())
+}
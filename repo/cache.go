@@ -0,0 +1,312 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hash statuses of the cached files
+const (
+	HashUnknown  = "unknown"
+	HashOK       = "ok"
+	HashMismatch = "mismatch"
+)
+
+// CacheEntry is a downloaded image or a virtual machine archive
+type CacheEntry struct {
+	Path string    `json:"-"`
+	Size int64     `json:"-"`
+	URL  string    `json:"URL,omitempty"`
+	Hash string    `json:"Hash,omitempty"`
+	Used time.Time `json:"Used"`
+	// Status is a result of the last verification against Hash
+	Status   string    `json:"Status,omitempty"`
+	Verified time.Time `json:"Verified,omitempty"`
+}
+
+// Name returns path of the cached file relative to the iotit directory
+func (c *CacheEntry) Name() string {
+	if rel, err := filepath.Rel(baseDir, c.Path); err == nil {
+		return rel
+	}
+	return c.Path
+}
+
+// cacheIndex stores source URLs, hashes and last used times of the cached files
+var cacheIndex = filepath.Join(baseDir, "cache.json")
+
+var cacheMutex sync.Mutex
+
+func loadCacheIndex() map[string]*CacheEntry {
+	index := map[string]*CacheEntry{}
+	data, err := ioutil.ReadFile(cacheIndex)
+	if err != nil {
+		return index
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		log.WithField("path", cacheIndex).Error(err)
+	}
+	return index
+}
+
+func saveCacheIndex(index map[string]*CacheEntry) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheIndex, data, 0644)
+}
+
+// updateCacheIndex applies fn to the index entry of the file and saves the index
+func updateCacheIndex(file string, fn func(e *CacheEntry)) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	index := loadCacheIndex()
+	e := &CacheEntry{Path: file}
+	key := e.Name()
+	if i, ok := index[key]; ok {
+		e = i
+	}
+	fn(e)
+	index[key] = e
+	return saveCacheIndex(index)
+}
+
+// TouchCache records usage of the cached file downloaded from the url, hash is an expected hash of the file
+func TouchCache(file, url, hash string) error {
+	return updateCacheIndex(file, func(e *CacheEntry) {
+		if url != "" {
+			e.URL = url
+		}
+		if hash != "" && hash != e.Hash {
+			e.Hash = hash
+			e.Status = ""
+		}
+		e.Used = time.Now()
+	})
+}
+
+// cachedDigest returns the digest recorded for the existing cached file downloaded from the url
+func cachedDigest(url string) *Digest {
+	cacheMutex.Lock()
+	index := loadCacheIndex()
+	cacheMutex.Unlock()
+
+	for name, e := range index {
+		if e.URL != url || e.Hash == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, name)); err != nil {
+			continue
+		}
+		if d, err := ParseDigest(e.Hash); err == nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// CacheEntries lists cached images and virtual machine archives sorted by last used time, recently used first
+func CacheEntries() ([]*CacheEntry, error) {
+	index := loadCacheIndex()
+	var entries []*CacheEntry
+	for _, dir := range []string{ImageDir, VboxDir} {
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			// virtual machine presets are stored next to the versioned archives
+			if filepath.Dir(p) == VboxDir || strings.HasSuffix(p, stateSuffix) {
+				return nil
+			}
+			e := &CacheEntry{Path: p, Used: info.ModTime()}
+			if i, ok := index[e.Name()]; ok {
+				e = i
+				e.Path = p
+			}
+			e.Size = info.Size()
+			if e.Hash == "" {
+				e.Hash = lookupHash(e)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Used.After(entries[j].Used) })
+	return entries, nil
+}
+
+// lookupHash searches hash of the cached image in the repositories by the image url or file name
+func lookupHash(e *CacheEntry) string {
+	if dm == nil {
+		if err := initDeviceCollection(); err != nil {
+			return ""
+		}
+	}
+	name := filepath.Base(e.Path)
+	var hash string
+	var search func(m *DeviceMapping)
+	search = func(m *DeviceMapping) {
+		for _, img := range m.Images {
+			if img.Hash != "" && (img.URL == e.URL || filepath.Base(img.URL) == name) {
+				hash = img.Hash
+			}
+		}
+		for _, s := range m.Sub {
+			search(s)
+		}
+	}
+	for i := range dm.Devices {
+		search(&dm.Devices[i])
+	}
+	return hash
+}
+
+// HashStatus returns result of the last verification or unknown if the file wasn't verified or hash isn't known
+func (c *CacheEntry) HashStatus() string {
+	if c.Hash == "" || c.Status == "" {
+		return HashUnknown
+	}
+	return c.Status
+}
+
+// Verify calculates hash of the cached file and compares it with the expected one, the result is saved in the index
+func (c *CacheEntry) Verify() (string, error) {
+	if c.Hash == "" {
+		return HashUnknown, nil
+	}
+	d, err := ParseDigest(c.Hash)
+	if err != nil {
+		return "", err
+	}
+	ok, err := d.HashFile(c.Path)
+	if err != nil {
+		return "", err
+	}
+	c.Status = HashMismatch
+	if ok {
+		c.Status = HashOK
+	}
+	c.Verified = time.Now()
+
+	return c.Status, updateCacheIndex(c.Path, func(e *CacheEntry) {
+		e.Hash, e.Status, e.Verified = c.Hash, c.Status, c.Verified
+		if e.Used.IsZero() {
+			e.Used = c.Used
+		}
+	})
+}
+
+// SetCacheStatus saves result of the cached file verification against the hash
+func SetCacheStatus(file, hash, status string) error {
+	return updateCacheIndex(file, func(e *CacheEntry) {
+		e.Hash, e.Status, e.Verified = hash, status, time.Now()
+	})
+}
+
+// RemoveCacheEntry deletes the cached file and it's index entry
+func RemoveCacheEntry(c *CacheEntry) error {
+	if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.HasSuffix(c.Path, partSuffix) {
+		os.Remove(strings.TrimSuffix(c.Path, partSuffix) + stateSuffix)
+	}
+	if dir := filepath.Dir(c.Path); dir != ImageDir && dir != VboxDir {
+		os.Remove(dir)
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	index := loadCacheIndex()
+	delete(index, c.Name())
+	return saveCacheIndex(index)
+}
+
+// PruneCache selects entries which aren't used longer than maxAge and least recently used ones exceeding maxSize,
+// zero values disable the limits. Entries are removed unless it's a dry run
+func PruneCache(maxSize int64, maxAge time.Duration, dryRun bool) ([]*CacheEntry, error) {
+	entries, err := CacheEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	var pruned []*CacheEntry
+	for _, e := range entries {
+		if (maxAge > 0 && time.Since(e.Used) > maxAge) || (maxSize > 0 && total+e.Size > maxSize) {
+			pruned = append(pruned, e)
+			continue
+		}
+		total += e.Size
+	}
+
+	if !dryRun {
+		for _, e := range pruned {
+			if err := RemoveCacheEntry(e); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// ClearCache removes all cached images and virtual machine archives
+func ClearCache() ([]*CacheEntry, error) {
+	entries, err := CacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := RemoveCacheEntry(e); err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+var sizeUnits = map[string]int64{"": 1, "B": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+// ParseSize parses sizes like 512M, 10GB or 1.5G
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	unit := ""
+	if i >= 0 {
+		s, unit = s[:i], s[i:]
+	}
+	m, ok := sizeUnits[unit]
+	n, err := strconv.ParseFloat(s, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s+unit)
+	}
+	return int64(n * float64(m)), nil
+}
+
+// ParseAge parses durations like 30d, 12h or 1h30m
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
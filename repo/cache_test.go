@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	assert := assert.New(t)
+	for s, n := range map[string]int64{"512": 512, "1K": 1024, "10GB": 10 << 30, "1.5M": 3 << 19, "2GiB": 2 << 30} {
+		size, err := ParseSize(s)
+		assert.NoError(err)
+		assert.Equal(n, size, s)
+	}
+	_, err := ParseSize("10X")
+	assert.Error(err)
+
+	age, err := ParseAge("30d")
+	assert.NoError(err)
+	assert.Equal(30*24*time.Hour, age)
+}
+
+func TestPruneCache(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "iotit-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	base, images, vbox, index := baseDir, ImageDir, VboxDir, cacheIndex
+	defer func() { baseDir, ImageDir, VboxDir, cacheIndex = base, images, vbox, index }()
+	baseDir, ImageDir, VboxDir = dir, filepath.Join(dir, "images"), filepath.Join(dir, "virtualbox")
+	cacheIndex = filepath.Join(dir, "cache.json")
+	dm = &DeviceCollection{}
+	defer func() { dm = nil }()
+
+	files := map[string]time.Duration{"old.img": 60 * 24 * time.Hour, "recent.img": time.Hour, "new.img": 0}
+	for name, age := range files {
+		p := filepath.Join(ImageDir, "pi", name)
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(ioutil.WriteFile(p, make([]byte, 1024), 0644))
+		assert.NoError(TouchCache(p, "https://example.com/"+name, ""))
+		assert.NoError(updateCacheIndex(p, func(e *CacheEntry) { e.Used = time.Now().Add(-age) }))
+	}
+
+	pruned, err := PruneCache(0, 30*24*time.Hour, true)
+	assert.NoError(err)
+	if assert.Len(pruned, 1) {
+		assert.Equal(filepath.Join("images", "pi", "old.img"), pruned[0].Name())
+	}
+
+	pruned, err = PruneCache(1024, 0, false)
+	assert.NoError(err)
+	assert.Len(pruned, 2)
+	entries, err := CacheEntries()
+	assert.NoError(err)
+	if assert.Len(entries, 1) {
+		assert.Equal("https://example.com/new.img", entries[0].URL)
+	}
+}
+
+func TestCachedDigest(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "iotit-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	base, images, index := baseDir, ImageDir, cacheIndex
+	defer func() { baseDir, ImageDir, cacheIndex = base, images, index }()
+	baseDir, ImageDir = dir, filepath.Join(dir, "images")
+	cacheIndex = filepath.Join(dir, "cache.json")
+
+	sum := "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	p := filepath.Join(ImageDir, "pi", "lite.img")
+	assert.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+	assert.NoError(ioutil.WriteFile(p, []byte("test"), 0644))
+	assert.NoError(TouchCache(p, "https://example.com/lite.img", sum))
+
+	// the downloaded checksum file takes precedence over the cached digest, the image may have been updated
+	updated := "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  lite.img\n", strings.TrimPrefix(updated, "sha256:"))
+	}))
+	defer srv.Close()
+	img := &DeviceImage{URL: "https://example.com/lite.img", HashURL: srv.URL + "/SHA256SUMS"}
+	d, err := img.Digest()
+	assert.NoError(err)
+	assert.Equal(updated, d.String())
+
+	// the cached digest is used offline
+	img.HashURL = "http://127.0.0.1:1/SHA256SUMS"
+	d, err = img.Digest()
+	assert.NoError(err)
+	assert.Equal(sum, d.String())
+
+	assert.NoError(os.Remove(p))
+	_, err = img.Digest()
+	assert.Error(err)
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Digest algorithms
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+	MD5    = "md5"
+)
+
+// digestSizes are lengths of hex encoded sums, they select the algorithm of untagged hashes
+var digestSizes = map[int]string{32: MD5, 64: SHA256, 128: SHA512}
+
+// Digest is a hash sum of the image tagged with it's algorithm
+type Digest struct {
+	Algorithm string
+	Sum       string
+}
+
+// ParseDigest parses `sha256:…`, `sha512:…` or `md5:…` digests, untagged hex sums are recognized by their length
+func ParseDigest(s string) (*Digest, error) {
+	s = strings.TrimSpace(s)
+	d := &Digest{Sum: strings.ToLower(s)}
+	if i := strings.Index(s, ":"); i >= 0 {
+		d.Algorithm, d.Sum = strings.ToLower(s[:i]), strings.ToLower(s[i+1:])
+	} else {
+		d.Algorithm = digestSizes[len(d.Sum)]
+	}
+
+	if d.Algorithm == "" || digestSizes[len(d.Sum)] != d.Algorithm {
+		return nil, fmt.Errorf("%q is not a sha256, sha512 or md5 digest", s)
+	}
+	if _, err := hex.DecodeString(d.Sum); err != nil {
+		return nil, fmt.Errorf("%q is not a hex encoded digest", s)
+	}
+	return d, nil
+}
+
+// New returns hash of the digest algorithm
+func (d *Digest) New() hash.Hash {
+	switch d.Algorithm {
+	case SHA512:
+		return sha512.New()
+	case MD5:
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// Matches compares the digest with the calculated sum
+func (d *Digest) Matches(sum []byte) bool {
+	return hex.EncodeToString(sum) == d.Sum
+}
+
+// Name returns upper-cased algorithm name used in messages
+func (d *Digest) Name() string {
+	return strings.ToUpper(d.Algorithm)
+}
+
+func (d *Digest) String() string {
+	return d.Algorithm + ":" + d.Sum
+}
+
+// HashFile verifies the file against the digest
+func (d *Digest) HashFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := d.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return d.Matches(h.Sum(nil)), nil
+}
+
+// Digest returns digest of the image from the Hash or downloads it from the HashURL checksum file,
+// it returns nil if neither is set. The checksum file may be updated together with the image, so the digest recorded
+// for the cached image is used only when the file can't be downloaded, cached images are verified offline
+func (i *DeviceImage) Digest() (*Digest, error) {
+	if i.Hash != "" {
+		return ParseDigest(i.Hash)
+	}
+	if i.HashURL == "" {
+		return nil, nil
+	}
+	data, err := fetch(i.HashURL)
+	if err != nil {
+		if d := cachedDigest(i.URL); d != nil {
+			log.WithField("url", i.HashURL).WithError(err).Warn("checksum file isn't downloaded, using the cached digest")
+			return d, nil
+		}
+		return nil, err
+	}
+	return parseChecksums(data, FileName(i.URL), algorithmOf(i.HashURL))
+}
+
+// algorithmOf guesses the algorithm from the checksum file name like `image.sha512` or `SHA256SUMS`
+func algorithmOf(u string) string {
+	name := strings.ToLower(FileName(u))
+	for _, a := range []string{SHA512, SHA256, MD5} {
+		if strings.Contains(name, a) {
+			return a
+		}
+	}
+	return ""
+}
+
+// bsdChecksum matches `SHA256 (image.img) = …` lines
+var bsdChecksum = regexp.MustCompile(`^([A-Za-z0-9]+) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+
+// parseChecksums finds the digest of the file in GNU (`sum  name`, `sum *name`) or BSD style checksum files,
+// a single sum without a file name is used as is
+func parseChecksums(data []byte, name, algorithm string) (*Digest, error) {
+	var sums []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+			if m[2] == name {
+				return ParseDigest(strings.ToLower(m[1]) + ":" + m[3])
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			sums = append(sums, fields[0])
+			continue
+		}
+		if strings.TrimPrefix(fields[len(fields)-1], "*") == name || strings.HasSuffix(fields[len(fields)-1], "/"+name) {
+			return checksum(fields[0], algorithm)
+		}
+	}
+	if len(sums) == 1 {
+		return checksum(sums[0], algorithm)
+	}
+	return nil, fmt.Errorf("checksum of %s is not found", name)
+}
+
+func checksum(sum, algorithm string) (*Digest, error) {
+	if algorithm != "" {
+		return ParseDigest(algorithm + ":" + sum)
+	}
+	return ParseDigest(sum)
+}
@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestParseDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ParseDigest(helloSHA256)
+	assert.NoError(err)
+	assert.Equal(SHA256, d.Algorithm)
+
+	d, err = ParseDigest("MD5:5D41402ABC4B2A76B9719D911017C592")
+	assert.NoError(err)
+	assert.Equal(MD5, d.Algorithm)
+	h := d.New()
+	h.Write([]byte("hello"))
+	assert.True(d.Matches(h.Sum(nil)))
+
+	_, err = ParseDigest("sha512:" + helloSHA256)
+	assert.Error(err)
+	_, err = ParseDigest("sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+	assert.Error(err)
+}
+
+func TestParseChecksums(t *testing.T) {
+	assert := assert.New(t)
+	gnu := []byte("# comment\n" + helloSHA256 + "  other.img\n" +
+		"5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592 *raspbian.zip\n")
+	d, err := parseChecksums(gnu, "raspbian.zip", algorithmOf("https://example.com/SHA256SUMS"))
+	assert.NoError(err)
+	assert.Equal("sha256:5d41402abc4b2a76b9719d911017c5925d41402abc4b2a76b9719d911017c592", d.String())
+
+	d, err = parseChecksums([]byte("SHA256 (raspbian.zip) = "+helloSHA256+"\n"), "raspbian.zip", "")
+	assert.NoError(err)
+	assert.Equal(helloSHA256, d.Sum)
+
+	d, err = parseChecksums([]byte(helloSHA256+"\n"), "raspbian.zip", algorithmOf("raspbian.zip.sha256"))
+	assert.NoError(err)
+	assert.Equal(SHA256, d.Algorithm)
+
+	_, err = parseChecksums(gnu, "missing.zip", SHA256)
+	assert.Error(err)
+}
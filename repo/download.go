@@ -0,0 +1,502 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// Suffixes of the partially downloaded file and it's state
+const (
+	partSuffix  = ".part"
+	stateSuffix = ".part.json"
+)
+
+// downloadAttempts is a number of attempts to download every segment, each attempt resumes the segment
+const downloadAttempts = 5
+
+// DownloadOptions configures Download
+type DownloadOptions struct {
+	// Connections is a number of segments downloaded in parallel, servers without range requests use one
+	Connections int
+	// Progress is called with downloaded and total number of bytes, total is 0 when it's unknown
+	Progress func(written, total int64)
+	// Hash is written with the file content while it's downloaded, or with the cached file
+	Hash hash.Hash
+}
+
+// segment is a byte range [Start, End) of the file, Done bytes of it are written
+type segment struct {
+	Start int64 `json:"Start"`
+	End   int64 `json:"End"`
+	Done  int64 `json:"Done"`
+}
+
+// downloadState is saved next to the partial file to resume it
+type downloadState struct {
+	Size     int64      `json:"Size"`
+	ETag     string     `json:"ETag,omitempty"`
+	Modified string     `json:"Modified,omitempty"`
+	Segments []*segment `json:"Segments"`
+}
+
+// remote describes the file on the server
+type remote struct {
+	url      string
+	size     int64
+	ranges   bool
+	etag     string
+	modified string
+}
+
+// httpClient honors HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	},
+}
+
+// FileName returns a name of the file downloaded from the url
+func FileName(u string) string {
+	if p, err := url.Parse(u); err == nil && p.Path != "" {
+		return pathpkg.Base(p.Path)
+	}
+	return pathpkg.Base(u)
+}
+
+// Download downloads the file from the first url which responds into the dir, other urls are mirrors of the same
+// file used when the download fails. Partial files are resumed with range requests, so an interrupted download
+// continues where it stopped. Existing file is reused unless the server reports a different size
+func Download(urls []string, dir string, opts *DownloadOptions) (string, error) {
+	if len(urls) == 0 {
+		return "", errors.New("no image URL")
+	}
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	help.CreateDir(dir)
+	file := filepath.Join(dir, FileName(urls[0]))
+
+	var r *remote
+	var err error
+	for _, u := range urls {
+		if r, err = probe(u); err == nil {
+			break
+		}
+		log.WithField("url", u).Error(err)
+	}
+
+	if info, serr := os.Stat(file); serr == nil {
+		if r == nil || r.size <= 0 || r.size == info.Size() {
+			log.WithField("path", file).Debug("cached")
+			if opts.Progress != nil {
+				opts.Progress(info.Size(), info.Size())
+			}
+			if opts.Hash != nil {
+				return file, hashFile(file, opts.Hash)
+			}
+			return file, nil
+		}
+		fmt.Printf("[+] Delete corrupted cached file %s\n", file)
+		os.Remove(file)
+	}
+	if r == nil {
+		return "", err
+	}
+
+	if r.ranges && r.size > 0 {
+		err = downloadSegments(file, r, mirrors(r.url, urls), opts)
+	} else {
+		err = downloadStream(file, r, mirrors(r.url, urls), opts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(file + stateSuffix)
+	return file, os.Rename(file+partSuffix, file)
+}
+
+func hashFile(file string, h hash.Hash) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// mirrors returns urls starting with the responding one
+func mirrors(first string, urls []string) []string {
+	r := []string{first}
+	for _, u := range urls {
+		if u != first {
+			r = append(r, u)
+		}
+	}
+	return r
+}
+
+// probe requests the first byte of the file to check the size and range requests support
+func probe(u string) (*remote, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	r := &remote{url: u, etag: resp.Header.Get("ETag"), modified: resp.Header.Get("Last-Modified")}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		r.ranges = true
+		r.size = contentRangeSize(resp.Header.Get("Content-Range"))
+	case http.StatusOK:
+		r.size = resp.ContentLength
+	default:
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return r, nil
+}
+
+// contentRangeSize returns total size from `bytes 0-0/1234` or -1
+func contentRangeSize(h string) int64 {
+	i := strings.LastIndex(h, "/")
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(h[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// loadState returns saved state of the partial file if it's the same remote file, or a new one split into n segments
+func loadState(file string, r *remote, n int) *downloadState {
+	s := &downloadState{}
+	if data, err := ioutil.ReadFile(file + stateSuffix); err == nil && json.Unmarshal(data, s) == nil &&
+		s.Size == r.size && s.ETag == r.etag && s.Modified == r.modified && len(s.Segments) > 0 {
+		if _, err := os.Stat(file + partSuffix); err == nil {
+			log.WithField("path", file).Debug("resuming download")
+			return s
+		}
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	if min := int64(1 << 20); r.size/int64(n) < min {
+		n = int(r.size/min) + 1
+	}
+	s = &downloadState{Size: r.size, ETag: r.etag, Modified: r.modified}
+	step := r.size / int64(n)
+	for i := 0; i < n; i++ {
+		sg := &segment{Start: int64(i) * step, End: int64(i+1) * step}
+		if i == n-1 {
+			sg.End = r.size
+		}
+		s.Segments = append(s.Segments, sg)
+	}
+	os.Remove(file + partSuffix)
+	return s
+}
+
+// downloadSegments downloads segments of the file concurrently with range requests, the state is saved
+// every second, so the partial file can be resumed
+func downloadSegments(file string, r *remote, urls []string, opts *DownloadOptions) error {
+	s := loadState(file, r, opts.Connections)
+	f, err := os.OpenFile(file+partSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(r.size); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var written int64
+	for _, sg := range s.Segments {
+		written += sg.Done
+	}
+	save := func() {
+		mu.Lock()
+		data, err := json.Marshal(s)
+		mu.Unlock()
+		if err == nil {
+			ioutil.WriteFile(file+stateSuffix, data, 0644)
+		}
+	}
+	report := func(n int64) {
+		mu.Lock()
+		written += n
+		w := written
+		mu.Unlock()
+		if opts.Progress != nil {
+			opts.Progress(w, r.size)
+		}
+	}
+	report(0)
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				save()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	hashed := make(chan error, 1)
+	if opts.Hash != nil {
+		go func() { hashed <- followHash(f, s, &mu, opts.Hash, done) }()
+	}
+
+	errs := make(chan error, len(s.Segments))
+	for i, sg := range s.Segments {
+		go func(i int, sg *segment) {
+			var err error
+			for attempt := 0; attempt < downloadAttempts; attempt++ {
+				mu.Lock()
+				complete := sg.Start+sg.Done >= sg.End
+				mu.Unlock()
+				if complete {
+					errs <- nil
+					return
+				}
+				if attempt > 0 {
+					time.Sleep(time.Duration(attempt) * time.Second)
+				}
+				u := urls[(i+attempt)%len(urls)]
+				if err = fetchSegment(f, u, r, sg, &mu, report); err == nil {
+					errs <- nil
+					return
+				}
+				log.WithField("url", u).WithField("segment", i).Error(err)
+			}
+			errs <- err
+		}(i, sg)
+	}
+
+	for range s.Segments {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	close(done)
+	save()
+	if err != nil {
+		return fmt.Errorf("download failed, run the command again to resume it: %s", err)
+	}
+	if opts.Hash != nil {
+		if err := <-hashed; err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// frontier returns size of the downloaded part of the file from it's beginning
+func (s *downloadState) frontier() int64 {
+	var pos int64
+	for _, sg := range s.Segments {
+		if sg.Start != pos {
+			break
+		}
+		pos = sg.Start + sg.Done
+		if pos < sg.End {
+			break
+		}
+	}
+	return pos
+}
+
+// followHash hashes the file behind the downloaded frontier, so the hash is ready when the download finishes.
+// Written data is read back from the page cache, resumed parts are read from the disk
+func followHash(f *os.File, s *downloadState, mu *sync.Mutex, h hash.Hash, done chan struct{}) error {
+	buf := make([]byte, 1<<20)
+	var pos int64
+	for {
+		mu.Lock()
+		end := s.frontier()
+		mu.Unlock()
+
+		if pos < end {
+			n := int64(len(buf))
+			if end-pos < n {
+				n = end - pos
+			}
+			if _, err := f.ReadAt(buf[:n], pos); err != nil {
+				return err
+			}
+			h.Write(buf[:n])
+			pos += n
+			continue
+		}
+		if pos >= s.Size {
+			return nil
+		}
+
+		select {
+		case <-done:
+			mu.Lock()
+			end = s.frontier()
+			mu.Unlock()
+			if end == pos {
+				return io.ErrUnexpectedEOF
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// fetchSegment requests the rest of the segment and writes it into the file at the segment offset
+func fetchSegment(f *os.File, u string, r *remote, sg *segment, mu *sync.Mutex, report func(int64)) error {
+	mu.Lock()
+	from := sg.Start + sg.Done
+	mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, sg.End-1))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("GET %s: range request failed: %s", u, resp.Status)
+	}
+	if size := contentRangeSize(resp.Header.Get("Content-Range")); size != r.size {
+		return fmt.Errorf("GET %s: size %d differs from %d", u, size, r.size)
+	}
+
+	buf := make([]byte, 256<<10)
+	for from < sg.End {
+		n, rerr := resp.Body.Read(buf)
+		if int64(n) > sg.End-from {
+			n = int(sg.End - from)
+		}
+		if n > 0 {
+			if _, err := f.WriteAt(buf[:n], from); err != nil {
+				return err
+			}
+			from += int64(n)
+			mu.Lock()
+			sg.Done = from - sg.Start
+			mu.Unlock()
+			report(int64(n))
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if from < sg.End {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// downloadStream downloads the file without range requests, every attempt starts from the beginning
+func downloadStream(file string, r *remote, urls []string, opts *DownloadOptions) error {
+	var err error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		u := urls[attempt%len(urls)]
+		if err = streamFile(file, u, opts); err == nil {
+			return nil
+		}
+		log.WithField("url", u).Error(err)
+	}
+	return err
+}
+
+func streamFile(file, u string, opts *DownloadOptions) error {
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	f, err := os.Create(file + partSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if opts.Hash != nil {
+		opts.Hash.Reset()
+		w = io.MultiWriter(f, opts.Hash)
+	}
+	if opts.Progress != nil {
+		w = &progressWriter{w: w, total: resp.ContentLength, fn: opts.Progress}
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength > 0 && n != resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	return f.Sync()
+}
+
+// progressWriter reports number of written bytes
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	total   int64
+	fn      func(written, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.fn(p.written, p.total)
+	return n, err
+}
@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xshellinc/tools/lib/help"
+)
+
+func TestDownload(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ranges.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer plain.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	dir, err := ioutil.TempDir("", "iotit-download")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	sum := sha256.Sum256(data)
+	h := sha256.New()
+
+	// mirror is used when the main url fails, segments are downloaded in parallel and hashed while downloading
+	file, err := Download([]string{broken.URL + "/image.img", ranges.URL + "/image.img"}, dir, &DownloadOptions{Connections: 3, Hash: h})
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "image.img"), file)
+	b, _ := ioutil.ReadFile(file)
+	assert.True(bytes.Equal(data, b))
+	assert.Equal(sum[:], h.Sum(nil))
+
+	// cached file is hashed before it's reused
+	h.Reset()
+	_, err = Download([]string{ranges.URL + "/image.img"}, dir, &DownloadOptions{Hash: h})
+	assert.NoError(err)
+	assert.Equal(sum[:], h.Sum(nil))
+
+	// interrupted download is resumed from the saved state
+	os.Remove(file)
+	s := loadState(file, &remote{size: int64(len(data))}, 2)
+	s.Segments[0].Done = 1 << 20
+	state, _ := json.Marshal(s)
+	ioutil.WriteFile(file+stateSuffix, state, 0644)
+	ioutil.WriteFile(file+partSuffix, data[:1<<20], 0644)
+	var written int64
+	h.Reset()
+	_, err = Download([]string{ranges.URL + "/image.img"}, dir, &DownloadOptions{Connections: 2, Hash: h, Progress: func(w, total int64) {
+		if written == 0 {
+			written = w
+		}
+	}})
+	assert.NoError(err)
+	assert.Equal(int64(1<<20), written)
+	b, _ = ioutil.ReadFile(file)
+	assert.True(bytes.Equal(data, b))
+	assert.False(help.Exists(file + stateSuffix))
+	assert.Equal(sum[:], h.Sum(nil))
+
+	// servers without range requests are downloaded in one stream
+	os.Remove(file)
+	_, err = Download([]string{plain.URL + "/image.img"}, dir, &DownloadOptions{Connections: 4, Hash: h})
+	assert.NoError(err)
+	b, _ = ioutil.ReadFile(file)
+	assert.True(bytes.Equal(data, b))
+	assert.Equal(sum[:], h.Sum(nil))
+}
@@ -1,15 +1,18 @@
 package repo
 
 import (
-	"encoding/json"
 	"errors"
-	log "github.com/sirupsen/logrus"
-	"github.com/xshellinc/tools/lib/help"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/lib/help"
 )
 
 // DeviceImage contains url, title, username and password which are used after flashing
@@ -19,7 +22,17 @@ type DeviceImage struct {
 	Title string `json:"Title,omitempty"`
 	User  string `json:"User,omitempty"`
 	Pass  string `json:"Pass,omitempty"`
-	Hash  string `json:"Hash,omitempty"`
+	// Hash is a digest of the image like `sha256:…`, `sha512:…` or `md5:…`, untagged hex sums are sha256 ones
+	Hash string `json:"Hash,omitempty"`
+	// HashURL is a checksum file like `image.sha256` or `SHA256SUMS` used when Hash isn't set
+	HashURL string `json:"HashURL,omitempty"`
+	// Mirrors are alternative URLs of the same image
+	Mirrors []string `json:"Mirrors,omitempty"`
+}
+
+// URLs returns image URL followed by it's mirrors
+func (i *DeviceImage) URLs() []string {
+	return append([]string{i.URL}, i.Mirrors...)
 }
 
 // DeviceMapping is a collection of device, it sub-types and sets of images for these devices
@@ -40,8 +53,11 @@ type DeviceCollection struct {
 	Version string          `json:"Version,omitempty"`
 }
 
-// Images repository URL
-const imagesRepo = "https://raw.githubusercontent.com/xshellinc/iotit/master/mapping.json"
+// ImagesRepo is the default images repository URL
+const ImagesRepo = "https://raw.githubusercontent.com/xshellinc/iotit/master/mapping.json"
+
+// mappingURL is where DownloadDevicesRepository gets mapping.json, tests replace it
+var mappingURL = ImagesRepo
 
 var path string
 var dm *DeviceCollection
@@ -123,28 +139,77 @@ func (d *DeviceCollection) getDevices() []string {
 	return devices
 }
 
-// DownloadDevicesRepository downloads new mapping.json from the cloud
+// DownloadDevicesRepository downloads new mapping.json from the cloud. It's signature and content are verified
+// before the cached copy is replaced, so the cached copy is used when verification fails
 func DownloadDevicesRepository() error {
 	log.Info("Downloading new mapping.json...")
-	if err := help.DownloadFile(path, imagesRepo); err != nil {
+	data, err := fetch(mappingURL)
+	if err != nil {
 		log.Error(err)
 		return err
 	}
-	// update file modification date so on the next run we don't try to download it again
-	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+
+	var sig []byte
+	if MappingPublicKey != "" {
+		if sig, err = fetch(mappingURL + signatureSuffix); err != nil {
+			return rejectMapping(err)
+		}
+	}
+	if err := verifyMapping(data, sig); err != nil {
+		return rejectMapping(err)
+	}
+	if _, err := ParseDeviceCollection(data); err != nil {
+		return rejectMapping(err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
 		log.Error(err)
 		return err
 	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Error(err)
+		return err
+	}
+	// collection is loaded again from the new file
+	dm = nil
 
 	return nil
 }
 
+// rejectMapping reports that downloaded mapping.json can't be trusted
+func rejectMapping(err error) error {
+	log.Error(err)
+	if help.Exists(path) {
+		fmt.Println("[-] Downloaded mapping.json is rejected, using the cached copy:", err)
+	}
+	return err
+}
+
+// maxMappingSize limits size of the downloaded mapping.json
+const maxMappingSize = 10 << 20
+
+// fetch downloads small file into memory
+func fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxMappingSize))
+}
+
 // CheckDevicesRepository checks mapping.json for updates
 func CheckDevicesRepository() {
 	log.Info("Checking for mapping.json updates...")
 	if info, err := os.Stat(path); os.IsNotExist(err) || time.Now().Sub(info.ModTime()).Hours() >= 24 {
 		DownloadDevicesRepository()
 	}
+	updateSources(false)
 }
 
 // SetPath of the mapping.json file
@@ -199,16 +264,11 @@ func GetDevices() []string {
 	return dm.getDevices()
 }
 
-// initDeviceCollection initializes deviceCollection from file, alternatively from the internal constant
+// initDeviceCollection initializes deviceCollection from the default mapping.json merged with additional repositories
 func initDeviceCollection() error {
-	dm = &DeviceCollection{}
-
-	d, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
-
-	if err := json.Unmarshal(d, dm); err != nil {
+	var err error
+	if dm, err = loadCollections(); err != nil {
+		dm = &DeviceCollection{}
 		return err
 	}
 
@@ -217,8 +277,7 @@ func initDeviceCollection() error {
 
 // GenMappingFile generates mapping.json file
 func GenMappingFile() error {
-	DownloadDevicesRepository()
-	return nil
+	return DownloadDevicesRepository()
 }
 
 // fillEmptyImages updates substructures' empty image arrays with the parent one
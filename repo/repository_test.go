@@ -1,6 +1,9 @@
 package repo
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 
@@ -16,8 +19,42 @@ func cleanUp() {
 	os.Remove(path)
 }
 
+// serveMapping serves mapping.json of the repository signed with a test key, which is pinned until the returned
+// function restores the default one
+func serveMapping(t *testing.T) func() {
+	data, err := ioutil.ReadFile("../mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(data, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mapping.json":
+			w.Write(data)
+		case "/mapping.json" + signatureSuffix:
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	key, url := MappingPublicKey, mappingURL
+	MappingPublicKey, mappingURL = pub, srv.URL+"/mapping.json"
+	return func() {
+		MappingPublicKey, mappingURL = key, url
+		srv.Close()
+	}
+}
+
 func TestGenMappingFile(t *testing.T) {
 	assert := assert.New(t)
+	defer serveMapping(t)()
 	err := GenMappingFile()
 	assert.NoError(err)
 
@@ -25,6 +62,10 @@ func TestGenMappingFile(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(stat.Mode()&0644, os.FileMode(0644), "Wrong filemode:", stat.Mode())
 
+	// a mapping signed with another key is rejected and the error is returned
+	MappingPublicKey, _, _ = GenerateKey()
+	assert.Error(GenMappingFile())
+
 	cleanUp()
 }
 
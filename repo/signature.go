@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+)
+
+// MappingPublicKey is a base64 encoded ed25519 public key which signs mapping.json, it comes from linker.
+// Signature isn't verified when the key isn't set, e.g. in development builds
+var MappingPublicKey = ""
+
+// signatureSuffix is appended to mapping.json URL to get it's detached signature
+const signatureSuffix = ".sig"
+
+// ErrSignature is returned when mapping.json signature doesn't match the pinned public key
+var ErrSignature = errors.New("mapping.json signature verification failed")
+
+// VerifySignature verifies detached base64 encoded ed25519 signature of the data
+func VerifySignature(data, sig []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid mapping.json public key")
+	}
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return fmt.Errorf("%s: malformed signature", ErrSignature)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, s) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// verifyMapping verifies signature with the pinned key if it's set, missing signature fails verification then
+func verifyMapping(data, sig []byte) error {
+	if MappingPublicKey == "" {
+		log.Warn("mapping.json public key isn't set, signature isn't verified")
+		return nil
+	}
+	if len(sig) == 0 {
+		return fmt.Errorf("%s: signature is missing", ErrSignature)
+	}
+	return VerifySignature(data, sig, MappingPublicKey)
+}
+
+// Sign returns base64 encoded detached signature of the data, key is base64 encoded ed25519 private key
+func Sign(data []byte, privateKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), data)
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+// GenerateKey returns base64 encoded ed25519 public and private keys to sign mapping.json
+func GenerateKey() (public, private string, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
@@ -0,0 +1,330 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// DefaultSource is a name of the upstream images repository
+const DefaultSource = "default"
+
+// Source is an additional images repository, it's either a URL of mapping.json or a path to the local file
+type Source struct {
+	Name      string `json:"Name"`
+	URL       string `json:"URL"`
+	PublicKey string `json:"PublicKey,omitempty"`
+}
+
+// sourcesFile stores additional repositories, ordered by precedence
+var sourcesFile = filepath.Join(baseDir, "repos.json")
+
+// sourcesDir stores downloaded copies of remote repositories
+var sourcesDir = filepath.Join(baseDir, "repos")
+
+var sourceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Local returns true if the source is a file on this workstation
+func (s *Source) Local() bool {
+	u, err := url.Parse(s.URL)
+	return err != nil || (u.Scheme != "http" && u.Scheme != "https")
+}
+
+// cache returns a path of the downloaded mapping.json of the remote source or the path of the local one
+func (s *Source) cache() string {
+	if s.Local() {
+		return s.URL
+	}
+	return filepath.Join(sourcesDir, s.Name+".json")
+}
+
+// load reads and validates mapping.json of the source
+func (s *Source) load() (*DeviceCollection, error) {
+	data, err := ioutil.ReadFile(s.cache())
+	if err != nil {
+		return nil, err
+	}
+	return ParseDeviceCollection(data)
+}
+
+// download fetches remote mapping.json, verifies it with the source key if it's set, and replaces the cached copy
+func (s *Source) download() error {
+	if s.Local() {
+		_, err := s.load()
+		return err
+	}
+
+	data, err := fetch(s.URL)
+	if err != nil {
+		return err
+	}
+	if s.PublicKey != "" {
+		sig, err := fetch(s.URL + signatureSuffix)
+		if err != nil {
+			return err
+		}
+		if err := VerifySignature(data, sig, s.PublicKey); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseDeviceCollection(data); err != nil {
+		return err
+	}
+
+	help.CreateDir(sourcesDir)
+	tmp := s.cache() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cache())
+}
+
+// expired returns true if the remote source wasn't downloaded during the last day
+func (s *Source) expired() bool {
+	if s.Local() {
+		return false
+	}
+	info, err := os.Stat(s.cache())
+	return os.IsNotExist(err) || time.Now().Sub(info.ModTime()).Hours() >= 24
+}
+
+// Sources returns additional repositories ordered by precedence
+func Sources() ([]*Source, error) {
+	var sources []*Source
+	data, err := ioutil.ReadFile(sourcesFile)
+	if os.IsNotExist(err) {
+		return sources, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("%s: %s", sourcesFile, err)
+	}
+	return sources, nil
+}
+
+func saveSources(sources []*Source) error {
+	data, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sourcesFile, data, 0644)
+}
+
+// AddSource downloads and validates mapping.json of the new repository and saves it after existing ones,
+// location is either http(s) URL or a path to the local file
+func AddSource(name, location, publicKey string) (*Source, error) {
+	if !sourceName.MatchString(name) || strings.EqualFold(name, DefaultSource) {
+		return nil, fmt.Errorf("invalid repository name: %q", name)
+	}
+	sources, err := Sources()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		if strings.EqualFold(s.Name, name) {
+			return nil, fmt.Errorf("repository %s already exists", s.Name)
+		}
+	}
+
+	s := &Source{Name: name, URL: location, PublicKey: publicKey}
+	if s.Local() {
+		if s.URL, err = filepath.Abs(location); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.download(); err != nil {
+		return nil, err
+	}
+
+	if err := saveSources(append(sources, s)); err != nil {
+		return nil, err
+	}
+	dm = nil
+	return s, nil
+}
+
+// RemoveSource removes the repository and it's downloaded copy
+func RemoveSource(name string) error {
+	if strings.EqualFold(name, DefaultSource) {
+		return errors.New("default repository can't be removed")
+	}
+	sources, err := Sources()
+	if err != nil {
+		return err
+	}
+	for i, s := range sources {
+		if strings.EqualFold(s.Name, name) {
+			if !s.Local() {
+				os.Remove(s.cache())
+			}
+			dm = nil
+			return saveSources(append(sources[:i], sources[i+1:]...))
+		}
+	}
+	return fmt.Errorf("repository %s not found", name)
+}
+
+// updateSources downloads remote repositories, all of them or only expired ones
+func updateSources(all bool) error {
+	sources, err := Sources()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	var failed []string
+	for _, s := range sources {
+		if !all && !s.expired() {
+			continue
+		}
+		log.WithField("repo", s.Name).Info("Downloading mapping.json...")
+		if err := s.download(); err != nil {
+			log.WithField("repo", s.Name).Error(err)
+			fmt.Printf("[-] Repository %s is not updated, using the cached copy: %s\n", s.Name, err)
+			failed = append(failed, s.Name)
+		}
+	}
+	dm = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("repositories are not updated: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// UpdateSources downloads mapping.json of all remote additional repositories
+func UpdateSources() error {
+	return updateSources(true)
+}
+
+// loadCollections loads additional repositories and the default one, merged in the order of precedence
+func loadCollections() (*DeviceCollection, error) {
+	sources, err := Sources()
+	if err != nil {
+		log.Error(err)
+	}
+
+	var cols []*DeviceCollection
+	for _, s := range sources {
+		c, err := s.load()
+		if err != nil {
+			log.WithField("repo", s.Name).Error(err)
+			fmt.Printf("[-] Repository %s is skipped: %s\n", s.Name, err)
+			continue
+		}
+		cols = append(cols, c)
+	}
+
+	var version string
+	d, err := ioutil.ReadFile(path)
+	if err == nil {
+		var c *DeviceCollection
+		if c, err = ParseDeviceCollection(d); err == nil {
+			cols = append(cols, c)
+			version = c.Version
+		} else {
+			log.WithField("path", path).Error(err)
+		}
+	}
+	if len(cols) == 0 {
+		return nil, err
+	}
+
+	r := mergeCollections(cols...)
+	if version != "" {
+		r.Version = version
+	}
+	return r, nil
+}
+
+// mergeCollections merges collections, the first ones take precedence. Devices and sub-types are matched
+// by names or aliases, images of the matched devices are appended unless their title or alias is already used
+func mergeCollections(cols ...*DeviceCollection) *DeviceCollection {
+	r := &DeviceCollection{}
+	for _, c := range cols {
+		if r.Version == "" {
+			r.Version = c.Version
+		}
+		for i := range c.Devices {
+			if m := matchDevice(r.Devices, &c.Devices[i]); m != nil {
+				mergeDevice(m, &c.Devices[i])
+				continue
+			}
+			r.Devices = append(r.Devices, c.Devices[i])
+		}
+	}
+	return r
+}
+
+// matchDevice returns a device with the same name or alias
+func matchDevice(devices []DeviceMapping, d *DeviceMapping) *DeviceMapping {
+	for i := range devices {
+		if sameDevice(&devices[i], d) {
+			return &devices[i]
+		}
+	}
+	return nil
+}
+
+func sameDevice(a, b *DeviceMapping) bool {
+	keys := func(m *DeviceMapping) []string {
+		k := []string{strings.ToLower(m.Name)}
+		if m.Alias != "" {
+			k = append(k, strings.ToLower(m.Alias))
+		}
+		return k
+	}
+	for _, x := range keys(a) {
+		for _, y := range keys(b) {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeDevice adds images and sub-types of the lower precedence device d to m
+func mergeDevice(m, d *DeviceMapping) {
+	// device referenced by alias gets it's name, the name selects the flasher
+	if d.Alias != "" && strings.EqualFold(m.Name, d.Alias) {
+		m.Name = d.Name
+	}
+	if m.Alias == "" || strings.EqualFold(m.Alias, d.Name) {
+		m.Alias = d.Alias
+	}
+
+next:
+	for _, img := range d.Images {
+		for _, o := range m.Images {
+			if strings.EqualFold(o.Title, img.Title) || (img.Alias != "" && strings.EqualFold(o.Alias, img.Alias)) {
+				continue next
+			}
+		}
+		m.Images = append(m.Images, img)
+	}
+
+	for _, sub := range d.Sub {
+		found := false
+		for _, s := range m.Sub {
+			if sameDevice(s, sub) {
+				mergeDevice(s, sub)
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.Sub = append(m.Sub, sub)
+		}
+	}
+}
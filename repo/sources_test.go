@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeCollections(t *testing.T) {
+	assert := assert.New(t)
+	private := &DeviceCollection{Devices: []DeviceMapping{
+		{Name: "raspi", Images: []DeviceImage{{Title: "Golden", Alias: "our-golden", URL: "https://intra/golden.img"}}},
+		{Name: "custom-board", Images: []DeviceImage{{Title: "Custom", URL: "https://intra/custom.img"}}},
+	}}
+	upstream := &DeviceCollection{Devices: []DeviceMapping{
+		{Name: "Raspberry Pi", Alias: "raspi", Images: []DeviceImage{
+			{Title: "Lite", Alias: "lite", URL: "https://up/lite.img"},
+			{Title: "golden", URL: "https://up/golden.img"},
+		}},
+		{Name: "Beaglebone", Sub: []*DeviceMapping{{Name: "BeagleBoard-xM", Alias: "bbxm"}}},
+	}}
+
+	m := mergeCollections(private, upstream)
+	assert.Len(m.Devices, 3)
+
+	d, err := m.findDevice("raspi")
+	assert.NoError(err)
+	assert.Equal("Raspberry Pi", d.Name)
+	assert.Equal("raspi", d.Alias)
+	if assert.Len(d.Images, 2) {
+		assert.Equal("https://intra/golden.img", d.Images[0].URL)
+		assert.Equal("lite", d.Images[1].Alias)
+	}
+	assert.NoError(d.FindImage("our-golden"))
+
+	_, err = m.findDevice("bbxm")
+	assert.NoError(err)
+	_, err = m.findDevice("custom-board")
+	assert.NoError(err)
+}
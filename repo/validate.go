@@ -0,0 +1,136 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ValidationError contains all problems found in mapping.json
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid mapping.json: " + strings.Join(v, "; ")
+}
+
+// ParseDeviceCollection decodes and validates mapping.json, unknown fields are ignored,
+// so mappings with fields added by newer versions are still loaded
+func ParseDeviceCollection(data []byte) (*DeviceCollection, error) {
+	return parseDeviceCollection(data, false)
+}
+
+// ParseDeviceCollectionStrict is the same as ParseDeviceCollection, but it rejects unknown fields.
+// It's used before mapping.json is signed
+func ParseDeviceCollectionStrict(data []byte) (*DeviceCollection, error) {
+	return parseDeviceCollection(data, true)
+}
+
+func parseDeviceCollection(data []byte, strict bool) (*DeviceCollection, error) {
+	d := &DeviceCollection{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(d); err != nil {
+		if e, ok := err.(*json.SyntaxError); ok {
+			return nil, fmt.Errorf("invalid mapping.json: %s at offset %d", e, e.Offset)
+		}
+		return nil, fmt.Errorf("invalid mapping.json: %s", err)
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Validate checks required fields, URLs, hashes and uniqueness of names and aliases
+func (d *DeviceCollection) Validate() error {
+	var errs ValidationError
+	if len(d.Devices) == 0 {
+		errs = append(errs, "Devices: at least one device is required")
+	}
+
+	names := map[string]string{}
+	for i := range d.Devices {
+		validateDevice(&d.Devices[i], fmt.Sprintf("Devices[%d]", i), false, names, &errs)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateDevice checks device and it's sub-types, inherited is set when parent images are used by sub-types
+// without images, names contains lower-cased names and aliases used so far
+func validateDevice(m *DeviceMapping, p string, inherited bool, names map[string]string, errs *ValidationError) {
+	add := func(field, format string, args ...interface{}) {
+		*errs = append(*errs, fmt.Sprintf("%s.%s: ", p, field)+fmt.Sprintf(format, args...))
+	}
+
+	if strings.TrimSpace(m.Name) == "" {
+		add("Name", "is required")
+	}
+	for field, name := range map[string]string{"Name": m.Name, "Alias": m.Alias} {
+		key := strings.ToLower(name)
+		if key == "" {
+			continue
+		}
+		if prev, ok := names[key]; ok {
+			add(field, "%q is already used by %s", name, prev)
+			continue
+		}
+		names[key] = p
+	}
+	if len(m.Images) == 0 && len(m.Sub) == 0 && !inherited {
+		add("Images", "either Images or Sub is required")
+	}
+
+	aliases := map[string]int{}
+	for i, img := range m.Images {
+		ip := fmt.Sprintf("Images[%d]", i)
+		if img.URL == "" {
+			add(ip+".URL", "is required")
+		} else if !validURL(img.URL) {
+			add(ip+".URL", "%q is not a valid http or https URL", img.URL)
+		}
+		for j, m := range img.Mirrors {
+			if !validURL(m) {
+				add(fmt.Sprintf("%s.Mirrors[%d]", ip, j), "%q is not a valid http or https URL", m)
+			}
+		}
+		if strings.TrimSpace(img.Title) == "" {
+			add(ip+".Title", "is required")
+		}
+		if img.Alias != "" {
+			if prev, ok := aliases[strings.ToLower(img.Alias)]; ok {
+				add(ip+".Alias", "%q is already used by Images[%d]", img.Alias, prev)
+			} else {
+				aliases[strings.ToLower(img.Alias)] = i
+			}
+		}
+		if img.Hash != "" {
+			if _, err := ParseDigest(img.Hash); err != nil {
+				add(ip+".Hash", "%s", err)
+			}
+		}
+		if img.HashURL != "" && !validURL(img.HashURL) {
+			add(ip+".HashURL", "%q is not a valid http or https URL", img.HashURL)
+		}
+	}
+
+	for i, sub := range m.Sub {
+		if sub == nil {
+			add(fmt.Sprintf("Sub[%d]", i), "is null")
+			continue
+		}
+		validateDevice(sub, fmt.Sprintf("%s.Sub[%d]", p, i), inherited || len(m.Images) > 0, names, errs)
+	}
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeviceCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../mapping.json")
+	assert.NoError(err)
+	_, err = ParseDeviceCollection(data)
+	assert.NoError(err)
+
+	_, err = ParseDeviceCollection([]byte(`{"Devices": [`))
+	assert.Error(err)
+
+	unknown := []byte(`{"Devices": [{"Name": "pi", "Images": [{"URL": "https://host/a.img", "Title": "t"}]}], "Foo": 1}`)
+	_, err = ParseDeviceCollection(unknown)
+	assert.NoError(err)
+	_, err = ParseDeviceCollectionStrict(unknown)
+	assert.Error(err)
+
+	_, err = ParseDeviceCollection([]byte(`{"Devices": [
+		{"Name": "pi", "Images": [{"URL": "ftp://host/a.img", "Hash": "abc"}]},
+		{"Name": "PI", "Sub": [{"Name": "zero"}]}
+	]}`))
+	if assert.IsType(ValidationError{}, err) {
+		v := err.(ValidationError)
+		assert.Contains(v.Error(), "Devices[0].Images[0].URL")
+		assert.Contains(v.Error(), "Devices[0].Images[0].Title")
+		assert.Contains(v.Error(), "Devices[0].Images[0].Hash")
+		assert.Contains(v.Error(), "Devices[1].Name")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	assert := assert.New(t)
+	pub, priv, err := GenerateKey()
+	assert.NoError(err)
+
+	data := []byte(`{"Devices": []}`)
+	sig, err := Sign(data, priv)
+	assert.NoError(err)
+	assert.NoError(VerifySignature(data, sig, pub))
+	assert.Equal(ErrSignature, VerifySignature(append(data, ' '), sig, pub))
+	assert.Error(VerifySignature(data, []byte("garbage"), pub))
+}
+
+func TestVerifyMapping(t *testing.T) {
+	assert := assert.New(t)
+	defer func(key string) { MappingPublicKey = key }(MappingPublicKey)
+
+	data, err := ioutil.ReadFile("../mapping.json")
+	assert.NoError(err)
+
+	// development builds don't verify signatures
+	MappingPublicKey = ""
+	assert.NoError(verifyMapping(data, nil))
+
+	pub, priv, err := GenerateKey()
+	assert.NoError(err)
+	sig, err := Sign(data, priv)
+	assert.NoError(err)
+	MappingPublicKey = pub
+	assert.NoError(verifyMapping(data, sig))
+	assert.Error(verifyMapping(append(data, ' '), sig))
+	assert.Error(verifyMapping(data, nil))
+}
@@ -0,0 +1,145 @@
+package workstation
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// Source returns image content for the n-th disk of the batch and it's size, so the image can be customized per disk
+type Source func(n int) (io.ReadCloser, int64, error)
+
+// Progress is called with amount of bytes written to the n-th disk of the batch
+type Progress func(n int, written, total int64)
+
+// Result is an outcome of writing the image to one of the disks in batch mode
+type Result struct {
+	N        int
+	Disk     *MountInfo
+	Written  int64
+	Duration time.Duration
+	Err      error
+}
+
+// streamWriter is implemented by every OS workstation to write image stream to the raw disk
+type streamWriter interface {
+	// prepareBatch is called once before concurrent writes, e.g. to ask sudo password
+	prepareBatch() error
+	writeStream(m *MountInfo, r io.Reader) error
+}
+
+// DiskName returns disk device path
+func (m *MountInfo) DiskName() string {
+	return m.diskName
+}
+
+// DeviceName returns disk model name
+func (m *MountInfo) DeviceName() string {
+	return m.deviceName
+}
+
+// selectDisks returns removable disks by their names, all removable disks are returned if all is true
+func selectDisks(ws WorkStation, names []string, all bool) ([]*MountInfo, error) {
+	mounts, err := ws.ListRemovableDisk()
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		return mounts, nil
+	}
+
+	var out []*MountInfo
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		var dev *MountInfo
+		for _, m := range mounts {
+			if m.diskName == name || m.diskNameRaw == name {
+				dev = m
+				break
+			}
+		}
+		if dev == nil {
+			return nil, fmt.Errorf("disk %s is not a removable disk, try to list disks with `iotit list disks`", name)
+		}
+		for _, m := range out {
+			if m == dev {
+				return nil, fmt.Errorf("disk %s is listed twice", name)
+			}
+		}
+		if ok, err := help.FileModeMask(dev.diskNameRaw, 0200); err == nil && !ok {
+			return nil, fmt.Errorf("disk %s seems locked, please unlock your SD card", name)
+		}
+		out = append(out, dev)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no disks selected")
+	}
+	return out, nil
+}
+
+// writeBatch writes images to the disks concurrently
+func writeBatch(w streamWriter, disks []*MountInfo, src Source, progress Progress) []*Result {
+	return runBatch(w.prepareBatch, disks, src, progress, func(m *MountInfo, r io.Reader, size int64) error {
+		return w.writeStream(m, r)
+	})
+}
+
+// runBatch calls fn for every disk concurrently with the image stream of that disk
+func runBatch(prepare func() error, disks []*MountInfo, src Source, progress Progress,
+	fn func(m *MountInfo, r io.Reader, size int64) error) []*Result {
+	results := make([]*Result, len(disks))
+	for i, m := range disks {
+		results[i] = &Result{N: i, Disk: m}
+	}
+	if err := prepare(); err != nil {
+		for _, r := range results {
+			r.Err = err
+		}
+		return results
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, r := range results {
+		wg.Add(1)
+		go func(r *Result) {
+			defer wg.Done()
+			start := time.Now()
+			defer func() { r.Duration = time.Since(start) }()
+
+			rc, size, err := src(r.N)
+			if err != nil {
+				r.Err = err
+				return
+			}
+			defer rc.Close()
+
+			cr := &countingReader{r: rc, fn: func(n int64) {
+				if progress != nil {
+					progress(r.N, n, size)
+				}
+			}}
+			r.Err = fn(r.Disk, cr, size)
+			r.Written = cr.n
+		}(r)
+	}
+	wg.Wait()
+	return results
+}
+
+// countingReader reports amount of bytes read
+type countingReader struct {
+	r  io.Reader
+	n  int64
+	fn func(int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.fn(c.n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+// +build !windows
+
+package workstation
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/xshellinc/tools/lib/help"
+	"github.com/xshellinc/tools/lib/sudo"
+)
+
+// authorize asks sudo password once, so the following commands are executed with non-interactive sudo.
+// progress is a spinner channel which is paused while the password is entered
+func authorize(progress chan bool) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if exec.Command("sudo", "-n", "true").Run() == nil {
+		return nil
+	}
+	if progress == nil {
+		fmt.Println("[+] You may need to enter your user password")
+	}
+	if _, eut, err := sudo.Exec(sudo.InputMaskedPassword, progress, "-v"); err != nil {
+		return err
+	} else if exec.Command("sudo", "-n", "true").Run() != nil {
+		return fmt.Errorf("sudo authorization failed: %s", strings.TrimSpace(string(eut)))
+	}
+	return nil
+}
+
+// privileged returns command executed with non-interactive sudo unless the current user is root
+func privileged(name string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("sudo", append([]string{"-n", name}, args...)...)
+}
+
+// pipeStream runs privileged command reading r from the standard input
+func pipeStream(r io.Reader, name string, args ...string) error {
+	cmd := privileged(name, args...)
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// rawStream writes r into the disk with the raw writer skipping transfer of zero blocks. Unless the current user is root,
+// the writer runs in the `iotit write-raw` process started with sudo
+func rawStream(disk string, r io.Reader) error {
+	if os.Geteuid() == 0 {
+		_, err := WriteRaw(disk, r, 0, &WriteOptions{SkipZero: true})
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return pipeStream(r, exe, "write-raw", "--disk", disk, "--skip-zero")
+}
+
+// writeImage writes the image file into the disk printing it's progress
+func writeImage(img, disk string, job *help.BackgroundJob) error {
+	if err := authorize(job.Progress); err != nil {
+		return err
+	}
+	f, err := os.Open(img)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return errors.New("image is empty")
+	}
+
+	job.Active(false)
+	err = rawStream(disk, newMeter(f, fi.Size(), func(s *Stats) {
+		fmt.Printf("\r\033[K[+] Flashing: %s", s)
+	}))
+	fmt.Println()
+	return err
+}
@@ -0,0 +1,117 @@
+package workstation
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// USB serial chips recognized by their vendor and product IDs
+const (
+	ChipCP210x    = "CP210x"
+	ChipCH340     = "CH340"
+	ChipFTDI      = "FTDI"
+	ChipToradex   = "Toradex"
+	ChipEspressif = "Espressif"
+)
+
+// Port is a serial port of the workstation, USB fields are empty for other ports
+type Port struct {
+	Name         string `json:"name" yaml:"name"`
+	VID          string `json:"vid,omitempty" yaml:"vid,omitempty"`
+	PID          string `json:"pid,omitempty" yaml:"pid,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty" yaml:"product,omitempty"`
+	Serial       string `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Chip         string `json:"chip,omitempty" yaml:"chip,omitempty"`
+}
+
+// String describes the port in dialogs
+func (p *Port) String() string {
+	s := p.Name
+	var info []string
+	for _, v := range []string{p.Chip, p.Manufacturer, p.Product} {
+		if v != "" && !strings.Contains(strings.Join(info, " "), v) {
+			info = append(info, v)
+		}
+	}
+	if p.VID != "" {
+		info = append(info, p.VID+":"+p.PID)
+	}
+	if p.Serial != "" {
+		info = append(info, "serial "+p.Serial)
+	}
+	if len(info) > 0 {
+		s += " (" + strings.Join(info, ", ") + ")"
+	}
+	return s
+}
+
+// guessChip recognizes USB serial chip by vendor and product IDs or the manufacturer
+func (p *Port) guessChip() string {
+	vid, pid := strings.ToLower(p.VID), strings.ToLower(p.PID)
+	switch {
+	case vid == "10c4" && (pid == "ea60" || pid == "ea70" || pid == "ea71"):
+		return ChipCP210x
+	case vid == "1a86":
+		return ChipCH340
+	case vid == "0403":
+		return ChipFTDI
+	case vid == "1b67" || strings.Contains(strings.ToLower(p.Manufacturer), "toradex"):
+		return ChipToradex
+	case vid == "303a":
+		return ChipEspressif
+	}
+	return ""
+}
+
+// ListPorts returns serial ports sorted by name, USB ports are described with their IDs and the chip guess
+func ListPorts() ([]*Port, error) {
+	ports, err := listPorts()
+	if err != nil {
+		return nil, err
+	}
+	if ports == nil {
+		ports = []*Port{}
+	}
+	for _, p := range ports {
+		p.VID, p.PID = strings.ToLower(p.VID), strings.ToLower(p.PID)
+		p.Chip = p.guessChip()
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports, nil
+}
+
+// FindPort searches the port by it's name, base name or USB serial number,
+// device paths which aren't listed are returned as is
+func FindPort(ports []*Port, spec string) (*Port, error) {
+	for _, p := range ports {
+		if p.Name == spec {
+			return p, nil
+		}
+	}
+	for _, p := range ports {
+		if filepath.Base(p.Name) == spec || (p.Serial != "" && strings.EqualFold(p.Serial, spec)) {
+			return p, nil
+		}
+	}
+	if strings.HasPrefix(spec, "/dev/") || strings.HasPrefix(strings.ToUpper(spec), "COM") {
+		return &Port{Name: spec}, nil
+	}
+	return nil, fmt.Errorf("serial port %s not found", spec)
+}
+
+// FilterPorts returns ports with the chips
+func FilterPorts(ports []*Port, chips ...string) []*Port {
+	var r []*Port
+	for _, p := range ports {
+		for _, c := range chips {
+			if p.Chip == c {
+				r = append(r, p)
+				break
+			}
+		}
+	}
+	return r
+}
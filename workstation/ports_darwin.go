@@ -0,0 +1,16 @@
+package workstation
+
+import (
+	"fmt"
+
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// listPorts lists USB serial adapters from the IOKit registry, call-out devices are used
+func listPorts() ([]*Port, error) {
+	out, err := help.ExecCmd("ioreg", []string{"-r", "-c", "IOUSBHostDevice", "-l", "-w0"})
+	if err != nil {
+		return nil, fmt.Errorf("ioreg: %s", out)
+	}
+	return parseIoreg(out), nil
+}
@@ -0,0 +1,55 @@
+package workstation
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ioregProperty matches `"idVendor" = 4292` and `"USB Serial Number" = "0001"` lines
+var ioregProperty = regexp.MustCompile(`"([^"]+)" = "?([^"]*)"?$`)
+
+// parseIoreg assigns call-out devices to the closest preceding USB device, it parses `ioreg` output of macOS
+func parseIoreg(out string) []*Port {
+	var ports []*Port
+	var usb Port
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "<class IOUSBHostDevice") || strings.Contains(line, "<class IOUSBDevice") {
+			usb = Port{}
+			continue
+		}
+		m := ioregProperty.FindStringSubmatch(strings.TrimSpace(strings.TrimLeft(line, " |")))
+		if m == nil {
+			continue
+		}
+		switch m[1] {
+		case "idVendor":
+			usb.VID = hex4(m[2])
+		case "idProduct":
+			usb.PID = hex4(m[2])
+		case "USB Vendor Name":
+			usb.Manufacturer = m[2]
+		case "USB Product Name":
+			usb.Product = m[2]
+		case "USB Serial Number":
+			usb.Serial = m[2]
+		case "IOCalloutDevice":
+			if !strings.Contains(m[2], "Bluetooth-") && !strings.Contains(m[2], "-Wireless") {
+				p := usb
+				p.Name = m[2]
+				ports = append(ports, &p)
+			}
+		}
+	}
+	return ports
+}
+
+// hex4 formats decimal IDs of ioreg as 4 hex digits
+func hex4(s string) string {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return s
+	}
+	return fmt.Sprintf("%04x", n)
+}
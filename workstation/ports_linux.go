@@ -0,0 +1,54 @@
+package workstation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysClassTTY is a sysfs directory of tty devices
+var sysClassTTY = "/sys/class/tty"
+
+// listPorts lists USB serial adapters and CDC ACM devices, USB attributes are read from sysfs
+func listPorts() ([]*Port, error) {
+	var ports []*Port
+	for _, pattern := range []string{"ttyUSB*", "ttyACM*"} {
+		list, err := filepath.Glob(filepath.Join(sysClassTTY, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, tty := range list {
+			p := &Port{Name: "/dev/" + filepath.Base(tty)}
+			if dir := usbDevice(filepath.Join(tty, "device")); dir != "" {
+				p.VID = sysAttr(dir, "idVendor")
+				p.PID = sysAttr(dir, "idProduct")
+				p.Manufacturer = sysAttr(dir, "manufacturer")
+				p.Product = sysAttr(dir, "product")
+				p.Serial = sysAttr(dir, "serial")
+			}
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// usbDevice returns sysfs directory of the USB device which the interface belongs to
+func usbDevice(dev string) string {
+	dir, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return ""
+	}
+	for i := 0; i < 5 && len(dir) > 1; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err == nil {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+	return ""
+}
+
+func sysAttr(dir, name string) string {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(b))
+}
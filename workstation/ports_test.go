@@ -0,0 +1,64 @@
+package workstation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindPort(t *testing.T) {
+	assert := assert.New(t)
+	ports := []*Port{
+		{Name: "/dev/ttyUSB0", VID: "10c4", PID: "ea60", Serial: "0001"},
+		{Name: "/dev/ttyUSB1", VID: "1a86", PID: "7523"},
+		{Name: "/dev/ttyACM0", Manufacturer: "Toradex"},
+	}
+	assert.Equal(ChipCP210x, ports[0].guessChip())
+	assert.Equal(ChipCH340, ports[1].guessChip())
+	assert.Equal(ChipToradex, ports[2].guessChip())
+
+	p, err := FindPort(ports, "ttyUSB1")
+	assert.NoError(err)
+	assert.Equal("/dev/ttyUSB1", p.Name)
+	p, err = FindPort(ports, "0001")
+	assert.NoError(err)
+	assert.Equal("/dev/ttyUSB0", p.Name)
+	p, err = FindPort(ports, "/dev/ttyS0")
+	assert.NoError(err)
+	assert.Equal("/dev/ttyS0", p.Name)
+	_, err = FindPort(ports, "A50285BI")
+	assert.Error(err)
+}
+
+func TestParseIoreg(t *testing.T) {
+	assert := assert.New(t)
+	out := `+-o CP2102 USB to UART Bridge Controller@14100000  <class IOUSBHostDevice, id 0x100000a4f, registered, matched, active, busy 0 (4 ms), retain 28>
+  | {
+  |   "idProduct" = 60000
+  |   "USB Product Name" = "CP2102 USB to UART Bridge Controller"
+  |   "USB Vendor Name" = "Silicon Labs"
+  |   "idVendor" = 4292
+  |   "USB Serial Number" = "0001"
+  | }
+  |
+  +-o IOSerialBSDClient  <class IOSerialBSDClient, id 0x100000a55, registered, matched, active, busy 0 (0 ms), retain 6>
+      {
+        "IOCalloutDevice" = "/dev/cu.SLAB_USBtoUART"
+        "IODialinDevice" = "/dev/tty.SLAB_USBtoUART"
+      }
++-o Magic Keyboard@14200000  <class IOUSBHostDevice, id 0x100000b01, registered, matched, active, busy 0 (2 ms), retain 20>
+  | {
+  |   "idVendor" = 1452
+  |   "USB Product Name" = "Magic Keyboard"
+  | }
+      {
+        "IOCalloutDevice" = "/dev/cu.Bluetooth-Incoming-Port"
+      }
+`
+	ports := parseIoreg(out)
+	if assert.Len(ports, 1) {
+		assert.Equal(&Port{Name: "/dev/cu.SLAB_USBtoUART", VID: "10c4", PID: "ea60", Serial: "0001",
+			Manufacturer: "Silicon Labs", Product: "CP2102 USB to UART Bridge Controller"}, ports[0])
+		assert.Equal(ChipCP210x, ports[0].guessChip())
+	}
+}
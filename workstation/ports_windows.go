@@ -0,0 +1,116 @@
+package workstation
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const usbEnum = `SYSTEM\CurrentControlSet\Enum\USB`
+
+// listPorts lists COM ports from the registry, USB attributes are taken from the USB enumerator
+func listPorts() ([]*Port, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DEVICEMAP\SERIALCOMM\`, registry.QUERY_VALUE)
+	if err != nil {
+		// the key doesn't exist when there are no serial ports
+		return nil, nil
+	}
+	defer k.Close()
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	usb := usbPorts()
+	var ports []*Port
+	for _, n := range names {
+		v, _, err := k.GetStringValue(n)
+		if err != nil {
+			continue
+		}
+		p := &Port{Name: v}
+		if u, ok := usb[v]; ok {
+			u.Name = v
+			p = u
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// usbPorts maps COM port names to USB devices, e.g. `VID_10C4&PID_EA60\0001\Device Parameters\PortName`
+func usbPorts() map[string]*Port {
+	r := map[string]*Port{}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, usbEnum, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return r
+	}
+	defer k.Close()
+	ids, _ := k.ReadSubKeyNames(0)
+	for _, id := range ids {
+		var vid, pid string
+		for _, part := range strings.Split(id, "&") {
+			if strings.HasPrefix(part, "VID_") {
+				vid = part[4:]
+			} else if strings.HasPrefix(part, "PID_") {
+				pid = part[4:]
+			}
+		}
+		if vid == "" {
+			continue
+		}
+		dk, err := registry.OpenKey(k, id, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		instances, _ := dk.ReadSubKeyNames(0)
+		for _, inst := range instances {
+			p := instanceParams(dk, inst)
+			if p == nil {
+				continue
+			}
+			p.VID, p.PID = vid, pid
+			// generated instance IDs of devices without serial numbers contain ampersands
+			if !strings.Contains(inst, "&") {
+				p.Serial = inst
+			}
+			r[p.Name] = p
+		}
+		dk.Close()
+	}
+	return r
+}
+
+// instanceParams reads port name and descriptions of the device instance
+func instanceParams(dk registry.Key, inst string) *Port {
+	ik, err := registry.OpenKey(dk, inst, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer ik.Close()
+	pk, err := registry.OpenKey(ik, "Device Parameters", registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer pk.Close()
+	name, _, err := pk.GetStringValue("PortName")
+	if err != nil {
+		return nil
+	}
+	p := &Port{Name: name}
+	p.Manufacturer = registryText(ik, "Mfg")
+	p.Product = registryText(ik, "DeviceDesc")
+	return p
+}
+
+// registryText strips inf references like `@oem.inf,%mfg%;Silicon Labs`
+func registryText(k registry.Key, name string) string {
+	v, _, err := k.GetStringValue(name)
+	if err != nil {
+		return ""
+	}
+	if i := strings.LastIndex(v, ";"); i >= 0 {
+		v = v[i+1:]
+	}
+	return v
+}
@@ -0,0 +1,215 @@
+package workstation
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+)
+
+const (
+	// rawBlockSize is a default size of blocks written to the raw disk
+	rawBlockSize = 4 << 20
+	// rawAlign is an alignment of buffers required by direct I/O
+	rawAlign = 4096
+	// defaultSectorSize is used when the disk doesn't report it's logical block size, e.g. for regular files.
+	// Unaligned tail of the image is written with read-modify-write of the last logical block
+	defaultSectorSize = 512
+)
+
+// WriteOptions control the raw disk writer
+type WriteOptions struct {
+	// BlockSize is rounded up to 4096 bytes or the logical block size of the disk if it's larger, 4MB is used by default
+	BlockSize int
+	// SkipZero doesn't transfer blocks containing only zeros, the disk zeroes them itself with BLKZEROOUT on linux.
+	// They're written as usual when the disk doesn't support it or on other systems
+	SkipZero bool
+	// Progress is called after every written or skipped block
+	Progress func(s *Stats)
+}
+
+// Stats contains progress of writing
+type Stats struct {
+	// Written is amount of bytes of the image processed so far, including skipped ones
+	Written int64
+	Skipped int64
+	// Total is size of the image, it's 0 if unknown, e.g. for compressed streams
+	Total   int64
+	Elapsed time.Duration
+}
+
+// WriteRaw writes the stream into the raw disk bypassing the page cache, disk is synced before return.
+// total is used for the progress only and can be 0 when stream size is unknown.
+func WriteRaw(disk string, r io.Reader, total int64, opts *WriteOptions) (*Stats, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	bs := opts.BlockSize
+	if bs <= 0 {
+		bs = rawBlockSize
+	}
+
+	unlock, err := lockDisk(disk)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err := openDirect(disk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// direct I/O offsets and sizes are multiples of the logical block size
+	sector := logicalBlockSize(f)
+	align := rawAlign
+	if sector > align {
+		align = sector
+	}
+	bs = (bs + align - 1) / align * align
+	buf := alignedBuffer(bs, align)
+	s := &Stats{Total: total}
+	start := time.Now()
+	for off := int64(0); ; {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			b := buf[:n]
+			var err error
+			if opts.SkipZero && len(b)%sector == 0 && isZero(b) {
+				var zeroed bool
+				if zeroed, err = zeroRange(f, b, off, sector); zeroed {
+					s.Skipped += int64(n)
+				}
+			} else {
+				err = writeAligned(f, b, off, sector)
+			}
+			if err != nil {
+				return s, fmt.Errorf("cannot write %s at offset %d: %s", disk, off, err)
+			}
+			off += int64(n)
+			s.Written = off
+			s.Elapsed = time.Since(start)
+			if opts.Progress != nil {
+				opts.Progress(s)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return s, rerr
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return s, fmt.Errorf("cannot sync %s: %s", disk, err)
+	}
+	s.Elapsed = time.Since(start)
+	return s, nil
+}
+
+// writeAligned writes sector aligned part of the block directly and the rest with read-modify-write of the last sector
+func writeAligned(f *os.File, b []byte, off int64, sectorSize int) error {
+	aligned := len(b) / sectorSize * sectorSize
+	if aligned > 0 {
+		if _, err := f.WriteAt(b[:aligned], off); err != nil {
+			return err
+		}
+	}
+	if aligned == len(b) {
+		return nil
+	}
+
+	sector := alignedBuffer(sectorSize, rawAlign)
+	if _, err := f.ReadAt(sector, off+int64(aligned)); err != nil && err != io.EOF {
+		return err
+	}
+	copy(sector, b[aligned:])
+	_, err := f.WriteAt(sector, off+int64(aligned))
+	return err
+}
+
+// alignedBuffer returns buffer which address is aligned for direct I/O, align is a power of two
+func alignedBuffer(size, align int) []byte {
+	b := make([]byte, size+align)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) & uintptr(align-1)); rem != 0 {
+		off = align - rem
+	}
+	return b[off : off+size]
+}
+
+// Throughput returns average speed in bytes per second
+func (s *Stats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Written) / s.Elapsed.Seconds()
+}
+
+// ETA returns estimated time left, it's 0 if total size is unknown
+func (s *Stats) ETA() time.Duration {
+	speed := s.Throughput()
+	if s.Total <= s.Written || speed == 0 {
+		return 0
+	}
+	return time.Duration(float64(s.Total-s.Written) / speed * float64(time.Second))
+}
+
+// String returns progress like `1.2GB / 3.8GB 31% 21.4MB/s ETA 2m3s`
+func (s *Stats) String() string {
+	speed := FormatBytes(int64(s.Throughput())) + "/s"
+	if s.Total <= 0 {
+		return fmt.Sprintf("%s %s", FormatBytes(s.Written), speed)
+	}
+	return fmt.Sprintf("%s / %s %d%% %s ETA %s", FormatBytes(s.Written), FormatBytes(s.Total),
+		s.Written*100/s.Total, speed, s.ETA().Round(time.Second))
+}
+
+// formatBytes returns human readable size
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isZero returns true if the block contains only zeros
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// meter reports Stats of the stream while it's read, so progress of piped writers can be shown
+type meter struct {
+	r     io.Reader
+	s     Stats
+	start time.Time
+	last  time.Time
+	fn    func(s *Stats)
+}
+
+func newMeter(r io.Reader, total int64, fn func(s *Stats)) *meter {
+	return &meter{r: r, s: Stats{Total: total}, start: time.Now(), fn: fn}
+}
+
+func (m *meter) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.s.Written += int64(n)
+	if now := time.Now(); now.Sub(m.last) >= time.Second/2 || err != nil {
+		m.last = now
+		m.s.Elapsed = now.Sub(m.start)
+		m.fn(&m.s)
+	}
+	return n, err
+}
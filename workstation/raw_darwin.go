@@ -0,0 +1,37 @@
+package workstation
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// dkiocGetBlockSize is the DKIOCGETBLOCKSIZE ioctl returning the logical block size of the disk
+const dkiocGetBlockSize = 0x40046418
+
+// openDirect opens the raw disk with synchronous I/O and disabled data caching
+func openDirect(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1); errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+	return f, nil
+}
+
+// logicalBlockSize returns the logical block size of the raw disk, 512 is returned for regular files
+func logicalBlockSize(f *os.File) int {
+	var size uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), dkiocGetBlockSize, uintptr(unsafe.Pointer(&size))); errno != 0 || size == 0 {
+		return defaultSectorSize
+	}
+	return int(size)
+}
+
+// zeroRange writes zeros, macOS doesn't have a way to zero a range of the raw disk
+func zeroRange(f *os.File, b []byte, off int64, sectorSize int) (bool, error) {
+	return false, writeAligned(f, b, off, sectorSize)
+}
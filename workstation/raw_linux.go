@@ -0,0 +1,37 @@
+package workstation
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// blkZeroOut is the BLKZEROOUT ioctl, the kernel zeroes the range with WRITE ZEROES or discard when the disk supports it
+	blkZeroOut = 0x127f
+	// blkSSZGet is the BLKSSZGET ioctl returning the logical block size of the disk
+	blkSSZGet = 0x1268
+)
+
+// openDirect opens the disk with direct and synchronous I/O
+func openDirect(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_SYNC|syscall.O_DIRECT, 0)
+}
+
+// logicalBlockSize returns the logical block size of the block device, 512 is returned for regular files
+func logicalBlockSize(f *os.File) int {
+	var size int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkSSZGet, uintptr(unsafe.Pointer(&size))); errno != 0 || size <= 0 {
+		return defaultSectorSize
+	}
+	return int(size)
+}
+
+// zeroRange zeroes the range of the block device, b is written when the ioctl isn't supported, e.g. for regular files
+func zeroRange(f *os.File, b []byte, off int64, sectorSize int) (bool, error) {
+	r := [2]uint64{uint64(off), uint64(len(b))}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkZeroOut, uintptr(unsafe.Pointer(&r[0]))); errno == 0 {
+		return true, nil
+	}
+	return false, writeAligned(f, b, off, sectorSize)
+}
@@ -0,0 +1,74 @@
+// +build !windows
+
+package workstation
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRaw(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "iotit-raw")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	disk := filepath.Join(dir, "disk")
+
+	// image with a zero block in the middle and unaligned tail
+	img := append(bytes.Repeat([]byte{1}, 8192), make([]byte, 8192)...)
+	img = append(img, bytes.Repeat([]byte{2}, 700)...)
+	content := bytes.Repeat([]byte{0xFF}, 32768)
+	assert.NoError(ioutil.WriteFile(disk, content, 0600))
+	if f, err := openDirect(disk); err != nil {
+		t.Skip("direct I/O is not supported:", err)
+	} else {
+		f.Close()
+	}
+
+	calls := 0
+	s, err := WriteRaw(disk, bytes.NewReader(img), int64(len(img)), &WriteOptions{
+		BlockSize: 8192,
+		Progress:  func(*Stats) { calls++ },
+	})
+	assert.NoError(err)
+	assert.Equal(int64(len(img)), s.Written)
+	assert.Equal(3, calls)
+	data, _ := ioutil.ReadFile(disk)
+	assert.Equal(img, data[:len(img)])
+	assert.Equal(content[len(img):], data[len(img):])
+
+	// zero block of a regular file is written, because BLKZEROOUT works with block devices only
+	assert.NoError(ioutil.WriteFile(disk, content, 0600))
+	s, err = WriteRaw(disk, bytes.NewReader(img), 0, &WriteOptions{BlockSize: 8192, SkipZero: true})
+	assert.NoError(err)
+	assert.Equal(int64(0), s.Skipped)
+	data, _ = ioutil.ReadFile(disk)
+	assert.Equal(img, data[:len(img)])
+}
+
+func TestWriteAligned(t *testing.T) {
+	assert := assert.New(t)
+	f, err := ioutil.TempFile("", "iotit-raw")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// the unaligned tail keeps the rest of the 4K logical block
+	content := bytes.Repeat([]byte{0xFF}, 3*4096)
+	f.Write(content)
+	b := bytes.Repeat([]byte{1}, 4096+100)
+	assert.NoError(writeAligned(f, b, 4096, 4096))
+	data, _ := ioutil.ReadFile(f.Name())
+	assert.Equal(content[:4096], data[:4096])
+	assert.Equal(b, data[4096:4096+len(b)])
+	assert.Equal(content[4096+len(b):], data[4096+len(b):])
+}
@@ -0,0 +1,142 @@
+package workstation
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl and file flags which aren't defined by syscall
+const (
+	fileFlagNoBuffering          = 0x20000000
+	fileFlagWriteThrough         = 0x80000000
+	fsctlLockVolume              = 0x00090018
+	fsctlDismountVolume          = 0x00090020
+	ioctlDiskGetDriveGeometry    = 0x00070000
+	ioctlVolumeGetVolDiskExtents = 0x00560000
+)
+
+// harddisk matches disk names listed by wmic like `\\?\Device\Harddisk1\Partition0` and physical drive paths
+var harddisk = regexp.MustCompile(`(?i)^\\\\[?.]\\(?:Device\\Harddisk(\d+)\\Partition0|PhysicalDrive(\d+))$`)
+
+type diskGeometry struct {
+	Cylinders         int64
+	MediaType         uint32
+	TracksPerCylinder uint32
+	SectorsPerTrack   uint32
+	BytesPerSector    uint32
+}
+
+type diskExtent struct {
+	DiskNumber     uint32
+	_              uint32
+	StartingOffset int64
+	ExtentLength   int64
+}
+
+type volumeDiskExtents struct {
+	NumberOfDiskExtents uint32
+	_                   uint32
+	Extents             [16]diskExtent
+}
+
+// physicalDrive returns `\\.\PhysicalDriveN` path of the disk and it's number, other names are returned as is
+func physicalDrive(name string) (string, int) {
+	if m := harddisk.FindStringSubmatch(name); m != nil {
+		num := m[1] + m[2]
+		n, _ := strconv.Atoi(num)
+		return `\\.\PhysicalDrive` + num, n
+	}
+	return name, -1
+}
+
+// openDirect opens the disk with unbuffered write-through I/O
+func openDirect(name string) (*os.File, error) {
+	path, _ := physicalDrive(name)
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, fileFlagNoBuffering|fileFlagWriteThrough, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", path, err)
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// logicalBlockSize returns the sector size of the disk, 512 is returned for regular files
+func logicalBlockSize(f *os.File) int {
+	var g diskGeometry
+	var n uint32
+	err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), ioctlDiskGetDriveGeometry, nil, 0,
+		(*byte)(unsafe.Pointer(&g)), uint32(unsafe.Sizeof(g)), &n, nil)
+	if err != nil || g.BytesPerSector == 0 {
+		return defaultSectorSize
+	}
+	return int(g.BytesPerSector)
+}
+
+// zeroRange writes zeros, windows doesn't have a way to zero a range of the physical drive
+func zeroRange(f *os.File, b []byte, off int64, sectorSize int) (bool, error) {
+	return false, writeAligned(f, b, off, sectorSize)
+}
+
+// lockDisk locks and dismounts volumes with drive letters of the disk, windows denies writing over mounted volumes.
+// Volumes are unlocked and mounted again by the returned function
+func lockDisk(name string) (func(), error) {
+	_, disk := physicalDrive(name)
+	var locked []syscall.Handle
+	unlock := func() {
+		for _, h := range locked {
+			syscall.CloseHandle(h)
+		}
+	}
+	if disk < 0 {
+		return unlock, nil
+	}
+
+	for l := 'A'; l <= 'Z'; l++ {
+		volume := fmt.Sprintf(`\\.\%c:`, l)
+		p, _ := syscall.UTF16PtrFromString(volume)
+		h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+			nil, syscall.OPEN_EXISTING, 0, 0)
+		if err != nil {
+			continue
+		}
+		if !onDisk(h, disk) {
+			syscall.CloseHandle(h)
+			continue
+		}
+		var n uint32
+		for _, code := range []uint32{fsctlLockVolume, fsctlDismountVolume} {
+			if err := syscall.DeviceIoControl(h, code, nil, 0, nil, 0, &n, nil); err != nil {
+				syscall.CloseHandle(h)
+				unlock()
+				return nil, fmt.Errorf("cannot dismount %c: of %s, close programs using it: %s", l, name, err)
+			}
+		}
+		locked = append(locked, h)
+	}
+	return unlock, nil
+}
+
+// onDisk checks that the volume has an extent on the disk
+func onDisk(volume syscall.Handle, disk int) bool {
+	var e volumeDiskExtents
+	var n uint32
+	err := syscall.DeviceIoControl(volume, ioctlVolumeGetVolDiskExtents, nil, 0,
+		(*byte)(unsafe.Pointer(&e)), uint32(unsafe.Sizeof(e)), &n, nil)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < int(e.NumberOfDiskExtents) && i < len(e.Extents); i++ {
+		if int(e.Extents[i].DiskNumber) == disk {
+			return true
+		}
+	}
+	return false
+}
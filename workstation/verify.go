@@ -0,0 +1,180 @@
+package workstation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/xshellinc/tools/lib/help"
+)
+
+// verifyBlock is a size of blocks compared at once
+const verifyBlock = 4 << 20
+
+// MismatchError is returned when the disk content differs from the image
+type MismatchError struct {
+	Offset int64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("disk content differs from the image at offset %d (0x%x)", e.Offset, e.Offset)
+}
+
+// streamReader is implemented by every OS workstation to read back the raw disk
+type streamReader interface {
+	// prepareBatch is called once before reading, e.g. to ask sudo password
+	prepareBatch() error
+	// readStream returns the disk content from the beginning, closing the reader stops reading
+	readStream(m *MountInfo) (io.ReadCloser, error)
+}
+
+// selected returns the disk selected by WriteToDisk or the disk workstation was created with
+func (w *workstation) selected(ws WorkStation) (*MountInfo, error) {
+	if w.mount != nil && w.mount.diskName != "" {
+		return w.mount, nil
+	}
+	if w.Disk == "" {
+		return nil, errors.New("disk is not selected")
+	}
+	mounts, err := ws.ListRemovableDisk()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		if m.diskName == w.Disk || m.diskNameRaw == w.Disk {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("disk %s is not a removable disk, try to list disks with `iotit list disks`", w.Disk)
+}
+
+// verifyJob compares the disk with the image file in background
+func verifyJob(r streamReader, m *MountInfo, img string) (*help.BackgroundJob, error) {
+	f, err := os.Open(img)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := r.prepareBatch(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	fmt.Printf("[+] Verifying %s against %s\n", m.diskName, img)
+	job := help.NewBackgroundJob()
+	go func() {
+		defer job.Close()
+		defer f.Close()
+		if err := verifyDisk(r, m, f, fi.Size()); err != nil {
+			job.Error(err)
+			return
+		}
+		fmt.Printf("\r[+] Done verifying %s, %d bytes match the image\n", m.diskName, fi.Size())
+	}()
+	return job, nil
+}
+
+// verifyBatch compares the disks with their images concurrently
+func verifyBatch(r streamReader, disks []*MountInfo, src Source, progress Progress) []*Result {
+	return runBatch(r.prepareBatch, disks, src, progress, func(m *MountInfo, img io.Reader, size int64) error {
+		return verifyDisk(r, m, img, size)
+	})
+}
+
+// verifyDisk reads size bytes back from the disk and compares them with the image
+func verifyDisk(r streamReader, m *MountInfo, img io.Reader, size int64) error {
+	disk, err := r.readStream(m)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	return compare(img, disk, size)
+}
+
+// compare compares size bytes of both streams block by block and returns MismatchError with the first differing offset,
+// the whole image stream is compared when size is 0
+func compare(img, disk io.Reader, size int64) error {
+	a := make([]byte, verifyBlock)
+	b := make([]byte, verifyBlock)
+	for off := int64(0); size <= 0 || off < size; {
+		n := int64(verifyBlock)
+		if size > 0 && size-off < n {
+			n = size - off
+		}
+		read, err := io.ReadFull(img, a[:n])
+		if size <= 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			n = int64(read)
+		} else if err != nil {
+			return fmt.Errorf("cannot read image at offset %d: %s", off, err)
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := io.ReadFull(disk, b[:n]); err != nil {
+			return fmt.Errorf("cannot read disk at offset %d: %s", off, err)
+		}
+		if !bytes.Equal(a[:n], b[:n]) {
+			for i := range a[:n] {
+				if a[i] != b[i] {
+					return &MismatchError{off + int64(i)}
+				}
+			}
+		}
+		off += n
+	}
+	return nil
+}
+
+// cmdReader reads standard output of the command
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	waited bool
+}
+
+// startReader starts the command and returns reader of it's output, closing the reader stops the command
+func startReader(cmd *exec.Cmd) (io.ReadCloser, error) {
+	r := &cmdReader{cmd: cmd}
+	cmd.Stderr = &r.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r.ReadCloser = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Read returns command error with it's stderr when the output ends
+func (r *cmdReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF && !r.waited {
+		r.waited = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s: %s", werr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// Close closes the pipe and stops the command if it's still running, privileged dd is terminated by SIGPIPE
+func (r *cmdReader) Close() error {
+	r.ReadCloser.Close()
+	if !r.waited {
+		r.waited = true
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+	return nil
+}
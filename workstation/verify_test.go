@@ -0,0 +1,29 @@
+package workstation
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	assert := assert.New(t)
+	img := bytes.Repeat([]byte{1, 2, 3, 4}, verifyBlock/2+100)
+	size := int64(len(img))
+
+	disk := append(append([]byte{}, img...), 0xFF, 0xFF)
+	assert.NoError(compare(bytes.NewReader(img), bytes.NewReader(disk), size))
+
+	disk[verifyBlock+7] = 0
+	err := compare(bytes.NewReader(img), bytes.NewReader(disk), size)
+	if assert.IsType(&MismatchError{}, err) {
+		assert.Equal(int64(verifyBlock+7), err.(*MismatchError).Offset)
+	}
+
+	assert.Error(compare(bytes.NewReader(img), bytes.NewReader(img[:100]), size))
+
+	// size of decompressed streams is unknown
+	assert.IsType(&MismatchError{}, compare(bytes.NewReader(img), bytes.NewReader(disk), 0))
+	assert.NoError(compare(bytes.NewReader(img[:verifyBlock]), bytes.NewReader(disk), 0))
+}
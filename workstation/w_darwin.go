@@ -2,9 +2,11 @@ package workstation
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -52,7 +54,7 @@ func (d *workstation) CopyToDisk(img string) (job *help.BackgroundJob, err error
 			}
 		}
 		if dev == nil {
-			return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+			return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 		}
 	}
 
@@ -106,7 +108,7 @@ func (d *workstation) WriteToDisk(img string) (job *help.BackgroundJob, err erro
 				}
 			}
 			if dev == nil {
-				return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+				return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 			}
 		}
 
@@ -156,48 +158,26 @@ func (d *workstation) WriteToDisk(img string) (job *help.BackgroundJob, err erro
 
 			var eut []byte
 			if _, eut, err = sudo.Exec(sudo.InputMaskedPassword, job.Progress, args...); err != nil {
-
 				job.Active(false)
 				fmt.Println("\r[-] Can't unmount disk. Please make sure your password is correct and press Enter to retry")
 				fmt.Print("\r[-] ", string(eut))
-			} else {
-				break
-			}
-		}
-
-		if err != nil {
-			job.Error(err)
-			return
-		}
-
-		args = []string{
-			"dd",
-			fmt.Sprintf("if=%s", img),
-			fmt.Sprintf("of=%s", d.mount.diskNameRaw),
-			"bs=1048576",
-		}
-
-		for attempt := 0; attempt < writeAttempts; attempt++ {
-			if attempt > 0 && !dialogs.YesNoDialog("Continue?") {
-				break
+				continue
 			}
-			job.Active(true)
 
-			var eut []byte
-			if _, eut, err = sudo.Exec(sudo.InputMaskedPassword, job.Progress, args...); err != nil {
+			// macOS may remount the disk before it's opened, so writing is retried with unmounting
+			if err = writeImage(img, d.mount.diskNameRaw, job); err != nil {
 				job.Active(false)
-				fmt.Println("\r[-] Can't write to disk. Please make sure your password is correct")
-				fmt.Println("\r[-] ", string(eut))
-			} else {
-				job.Active(false)
-				fmt.Printf("\r[+] Done writing %s to %s \n", img, d.mount.diskName)
-				break
+				fmt.Println("\r[-] Can't write to disk:", err)
+				continue
 			}
+			break
 		}
 
 		if err != nil {
 			job.Error(err)
+			return
 		}
+		fmt.Printf("\r[+] Done writing %s to %s \n", img, d.mount.diskName)
 	}()
 
 	d.writable = true
@@ -212,71 +192,88 @@ func (d *workstation) ListRemovableDisk() ([]*MountInfo, error) {
 		if attempt > 0 && !dialogs.YesNoDialog("Continue?") {
 			return out, fmt.Errorf("No SD card found")
 		}
-		regex := regexp.MustCompile("^disk([0-9]+)$")
-		var devDisks []string
-		files, _ := ioutil.ReadDir("/dev/")
-		for _, f := range files {
-			fileName := f.Name()
-			if regex.MatchString(fileName) {
-				devDisks = append(devDisks, fileName)
-			}
+		out = listDisks()
+		if len(out) == 0 {
+			fmt.Println("[-] Removable disks not found.\n[-] Please insert your SD card and start command again")
+			continue
 		}
-		for _, devDisk := range devDisks {
-			var p = &MountInfo{}
-			diskMap := make(map[string]string)
-			removable := true
-
-			stdout, err := help.ExecCmd(diskUtil, []string{"info", "/dev/" + devDisk})
-			if err != nil {
-				stdout = ""
-			}
-			diskutilInfo := strings.Split(stdout, "\n")
-			for _, line := range diskutilInfo {
-				if strings.Contains(line, "Protocol") {
-					diskProtocol := strings.Trim(strings.Split(line, ":")[1], " ")
-					for _, protocol := range []string{"SATA", "ATA", "Disk Image", "PCI", "SAS"} {
-						if strings.Contains(diskProtocol, protocol) {
-							removable = false
-						}
+		d.mounts = out
+		break
+	}
+
+	return out, nil
+}
+
+// Disks lists removable disks without printing and prompting
+func (d *workstation) Disks() ([]*MountInfo, error) {
+	return listDisks(), nil
+}
+
+// sizeBytes matches `Disk Size: 7.9 GB (7948206080 Bytes) (exactly 15523840 512-Byte-Units)`
+var sizeBytes = regexp.MustCompile(`\(([0-9]+) Bytes\)`)
+
+// listDisks reads removable disks with diskutil
+func listDisks() []*MountInfo {
+	var out = []*MountInfo{}
+	regex := regexp.MustCompile("^disk([0-9]+)$")
+	var devDisks []string
+	files, _ := ioutil.ReadDir("/dev/")
+	for _, f := range files {
+		fileName := f.Name()
+		if regex.MatchString(fileName) {
+			devDisks = append(devDisks, fileName)
+		}
+	}
+	for _, devDisk := range devDisks {
+		var p = &MountInfo{}
+		diskMap := make(map[string]string)
+		removable := true
+
+		stdout, err := help.ExecCmd(diskUtil, []string{"info", "/dev/" + devDisk})
+		if err != nil {
+			stdout = ""
+		}
+		diskutilInfo := strings.Split(stdout, "\n")
+		for _, line := range diskutilInfo {
+			if strings.Contains(line, "Protocol") {
+				diskProtocol := strings.Trim(strings.Split(line, ":")[1], " ")
+				for _, protocol := range []string{"SATA", "ATA", "Disk Image", "PCI", "SAS"} {
+					if strings.Contains(diskProtocol, protocol) {
+						removable = false
 					}
 				}
-				if strings.Contains(line, "Device Identifier") {
-					diskName := strings.Trim(strings.Split(line, ":")[1], " ")
-					diskMap["diskName"] = "/dev/" + diskName
-					diskMap["diskNameRaw"] = "/dev/r" + diskName
-				}
+			}
+			if strings.Contains(line, "Device Identifier") {
+				diskName := strings.Trim(strings.Split(line, ":")[1], " ")
+				diskMap["diskName"] = "/dev/" + diskName
+				diskMap["diskNameRaw"] = "/dev/r" + diskName
+			}
 
-				if strings.Contains(line, "Device / Media Name") {
-					deviceName := strings.Trim(strings.Split(line, ":")[1], " ")
-					deviceName = strings.Split(deviceName, " Media")[0]
-					diskMap["deviceName"] = deviceName
-				}
+			if strings.Contains(line, "Device / Media Name") {
+				deviceName := strings.Trim(strings.Split(line, ":")[1], " ")
+				deviceName = strings.Split(deviceName, " Media")[0]
+				diskMap["deviceName"] = deviceName
+			}
 
-				if strings.Contains(line, "Total Size") {
-					deviceSize := strings.Trim(strings.Split(line, ":")[1], " ")
-					deviceSize = strings.Split(deviceSize, " (")[0]
-					diskMap["deviceSize"] = deviceSize
+			if strings.Contains(line, "Total Size") || strings.Contains(line, "Disk Size") {
+				deviceSize := strings.Trim(strings.Split(line, ":")[1], " ")
+				if m := sizeBytes.FindStringSubmatch(deviceSize); m != nil {
+					p.size, _ = strconv.ParseInt(m[1], 10, 64)
 				}
-			}
-			if removable {
-				p.deviceName = diskMap["deviceName"]
-				p.deviceSize = diskMap["deviceSize"]
-				p.diskName = diskMap["diskName"]
-				p.diskNameRaw = diskMap["diskNameRaw"]
-				out = append(out, p)
-				log.Debug(diskMap)
+				deviceSize = strings.Split(deviceSize, " (")[0]
+				diskMap["deviceSize"] = deviceSize
 			}
 		}
-
-		if len(out) == 0 {
-			fmt.Println("[-] Removable disks not found.\n[-] Please insert your SD card and start command again")
-			continue
+		if removable {
+			p.deviceName = diskMap["deviceName"]
+			p.deviceSize = diskMap["deviceSize"]
+			p.diskName = diskMap["diskName"]
+			p.diskNameRaw = diskMap["diskNameRaw"]
+			out = append(out, p)
+			log.Debug(diskMap)
 		}
-		d.mounts = out
-		break
 	}
-
-	return out, nil
+	return out
 }
 
 // Ejects the mounted disk
@@ -347,3 +344,44 @@ func (d *workstation) CleanDisk(disk string) error {
 func (d *workstation) PrintDisks() {
 	d.printDisks(d)
 }
+
+// SelectDisks returns removable disks for batch writing
+func (d *workstation) SelectDisks(names []string, all bool) ([]*MountInfo, error) {
+	return selectDisks(d, names, all)
+}
+
+// WriteToDisks writes images to the disks concurrently
+func (d *workstation) WriteToDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return writeBatch(d, disks, src, progress)
+}
+
+func (d *workstation) prepareBatch() error {
+	return authorize(nil)
+}
+
+// writeStream unmounts the disk and writes the stream into the raw disk with the raw writer
+func (d *workstation) writeStream(m *MountInfo, r io.Reader) error {
+	if out, err := help.ExecCmd(diskUtil, []string{"unmountDisk", m.diskName}); err != nil {
+		return fmt.Errorf("error unmounting disk: %s: %s", m.diskName, out)
+	}
+	return rawStream(m.diskNameRaw, r)
+}
+
+// Verify compares the disk with the image
+func (d *workstation) Verify(img string) (*help.BackgroundJob, error) {
+	m, err := d.selected(d)
+	if err != nil {
+		return nil, err
+	}
+	return verifyJob(d, m, img)
+}
+
+// VerifyDisks compares the disks with their images concurrently
+func (d *workstation) VerifyDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return verifyBatch(d, disks, src, progress)
+}
+
+// readStream reads the raw disk which isn't cached
+func (d *workstation) readStream(m *MountInfo) (io.ReadCloser, error) {
+	return startReader(privileged("dd", "if="+m.diskNameRaw, "bs=1m"))
+}
@@ -2,6 +2,7 @@ package workstation
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -33,6 +34,21 @@ func newWorkstation(disk string) WorkStation {
 // Lists available mounts
 func (l *linux) ListRemovableDisk() ([]*MountInfo, error) {
 	fmt.Println("[+] Listing available disks...")
+	out := listDisks()
+	if !(len(out) > 0) {
+		return nil, fmt.Errorf("[-] No mounts found.\n[-] Please insert your SD card and start command again")
+	}
+	l.workstation.mounts = out
+	return out, nil
+}
+
+// Disks lists removable disks without printing and prompting
+func (l *linux) Disks() ([]*MountInfo, error) {
+	return listDisks(), nil
+}
+
+// listDisks reads removable disks and SD cards from sysfs
+func listDisks() []*MountInfo {
 	regex := regexp.MustCompile(`(sd[a-z])$`)
 	regexMmcblk := regexp.MustCompile(`(mmcblk[0-9])$`)
 	var (
@@ -93,15 +109,13 @@ func (l *linux) ListRemovableDisk() ([]*MountInfo, error) {
 			p.diskName = diskMap["diskName"]
 			p.diskNameRaw = diskMap["diskNameRaw"]
 			p.deviceSize = diskMap["deviceSize"]
+			// sysfs size is always in 512 bytes sectors
+			p.size = deviceSizeInSectorsParsed * 512
 			out = append(out, p)
 		}
 	}
 
-	if !(len(out) > 0) {
-		return nil, fmt.Errorf("[-] No mounts found.\n[-] Please insert your SD card and start command again")
-	}
-	l.workstation.mounts = out
-	return out, nil
+	return out
 }
 
 // Unmounts the disk
@@ -152,7 +166,7 @@ func (l *linux) CopyToDisk(img string) (job *help.BackgroundJob, err error) {
 			}
 		}
 		if dev == nil {
-			return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+			return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 		}
 	}
 
@@ -206,7 +220,7 @@ func (l *linux) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 				}
 			}
 			if dev == nil {
-				return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+				return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 			}
 		}
 
@@ -241,36 +255,11 @@ func (l *linux) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 	go func() {
 		defer job.Close()
 
-		args := []string{
-			"dd",
-			fmt.Sprintf("if=%s", img),
-			fmt.Sprintf("of=%s", l.workstation.mount.diskName),
-			"bs=4M",
-		}
-
-		var err error
-		for attempt := 0; attempt < writeAttempts; attempt++ {
-			if attempt > 0 && !dialogs.YesNoDialog("Continue?") {
-				break
-			}
-			job.Active(true)
-
-			var out, eut []byte
-			if out, eut, err = sudo.Exec(sudo.InputMaskedPassword, job.Progress, args...); err != nil {
-				help.LogCmdErrors(string(out), string(eut), err, args...)
-
-				job.Active(false)
-				fmt.Println("\r[-] Can't write to disk. Please make sure your password is correct")
-			} else {
-				job.Active(false)
-				fmt.Printf("\r[+] Done writing %s to %s \n", img, l.workstation.mount.diskName)
-				break
-			}
-		}
-
-		if err != nil {
+		if err := writeImage(img, l.workstation.mount.diskName, job); err != nil {
 			job.Error(err)
+			return
 		}
+		fmt.Printf("\r[+] Done writing %s to %s \n", img, l.workstation.mount.diskName)
 	}()
 
 	l.workstation.writable = true
@@ -379,3 +368,45 @@ func (l *linux) CleanDisk(disk string) error {
 func (l *linux) PrintDisks() {
 	l.workstation.printDisks(l)
 }
+
+// SelectDisks returns removable disks for batch writing
+func (l *linux) SelectDisks(names []string, all bool) ([]*MountInfo, error) {
+	return selectDisks(l, names, all)
+}
+
+// WriteToDisks writes images to the disks concurrently
+func (l *linux) WriteToDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return writeBatch(l, disks, src, progress)
+}
+
+func (l *linux) prepareBatch() error {
+	return authorize(nil)
+}
+
+// writeStream unmounts disk partitions and writes the stream with the raw writer
+func (l *linux) writeStream(m *MountInfo, r io.Reader) error {
+	script := fmt.Sprintf("for p in %s?* ; do umount $p 2>/dev/null ; done ; true", m.diskName)
+	if out, err := privileged("sh", "-c", script).CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot unmount %s: %s", m.diskName, out)
+	}
+	return rawStream(m.diskName, r)
+}
+
+// Verify compares the disk with the image
+func (l *linux) Verify(img string) (*help.BackgroundJob, error) {
+	m, err := l.workstation.selected(l)
+	if err != nil {
+		return nil, err
+	}
+	return verifyJob(l, m, img)
+}
+
+// VerifyDisks compares the disks with their images concurrently
+func (l *linux) VerifyDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return verifyBatch(l, disks, src, progress)
+}
+
+// readStream reads the disk with direct I/O, so the page cache filled by writing isn't read back
+func (l *linux) readStream(m *MountInfo) (io.ReadCloser, error) {
+	return startReader(privileged("dd", "if="+m.diskName, "bs=4M", "iflag=direct"))
+}
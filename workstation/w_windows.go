@@ -1,8 +1,10 @@
 package workstation
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"syscall"
 
@@ -32,20 +34,38 @@ format fs=fat32 label=KERNEL quick
 
 type windows struct {
 	*workstation
+	// dd is used to read disks back for verification only
 	ddPath string
+	ddOnce sync.Once
+	ddErr  error
 }
 
 // Initializes windows workstation
 func newWorkstation(disk string) WorkStation {
 	m := new(MountInfo)
 	var ms []*MountInfo
-	return &windows{&workstation{disk, runtime.GOOS, true, m, ms}, ""}
+	return &windows{workstation: &workstation{disk, runtime.GOOS, true, m, ms}}
 }
 
 // Lists available mounts
 func (w *windows) ListRemovableDisk() ([]*MountInfo, error) {
 	log.Debug("Listing disks...")
 	fmt.Println("[+] Listing available disks...")
+	out := listDisks()
+	if !(len(out) > 0) {
+		return nil, fmt.Errorf("[-] No removable disks found, please insert your SD card and try again.\n[-] Please remember to run this tool as an administrator.")
+	}
+	w.workstation.mounts = out
+	return out, nil
+}
+
+// Disks lists removable disks without printing and prompting
+func (w *windows) Disks() ([]*MountInfo, error) {
+	return listDisks(), nil
+}
+
+// listDisks reads removable disks with wmic
+func listDisks() []*MountInfo {
 	var out = []*MountInfo{}
 
 	// stdout, err := help.ExecCmd("wmic", []string{"diskdrive", "get", "DeviceID,index,InterfaceType,MediaType,Model,Size", "/format:csv"})
@@ -73,6 +93,7 @@ func (w *windows) ListRemovableDisk() ([]*MountInfo, error) {
 			var p = &MountInfo{}
 			size := record[6]
 			p.deviceSize = size
+			p.size, _ = strconv.ParseInt(size, 10, 64)
 			sizeInt, _ := strconv.Atoi(size)
 			sizeFloat := math.Ceil(float64(sizeInt) / 1024 / 1024 / 1024)
 			p.deviceName = record[5] + " [" + strconv.Itoa(int(sizeFloat)) + "GB]"
@@ -82,11 +103,7 @@ func (w *windows) ListRemovableDisk() ([]*MountInfo, error) {
 		}
 	}
 	log.WithField("out", out).Debug("got drives")
-	if !(len(out) > 0) {
-		return nil, fmt.Errorf("[-] No removable disks found, please insert your SD card and try again.\n[-] Please remember to run this tool as an administrator.")
-	}
-	w.workstation.mounts = out
-	return out, nil
+	return out
 }
 
 // Unmounts the disk
@@ -127,7 +144,7 @@ func (w *windows) CopyToDisk(img string) (job *help.BackgroundJob, err error) {
 			}
 		}
 		if dev == nil {
-			return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+			return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 		}
 	}
 
@@ -178,7 +195,7 @@ func (w *windows) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 				}
 			}
 			if w.workstation.mount == nil {
-				return nil, fmt.Errorf("Disk name not recognised, try to list disks with " + dialogs.PrintColored("disks") + " argument")
+				return nil, fmt.Errorf("Disk name not recognised, try to list disks with %s argument", dialogs.PrintColored("disks"))
 			}
 		}
 		break
@@ -188,14 +205,6 @@ func (w *windows) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 		return nil, err
 	}
 
-	if w.ddPath == "" {
-		if err := w.getDDBinary(); err != nil {
-			log.Error(err)
-			fmt.Println("[-] Error downloading dd binary")
-			return nil, err
-		}
-	}
-
 	if len(w.Disk) == 0 && !dialogs.YesNoDialog("Are you sure? ") {
 		return nil, nil
 	}
@@ -213,41 +222,25 @@ func (w *windows) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 					break
 				}
 			}
-			job.Active(true)
-			var out []byte
-			if out, err = exec.Command(w.ddPath,
-				"--filter=removable",
-				fmt.Sprintf("if=%s", img),
-				fmt.Sprintf("of=%s", w.workstation.mount.diskName),
-				"bs=1M").CombinedOutput(); err != nil {
-				log.WithField("out", string(out)).Error("Error while executing: `", w.ddPath)
-				job.Active(false)
-				fmt.Println("\r[-] Can't write to disk.")
-			} else {
-				sout := string(out)
-				job.Active(false)
-				log.WithField("out", sout).Debug("dd finished")
-				if strings.Contains(sout, "Error ") {
-					if strings.Contains(sout, "Access is denied") || strings.Contains(sout, "The device is not ready") {
-						fmt.Println("\n[-] Can't write to disk. Please make sure to run this tool as administrator, close all Explorer windows, try reconnecting your disk and finally reboot your computer.\n [-] You may need to run this tool with `clean` argument to clean your disk partition table before applying image.")
-						if dialogs.YesNoDialog("Or we can try to clean it's partitions right now, should we proceed?") {
-							if derr := w.CleanDisk(""); derr != nil {
-								fmt.Println("[-] Disk cleaning failed:", derr)
-								continue
-							} else {
-								for !dialogs.YesNoDialog("[+] Disk formatted, now please reconnect the device. Type yes once you've done it.") {
-								}
-							}
-						}
+			if err = writeImage(img, w.workstation.mount.diskName, job); err == nil {
+				fmt.Printf("\r[+] Done writing %s to %s \n", img, w.workstation.mount.diskName)
+				return
+			}
+			log.WithField("disk", w.workstation.mount.diskName).Error(err)
+			if strings.Contains(err.Error(), "Access is denied") || strings.Contains(err.Error(), "The device is not ready") {
+				fmt.Println("\n[-] Can't write to disk. Please make sure to run this tool as administrator, close all Explorer windows, try reconnecting your disk and finally reboot your computer.\n [-] You may need to run this tool with `clean` argument to clean your disk partition table before applying image.")
+				if dialogs.YesNoDialog("Or we can try to clean it's partitions right now, should we proceed?") {
+					if derr := w.CleanDisk(""); derr != nil {
+						fmt.Println("[-] Disk cleaning failed:", derr)
 						continue
 					} else {
-						fmt.Println(sout)
-						continue
+						for !dialogs.YesNoDialog("[+] Disk formatted, now please reconnect the device. Type yes once you've done it.") {
+						}
 					}
 				}
-				fmt.Printf("\r[+] Done writing %s to %s \n", img, w.workstation.mount.diskName)
-				return
+				continue
 			}
+			fmt.Println("\r[-] Can't write to disk:", err)
 		}
 
 		if err != nil {
@@ -260,6 +253,39 @@ func (w *windows) WriteToDisk(img string) (job *help.BackgroundJob, err error) {
 	return job, nil
 }
 
+// writeImage writes the image file into the disk with the raw writer printing it's progress
+func writeImage(img, disk string, job *help.BackgroundJob) error {
+	f, err := os.Open(img)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return errors.New("image is empty")
+	}
+
+	job.Active(false)
+	_, err = WriteRaw(disk, f, fi.Size(), &WriteOptions{Progress: func(s *Stats) {
+		fmt.Printf("\r\033[K[+] Flashing: %s", s)
+	}})
+	fmt.Println()
+	return err
+}
+
+// dd returns path of dd downloading it once
+func (w *windows) dd() (string, error) {
+	w.ddOnce.Do(func() {
+		if w.ddErr = w.getDDBinary(); w.ddErr != nil {
+			fmt.Println("[-] Error downloading dd binary")
+		}
+	})
+	return w.ddPath, w.ddErr
+}
+
 func (w *windows) getDDBinary() error {
 	dst := help.GetTempDir() + help.Separator()
 	url := "https://cdn.isaax.io/isaax-distro/utilities/dd/ddrelease64.zip"
@@ -342,3 +368,46 @@ func (w *windows) CleanDisk(disk string) error {
 func (w *windows) PrintDisks() {
 	w.workstation.printDisks(w)
 }
+
+// SelectDisks returns removable disks for batch writing
+func (w *windows) SelectDisks(names []string, all bool) ([]*MountInfo, error) {
+	return selectDisks(w, names, all)
+}
+
+// WriteToDisks writes images to the disks concurrently
+func (w *windows) WriteToDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return writeBatch(w, disks, src, progress)
+}
+
+func (w *windows) prepareBatch() error {
+	return nil
+}
+
+// writeStream writes the stream with the raw writer, volumes of the disk are dismounted while it's written
+func (w *windows) writeStream(m *MountInfo, r io.Reader) error {
+	_, err := WriteRaw(m.diskName, r, 0, nil)
+	return err
+}
+
+// Verify compares the disk with the image
+func (w *windows) Verify(img string) (*help.BackgroundJob, error) {
+	m, err := w.workstation.selected(w)
+	if err != nil {
+		return nil, err
+	}
+	return verifyJob(w, m, img)
+}
+
+// VerifyDisks compares the disks with their images concurrently
+func (w *windows) VerifyDisks(disks []*MountInfo, src Source, progress Progress) []*Result {
+	return verifyBatch(w, disks, src, progress)
+}
+
+// readStream reads the disk with dd writing to the standard output
+func (w *windows) readStream(m *MountInfo) (io.ReadCloser, error) {
+	dd, err := w.dd()
+	if err != nil {
+		return nil, err
+	}
+	return startReader(exec.Command(dd, fmt.Sprintf("if=%s", m.diskName), "of=-", "bs=1M"))
+}
@@ -15,6 +15,16 @@ type WorkStation interface {
 	Eject() error
 	CleanDisk(disk string) error
 	PrintDisks()
+	// Disks lists removable disks without printing and prompting
+	Disks() ([]*MountInfo, error)
+	// SelectDisks returns removable disks by their names or all of them for batch writing
+	SelectDisks(names []string, all bool) ([]*MountInfo, error)
+	// WriteToDisks writes image to several disks concurrently
+	WriteToDisks(disks []*MountInfo, src Source, progress Progress) []*Result
+	// Verify reads back the disk selected by WriteToDisk or given to NewWorkStation and compares it with the image
+	Verify(img string) (job *help.BackgroundJob, err error)
+	// VerifyDisks compares several disks with their images concurrently
+	VerifyDisks(disks []*MountInfo, src Source, progress Progress) []*Result
 }
 
 // Workstation struct contains parameters such as:
@@ -33,6 +43,22 @@ type MountInfo struct {
 	diskName    string
 	diskNameRaw string
 	deviceSize  string
+	// size of the disk in bytes
+	size int64
+}
+
+// DiskInfo describes removable disk in machine-readable output
+type DiskInfo struct {
+	Name      string `json:"name" yaml:"name"`
+	Path      string `json:"path" yaml:"path"`
+	RawPath   string `json:"raw_path" yaml:"raw_path"`
+	Size      int64  `json:"size" yaml:"size"`
+	Removable bool   `json:"removable" yaml:"removable"`
+}
+
+// Info returns exported disk fields, only removable disks are listed
+func (m *MountInfo) Info() *DiskInfo {
+	return &DiskInfo{Name: m.deviceName, Path: m.diskName, RawPath: m.diskNameRaw, Size: m.size, Removable: true}
 }
 
 // NewWorkStation returns workstation depending on the OS